@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// How the xray server picks up the changed files and config
+const (
+	applyRestart = "restart"
+	applyReload  = "reload"
+	applyAPI     = "api"
+)
+
+// ApplyStrategy decides how the changes are applied to the xray server, since a
+// restart drops every connected client
+type ApplyStrategy struct {
+	// restart; reload (the reload of the service manager, which xray itself does
+	// not handle, so the service shall define it); api (the warp outbound is
+	// replaced through the HandlerService of the xray API without a restart, the
+	// updated files still require a restart)
+	Mode string `koanf:"mode"`
+	// Local time range, e.g. 03:00-05:00, which may span midnight. The file
+	// updates and the server config changes requiring a restart are not made
+	// outside of it, but deferred to the next run within it. They are made any
+	// time if empty.
+	MaintenanceWindow string `koanf:"maintenance_window"`
+}
+
+// Time range of a day, as the offsets since midnight
+type maintenanceWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// Returns nil if the window is empty
+func parseMaintenanceWindow(s string) (*maintenanceWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("the maintenance window %q shall be a range like 03:00-05:00", s)
+	}
+
+	var w maintenanceWindow
+	for _, bound := range []struct {
+		s      string
+		offset *time.Duration
+	}{{from, &w.start}, {to, &w.end}} {
+		t, err := time.Parse("15:04", strings.TrimSpace(bound.s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q in the maintenance window %q", bound.s, s)
+		}
+		*bound.offset = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("the maintenance window %q is empty", s)
+	}
+	return &w, nil
+}
+
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	// The window spans midnight
+	return offset >= w.start || offset < w.end
+}
+
+func validateApplyStrategy(a ApplyStrategy) error {
+	switch a.Mode {
+	case applyRestart, applyReload, applyAPI:
+	default:
+		return fmt.Errorf("unknown apply mode %q, expected %s, %s or %s", a.Mode,
+			applyRestart, applyReload, applyAPI)
+	}
+	_, err := parseMaintenanceWindow(a.MaintenanceWindow)
+	return err
+}
+
+var errServerConfigDeferred = errors.New("the restart it requires has been deferred " +
+	"to the maintenance window")
+
+// Reports whether a restart of the xray service has to wait for the maintenance
+// window. The reloads are never deferred.
+func (app *Application) restartDeferred() bool {
+	if app.applyStrategy.Mode == applyReload {
+		return false
+	}
+	// The window has been validated with the config
+	w, _ := parseMaintenanceWindow(app.applyStrategy.MaintenanceWindow)
+	if w == nil {
+		return false
+	}
+	now := time.Now
+	if app.now != nil {
+		now = app.now
+	}
+	return !w.contains(now())
+}
+
+// Restarts the xray service, or reloads it if reload is set, and checks its
+// health afterwards
+func (app *Application) cycleXrayService(ctx context.Context, reload bool) error {
+	since := time.Now()
+	var err error
+	if reload {
+		err = utils.CheckServiceReload(ctx, app.xrayService)
+	} else {
+		err = utils.CheckServiceOperability(ctx, app.xrayService)
+	}
+	if err == nil {
+		err = app.checkXrayHealth(ctx, since)
+	}
+	if err != nil {
+		app.attachXrayLogs(ctx, since)
+	}
+	return err
+}
+
+// Makes the xray service pick up its changed files or config: reloads it with
+// the reload strategy, restarts it otherwise
+func (app *Application) refreshXrayService(ctx context.Context) error {
+	return app.cycleXrayService(ctx, app.applyStrategy.Mode == applyReload)
+}
+
+// Replaces the warp outbound of the running xray server with the one of the
+// config through the HandlerService of the xray API. removed reports whether the
+// running server has lost its previous outbound already.
+func (app *Application) hotSwapWarpOutbound(ctx context.Context, xray Xray, xrayServerConfig *ServerConfig) (removed bool, err error) {
+	address := xrayServerConfig.API.handlerAddress()
+	if address == "" {
+		return false, errors.New("the server config does not serve the HandlerService " +
+			"of the xray API on a listen address")
+	}
+	var outbound *SrvOutbound
+	for i, outb := range xrayServerConfig.Outbounds {
+		if outb.Protocol == "wireguard" && outb.Settings != nil {
+			outbound = &xrayServerConfig.Outbounds[i]
+			break
+		}
+	}
+	if outbound == nil || outbound.Tag == "" {
+		return false, errors.New("the server config has no tagged wireguard outbound")
+	}
+
+	dir, err := os.MkdirTemp("", "xray-outbound-")
+	if err != nil {
+		return false, fmt.Errorf("failed to create a temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+	outboundFile := filepath.Join(dir, "outbound.json")
+	if err := utils.WriteStructToJSONFile(&struct {
+		Outbounds []SrvOutbound `json:"outbounds"`
+	}{[]SrvOutbound{*outbound}}, outboundFile); err != nil {
+		return false, err
+	}
+
+	run := app.fileExecutor
+	if run == nil {
+		run = utils.ExecuteFile
+	}
+	since := time.Now()
+	server := "--server=" + address
+	if out, err := run(ctx, xray.ExecutableFilePath, "api", "rmo", server, outbound.Tag); err != nil {
+		return false, fmt.Errorf("failed to remove the outbound %s: %w: %s", outbound.Tag,
+			err, strings.TrimSpace(out))
+	}
+	if out, err := run(ctx, xray.ExecutableFilePath, "api", "ado", server, outboundFile); err != nil {
+		return true, fmt.Errorf("failed to add the outbound %s: %w: %s", outbound.Tag,
+			err, strings.TrimSpace(out))
+	}
+
+	active, err := app.xrayService.IsActive(ctx)
+	if err != nil {
+		return true, err
+	}
+	if !active {
+		return true, fmt.Errorf("%s is not active after the outbound has been replaced",
+			app.xrayService.Name())
+	}
+	return true, app.checkXrayHealth(ctx, since)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2025, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		window  string
+		errMsg  string
+		inside  []time.Time
+		outside []time.Time
+	}{
+		{window: "03:00-05:00", inside: []time.Time{at(3, 0), at(4, 59)}, outside: []time.Time{at(2, 59), at(5, 0), at(15, 0)}},
+		{window: "23:30 - 01:00", inside: []time.Time{at(23, 30), at(0, 0), at(0, 59)}, outside: []time.Time{at(1, 0), at(12, 0), at(23, 29)}},
+		{window: "03:00", errMsg: "shall be a range"},
+		{window: "03:00-25:00", errMsg: `invalid time "25:00"`},
+		{window: "03:00-03:00", errMsg: "is empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.window, func(t *testing.T) {
+			w, err := parseMaintenanceWindow(tt.window)
+			if tt.errMsg != "" {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+				return
+			}
+			utils.AssertNoError(t, err)
+			for _, inside := range tt.inside {
+				utils.AssertCorrectBool(t, true, w.contains(inside))
+			}
+			for _, outside := range tt.outside {
+				utils.AssertCorrectBool(t, false, w.contains(outside))
+			}
+		})
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		w, err := parseMaintenanceWindow("")
+		utils.AssertNoError(t, err)
+		if w != nil {
+			t.Errorf("Expected no window, got %+v", w)
+		}
+	})
+}
+
+func TestValidateApplyStrategy(t *testing.T) {
+	utils.AssertNoError(t, validateApplyStrategy(ApplyStrategy{Mode: applyAPI, MaintenanceWindow: "03:00-05:00"}))
+	utils.AssertErrorContains(t, validateApplyStrategy(ApplyStrategy{Mode: "hot"}), `unknown apply mode "hot"`)
+	utils.AssertErrorContains(t, validateApplyStrategy(ApplyStrategy{Mode: applyRestart, MaintenanceWindow: "night"}), "shall be a range")
+}
+
+func TestRestartDeferred(t *testing.T) {
+	noon := func() time.Time { return time.Date(2025, 1, 1, 12, 0, 0, 0, time.Local) }
+
+	tests := []struct {
+		name     string
+		strategy ApplyStrategy
+		want     bool
+	}{
+		{"no window", ApplyStrategy{Mode: applyRestart}, false},
+		{"within the window", ApplyStrategy{Mode: applyRestart, MaintenanceWindow: "11:00-13:00"}, false},
+		{"outside the window", ApplyStrategy{Mode: applyRestart, MaintenanceWindow: "03:00-05:00"}, true},
+		{"api outside the window", ApplyStrategy{Mode: applyAPI, MaintenanceWindow: "03:00-05:00"}, true},
+		{"reload is never deferred", ApplyStrategy{Mode: applyReload, MaintenanceWindow: "03:00-05:00"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Application{applyStrategy: tt.strategy, now: noon}
+			utils.AssertCorrectBool(t, tt.want, app.restartDeferred())
+		})
+	}
+}
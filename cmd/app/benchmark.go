@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// What is done if warp is operational but its benchmark is below the thresholds
+const (
+	onSlowReport      = "report"
+	onSlowEndpoint    = "endpoint"
+	onSlowCredentials = "credentials"
+
+	benchmarkRequestTimeout = 15 * time.Second
+)
+
+// Benchmark measures whether warp is usable rather than only operational
+type Benchmark struct {
+	Enabled bool `koanf:"enabled"`
+	// Downloaded through the verification client on every request
+	URL string `koanf:"url"`
+	// Number of the downloads, the jitter is computed over them
+	Requests int `koanf:"requests"`
+	// Thresholds, 0 disables the threshold
+	MaxTTFB           time.Duration `koanf:"max_ttfb"`
+	MaxJitter         time.Duration `koanf:"max_jitter"`
+	MinThroughputMbps float64       `koanf:"min_throughput_mbps"`
+	// report, endpoint (pick another endpoint for the current credentials) or
+	// credentials (obtain new credentials)
+	OnSlow string `koanf:"on_slow"`
+	// File the results are appended to as JSON lines, relative to the workdir
+	// unless absolute. No history is kept if empty.
+	HistoryFile string `koanf:"history_file"`
+	// Number of the latest results the history file keeps, 0 keeps them all
+	HistoryLimit int `koanf:"history_limit"`
+}
+
+func validateBenchmark(b Benchmark) error {
+	if !b.Enabled {
+		return nil
+	}
+	if b.URL == "" || b.Requests <= 0 {
+		return fmt.Errorf("the warp benchmark shall have the url and a positive " +
+			"number of requests")
+	}
+	if b.HistoryLimit < 0 {
+		return fmt.Errorf("the history_limit of the warp benchmark cannot be negative")
+	}
+	if !slices.Contains([]string{onSlowReport, onSlowEndpoint, onSlowCredentials}, b.OnSlow) {
+		return fmt.Errorf("unknown on_slow %q of the warp benchmark, expected %s, %s "+
+			"or %s", b.OnSlow, onSlowReport, onSlowEndpoint, onSlowCredentials)
+	}
+	return nil
+}
+
+// BenchmarkResult is a single run of the benchmark
+type BenchmarkResult struct {
+	Time     time.Time `json:"time"`
+	Requests int       `json:"requests"`
+	Failed   int       `json:"failed"`
+	// Median time to the first byte
+	TTFB time.Duration `json:"ttfb"`
+	// Mean difference of the times to the first byte of the successive requests
+	Jitter         time.Duration `json:"jitter"`
+	ThroughputMbps float64       `json:"throughput_mbps"`
+	// Thresholds the result is below
+	Violations []string `json:"violations,omitempty"`
+	// The last error if all the requests have failed
+	Err string `json:"error,omitempty"`
+}
+
+func (r BenchmarkResult) String() string {
+	s := fmt.Sprintf("ttfb %s, jitter %s, throughput %.2f Mbps, %d of %d requests failed",
+		r.TTFB.Round(time.Millisecond), r.Jitter.Round(time.Millisecond),
+		r.ThroughputMbps, r.Failed, r.Requests)
+	if len(r.Violations) > 0 {
+		s += "; " + strings.Join(r.Violations, "; ")
+	}
+	return s
+}
+
+// Summarizes the downloads and compares the summary with the thresholds
+func summarizeBenchmark(b Benchmark, downloads []utils.DownloadStats, errs []error) BenchmarkResult {
+	r := BenchmarkResult{Time: time.Now(), Requests: len(downloads) + len(errs), Failed: len(errs)}
+	if len(downloads) == 0 {
+		if len(errs) > 0 {
+			r.Err = errs[len(errs)-1].Error()
+		}
+		r.Violations = append(r.Violations, "all the requests have failed")
+		return r
+	}
+
+	ttfbs := make([]time.Duration, len(downloads))
+	var bytes int64
+	var transfer time.Duration
+	for i, d := range downloads {
+		ttfbs[i] = d.TTFB
+		bytes += d.Bytes
+		transfer += d.Transfer
+	}
+
+	for i := 1; i < len(ttfbs); i++ {
+		r.Jitter += (ttfbs[i] - ttfbs[i-1]).Abs()
+	}
+	if len(ttfbs) > 1 {
+		r.Jitter /= time.Duration(len(ttfbs) - 1)
+	}
+	slices.Sort(ttfbs)
+	r.TTFB = ttfbs[len(ttfbs)/2]
+	if transfer > 0 {
+		r.ThroughputMbps = float64(bytes) * 8 / transfer.Seconds() / 1e6
+	}
+
+	if r.Failed > 0 {
+		r.Violations = append(r.Violations, fmt.Sprintf("%d of %d requests have failed",
+			r.Failed, r.Requests))
+	}
+	if b.MaxTTFB > 0 && r.TTFB > b.MaxTTFB {
+		r.Violations = append(r.Violations, fmt.Sprintf("ttfb %s exceeds %s",
+			r.TTFB.Round(time.Millisecond), b.MaxTTFB))
+	}
+	if b.MaxJitter > 0 && r.Jitter > b.MaxJitter {
+		r.Violations = append(r.Violations, fmt.Sprintf("jitter %s exceeds %s",
+			r.Jitter.Round(time.Millisecond), b.MaxJitter))
+	}
+	// A body received in a single read says nothing about the throughput
+	if b.MinThroughputMbps > 0 && transfer > 0 && r.ThroughputMbps < b.MinThroughputMbps {
+		r.Violations = append(r.Violations, fmt.Sprintf("throughput %.2f Mbps is below "+
+			"%.2f Mbps", r.ThroughputMbps, b.MinThroughputMbps))
+	}
+	return r
+}
+
+// Downloads the benchmark URL through the proxy the configured number of times
+func runBenchmark(ctx context.Context, b Benchmark, proxy *utils.Proxy) BenchmarkResult {
+	var downloads []utils.DownloadStats
+	var errs []error
+	for range b.Requests {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			continue
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, benchmarkRequestTimeout)
+		stats, err := utils.MeasureDownload(reqCtx, b.URL, proxy)
+		cancel()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		downloads = append(downloads, stats)
+	}
+	return summarizeBenchmark(b, downloads, errs)
+}
+
+// How long the verification client shall live for the benchmark
+func benchmarkBudget(b Benchmark) time.Duration {
+	if !b.Enabled {
+		return 0
+	}
+	return time.Duration(b.Requests) * benchmarkRequestTimeout
+}
+
+// Marks an operational diagnosis as slow if the benchmark is below the thresholds
+func applyBenchmark(d WarpDiagnosis, r BenchmarkResult) WarpDiagnosis {
+	d.Benchmark = &r
+	if d.OK() && len(r.Violations) > 0 {
+		d.Status = WarpSlow
+		d.Err = fmt.Errorf("%s", strings.Join(r.Violations, "; "))
+	}
+	return d
+}
+
+// A line of the warp history file
+type warpHistoryEntry struct {
+	Status    string          `json:"status"`
+	Egress    string          `json:"egress,omitempty"`
+	Colo      string          `json:"colo,omitempty"`
+	Endpoint  string          `json:"endpoint,omitempty"`
+	Benchmark BenchmarkResult `json:"benchmark"`
+}
+
+// Appends the result of the benchmark to the history file, dropping the oldest
+// results beyond the limit
+func appendWarpHistory(path string, limit int, d WarpDiagnosis, endpoint string) error {
+	if path == "" || d.Benchmark == nil {
+		return nil
+	}
+	line, err := json.Marshal(warpHistoryEntry{
+		Status:    d.Status.String(),
+		Egress:    d.EgressIP,
+		Colo:      d.Colo,
+		Endpoint:  endpoint,
+		Benchmark: *d.Benchmark,
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read the warp history file: %w", err)
+	}
+	var lines []string
+	if history := strings.TrimSpace(string(data)); history != "" {
+		lines = strings.Split(history, "\n")
+	}
+	lines = append(lines, string(line))
+	if limit > 0 && len(lines) > limit {
+		lines = lines[len(lines)-limit:]
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	if err := utils.WriteFileAtomically(path, strings.NewReader(content), 0644); err != nil {
+		return fmt.Errorf("failed to write the warp history file: %w", err)
+	}
+	return nil
+}
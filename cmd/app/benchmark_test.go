@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestValidateBenchmark(t *testing.T) {
+	valid := Benchmark{Enabled: true, URL: "https://example.com", Requests: 3, OnSlow: onSlowEndpoint}
+
+	tests := []struct {
+		name      string
+		benchmark func(b Benchmark) Benchmark
+		errMsg    string
+	}{
+		{"valid", func(b Benchmark) Benchmark { return b }, ""},
+		{"disabled", func(b Benchmark) Benchmark { return Benchmark{} }, ""},
+		{"no url", func(b Benchmark) Benchmark { b.URL = ""; return b }, "shall have the url"},
+		{"no requests", func(b Benchmark) Benchmark { b.Requests = 0; return b }, "positive number"},
+		{"unknown action", func(b Benchmark) Benchmark { b.OnSlow = "restart"; return b }, `unknown on_slow "restart"`},
+		{"negative history limit", func(b Benchmark) Benchmark { b.HistoryLimit = -1; return b }, "cannot be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBenchmark(tt.benchmark(valid))
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestSummarizeBenchmark(t *testing.T) {
+	ms := time.Millisecond
+	download := func(ttfb time.Duration) utils.DownloadStats {
+		// 1 Mbit per 100 ms, i.e. 10 Mbps
+		return utils.DownloadStats{TTFB: ttfb, Bytes: 125_000, Transfer: 100 * ms}
+	}
+	thresholds := Benchmark{MaxTTFB: 500 * ms, MaxJitter: 100 * ms, MinThroughputMbps: 5}
+
+	tests := []struct {
+		name       string
+		benchmark  Benchmark
+		downloads  []utils.DownloadStats
+		errs       []error
+		ttfb       time.Duration
+		jitter     time.Duration
+		violations []string
+	}{
+		{
+			name:      "usable",
+			benchmark: thresholds,
+			downloads: []utils.DownloadStats{download(100 * ms), download(200 * ms), download(150 * ms)},
+			ttfb:      150 * ms,
+			jitter:    75 * ms,
+		},
+		{
+			name:       "slow and jittery",
+			benchmark:  thresholds,
+			downloads:  []utils.DownloadStats{download(900 * ms), download(600 * ms), download(1200 * ms)},
+			ttfb:       900 * ms,
+			jitter:     450 * ms,
+			violations: []string{"ttfb 900ms exceeds 500ms", "jitter 450ms exceeds 100ms"},
+		},
+		{
+			name:       "low throughput and failures",
+			benchmark:  Benchmark{MinThroughputMbps: 20},
+			downloads:  []utils.DownloadStats{download(100 * ms)},
+			errs:       []error{errors.New("reset")},
+			ttfb:       100 * ms,
+			violations: []string{"1 of 2 requests have failed", "throughput 10.00 Mbps is below 20.00 Mbps"},
+		},
+		{
+			name:       "no thresholds",
+			downloads:  []utils.DownloadStats{download(5 * time.Second)},
+			ttfb:       5 * time.Second,
+			violations: nil,
+		},
+		{
+			name:       "all failed",
+			benchmark:  thresholds,
+			errs:       []error{errors.New("timeout")},
+			violations: []string{"all the requests have failed"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := summarizeBenchmark(tt.benchmark, tt.downloads, tt.errs)
+			utils.AssertCorrectString(t, tt.ttfb.String(), r.TTFB.String())
+			utils.AssertCorrectString(t, tt.jitter.String(), r.Jitter.String())
+			utils.AssertCorrectString(t, strings.Join(tt.violations, "; "), strings.Join(r.Violations, "; "))
+
+			d := applyBenchmark(WarpDiagnosis{Status: WarpOK}, r)
+			utils.AssertCorrectBool(t, len(tt.violations) == 0, d.OK())
+		})
+	}
+}
+
+func TestRunBenchmark(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(30 * time.Millisecond)
+		w.Write([]byte(strings.Repeat("x", 10_000)))
+	}))
+	defer ts.Close()
+
+	r := runBenchmark(context.Background(), Benchmark{URL: ts.URL, Requests: 3, MaxTTFB: 10 * time.Millisecond}, nil)
+	utils.AssertCorrectInt(t, 3, r.Requests)
+	utils.AssertCorrectInt(t, 0, r.Failed)
+	if r.TTFB < 30*time.Millisecond {
+		t.Errorf("Expected the ttfb of at least 30ms, got %s", r.TTFB)
+	}
+	utils.AssertCorrectInt(t, 1, len(r.Violations))
+}
+
+func TestAppendWarpHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	d := WarpDiagnosis{Status: WarpOK, EgressIP: "104.28.1.1", Colo: "AMS"}
+	utils.AssertNoError(t, appendWarpHistory(path, 0, d, "engage.cloudflareclient.com:2408"))
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatal("Expected no history without a benchmark")
+	}
+
+	for _, ttfb := range []time.Duration{time.Second, 2 * time.Second} {
+		d := applyBenchmark(d, BenchmarkResult{Requests: 1, TTFB: ttfb})
+		utils.AssertNoError(t, appendWarpHistory(path, 0, d, "engage.cloudflareclient.com:2408"))
+	}
+	utils.AssertNoError(t, appendWarpHistory("", 0, d, ""))
+
+	raw, err := os.ReadFile(path)
+	utils.AssertNoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	utils.AssertCorrectInt(t, 2, len(lines))
+
+	var entry warpHistoryEntry
+	utils.AssertNoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	utils.AssertCorrectString(t, WarpOK.String(), entry.Status)
+	utils.AssertCorrectString(t, "104.28.1.1", entry.Egress)
+	utils.AssertCorrectString(t, "engage.cloudflareclient.com:2408", entry.Endpoint)
+	utils.AssertCorrectString(t, (2 * time.Second).String(), entry.Benchmark.TTFB.String())
+
+	// The oldest results are dropped beyond the limit
+	d = applyBenchmark(d, BenchmarkResult{Requests: 1, TTFB: 3 * time.Second})
+	utils.AssertNoError(t, appendWarpHistory(path, 2, d, "engage.cloudflareclient.com:2408"))
+	raw, err = os.ReadFile(path)
+	utils.AssertNoError(t, err)
+	lines = strings.Split(strings.TrimSpace(string(raw)), "\n")
+	utils.AssertCorrectInt(t, 2, len(lines))
+	utils.AssertNoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	utils.AssertCorrectString(t, (2 * time.Second).String(), entry.Benchmark.TTFB.String())
+}
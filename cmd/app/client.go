@@ -1,22 +1,44 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"context"
-	"errors"
 	"fmt"
-	"io"
+	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/ilyakutilin/xray_maintainer/utils"
 )
 
+type ClientAccount struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+type ClientInboundSettings struct {
+	// Destination of the dokodemo-door inbound
+	Address string `json:"address,omitempty"`
+	// Authentication of the socks inbound: noauth or password
+	Auth     string          `json:"auth,omitempty"`
+	Accounts []ClientAccount `json:"accounts,omitempty"`
+	// UDP ASSOCIATE support of the socks inbound and the address it replies with
+	UDP bool   `json:"udp,omitempty"`
+	IP  string `json:"ip,omitempty"`
+}
+
 type ClientInbound struct {
-	Port     int    `json:"port"`
-	Protocol string `json:"protocol"`
+	Listen   string                 `json:"listen,omitempty"`
+	Port     int                    `json:"port"`
+	Protocol string                 `json:"protocol"`
+	Tag      string                 `json:"tag,omitempty"`
+	Settings *ClientInboundSettings `json:"settings,omitempty"`
 }
 
 type ClientOutboundSettingsServer struct {
@@ -37,9 +59,10 @@ type ClientOutbound struct {
 }
 
 type ClientRoutingRule struct {
-	Type        string `json:"type"`
-	OutboundTag string `json:"outboundTag"`
-	Network     string `json:"network"`
+	Type        string   `json:"type"`
+	InboundTag  []string `json:"inboundTag,omitempty"`
+	OutboundTag string   `json:"outboundTag"`
+	Network     string   `json:"network,omitempty"`
 }
 
 type ClientRouting struct {
@@ -47,57 +70,261 @@ type ClientRouting struct {
 	DomainStrategy string              `json:"domainStrategy"`
 }
 
+type ClientAPI struct {
+	Tag      string   `json:"tag"`
+	Services []string `json:"services"`
+}
+
 type ClientConfig struct {
 	Log       Log              `json:"log"`
+	API       *ClientAPI       `json:"api,omitempty"`
+	Stats     *struct{}        `json:"stats,omitempty"`
 	Inbounds  []ClientInbound  `json:"inbounds"`
 	Outbounds []ClientOutbound `json:"outbounds"`
 	Routing   ClientRouting    `json:"routing"`
 }
 
-func startXrayClient(ctx context.Context, xray Xray) (*exec.Cmd, io.ReadCloser, error) {
-	cmd := exec.CommandContext(ctx, xray.ExecutableFilePath, "-c", xray.Client.ConfigFilePath)
-	stdout, err := cmd.StdoutPipe()
+const (
+	// Tag of the inbound serving the proxy of the verification client
+	clientProxyTag = "proxy"
+	// Tag of the inbound serving the xray API of the verification client
+	clientAPITag = "api"
+)
+
+// Makes the client serve the xray API on the port, which is used to make sure
+// that the core has started
+func (c *ClientConfig) enableAPI(port int) {
+	c.API = &ClientAPI{Tag: clientAPITag, Services: []string{"StatsService"}}
+	c.Stats = &struct{}{}
+	c.Inbounds = append(c.Inbounds, ClientInbound{
+		Listen:   "127.0.0.1",
+		Port:     port,
+		Protocol: "dokodemo-door",
+		Tag:      clientAPITag,
+		Settings: &ClientInboundSettings{Address: "127.0.0.1"},
+	})
+	c.Routing.Rules = append([]ClientRoutingRule{{
+		Type:        "field",
+		InboundTag:  []string{clientAPITag},
+		OutboundTag: clientAPITag,
+	}}, c.Routing.Rules...)
+}
+
+func (c *ClientConfig) proxyInbound() *ClientInbound {
+	for i := range c.Inbounds {
+		if c.Inbounds[i].Tag == clientProxyTag {
+			return &c.Inbounds[i]
+		}
+	}
+	return nil
+}
+
+// Requires the username and the password from the clients of the proxy
+func (c *ClientConfig) setProxyAccount(user, pass string) {
+	inbound := c.proxyInbound()
+	if inbound.Settings == nil {
+		inbound.Settings = &ClientInboundSettings{}
+	}
+	if inbound.Protocol == "socks" {
+		inbound.Settings.Auth = "password"
+	}
+	inbound.Settings.Accounts = []ClientAccount{{User: user, Pass: pass}}
+}
+
+// The proxy served by the verification client
+func (c *ClientConfig) proxy() *utils.Proxy {
+	inbound := c.proxyInbound()
+	if inbound == nil {
+		return nil
+	}
+	proxy := &utils.Proxy{Protocol: utils.ProxyHTTP, IP: "127.0.0.1", Port: inbound.Port}
+	if inbound.Protocol == "socks" {
+		proxy.Protocol = utils.ProxySOCKS5
+	}
+	if inbound.Settings != nil && len(inbound.Settings.Accounts) > 0 {
+		proxy.Username = inbound.Settings.Accounts[0].User
+		proxy.Password = inbound.Settings.Accounts[0].Pass
+	}
+	return proxy
+}
+
+// Port of the API inbound, 0 if the API is not enabled
+func (c *ClientConfig) apiPort() int {
+	for _, inbound := range c.Inbounds {
+		if inbound.Tag == clientAPITag {
+			return inbound.Port
+		}
+	}
+	return 0
+}
+
+// Collects the output of the process from several goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// Returns up to n last lines of the output
+func (b *syncBuffer) tail(n int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	lines := strings.Split(strings.TrimRight(b.buf.String(), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// A temporary xray client running from its own directory
+type verificationClient struct {
+	executable string
+	config     *ClientConfig
+	dir        string
+	cmd        *exec.Cmd
+	output     syncBuffer
+	// Closed once the process has exited
+	exited  chan struct{}
+	waitErr error
+	stopped sync.Once
+}
+
+// Writes the config into a new temporary directory and starts xray from there
+// in its own process group. The client is stopped once the context is done.
+func startVerificationClient(ctx context.Context, executable string, config *ClientConfig) (*verificationClient, error) {
+	dir, err := os.MkdirTemp("", "xray-verification-*")
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to get stdout pipe: %w", err)
+		return nil, fmt.Errorf("failed to create the directory for the verification "+
+			"client: %w", err)
+	}
+
+	configPath := filepath.Join(dir, "config.json")
+	if err := utils.WriteStructToJSONFile(config, configPath); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("error writing client config to %q: %w", configPath, err)
+	}
+
+	c := &verificationClient{
+		executable: executable,
+		config:     config,
+		dir:        dir,
+		exited:     make(chan struct{}),
 	}
-	if err := cmd.Start(); err != nil {
-		return nil, nil, fmt.Errorf("failed to start xray process: %w", err)
+	c.cmd = exec.Command(executable, "-c", configPath)
+	c.cmd.Dir = dir
+	c.cmd.Stdout = &c.output
+	c.cmd.Stderr = &c.output
+	c.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := c.cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to start xray process: %w", err)
 	}
-	return cmd, stdout, nil
+
+	go func() {
+		c.waitErr = c.cmd.Wait()
+		close(c.exited)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.stop()
+		case <-c.exited:
+		}
+	}()
+
+	return c, nil
 }
 
-func watchXrayStartup(stdout io.ReadCloser, ready chan<- struct{}) {
-	scanner := bufio.NewScanner(stdout)
-	for scanner.Scan() {
-		line := scanner.Text()
-		fmt.Println("xray:", line)
-		if strings.Contains(line, "Failed to start:") {
-			close(ready)
-			return
+// Waits until the proxy port accepts the connections and the xray API responds.
+// Fails early if the process exits.
+func (c *verificationClient) waitReady(ctx context.Context) error {
+	proxyAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(c.config.proxy().Port))
+	apiPort := c.config.apiPort()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.exited:
+			return fmt.Errorf("xray exited during startup: %v. Output:\n%s",
+				c.waitErr, c.output.tail(10))
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for xray startup. Output:\n%s",
+				c.output.tail(10))
+		case <-ticker.C:
 		}
-		if strings.Contains(line, "Xray ") && strings.Contains(line, " started") {
-			close(ready)
-			return
+
+		conn, err := net.DialTimeout("tcp", proxyAddr, 300*time.Millisecond)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+
+		if apiPort == 0 || c.apiResponds(ctx, apiPort) {
+			return nil
 		}
 	}
 }
 
-func waitForXrayReady(ctx context.Context, ready <-chan struct{}, port int) error {
-	select {
-	case <-ready:
-		addr := fmt.Sprintf("127.0.0.1:%d", port)
-		return utils.WaitForPort(addr, 3*time.Second)
-	case <-ctx.Done():
-		return errors.New("timed out waiting for xray startup")
-	}
+// Queries the stats of the client via the xray API
+func (c *verificationClient) apiResponds(ctx context.Context, port int) bool {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	server := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	return exec.CommandContext(ctx, c.executable, "api", "statsquery",
+		"--server="+server).Run() == nil
+}
+
+// Terminates the whole process group, kills it if it does not exit in time,
+// and removes the directory of the client. Safe to call more than once.
+func (c *verificationClient) stop() {
+	c.stopped.Do(func() {
+		defer os.RemoveAll(c.dir)
+
+		pgid := c.cmd.Process.Pid
+		_ = syscall.Kill(-pgid, syscall.SIGTERM)
+		select {
+		case <-c.exited:
+		case <-time.After(3 * time.Second):
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+			<-c.exited
+		}
+	})
 }
 
-func terminateProcess(cmd *exec.Cmd) error {
-	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
-		return fmt.Errorf("failed to send SIGTERM: %w", err)
+// Makes sure the verification client can serve the proxy or an existing one is usable
+func validateClientProxy(client XrayClient) error {
+	if client.ProxyProtocol != "http" && client.ProxyProtocol != "socks" {
+		return fmt.Errorf("unknown proxy protocol %q of the verification client, "+
+			"expected http or socks", client.ProxyProtocol)
 	}
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("xray process exited with error: %w", err)
+	if client.ProxyURL != "" {
+		if _, err := utils.ParseProxyURL(client.ProxyURL); err != nil {
+			return fmt.Errorf("invalid proxy_url of the verification client: %w", err)
+		}
 	}
 	return nil
 }
+
+// Picks the ports of the proxy and of the API of the verification client. The
+// proxy port set in the config is kept, otherwise a free one is taken.
+func pickClientPorts(configured int) (proxy int, api int, err error) {
+	proxy = configured
+	if proxy == 0 {
+		if proxy, err = utils.FreePort(); err != nil {
+			return 0, 0, err
+		}
+	}
+	for api == 0 || api == proxy {
+		if api, err = utils.FreePort(); err != nil {
+			return 0, 0, err
+		}
+	}
+	return proxy, api, nil
+}
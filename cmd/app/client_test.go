@@ -1,72 +1,220 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
 )
 
-type fakeReadCloser struct {
-	*bytes.Buffer
+func TestPickClientPorts(t *testing.T) {
+	proxy, api, err := pickClientPorts(0)
+	utils.AssertNoError(t, err)
+	if proxy == 0 || api == 0 || proxy == api {
+		t.Errorf("Expected two different free ports, got %d and %d", proxy, api)
+	}
+
+	proxy, api, err = pickClientPorts(23456)
+	utils.AssertNoError(t, err)
+	utils.AssertCorrectInt(t, 23456, proxy)
+	if api == 0 || api == proxy {
+		t.Errorf("Expected a free API port, got %d", api)
+	}
+}
+
+func TestEnableAPI(t *testing.T) {
+	config := ClientConfig{
+		Inbounds: []ClientInbound{{Listen: "127.0.0.1", Port: 23456, Protocol: "http", Tag: clientProxyTag}},
+		Routing: ClientRouting{Rules: []ClientRoutingRule{
+			{Type: "field", OutboundTag: "shadowsocks", Network: "tcp,udp"},
+		}},
+	}
+	utils.AssertCorrectInt(t, 0, config.apiPort())
+
+	config.enableAPI(34567)
+	utils.AssertCorrectInt(t, 23456, config.proxy().Port)
+	utils.AssertCorrectInt(t, 34567, config.apiPort())
+	utils.AssertCorrectInt(t, 2, len(config.Routing.Rules))
+	// The API traffic shall not be routed to the proxy outbound
+	utils.AssertCorrectString(t, clientAPITag, config.Routing.Rules[0].OutboundTag)
+	if config.API == nil || config.Stats == nil {
+		t.Error("Expected the API and the stats to be enabled")
+	}
 }
 
-func (f *fakeReadCloser) Close() error { return nil }
+func TestClientConfigProxy(t *testing.T) {
+	serverConfig := ServerConfig{Inbounds: []SrvInbound{{
+		Protocol: "shadowsocks",
+		Port:     12345,
+		Settings: SrvInbSettings{Method: "testmethod", Password: "testpassword", Network: "tcp"},
+	}}}
+	server := XrayServer{IP: "1.1.1.1"}
 
-func TestWatchXrayStartup(t *testing.T) {
 	tests := []struct {
-		name        string
-		input       string
-		expectReady bool
+		name     string
+		protocol string
+		account  bool
+		want     utils.Proxy
 	}{
-		{
-			name:        "Xray started line triggers ready",
-			input:       "2025/05/16 15:44:52 [Warning] core: Xray 25.4.30 started\n",
-			expectReady: true,
-		},
-		{
-			name:        "Failed to start triggers ready",
-			input:       "Failed to start: something bad happened\n",
-			expectReady: true,
-		},
-		{
-			name:        "No trigger line does not close ready",
-			input:       "Some other log line\n",
-			expectReady: false,
-		},
+		{"http", "http", false, utils.Proxy{Protocol: utils.ProxyHTTP, IP: "127.0.0.1", Port: 23456}},
+		{"http with account", "http", true, utils.Proxy{Protocol: utils.ProxyHTTP, IP: "127.0.0.1",
+			Port: 23456, Username: "user", Password: "pass"}},
+		{"socks", "socks", false, utils.Proxy{Protocol: utils.ProxySOCKS5, IP: "127.0.0.1", Port: 23456}},
+		{"socks with account", "socks", true, utils.Proxy{Protocol: utils.ProxySOCKS5, IP: "127.0.0.1",
+			Port: 23456, Username: "user", Password: "pass"}},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			stdout := &fakeReadCloser{Buffer: bytes.NewBufferString(tt.input)}
-			ready := make(chan struct{})
-
-			go watchXrayStartup(stdout, ready)
+			client := XrayClient{ServerProtocol: "shadowsocks", Port: 23456, ProxyProtocol: tt.protocol}
+			config := getClientConfig(&client, &server, &serverConfig)
+			if tt.account {
+				config.setProxyAccount("user", "pass")
+			}
 
-			select {
-			case <-ready:
-				if !tt.expectReady {
-					t.Errorf("ready channel closed unexpectedly")
-				}
-			case <-time.After(200 * time.Millisecond):
-				if tt.expectReady {
-					t.Errorf("ready channel not closed as expected")
+			utils.AssertCorrectString(t, tt.protocol, config.Inbounds[0].Protocol)
+			if got := config.proxy(); *got != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, *got)
+			}
+			if tt.protocol == "socks" {
+				settings := config.Inbounds[0].Settings
+				if !settings.UDP {
+					t.Error("Expected the socks inbound to support UDP")
 				}
+				utils.AssertCorrectBool(t, tt.account, settings.Auth == "password")
 			}
 		})
 	}
 }
 
-func TestWaitForXrayReady_CtxTimeout(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
-	defer cancel()
+func TestValidateClientProxy(t *testing.T) {
+	tests := []struct {
+		name   string
+		client XrayClient
+		errMsg string
+	}{
+		{"socks", XrayClient{ProxyProtocol: "socks"}, ""},
+		{"existing proxy", XrayClient{ProxyProtocol: "http", ProxyURL: "socks5://127.0.0.1:1080"}, ""},
+		{"unknown protocol", XrayClient{ProxyProtocol: "shadowsocks"}, "unknown proxy protocol"},
+		{"invalid existing proxy", XrayClient{ProxyProtocol: "socks", ProxyURL: "ftp://127.0.0.1:21"}, "invalid proxy_url"},
+	}
 
-	ready := make(chan struct{}) // never closed
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateClientProxy(tt.client)
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
 
-	err := waitForXrayReady(ctx, ready, 12345)
-	if err == nil || !errors.Is(err, context.DeadlineExceeded) && !strings.Contains(err.Error(), "timed out") {
-		t.Errorf("expected timeout error, got: %v", err)
+// Tells whether the process exists and is not a zombie
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
 	}
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z" && fields[0] != "X"
+}
+
+func testClientConfig(t *testing.T) *ClientConfig {
+	t.Helper()
+	proxy, api, err := pickClientPorts(0)
+	utils.AssertNoError(t, err)
+	config := &ClientConfig{
+		Inbounds: []ClientInbound{{Listen: "127.0.0.1", Port: proxy, Protocol: "http", Tag: clientProxyTag}},
+		Outbounds: []ClientOutbound{{
+			Protocol: "shadowsocks",
+			Settings: ClientOutboundSettings{Servers: []ClientOutboundSettingsServer{
+				{Address: "127.0.0.1", Port: freePort(t)},
+			}},
+		}},
+	}
+	config.enableAPI(api)
+	return config
+}
+
+func TestVerificationClient(t *testing.T) {
+	t.Run("ready once the ports and the API respond", func(t *testing.T) {
+		fakeXray := buildFakeXray(t)
+		client, err := startVerificationClient(context.Background(), fakeXray, testClientConfig(t))
+		utils.AssertNoError(t, err)
+		defer client.stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		utils.AssertNoError(t, client.waitReady(ctx))
+
+		client.stop()
+		if processAlive(client.cmd.Process.Pid) {
+			t.Error("Expected the client to be stopped")
+		}
+		if _, err := os.Stat(client.dir); !os.IsNotExist(err) {
+			t.Errorf("Expected the directory of the client to be removed, got %v", err)
+		}
+	})
+
+	t.Run("exit during startup is reported with the output", func(t *testing.T) {
+		executable := writeScript(t, "#!/bin/sh\necho 'Failed to start: port in use' >&2\nexit 23\n")
+		client, err := startVerificationClient(context.Background(), executable, testClientConfig(t))
+		utils.AssertNoError(t, err)
+		defer client.stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = client.waitReady(ctx)
+		utils.AssertErrorContains(t, err, "xray exited during startup")
+		utils.AssertErrorContains(t, err, "Failed to start: port in use")
+	})
+
+	t.Run("output of the failed startup is attached", func(t *testing.T) {
+		executable := writeScript(t, "#!/bin/sh\necho 'Failed to start: port in use' >&2\nexit 23\n")
+		app := &Application{logger: GetLogger(false), logLines: 50}
+		xray := Xray{ExecutableFilePath: executable}
+
+		_, _, err := app.openVerificationProxy(context.Background(), xray, testClientConfig(t))
+		utils.AssertErrorContains(t, err, "xray exited during startup")
+		utils.AssertCorrectInt(t, 1, len(app.attachments))
+		utils.AssertCorrectString(t, "Failed to start: port in use", app.attachments[0].Content)
+	})
+
+	t.Run("the whole process group is killed on timeout", func(t *testing.T) {
+		pidFile := filepath.Join(t.TempDir(), "child.pid")
+		// Both the script and its child ignore SIGTERM
+		executable := writeScript(t, "#!/bin/sh\ntrap '' TERM\nsleep 300 &\necho $! > "+pidFile+"\nwait\n")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		client, err := startVerificationClient(ctx, executable, testClientConfig(t))
+		utils.AssertNoError(t, err)
+		defer client.stop()
+
+		utils.AssertErrorContains(t, client.waitReady(ctx), "timed out waiting for xray startup")
+
+		select {
+		case <-client.exited:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Expected the client to be killed")
+		}
+		raw, err := os.ReadFile(pidFile)
+		utils.AssertNoError(t, err)
+		child, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+		utils.AssertNoError(t, err)
+		deadline := time.Now().Add(time.Second)
+		for processAlive(child) && time.Now().Before(deadline) {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if processAlive(child) {
+			t.Errorf("Expected the child process %d to be killed along with the client", child)
+		}
+	})
 }
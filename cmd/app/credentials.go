@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// Supported sources of the WARP credentials
+const (
+	warpProviderAPI           = "api"
+	warpProviderWarpReg       = "warp-reg"
+	warpProviderWgcf          = "wgcf"
+	warpProviderWireguardConf = "wireguard-conf"
+	warpProviderStatic        = "static"
+)
+
+// CredentialProvider obtains a new set of the WARP credentials
+type CredentialProvider interface {
+	// Name identifies the provider in the logs and notifications
+	Name() string
+	GetCredentials(ctx context.Context) (CFCreds, error)
+}
+
+// Resolves the path of a provider file relative to the workdir
+func providerFilePath(workdir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(workdir, path)
+}
+
+// Returns the credential providers configured for the warp update in the order
+// they shall be tried. currentSecretKey is the private key of the warp outbound
+// of the server config, which the static pool and the stored WARP account skip.
+func (app *Application) newCredentialProviders(xray Xray, currentSecretKey string) ([]CredentialProvider, error) {
+	if len(xray.Warp.Providers) == 0 {
+		return nil, errors.New("no warp credential providers have been configured")
+	}
+
+	var providers []CredentialProvider
+	for i, pc := range xray.Warp.Providers {
+		switch pc.Type {
+		case warpProviderAPI:
+			provider := &WarpAPIProvider{
+				APIURL:           xray.Warp.APIURL,
+				License:          xray.Warp.License,
+				CurrentSecretKey: currentSecretKey,
+				Warn:             app.warn,
+			}
+			if xray.Warp.AccountFile != "" {
+				provider.Store = &warpAccountStore{
+					Path:    providerFilePath(app.workdir, xray.Warp.AccountFile),
+					KeyPath: providerFilePath(app.workdir, xray.Warp.AccountKeyFile),
+				}
+			}
+			providers = append(providers, provider)
+		case warpProviderWarpReg:
+			if xray.CFCredFilePath == "" {
+				return nil, fmt.Errorf("warp credential provider #%d (%s) requires "+
+					"the cf_cred_generator repo", i+1, pc.Type)
+			}
+			providers = append(providers, &WarpRegProvider{app: app, FilePath: xray.CFCredFilePath})
+		case warpProviderWgcf:
+			if pc.Path == "" {
+				return nil, fmt.Errorf("warp credential provider #%d (%s) requires "+
+					"the path to wgcf-profile.conf", i+1, pc.Type)
+			}
+			providers = append(providers, &WgcfProvider{
+				ProfilePath: providerFilePath(app.workdir, pc.Path),
+				AccountPath: providerFilePath(app.workdir, pc.Account),
+				API:         &WarpAPIProvider{APIURL: xray.Warp.APIURL},
+			})
+		case warpProviderWireguardConf:
+			if pc.Path == "" {
+				return nil, fmt.Errorf("warp credential provider #%d (%s) requires "+
+					"the path to the WireGuard config", i+1, pc.Type)
+			}
+			providers = append(providers, &WireguardConfProvider{
+				Path: providerFilePath(app.workdir, pc.Path),
+			})
+		case warpProviderStatic:
+			if len(pc.Pool) == 0 {
+				return nil, fmt.Errorf("warp credential provider #%d (%s) requires "+
+					"a non-empty pool", i+1, pc.Type)
+			}
+			providers = append(providers, &StaticPoolProvider{
+				Pool:             pc.Pool,
+				CurrentSecretKey: currentSecretKey,
+			})
+		default:
+			return nil, fmt.Errorf("unknown warp credential provider %q: only %s "+
+				"are supported", pc.Type, strings.Join([]string{warpProviderAPI,
+				warpProviderWarpReg, warpProviderWgcf, warpProviderWireguardConf,
+				warpProviderStatic}, ", "))
+		}
+	}
+
+	return providers, nil
+}
+
+// Asks the providers for the credentials in turn until one of them succeeds
+// and returns the credentials along with the name of that provider. In debug
+// mode the fake credentials are returned without asking any provider.
+func (app *Application) obtainCredentials(ctx context.Context, providers []CredentialProvider) (CFCreds, string, error) {
+	if app.debug {
+		app.logger.Info.Println("The app is in debug mode, so the fake credentials " +
+			"are used instead of the providers.")
+		creds, err := parseCFCreds(debugCFCredsOutput)
+		return creds, "debug", err
+	}
+
+	var errs utils.Errors
+
+	for _, p := range providers {
+		app.logger.Info.Printf("Obtaining new Cloudflare credentials from the %s "+
+			"provider...\n", p.Name())
+		creds, err := p.GetCredentials(ctx)
+		if err == nil {
+			err = validateCFCreds(creds)
+		}
+		if err != nil {
+			app.logger.Warning.Printf("The %s provider failed to provide the "+
+				"credentials: %v\n", p.Name(), err)
+			errs.Append(fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		return creds, p.Name(), nil
+	}
+
+	return CFCreds{}, "", fmt.Errorf("all the warp credential providers failed: %w", errs)
+}
+
+// Makes sure the credentials can be written into the warp outbound of the server config
+func validateCFCreds(creds CFCreds) error {
+	var errs utils.Errors
+
+	for name, key := range map[string]string{"private": creds.SecretKey, "public": creds.PublicKey} {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(decoded) != 32 {
+			errs.Append(fmt.Errorf("%s key %q is not a valid WireGuard key", name, key))
+		}
+	}
+	if ip := net.ParseIP(creds.V4); ip == nil || ip.To4() == nil {
+		errs.Append(fmt.Errorf("%q is not a valid IPv4 address", creds.V4))
+	}
+	if ip := net.ParseIP(creds.V6); ip == nil || ip.To4() != nil {
+		errs.Append(fmt.Errorf("%q is not a valid IPv6 address", creds.V6))
+	}
+	if !utils.IsValidEndpoint(creds.Endpoint) {
+		errs.Append(fmt.Errorf("%q is not a valid endpoint", creds.Endpoint))
+	}
+	if len(creds.Reserved) != 3 {
+		errs.Append(fmt.Errorf("reserved shall have 3 bytes, got %v", creds.Reserved))
+	}
+	for _, b := range creds.Reserved {
+		if b < 0 || b > 255 {
+			errs.Append(fmt.Errorf("reserved value %d is not a byte", b))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// WarpRegProvider runs the github.com/badafans/warp-reg binary and parses its output
+type WarpRegProvider struct {
+	app      *Application
+	FilePath string
+}
+
+func (p *WarpRegProvider) Name() string {
+	return warpProviderWarpReg
+}
+
+func (p *WarpRegProvider) GetCredentials(ctx context.Context) (CFCreds, error) {
+	output, err := p.app.getCFCreds(ctx, p.FilePath)
+	if err != nil {
+		return CFCreds{}, fmt.Errorf("error while launching the Cloudflare "+
+			"credentials generator: %w", err)
+	}
+	creds, err := parseCFCreds(output)
+	if err != nil {
+		return CFCreds{}, fmt.Errorf("error while parsing the generated Cloudflare "+
+			"credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// Parses a WireGuard config with a single peer. Besides the standard keys,
+// the Reserved key (e.g. "Reserved = 1, 2, 3" or "Reserved = [1, 2, 3]") that
+// the WARP tools add to the Interface or Peer section is understood. Without it,
+// the reserved bytes are zero.
+func parseWireguardConf(data string) (CFCreds, error) {
+	creds := CFCreds{Reserved: []int{0, 0, 0}}
+	var section string
+	peers := 0
+
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.Trim(line, "[] "))
+			if section == "peer" {
+				peers++
+			}
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return creds, fmt.Errorf("malformed line %q", line)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch {
+		case key == "reserved":
+			reserved, err := parseReserved(value)
+			if err != nil {
+				return creds, err
+			}
+			creds.Reserved = reserved
+		case section == "interface" && key == "privatekey":
+			creds.SecretKey = value
+		case section == "interface" && key == "address":
+			for _, addr := range strings.Split(value, ",") {
+				addr = strings.TrimSpace(addr)
+				ip, _, _ := strings.Cut(addr, "/")
+				parsed := net.ParseIP(ip)
+				switch {
+				case parsed == nil:
+					return creds, fmt.Errorf("interface address %q is not valid", addr)
+				case parsed.To4() != nil:
+					creds.V4 = ip
+				default:
+					creds.V6 = ip
+				}
+			}
+		case section == "peer" && key == "publickey":
+			creds.PublicKey = value
+		case section == "peer" && key == "endpoint":
+			creds.Endpoint = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return creds, err
+	}
+
+	if peers != 1 {
+		return creds, fmt.Errorf("the config shall have exactly one peer, got %d", peers)
+	}
+	for field, value := range map[string]string{"Interface.PrivateKey": creds.SecretKey,
+		"Peer.PublicKey": creds.PublicKey, "Peer.Endpoint": creds.Endpoint} {
+		if value == "" {
+			return creds, fmt.Errorf("missing required field: %s", field)
+		}
+	}
+
+	return creds, nil
+}
+
+func parseReserved(value string) ([]int, error) {
+	var reserved []int
+	for _, v := range strings.Split(strings.Trim(value, "[] "), ",") {
+		num, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || num < 0 || num > 255 {
+			return nil, fmt.Errorf("reserved %q shall be 3 comma separated bytes", value)
+		}
+		reserved = append(reserved, num)
+	}
+	if len(reserved) != 3 {
+		return nil, fmt.Errorf("reserved %q shall be 3 comma separated bytes", value)
+	}
+	return reserved, nil
+}
+
+// WireguardConfProvider reads the credentials from a WireGuard config dropped
+// into place by an operator
+type WireguardConfProvider struct {
+	Path string
+}
+
+func (p *WireguardConfProvider) Name() string {
+	return warpProviderWireguardConf
+}
+
+func (p *WireguardConfProvider) GetCredentials(ctx context.Context) (CFCreds, error) {
+	data, err := os.ReadFile(p.Path)
+	if err != nil {
+		return CFCreds{}, err
+	}
+	creds, err := parseWireguardConf(string(data))
+	if err != nil {
+		return CFCreds{}, fmt.Errorf("failed to parse %s: %w", p.Path, err)
+	}
+	return creds, nil
+}
+
+// The relevant part of the wgcf-account.toml written by github.com/ViRb3/wgcf
+type wgcfAccount struct {
+	DeviceID    string
+	AccessToken string
+}
+
+// Parses the flat "key = 'value'" TOML file that wgcf writes
+func parseWgcfAccount(data string) (wgcfAccount, error) {
+	var account wgcfAccount
+
+	for _, line := range strings.Split(data, "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `'"`)
+		switch strings.TrimSpace(key) {
+		case "device_id":
+			account.DeviceID = value
+		case "access_token":
+			account.AccessToken = value
+		}
+	}
+
+	if account.DeviceID == "" || account.AccessToken == "" {
+		return account, errors.New("device_id and access_token are required")
+	}
+	return account, nil
+}
+
+// WgcfProvider reads the credentials from the profile generated by
+// github.com/ViRb3/wgcf. The profile lacks the reserved bytes, so if the account
+// file is available, they are looked up in the device config via the WARP API.
+type WgcfProvider struct {
+	ProfilePath string
+	// Path to wgcf-account.toml, optional
+	AccountPath string
+	API         *WarpAPIProvider
+}
+
+func (p *WgcfProvider) Name() string {
+	return warpProviderWgcf
+}
+
+func (p *WgcfProvider) GetCredentials(ctx context.Context) (CFCreds, error) {
+	data, err := os.ReadFile(p.ProfilePath)
+	if err != nil {
+		return CFCreds{}, err
+	}
+	creds, err := parseWireguardConf(string(data))
+	if err != nil {
+		return CFCreds{}, fmt.Errorf("failed to parse %s: %w", p.ProfilePath, err)
+	}
+
+	if p.AccountPath == "" {
+		return creds, nil
+	}
+
+	data, err = os.ReadFile(p.AccountPath)
+	if err != nil {
+		return CFCreds{}, err
+	}
+	account, err := parseWgcfAccount(string(data))
+	if err != nil {
+		return CFCreds{}, fmt.Errorf("failed to parse %s: %w", p.AccountPath, err)
+	}
+
+	device, err := p.API.getDevice(ctx, account.DeviceID, account.AccessToken)
+	if err != nil {
+		return CFCreds{}, err
+	}
+	creds.Reserved, err = reservedFromClientID(device.Config.ClientID)
+	if err != nil {
+		return CFCreds{}, err
+	}
+
+	return creds, nil
+}
+
+// StaticCreds is a set of pre-generated WARP credentials
+type StaticCreds struct {
+	PrivateKey string `koanf:"private_key"`
+	PublicKey  string `koanf:"public_key"`
+	Reserved   []int  `koanf:"reserved"`
+	V4         string `koanf:"v4"`
+	V6         string `koanf:"v6"`
+	Endpoint   string `koanf:"endpoint"`
+}
+
+// StaticPoolProvider takes the credentials from a fixed pool configured by the
+// operator, without any network requests: the entry following the one the server
+// config uses, or the first entry if it uses none of them
+type StaticPoolProvider struct {
+	Pool []StaticCreds
+	// Private key of the credentials currently in use which are known not to work
+	CurrentSecretKey string
+}
+
+func (p *StaticPoolProvider) Name() string {
+	return warpProviderStatic
+}
+
+// Returns the credentials following the ones currently in use
+func (p *StaticPoolProvider) GetCredentials(ctx context.Context) (CFCreds, error) {
+	next := 0
+	for i, c := range p.Pool {
+		if c.PrivateKey == p.CurrentSecretKey {
+			if len(p.Pool) == 1 {
+				return CFCreds{}, errors.New("the only credentials in the pool " +
+					"are already in use")
+			}
+			next = (i + 1) % len(p.Pool)
+			break
+		}
+	}
+
+	c := p.Pool[next]
+	return CFCreds{
+		SecretKey: c.PrivateKey,
+		PublicKey: c.PublicKey,
+		Reserved:  c.Reserved,
+		V4:        c.V4,
+		V6:        c.V6,
+		Endpoint:  c.Endpoint,
+	}, nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+const (
+	testPrivateKey  = "FAKEFAKE/DEMO1234+NOTREALDATA/EXAMPLE12/abc="
+	testPrivateKey2 = "ZZZZ0000/FAKEYFAK+12345678/DEMODEMO/TEST0aY="
+)
+
+func testWireguardConf(extra string) string {
+	return fmt.Sprintf(`[Interface]
+PrivateKey = %s
+Address = 172.16.0.2/32, 2606:4700:110:8a36::1/128
+DNS = 1.1.1.1
+MTU = 1280
+%s
+[Peer]
+PublicKey = %s
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = engage.cloudflareclient.com:2408
+`, testPrivateKey, extra, fakeWarpPeerKey)
+}
+
+func TestParseWireguardConf(t *testing.T) {
+	tests := []struct {
+		name         string
+		input        string
+		wantReserved []int
+		errMsg       string
+	}{
+		{
+			name:         "plain config",
+			input:        testWireguardConf(""),
+			wantReserved: []int{0, 0, 0},
+		},
+		{
+			name:         "config with reserved",
+			input:        testWireguardConf("Reserved = 1, 2, 3"),
+			wantReserved: []int{1, 2, 3},
+		},
+		{
+			name:         "config with reserved in brackets",
+			input:        testWireguardConf("Reserved = [10,20,30]"),
+			wantReserved: []int{10, 20, 30},
+		},
+		{
+			name:   "invalid reserved",
+			input:  testWireguardConf("Reserved = 1, 2, 300"),
+			errMsg: "shall be 3 comma separated bytes",
+		},
+		{
+			name:   "no peer",
+			input:  "[Interface]\nPrivateKey = " + testPrivateKey + "\n",
+			errMsg: "exactly one peer, got 0",
+		},
+		{
+			name:   "missing private key",
+			input:  "[Interface]\n[Peer]\nPublicKey = a\nEndpoint = b:1\n",
+			errMsg: "missing required field: Interface.PrivateKey",
+		},
+		{
+			name:   "malformed line",
+			input:  "[Interface]\nPrivateKey\n",
+			errMsg: "malformed line",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds, err := parseWireguardConf(tt.input)
+			if tt.errMsg != "" {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+				return
+			}
+			utils.AssertNoError(t, err)
+			utils.AssertNoError(t, validateCFCreds(creds))
+			utils.AssertCorrectString(t, testPrivateKey, creds.SecretKey)
+			utils.AssertCorrectString(t, fakeWarpPeerKey, creds.PublicKey)
+			utils.AssertCorrectString(t, "172.16.0.2", creds.V4)
+			utils.AssertCorrectString(t, "2606:4700:110:8a36::1", creds.V6)
+			utils.AssertCorrectString(t, "engage.cloudflareclient.com:2408", creds.Endpoint)
+			utils.AssertCorrectString(t, fmt.Sprint(tt.wantReserved), fmt.Sprint(creds.Reserved))
+		})
+	}
+}
+
+func TestWgcfProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/reg/device-id" || r.Header.Get("Authorization") != "Bearer device-token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, fakeWarpRegResponse("BwgJ", "engage.cloudflareclient.com:2408"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	profile := filepath.Join(dir, "wgcf-profile.conf")
+	utils.AssertNoError(t, os.WriteFile(profile, []byte(testWireguardConf("")), 0600))
+
+	writeAccount := func(token string) string {
+		account := filepath.Join(dir, "wgcf-account.toml")
+		content := fmt.Sprintf("access_token = '%s'\ndevice_id = 'device-id'\n"+
+			"license_key = 'license'\nprivate_key = '%s'\n", token, testPrivateKey)
+		utils.AssertNoError(t, os.WriteFile(account, []byte(content), 0600))
+		return account
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	api := &WarpAPIProvider{APIURL: server.URL, HTTPClient: server.Client()}
+
+	t.Run("profile only", func(t *testing.T) {
+		p := &WgcfProvider{ProfilePath: profile, API: api}
+		creds, err := p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectString(t, "[0 0 0]", fmt.Sprint(creds.Reserved))
+	})
+
+	t.Run("reserved is looked up with the account", func(t *testing.T) {
+		p := &WgcfProvider{ProfilePath: profile, AccountPath: writeAccount("device-token"), API: api}
+		creds, err := p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectString(t, "[7 8 9]", fmt.Sprint(creds.Reserved))
+		utils.AssertCorrectString(t, testPrivateKey, creds.SecretKey)
+	})
+
+	t.Run("account rejected by the API", func(t *testing.T) {
+		p := &WgcfProvider{ProfilePath: profile, AccountPath: writeAccount("stale-token"), API: api}
+		_, err := p.GetCredentials(ctx)
+		utils.AssertErrorContains(t, err, "failed with status 401")
+	})
+
+	t.Run("missing profile", func(t *testing.T) {
+		p := &WgcfProvider{ProfilePath: filepath.Join(dir, "missing.conf"), API: api}
+		_, err := p.GetCredentials(ctx)
+		utils.AssertErrorContains(t, err, "no such file")
+	})
+}
+
+func TestStaticPoolProvider(t *testing.T) {
+	pool := []StaticCreds{
+		{PrivateKey: testPrivateKey, V4: "172.16.0.2"},
+		{PrivateKey: testPrivateKey2, V4: "172.16.0.3"},
+	}
+
+	tests := []struct {
+		name    string
+		pool    []StaticCreds
+		current string
+		wantV4  string
+		errMsg  string
+	}{
+		{name: "current key is not in the pool", pool: pool, current: "other", wantV4: "172.16.0.2"},
+		{name: "next one is taken", pool: pool, current: testPrivateKey, wantV4: "172.16.0.3"},
+		{name: "pool wraps around", pool: pool, current: testPrivateKey2, wantV4: "172.16.0.2"},
+		{name: "only entry is in use", pool: pool[:1], current: testPrivateKey, errMsg: "already in use"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &StaticPoolProvider{Pool: tt.pool, CurrentSecretKey: tt.current}
+			creds, err := p.GetCredentials(context.Background())
+			if tt.errMsg != "" {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+				return
+			}
+			utils.AssertNoError(t, err)
+			utils.AssertCorrectString(t, tt.wantV4, creds.V4)
+		})
+	}
+}
+
+type MockCredentialProvider struct {
+	name  string
+	creds CFCreds
+	err   error
+}
+
+func (p *MockCredentialProvider) Name() string { return p.name }
+
+func (p *MockCredentialProvider) GetCredentials(ctx context.Context) (CFCreds, error) {
+	return p.creds, p.err
+}
+
+func TestObtainCredentials(t *testing.T) {
+	valid := CFCreds{
+		SecretKey: testPrivateKey,
+		PublicKey: fakeWarpPeerKey,
+		Reserved:  []int{1, 2, 3},
+		V4:        "172.16.0.2",
+		V6:        "2606:4700:110:8a36::1",
+		Endpoint:  "engage.cloudflareclient.com:2408",
+	}
+	invalid := valid
+	invalid.Reserved = []int{1, 2}
+
+	tests := []struct {
+		name      string
+		providers []CredentialProvider
+		wantName  string
+		errMsg    string
+	}{
+		{
+			name: "first provider succeeds",
+			providers: []CredentialProvider{
+				&MockCredentialProvider{name: "first", creds: valid},
+				&MockCredentialProvider{name: "second", err: errors.New("unused")},
+			},
+			wantName: "first",
+		},
+		{
+			name: "falls back on error",
+			providers: []CredentialProvider{
+				&MockCredentialProvider{name: "first", err: errors.New("rate limited")},
+				&MockCredentialProvider{name: "second", creds: valid},
+			},
+			wantName: "second",
+		},
+		{
+			name: "falls back on invalid credentials",
+			providers: []CredentialProvider{
+				&MockCredentialProvider{name: "first", creds: invalid},
+				&MockCredentialProvider{name: "second", creds: valid},
+			},
+			wantName: "second",
+		},
+		{
+			name: "all providers fail",
+			providers: []CredentialProvider{
+				&MockCredentialProvider{name: "first", err: errors.New("rate limited")},
+				&MockCredentialProvider{name: "second", creds: invalid},
+			},
+			errMsg: "first: rate limited",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Application{logger: GetLogger(false)}
+			creds, name, err := app.obtainCredentials(context.Background(), tt.providers)
+			if tt.errMsg != "" {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+				return
+			}
+			utils.AssertNoError(t, err)
+			utils.AssertCorrectString(t, tt.wantName, name)
+			utils.AssertCorrectString(t, valid.SecretKey, creds.SecretKey)
+		})
+	}
+
+	t.Run("debug mode asks no provider", func(t *testing.T) {
+		app := &Application{debug: true, logger: GetLogger(false)}
+		creds, name, err := app.obtainCredentials(context.Background(), []CredentialProvider{
+			&MockCredentialProvider{name: "api", creds: valid},
+		})
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectString(t, "debug", name)
+		utils.AssertCorrectString(t, "engage.cloudflareclient.com:2408", creds.Endpoint)
+	})
+}
+
+func TestNewCredentialProviders(t *testing.T) {
+	app := &Application{logger: GetLogger(false), workdir: "/opt/xray"}
+
+	xray := Xray{
+		CFCredFilePath: "/opt/xray/cf_cred_generator",
+		Warp: Warp{Providers: []WarpProvider{
+			{Type: warpProviderWireguardConf, Path: "warp.conf"},
+			{Type: warpProviderAPI},
+			{Type: warpProviderWarpReg},
+			{Type: warpProviderWgcf, Path: "/etc/wgcf/wgcf-profile.conf"},
+			{Type: warpProviderStatic, Pool: []StaticCreds{{PrivateKey: testPrivateKey}}},
+		}},
+	}
+	providers, err := app.newCredentialProviders(xray, "")
+	utils.AssertNoError(t, err)
+
+	var names []string
+	for _, p := range providers {
+		names = append(names, p.Name())
+	}
+	utils.AssertCorrectString(t, "[wireguard-conf api warp-reg wgcf static]", fmt.Sprint(names))
+	utils.AssertCorrectString(t, "/opt/xray/warp.conf", providers[0].(*WireguardConfProvider).Path)
+	utils.AssertCorrectString(t, "/etc/wgcf/wgcf-profile.conf", providers[3].(*WgcfProvider).ProfilePath)
+
+	errTests := []struct {
+		name     string
+		provider WarpProvider
+		errMsg   string
+	}{
+		{"unknown type", WarpProvider{Type: "warp-go"}, `unknown warp credential provider "warp-go"`},
+		{"wgcf without a profile", WarpProvider{Type: warpProviderWgcf}, "requires the path"},
+		{"empty static pool", WarpProvider{Type: warpProviderStatic}, "non-empty pool"},
+		{"warp-reg without the repo", WarpProvider{Type: warpProviderWarpReg}, "cf_cred_generator"},
+	}
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := app.newCredentialProviders(Xray{Warp: Warp{Providers: []WarpProvider{tt.provider}}}, "")
+			utils.AssertErrorContains(t, err, tt.errMsg)
+		})
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// Kinds of out-of-band modifications of the managed files
+const (
+	driftMissing  = "missing"
+	driftModified = "modified"
+	driftMode     = "mode changed"
+)
+
+// A discrepancy between a managed file and what has been recorded
+// in the versions file when it was installed
+type fileDrift struct {
+	repo    Repo
+	version FileVersion
+	// The drifted file: the main file of the repo or one extracted alongside,
+	// and its recorded mode
+	name    string
+	path    string
+	mode    string
+	kind    string
+	details string
+}
+
+func (d fileDrift) String() string {
+	name := d.name
+	if name != d.repo.Filename {
+		name = fmt.Sprintf("%s extracted with %s", d.name, d.repo.Filename)
+	}
+	return fmt.Sprintf("%s (%s) is %s: %s", name, d.version.Tag, d.kind, d.details)
+}
+
+func formatFileMode(mode os.FileMode) string {
+	return fmt.Sprintf("%04o", mode.Perm())
+}
+
+func parseFileMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode %q: %w", mode, err)
+	}
+	return os.FileMode(m).Perm(), nil
+}
+
+// Compares the file with its recorded checksum and mode. Returns an empty kind
+// if the file is intact.
+func checkFileDrift(path string, recorded ExtractedFile) (kind, details string, err error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return driftMissing, "the file has been deleted", nil
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	checksum, size, err := utils.FileSHA256(path)
+	if err != nil {
+		return "", "", err
+	}
+	if checksum != recorded.SHA256 {
+		return driftModified, fmt.Sprintf("sha256 is %s (%d bytes) instead of %s (%d bytes)",
+			checksum, size, recorded.SHA256, recorded.Size), nil
+	}
+
+	if recorded.Mode != "" && formatFileMode(info.Mode()) != recorded.Mode {
+		return driftMode, fmt.Sprintf("mode is %s instead of %s",
+			formatFileMode(info.Mode()), recorded.Mode), nil
+	}
+	return "", "", nil
+}
+
+// Compares the managed files in the workdir, along with the files extracted
+// from the same release archives, with their records in the versions file.
+// Files without a recorded checksum (e.g. migrated from the legacy versions file)
+// cannot be checked and are skipped.
+func detectDrift(workdir string, state *VersionsState, repos []Repo) ([]fileDrift, error) {
+	var drifts []fileDrift
+
+	for _, repo := range repos {
+		fv, ok := state.Files[repo.Filename]
+		if !ok || fv.SHA256 == "" {
+			continue
+		}
+
+		names := []string{repo.Filename}
+		files := map[string]ExtractedFile{
+			repo.Filename: {SHA256: fv.SHA256, Size: fv.Size, Mode: fv.Mode},
+		}
+		for _, name := range slices.Sorted(maps.Keys(fv.Extras)) {
+			if _, ok := files[name]; !ok {
+				names = append(names, name)
+				files[name] = fv.Extras[name]
+			}
+		}
+
+		for _, name := range names {
+			path := providerFilePath(workdir, name)
+			kind, details, err := checkFileDrift(path, files[name])
+			if err != nil {
+				return nil, err
+			}
+			if kind != "" {
+				drifts = append(drifts, fileDrift{repo: repo, version: *fv, name: name,
+					path: path, mode: files[name].Mode, kind: kind, details: details})
+			}
+		}
+	}
+
+	return drifts, nil
+}
+
+// Always returns the same release tag, used to reinstall the recorded version
+type pinnedReleaseChecker struct {
+	tag string
+}
+
+func (rc pinnedReleaseChecker) GetLatestReleaseTag(apiURL string) (string, error) {
+	return rc.tag, nil
+}
+
+// Detects out-of-band modifications of the managed files and reports them
+// as warnings. If reconcile is set, the recorded versions of the modified or
+// missing files are reinstalled, and the changed modes are restored.
+func (app *Application) checkDrift(ctx context.Context, repos []Repo, reconcile bool, fileCreator func(repo Repo) File) error {
+	state, err := loadVersionsState(filepath.Join(app.workdir, versionsFileName))
+	if err != nil {
+		return fmt.Errorf("failed to load the versions file: %w", err)
+	}
+
+	drifts, err := detectDrift(app.workdir, state, repos)
+	if err != nil {
+		return fmt.Errorf("failed to check the managed files for modifications: %w", err)
+	}
+
+	// A reinstall of the release brings back all of its files at once
+	reinstalled := make(map[string]bool)
+	for _, d := range drifts {
+		if !reconcile {
+			app.warn(fmt.Sprintf("The managed file %s. Reconciliation is disabled, "+
+				"so the file has been left as is.", d))
+			continue
+		}
+
+		if d.kind == driftMode {
+			mode, err := parseFileMode(d.mode)
+			if err == nil {
+				err = os.Chmod(d.path, mode)
+			}
+			if err != nil {
+				app.warn(fmt.Sprintf("The managed file %s. Failed to restore the "+
+					"mode: %v", d, err))
+				continue
+			}
+			app.warn(fmt.Sprintf("The managed file %s. The mode has been restored.", d))
+			continue
+		}
+
+		if reinstalled[d.repo.Filename] {
+			continue
+		}
+		if d.version.Tag == "" || d.version.DownloadURL == "" {
+			app.warn(fmt.Sprintf("The managed file %s. The recorded version cannot "+
+				"be reinstalled since its download URL is unknown.", d))
+			continue
+		}
+
+		app.logger.Warning.Printf("The managed file %s. Reinstalling the recorded "+
+			"version...\n", d)
+		repo := d.repo
+		repo.DownloadURL = d.version.DownloadURL
+		file := fileCreator(repo)
+		file.releaseChecker = pinnedReleaseChecker{tag: d.version.Tag}
+		file.reinstall = true
+
+		// updateFile reports the failures it recovered from as warnings
+		installed, err := app.updateFile(ctx, file)
+		if err != nil {
+			return err
+		}
+		if installed {
+			reinstalled[d.repo.Filename] = true
+			app.warn(fmt.Sprintf("The managed file %s. The recorded version has "+
+				"been reinstalled.", d))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// Writes the managed file and records it in the versions file as installed
+func installManagedFile(t *testing.T, workdir string, fileName string, content string, url string) {
+	t.Helper()
+
+	filePath := filepath.Join(workdir, fileName)
+	if err := os.WriteFile(filePath, []byte(content), 0755); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	checksum, size, err := utils.FileSHA256(filePath)
+	utils.AssertNoError(t, err)
+
+	err = recordInstalledVersion(filepath.Join(workdir, versionsFileName), fileName, FileVersion{
+		Tag:         "v1.0.0",
+		Source:      sourceUpdate,
+		DownloadURL: url,
+		SHA256:      checksum,
+		Size:        size,
+		Mode:        "0755",
+	})
+	utils.AssertNoError(t, err)
+}
+
+func TestDetectDrift(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(t *testing.T, filePath string)
+		wantKind string
+	}{
+		{
+			name:   "Untouched file",
+			modify: func(t *testing.T, filePath string) {},
+		},
+		{
+			name: "Deleted file",
+			modify: func(t *testing.T, filePath string) {
+				utils.AssertNoError(t, os.Remove(filePath))
+			},
+			wantKind: driftMissing,
+		},
+		{
+			name: "Modified file",
+			modify: func(t *testing.T, filePath string) {
+				utils.AssertNoError(t, os.WriteFile(filePath, []byte("patched"), 0755))
+			},
+			wantKind: driftModified,
+		},
+		{
+			name: "Changed mode",
+			modify: func(t *testing.T, filePath string) {
+				utils.AssertNoError(t, os.Chmod(filePath, 0600))
+			},
+			wantKind: driftMode,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			workdir := t.TempDir()
+			installManagedFile(t, workdir, "xray", "original", "https://example.com/xray")
+			test.modify(t, filepath.Join(workdir, "xray"))
+
+			state, err := loadVersionsState(filepath.Join(workdir, versionsFileName))
+			utils.AssertNoError(t, err)
+
+			drifts, err := detectDrift(workdir, state, []Repo{{Filename: "xray"}})
+			utils.AssertNoError(t, err)
+
+			if test.wantKind == "" {
+				utils.AssertCorrectInt(t, 0, len(drifts))
+				return
+			}
+			utils.AssertCorrectInt(t, 1, len(drifts))
+			utils.AssertCorrectString(t, test.wantKind, drifts[0].kind)
+		})
+	}
+
+	t.Run("Extracted files are checked", func(t *testing.T) {
+		workdir := t.TempDir()
+		installManagedFile(t, workdir, "xray", "original", "https://example.com/xray")
+		license := filepath.Join(workdir, "LICENSE")
+		utils.AssertNoError(t, os.WriteFile(license, []byte("license"), 0644))
+		checksum, size, err := utils.FileSHA256(license)
+		utils.AssertNoError(t, err)
+
+		state, err := loadVersionsState(filepath.Join(workdir, versionsFileName))
+		utils.AssertNoError(t, err)
+		state.Files["xray"].Extras = map[string]ExtractedFile{
+			"LICENSE": {SHA256: checksum, Size: size, Mode: "0644"},
+		}
+
+		drifts, err := detectDrift(workdir, state, []Repo{{Filename: "xray"}})
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 0, len(drifts))
+
+		utils.AssertNoError(t, os.WriteFile(license, []byte("patched"), 0644))
+		drifts, err = detectDrift(workdir, state, []Repo{{Filename: "xray"}})
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 1, len(drifts))
+		utils.AssertCorrectString(t, driftModified, drifts[0].kind)
+		utils.AssertCorrectString(t, license, drifts[0].path)
+		if !strings.HasPrefix(drifts[0].String(), "LICENSE extracted with xray (v1.0.0) is modified") {
+			t.Errorf("Unexpected drift description %q", drifts[0])
+		}
+	})
+
+	t.Run("Files without a checksum are skipped", func(t *testing.T) {
+		workdir := t.TempDir()
+		err := recordInstalledVersion(filepath.Join(workdir, versionsFileName), "xray",
+			FileVersion{Tag: "v1.0.0", Source: sourceMigrated})
+		utils.AssertNoError(t, err)
+
+		state, err := loadVersionsState(filepath.Join(workdir, versionsFileName))
+		utils.AssertNoError(t, err)
+
+		drifts, err := detectDrift(workdir, state, []Repo{{Filename: "xray"}})
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 0, len(drifts))
+	})
+}
+
+// Remembers the URL the file has been downloaded from
+type URLRecordingDownloader struct {
+	url *string
+	err error
+}
+
+func (d URLRecordingDownloader) Download(filePath string, url string) error {
+	*d.url = url
+	if d.err != nil {
+		return d.err
+	}
+	return OrdinaryFileDownloader{}.Download(filePath, url)
+}
+
+func TestCheckDrift(t *testing.T) {
+	const pinnedURL = "https://github.com/XTLS/Xray-core/releases/download/v1.0.0/xray"
+
+	tests := []struct {
+		name            string
+		reconcile       bool
+		modify          func(t *testing.T, filePath string)
+		downloadErr     error
+		wantContent     string
+		wantMode        os.FileMode
+		wantURL         string
+		expectedWarning string
+	}{
+		{
+			name:      "Modified file is reported only",
+			reconcile: false,
+			modify: func(t *testing.T, filePath string) {
+				utils.AssertNoError(t, os.WriteFile(filePath, []byte("patched"), 0755))
+			},
+			wantContent:     "patched",
+			wantMode:        0755,
+			expectedWarning: "Reconciliation is disabled",
+		},
+		{
+			name:      "Modified file is reinstalled",
+			reconcile: true,
+			modify: func(t *testing.T, filePath string) {
+				utils.AssertNoError(t, os.WriteFile(filePath, []byte("patched"), 0755))
+			},
+			wantContent:     "mock content",
+			wantMode:        0755,
+			wantURL:         pinnedURL,
+			expectedWarning: "The recorded version has been reinstalled",
+		},
+		{
+			name:      "Deleted file is reinstalled",
+			reconcile: true,
+			modify: func(t *testing.T, filePath string) {
+				utils.AssertNoError(t, os.Remove(filePath))
+			},
+			wantContent:     "mock content",
+			wantMode:        0755,
+			wantURL:         pinnedURL,
+			expectedWarning: "The recorded version has been reinstalled",
+		},
+		{
+			name:      "Failed reinstall is not reported as done",
+			reconcile: true,
+			modify: func(t *testing.T, filePath string) {
+				utils.AssertNoError(t, os.WriteFile(filePath, []byte("patched"), 0755))
+			},
+			downloadErr:     errors.New("connection refused"),
+			wantContent:     "patched",
+			wantMode:        0755,
+			wantURL:         pinnedURL,
+			expectedWarning: "Failed to download the file xray",
+		},
+		{
+			name:      "Changed mode is restored",
+			reconcile: true,
+			modify: func(t *testing.T, filePath string) {
+				utils.AssertNoError(t, os.Chmod(filePath, 0600))
+			},
+			wantContent:     "original",
+			wantMode:        0755,
+			expectedWarning: "The mode has been restored",
+		},
+	}
+
+	for _, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		t.Run(test.name, func(t *testing.T) {
+			workdir := t.TempDir()
+			filePath := filepath.Join(workdir, "xray")
+			installManagedFile(t, workdir, "xray", "original", pinnedURL)
+			test.modify(t, filePath)
+
+			testApp := &Application{
+				debug:   true,
+				logger:  GetLogger(false),
+				workdir: workdir,
+			}
+
+			var downloadedFrom string
+			fileCreator := func(repo Repo) File {
+				return File{
+					repo:           repo,
+					releaseChecker: MockReleaseChecker{},
+					downloader:     URLRecordingDownloader{url: &downloadedFrom, err: test.downloadErr},
+				}
+			}
+
+			repos := []Repo{{
+				Filename:    "xray",
+				DownloadURL: "https://github.com/XTLS/Xray-core/releases/latest/download/xray",
+				Executable:  true,
+			}}
+			err := testApp.checkDrift(ctx, repos, test.reconcile, fileCreator)
+			utils.AssertNoError(t, err)
+
+			content, err := os.ReadFile(filePath)
+			utils.AssertNoError(t, err)
+			utils.AssertCorrectString(t, test.wantContent, string(content))
+
+			info, err := os.Stat(filePath)
+			utils.AssertNoError(t, err)
+			utils.AssertCorrectString(t, formatFileMode(test.wantMode), formatFileMode(info.Mode()))
+
+			utils.AssertCorrectString(t, test.wantURL, downloadedFrom)
+
+			if len(testApp.warnings) != 1 {
+				t.Fatalf("Expected 1 warning, got %d: %v", len(testApp.warnings), testApp.warnings)
+			}
+			if !strings.Contains(testApp.warnings[0], test.expectedWarning) {
+				t.Errorf("Expected warning to contain %q, got %q", test.expectedWarning,
+					testApp.warnings[0])
+			}
+
+			if test.wantURL != "" && test.downloadErr == nil {
+				state, err := loadVersionsState(filepath.Join(workdir, versionsFileName))
+				utils.AssertNoError(t, err)
+				fv := state.Files["xray"]
+				utils.AssertCorrectString(t, sourceReinstall, fv.Source)
+				utils.AssertCorrectString(t, "v1.0.0", fv.Tag)
+			}
+		})
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// Builds the stand-in for the xray executable from testdata/fakexray
+func buildFakeXray(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("the end-to-end tests build the fake xray executable")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go tool is required to build the fake xray executable")
+	}
+
+	path := filepath.Join(t.TempDir(), "xray")
+	out, err := exec.Command(goTool, "build", "-o", path, "./testdata/fakexray").CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to build the fake xray: %v\n%s", err, out)
+	}
+	return path
+}
+
+// Plays the xray server: an HTTP proxy on the port of the shadowsocks inbound
+// which passes the requests through "warp" only while the wireguard outbound of
+// the config loaded on the last restart has credentials that warp accepts.
+// Serves as the systemctl of the service as well.
+type fakeXrayServer struct {
+	mu         sync.Mutex
+	configPath string
+	// Secret keys accepted by warp
+	workingKeys map[string]bool
+	// Secret keys the service fails to start with
+	crashingKeys map[string]bool
+	// Secret keys the service starts with, but logs a fatal error
+	fatalKeys map[string]bool
+	journal   string
+	secretKey string
+	active    bool
+	restarts  int
+	// Outbounds replaced through the API
+	hotSwaps int
+}
+
+func (s *fakeXrayServer) restart() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restarts++
+
+	var config ServerConfig
+	if err := utils.ParseJSONFile(s.configPath, &config, true); err != nil {
+		s.active = false
+		return err
+	}
+	settings := warpOutboundSettings(&config)
+	if settings == nil || s.crashingKeys[settings.SecretKey] {
+		s.active = false
+		return fmt.Errorf("xray.service: main process exited, status=23")
+	}
+	s.secretKey = settings.SecretKey
+	s.active = true
+	s.journal = "Xray started\n"
+	if s.fatalKeys[settings.SecretKey] {
+		s.journal += "panic: runtime error: invalid memory address\n"
+	}
+	return nil
+}
+
+func (s *fakeXrayServer) executor(ctx context.Context, cmd string) (string, error) {
+	switch {
+	case strings.Contains(cmd, "systemctl restart"):
+		return "", s.restart()
+	case strings.Contains(cmd, "journalctl"):
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.journal, nil
+	case strings.Contains(cmd, "systemctl is-active"):
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.active {
+			return "active\n", nil
+		}
+		return "failed\n", nil
+	default:
+		return "", fmt.Errorf("unexpected command %q", cmd)
+	}
+}
+
+// Serves the xray API commands replacing the warp outbound of the running server
+func (s *fakeXrayServer) fileExecutor(ctx context.Context, filePath string, args ...string) (string, error) {
+	if len(args) < 4 || args[0] != "api" {
+		return "", fmt.Errorf("unexpected command %s %v", filePath, args)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch args[1] {
+	case "rmo":
+		s.secretKey = ""
+		return "", nil
+	case "ado":
+		var config ServerConfig
+		if err := utils.ParseJSONFile(args[3], &config, false); err != nil {
+			return "", err
+		}
+		s.secretKey = warpOutboundSettings(&config).SecretKey
+		s.hotSwaps++
+		return "", nil
+	default:
+		return "", fmt.Errorf("unexpected api command %v", args)
+	}
+}
+
+func (s *fakeXrayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	throughWarp := s.active && s.workingKeys[s.secretKey]
+	s.mu.Unlock()
+	if !throughWarp {
+		http.Error(w, "handshake did not complete", http.StatusBadGateway)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, r.URL.String(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Header.Set("X-Fake-Warp", "on")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// Answers in the trace format: through warp if the request has come via the fake
+// xray server, from the xray server address otherwise
+func fakeTraceChecker(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Fake-Warp") == "on" {
+		fmt.Fprint(w, "ip=104.28.1.1\ncolo=AMS\nwarp=on\n")
+		return
+	}
+	fmt.Fprint(w, "ip=127.0.0.1\ncolo=AMS\nwarp=off\n")
+}
+
+// Writes a fake warp-reg generator printing the credentials with the secret key
+func writeFakeGenerator(t *testing.T, dir string, secretKey string) string {
+	t.Helper()
+	path := filepath.Join(dir, "cf_cred_generator")
+	script := fmt.Sprintf("#!/bin/sh\ncat <<'EOF'\ndevice_id: e2e\nprivate_key: %s\n"+
+		"public_key: %s\nreserved: [ 1, 2, 3 ]\nv4: 172.16.0.2\n"+
+		"v6: 2606:4700:110:8a36::1\nendpoint: engage.cloudflareclient.com:2408\nEOF\n",
+		secretKey, fakeWarpPeerKey)
+	utils.AssertNoError(t, os.WriteFile(path, []byte(script), 0755))
+	return path
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	port, err := utils.FreePort()
+	utils.AssertNoError(t, err)
+	return port
+}
+
+func e2eServerConfig(ssPort int, secretKey string) ServerConfig {
+	return ServerConfig{
+		Log: Log{Loglevel: "warning"},
+		Inbounds: []SrvInbound{{
+			Protocol: "shadowsocks",
+			Tag:      "ss-in",
+			Port:     ssPort,
+			Sniffing: SrvInbSniffing{Enabled: true, DestOverride: []string{"http", "tls"}},
+			Settings: SrvInbSettings{
+				Method:   "2022-blake3-aes-128-gcm",
+				Password: "e2e-test-password",
+				Network:  "tcp,udp",
+			},
+		}},
+		Outbounds: []SrvOutbound{
+			{
+				Protocol: "wireguard",
+				Tag:      "warp",
+				Settings: &SrvOutbSettings{
+					SecretKey: secretKey,
+					Address:   []string{"172.16.0.2/32", "2606:4700:110:8a36::1/128"},
+					Peers: []SrvOutboundSettingsPeer{{
+						Endpoint:  "engage.cloudflareclient.com:2408",
+						PublicKey: fakeWarpPeerKey,
+					}},
+					Mtu:            1280,
+					Reserved:       []int{1, 2, 3},
+					Workers:        2,
+					DomainStrategy: "ForceIP",
+				},
+			},
+			{Protocol: "freedom", Tag: "direct"},
+		},
+		Routing: SrvRouting{
+			Rules:          []SrvRoutingRule{{Type: "field", OutboundTag: "warp", IP: []string{"0.0.0.0/0"}}},
+			DomainStrategy: "IPIfNonMatch",
+		},
+	}
+}
+
+func TestUpdateWarpEndToEnd(t *testing.T) {
+	fakeXray := buildFakeXray(t)
+
+	checker := httptest.NewServer(http.HandlerFunc(fakeTraceChecker))
+	defer checker.Close()
+
+	newKey := func() string {
+		keys, err := generateWireguardKeyPair()
+		utils.AssertNoError(t, err)
+		return keys.PrivateKey
+	}
+	brokenKey, workingKey, crashingKey, fatalKey := newKey(), newKey(), newKey(), newKey()
+	echo, dns := startUDPStandIns(t)
+
+	// Sets up the workdir, the fake xray server and the app
+	setup := func(t *testing.T, currentKey string, generatedKey string) (*Application, Xray, *fakeXrayServer) {
+		workdir := t.TempDir()
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		utils.AssertNoError(t, err)
+		server := &fakeXrayServer{
+			configPath:   filepath.Join(workdir, "config.json"),
+			workingKeys:  map[string]bool{workingKey: true},
+			crashingKeys: map[string]bool{crashingKey: true},
+			fatalKeys:    map[string]bool{fatalKey: true},
+		}
+		httpServer := &http.Server{Handler: server}
+		go httpServer.Serve(listener)
+		t.Cleanup(func() { httpServer.Close() })
+
+		config := e2eServerConfig(listener.Addr().(*net.TCPAddr).Port, currentKey)
+		utils.AssertNoError(t, utils.WriteStructToJSONFile(&config, server.configPath))
+		utils.AssertNoError(t, server.restart())
+
+		xray := Xray{
+			Server: XrayServer{
+				IP:             "127.0.0.1",
+				ServiceName:    "xray.service",
+				ServiceManager: utils.ServiceSystemd,
+				ConfigFilePath: server.configPath,
+				HealthCheck: HealthCheck{
+					Inbounds:      true,
+					FatalPatterns: []string{"panic:"},
+					RequestURL:    checker.URL + "/cdn-cgi/trace",
+				},
+			},
+			Client: XrayClient{
+				ServerProtocol:    "shadowsocks",
+				ProxyProtocol:     "socks",
+				ProxyAuth:         true,
+				IPCheckers:        []IPChecker{{Type: ipCheckerTrace, URL: checker.URL + "/cdn-cgi/trace"}},
+				IPCheckerDecision: ipCheckerDecisionMajority,
+				UDPProbes: []UDPProbe{
+					{Type: udpProbeDNS, Address: dns, Query: "cloudflare.com"},
+					{Type: udpProbeEcho, Address: echo},
+				},
+			},
+			Warp:               Warp{Providers: []WarpProvider{{Type: warpProviderWarpReg}}},
+			ExecutableFilePath: fakeXray,
+			CFCredFilePath:     writeFakeGenerator(t, workdir, generatedKey),
+		}
+
+		service, err := newXrayService(xray, Privileges{Mode: privilegeRoot}, workdir, server.executor)
+		utils.AssertNoError(t, err)
+		app := &Application{
+			logger:               GetLogger(false),
+			workdir:              workdir,
+			xrayServiceName:      xray.Server.ServiceName,
+			xrayServerConfigPath: server.configPath,
+			xrayService:          service,
+			applyStrategy:        ApplyStrategy{Mode: applyRestart},
+			fileExecutor:         server.fileExecutor,
+			xray:                 xray,
+			countryCode:          func(context.Context) (string, error) { return "NL", nil },
+			logLines:             50,
+		}
+		return app, xray, server
+	}
+
+	currentKey := func(t *testing.T, path string) string {
+		var config ServerConfig
+		utils.AssertNoError(t, utils.ParseJSONFile(path, &config, true))
+		return warpOutboundSettings(&config).SecretKey
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	t.Run("operational warp is left as it is", func(t *testing.T) {
+		app, xray, server := setup(t, workingKey, crashingKey)
+
+		utils.AssertNoError(t, app.updateWarp(ctx, xray))
+		utils.AssertCorrectString(t, workingKey, currentKey(t, xray.Server.ConfigFilePath))
+		utils.AssertCorrectInt(t, 1, server.restarts)
+		utils.AssertCorrectInt(t, 0, len(app.notes)+len(app.warnings))
+	})
+
+	t.Run("existing proxy is used instead of the verification client", func(t *testing.T) {
+		app, xray, server := setup(t, workingKey, crashingKey)
+
+		var config ServerConfig
+		utils.AssertNoError(t, utils.ParseJSONFile(xray.Server.ConfigFilePath, &config, true))
+		// The fake server is an HTTP proxy itself
+		xray.Client.ProxyURL = fmt.Sprintf("http://127.0.0.1:%d", config.Inbounds[0].Port)
+		xray.ExecutableFilePath = filepath.Join(t.TempDir(), "absent")
+
+		utils.AssertNoError(t, app.updateWarp(ctx, xray))
+		utils.AssertCorrectInt(t, 1, server.restarts)
+		utils.AssertCorrectInt(t, 0, len(app.notes)+len(app.warnings))
+	})
+
+	t.Run("slow warp gets another endpoint", func(t *testing.T) {
+		app, xray, server := setup(t, workingKey, crashingKey)
+
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			fmt.Fprint(w, "payload")
+		}))
+		defer slow.Close()
+		xray.Client.Benchmark = Benchmark{
+			Enabled:     true,
+			URL:         slow.URL,
+			Requests:    2,
+			MaxTTFB:     50 * time.Millisecond,
+			OnSlow:      onSlowEndpoint,
+			HistoryFile: "warp-history.jsonl",
+		}
+		xray.Warp.EndpointScan = EndpointScan{
+			Ranges:   []string{"162.159.192.1/32"},
+			Ports:    []int{2408},
+			Samples:  1,
+			Attempts: 1,
+			Timeout:  time.Second,
+		}
+		app.endpointProber = &FakeEndpointProber{results: map[string][]time.Duration{
+			"162.159.192.1:2408": {10 * time.Millisecond},
+		}}
+
+		utils.AssertNoError(t, app.updateWarp(ctx, xray))
+		var config ServerConfig
+		utils.AssertNoError(t, utils.ParseJSONFile(xray.Server.ConfigFilePath, &config, true))
+		settings := warpOutboundSettings(&config)
+		utils.AssertCorrectString(t, "162.159.192.1:2408", settings.Peers[0].Endpoint)
+		utils.AssertCorrectString(t, workingKey, settings.SecretKey)
+		utils.AssertCorrectInt(t, 2, server.restarts)
+		utils.AssertCorrectInt(t, 1, len(app.notes))
+
+		history, err := os.ReadFile(filepath.Join(app.workdir, "warp-history.jsonl"))
+		utils.AssertNoError(t, err)
+		if !strings.Contains(string(history), WarpSlow.String()) {
+			t.Errorf("Expected the slow benchmark in the history, got %s", history)
+		}
+	})
+
+	t.Run("broken credentials are replaced", func(t *testing.T) {
+		app, xray, server := setup(t, brokenKey, workingKey)
+		app.xray.Server.HealthCheck.ProxyRequests = true
+
+		utils.AssertNoError(t, app.updateWarp(ctx, xray))
+		utils.AssertCorrectString(t, workingKey, currentKey(t, xray.Server.ConfigFilePath))
+		utils.AssertCorrectInt(t, 2, server.restarts)
+		utils.AssertCorrectInt(t, 1, len(app.notes))
+		utils.AssertCorrectInt(t, 0, len(app.warnings))
+		if !strings.Contains(app.notes[0], "the warp tunnel does not pass the traffic") {
+			t.Errorf("Expected the note to contain the diagnosis, got %q", app.notes[0])
+		}
+		if _, err := os.Stat(xray.Server.ConfigFilePath + ".backup"); !os.IsNotExist(err) {
+			t.Error("Expected the backup of the server config to be removed")
+		}
+
+		// Warp is operational with the new credentials
+		utils.AssertNoError(t, app.updateWarp(ctx, xray))
+		utils.AssertCorrectInt(t, 2, server.restarts)
+	})
+
+	t.Run("warp outbound is replaced through the api", func(t *testing.T) {
+		app, xray, server := setup(t, brokenKey, workingKey)
+		app.applyStrategy.Mode = applyAPI
+
+		var config ServerConfig
+		utils.AssertNoError(t, utils.ParseJSONFile(xray.Server.ConfigFilePath, &config, true))
+		config.API = &SrvAPI{Tag: "api", Listen: "127.0.0.1:10085", Services: []string{"HandlerService"}}
+		utils.AssertNoError(t, utils.WriteStructToJSONFile(&config, xray.Server.ConfigFilePath))
+
+		utils.AssertNoError(t, app.updateWarp(ctx, xray))
+		utils.AssertCorrectString(t, workingKey, currentKey(t, xray.Server.ConfigFilePath))
+		utils.AssertCorrectString(t, workingKey, server.secretKey)
+		utils.AssertCorrectInt(t, 1, server.restarts)
+		utils.AssertCorrectInt(t, 1, server.hotSwaps)
+		utils.AssertCorrectInt(t, 1, len(app.notes))
+	})
+
+	t.Run("api falls back to the restart without the handler service", func(t *testing.T) {
+		app, xray, server := setup(t, brokenKey, workingKey)
+		app.applyStrategy.Mode = applyAPI
+
+		utils.AssertNoError(t, app.updateWarp(ctx, xray))
+		utils.AssertCorrectString(t, workingKey, currentKey(t, xray.Server.ConfigFilePath))
+		utils.AssertCorrectInt(t, 2, server.restarts)
+		utils.AssertCorrectInt(t, 0, server.hotSwaps)
+	})
+
+	t.Run("restart is deferred to the maintenance window", func(t *testing.T) {
+		app, xray, server := setup(t, brokenKey, workingKey)
+		app.applyStrategy.MaintenanceWindow = "03:00-04:00"
+		app.now = func() time.Time { return time.Date(2025, 1, 1, 12, 0, 0, 0, time.Local) }
+
+		utils.AssertNoError(t, app.updateWarp(ctx, xray))
+		utils.AssertCorrectString(t, brokenKey, currentKey(t, xray.Server.ConfigFilePath))
+		utils.AssertCorrectInt(t, 1, server.restarts)
+		utils.AssertCorrectInt(t, 1, len(app.warnings))
+		if !strings.Contains(app.warnings[0], "deferred to the maintenance window 03:00-04:00") {
+			t.Errorf("Expected the warning about the deferral, got %q", app.warnings[0])
+		}
+
+		// The credentials are applied within the window
+		app.now = func() time.Time { return time.Date(2025, 1, 2, 3, 30, 0, 0, time.Local) }
+		utils.AssertNoError(t, app.updateWarp(ctx, xray))
+		utils.AssertCorrectString(t, workingKey, currentKey(t, xray.Server.ConfigFilePath))
+		utils.AssertCorrectInt(t, 2, server.restarts)
+	})
+
+	t.Run("config is rolled back if the service fails", func(t *testing.T) {
+		app, xray, server := setup(t, brokenKey, crashingKey)
+
+		err := app.updateWarp(ctx, xray)
+		utils.AssertErrorContains(t, err, "the previous server config has been restored")
+		utils.AssertCorrectString(t, brokenKey, currentKey(t, xray.Server.ConfigFilePath))
+		utils.AssertCorrectInt(t, 3, server.restarts)
+		if !server.active {
+			t.Error("Expected the service to be active with the restored config")
+		}
+		utils.AssertCorrectInt(t, 0, len(app.notes))
+	})
+
+	t.Run("config is rolled back on a fatal error in the journal", func(t *testing.T) {
+		app, xray, server := setup(t, brokenKey, fatalKey)
+
+		err := app.updateWarp(ctx, xray)
+		utils.AssertErrorContains(t, err, "the previous server config has been restored")
+		utils.AssertCorrectString(t, brokenKey, currentKey(t, xray.Server.ConfigFilePath))
+		utils.AssertCorrectInt(t, 3, server.restarts)
+		// The journal of the failed restart is sent with the message
+		if len(app.attachments) == 0 ||
+			!strings.Contains(app.attachments[0].Content, "panic: runtime error") {
+			t.Errorf("Expected the journal with the panic to be attached, got %v", app.attachments)
+		}
+	})
+
+	t.Run("unreachable server is not fixed with new credentials", func(t *testing.T) {
+		app, xray, server := setup(t, brokenKey, workingKey)
+
+		var config ServerConfig
+		utils.AssertNoError(t, utils.ParseJSONFile(xray.Server.ConfigFilePath, &config, true))
+		config.Inbounds[0].Port = freePort(t)
+		utils.AssertNoError(t, utils.WriteStructToJSONFile(&config, xray.Server.ConfigFilePath))
+
+		err := app.updateWarp(ctx, xray)
+		utils.AssertErrorContains(t, err, "the upstream xray server inbound is unreachable")
+		utils.AssertCorrectString(t, brokenKey, currentKey(t, xray.Server.ConfigFilePath))
+		utils.AssertCorrectInt(t, 1, server.restarts)
+	})
+}
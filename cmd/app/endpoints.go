@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// EndpointProber sends the WireGuard handshake initiation packet to the endpoint
+// and returns the time it took to receive the response
+type EndpointProber interface {
+	Probe(ctx context.Context, endpoint string, packet []byte, timeout time.Duration) (time.Duration, error)
+}
+
+type UDPEndpointProber struct{}
+
+func (p UDPEndpointProber) Probe(ctx context.Context, endpoint string, packet []byte, timeout time.Duration) (time.Duration, error) {
+	return utils.ProbeWireguardEndpoint(ctx, endpoint, packet, timeout)
+}
+
+// Result of probing a single endpoint
+type endpointScore struct {
+	endpoint string
+	sent     int
+	received int
+	// Average handshake round trip time of the received responses
+	latency time.Duration
+}
+
+func (s endpointScore) loss() float64 {
+	if s.sent == 0 {
+		return 1
+	}
+	return float64(s.sent-s.received) / float64(s.sent)
+}
+
+func (s endpointScore) String() string {
+	return fmt.Sprintf("%s (loss %.0f%%, latency %v)", s.endpoint, s.loss()*100,
+		s.latency.Round(time.Millisecond))
+}
+
+// Picks the endpoints to probe: the one provided with the credentials first,
+// followed by the random addresses from the ranges combined with random ports
+func endpointCandidates(scan EndpointScan, current string, rnd *rand.Rand) ([]string, error) {
+	var prefixes []netip.Prefix
+	for _, r := range scan.Ranges {
+		prefix, err := netip.ParsePrefix(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint range %q: %w", r, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	if len(scan.Ports) == 0 {
+		return nil, fmt.Errorf("no ports to scan have been configured")
+	}
+
+	seen := make(map[string]bool)
+	var candidates []string
+	add := func(endpoint string) {
+		if !seen[endpoint] {
+			seen[endpoint] = true
+			candidates = append(candidates, endpoint)
+		}
+	}
+
+	if current != "" {
+		add(current)
+	}
+	if len(prefixes) == 0 {
+		return candidates, nil
+	}
+
+	// Give up on duplicates eventually, the ranges may be smaller than the sample
+	target := len(candidates) + scan.Samples
+	for i := 0; len(candidates) < target && i < scan.Samples*10; i++ {
+		prefix := prefixes[rnd.IntN(len(prefixes))]
+		port := scan.Ports[rnd.IntN(len(scan.Ports))]
+		add(net.JoinHostPort(randomAddrIn(prefix, rnd).String(), strconv.Itoa(port)))
+	}
+
+	return candidates, nil
+}
+
+// Returns a random address within the prefix
+func randomAddrIn(prefix netip.Prefix, rnd *rand.Rand) netip.Addr {
+	addr := prefix.Addr().AsSlice()
+	hostBits := len(addr)*8 - prefix.Bits()
+	for i := len(addr) - 1; i >= 0 && hostBits > 0; i-- {
+		bits := min(hostBits, 8)
+		mask := byte(1<<bits - 1)
+		addr[i] = addr[i]&^mask | byte(rnd.IntN(256))&mask
+		hostBits -= bits
+	}
+	result, _ := netip.AddrFromSlice(addr)
+	return result
+}
+
+// Probes the endpoint a number of times with the fresh handshake initiations
+func probeEndpoint(ctx context.Context, prober EndpointProber, endpoint string, creds *CFCreds, scan EndpointScan) endpointScore {
+	score := endpointScore{endpoint: endpoint}
+	var total time.Duration
+
+	for range scan.Attempts {
+		if ctx.Err() != nil {
+			break
+		}
+		packet, err := utils.WireguardHandshakeInitiation(creds.SecretKey, creds.PublicKey, creds.Reserved)
+		if err != nil {
+			break
+		}
+		score.sent++
+		rtt, err := prober.Probe(ctx, endpoint, packet, scan.Timeout)
+		if err != nil {
+			continue
+		}
+		score.received++
+		total += rtt
+	}
+
+	if score.received > 0 {
+		score.latency = total / time.Duration(score.received)
+	}
+	return score
+}
+
+// Orders the endpoints that responded at least once by loss and then by latency
+func rankEndpoints(scores []endpointScore) []endpointScore {
+	var ranked []endpointScore
+	for _, s := range scores {
+		if s.received > 0 {
+			ranked = append(ranked, s)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].loss() != ranked[j].loss() {
+			return ranked[i].loss() < ranked[j].loss()
+		}
+		return ranked[i].latency < ranked[j].latency
+	})
+	return ranked
+}
+
+// Probes the candidate endpoints concurrently with the WireGuard handshakes using
+// the new credentials and replaces the endpoint of the credentials with the best
+// one. If none of the endpoints responds, the credentials are left as they are.
+func (app *Application) selectWarpEndpoint(ctx context.Context, scan EndpointScan, creds *CFCreds, prober EndpointProber) error {
+	candidates, err := endpointCandidates(scan, creds.Endpoint, rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())))
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info.Printf("Probing %d warp endpoints with WireGuard handshakes...\n",
+		len(candidates))
+
+	scores := make([]endpointScore, len(candidates))
+	sem := make(chan struct{}, max(scan.Concurrency, 1))
+	var wg sync.WaitGroup
+	for i, endpoint := range candidates {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			scores[i] = probeEndpoint(ctx, prober, endpoint, creds, scan)
+		}()
+	}
+	wg.Wait()
+
+	ranked := rankEndpoints(scores)
+	if len(ranked) == 0 {
+		return fmt.Errorf("none of the %d probed warp endpoints has responded to "+
+			"the handshake", len(candidates))
+	}
+
+	for i, s := range ranked[:min(len(ranked), 3)] {
+		app.logger.Info.Printf("Warp endpoint #%d: %s\n", i+1, s)
+	}
+	if ranked[0].endpoint != creds.Endpoint {
+		app.logger.Info.Printf("Replacing the warp endpoint %s with %s\n",
+			creds.Endpoint, ranked[0].endpoint)
+	}
+	creds.Endpoint = ranked[0].endpoint
+
+	return nil
+}
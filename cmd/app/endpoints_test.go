@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestEndpointCandidates(t *testing.T) {
+	rnd := rand.New(rand.NewPCG(1, 2))
+	scan := EndpointScan{
+		Ranges:  []string{"162.159.192.0/24", "188.114.96.0/30"},
+		Ports:   []int{2408, 500},
+		Samples: 20,
+	}
+
+	candidates, err := endpointCandidates(scan, "engage.cloudflareclient.com:2408", rnd)
+	utils.AssertNoError(t, err)
+	utils.AssertCorrectInt(t, 21, len(candidates))
+	utils.AssertCorrectString(t, "engage.cloudflareclient.com:2408", candidates[0])
+
+	prefixes := []netip.Prefix{netip.MustParsePrefix("162.159.192.0/24"),
+		netip.MustParsePrefix("188.114.96.0/30")}
+	seen := make(map[string]bool)
+	for _, c := range candidates[1:] {
+		if seen[c] {
+			t.Errorf("Duplicate candidate %s", c)
+		}
+		seen[c] = true
+
+		host, port, err := net.SplitHostPort(c)
+		utils.AssertNoError(t, err)
+		if port != "2408" && port != "500" {
+			t.Errorf("Unexpected port in %s", c)
+		}
+		addr := netip.MustParseAddr(host)
+		if !prefixes[0].Contains(addr) && !prefixes[1].Contains(addr) {
+			t.Errorf("Candidate %s is outside of the ranges", c)
+		}
+	}
+
+	t.Run("ranges smaller than the sample", func(t *testing.T) {
+		scan := EndpointScan{Ranges: []string{"10.0.0.1/32"}, Ports: []int{1, 2}, Samples: 10}
+		candidates, err := endpointCandidates(scan, "", rnd)
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 2, len(candidates))
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		scan := EndpointScan{Ranges: []string{"162.159.192.0"}, Ports: []int{2408}}
+		_, err := endpointCandidates(scan, "", rnd)
+		utils.AssertErrorContains(t, err, "invalid endpoint range")
+	})
+}
+
+// Answers the handshakes according to the predefined behaviour of each endpoint.
+// Endpoints that are not listed never respond.
+type FakeEndpointProber struct {
+	mu sync.Mutex
+	// Round trip time of each successive probe of the endpoint, 0 for a loss
+	results map[string][]time.Duration
+	probes  map[string]int
+}
+
+func (p *FakeEndpointProber) Probe(ctx context.Context, endpoint string, packet []byte, timeout time.Duration) (time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(packet) != utils.WireguardInitiationSize {
+		return 0, errors.New("not a handshake initiation")
+	}
+	if p.probes == nil {
+		p.probes = make(map[string]int)
+	}
+	i := p.probes[endpoint]
+	p.probes[endpoint]++
+
+	results := p.results[endpoint]
+	if i >= len(results) || results[i] == 0 {
+		return 0, utils.ErrNoHandshakeResponse
+	}
+	return results[i], nil
+}
+
+func TestSelectWarpEndpoint(t *testing.T) {
+	keys, err := generateWireguardKeyPair()
+	utils.AssertNoError(t, err)
+
+	ms := time.Millisecond
+	tests := []struct {
+		name         string
+		results      map[string][]time.Duration
+		wantEndpoint string
+		errMsg       string
+	}{
+		{
+			name: "fastest endpoint without loss wins",
+			results: map[string][]time.Duration{
+				"engage.cloudflareclient.com:2408": {90 * ms, 80 * ms, 100 * ms},
+				"10.0.0.1:2408":                    {20 * ms, 0, 20 * ms},
+				"10.0.0.1:500":                     {40 * ms, 50 * ms, 45 * ms},
+			},
+			wantEndpoint: "10.0.0.1:500",
+		},
+		{
+			name: "current endpoint is kept if it is the best",
+			results: map[string][]time.Duration{
+				"engage.cloudflareclient.com:2408": {10 * ms, 10 * ms, 10 * ms},
+				"10.0.0.1:500":                     {40 * ms, 50 * ms, 45 * ms},
+			},
+			wantEndpoint: "engage.cloudflareclient.com:2408",
+		},
+		{
+			name:         "nothing responds",
+			results:      map[string][]time.Duration{},
+			wantEndpoint: "engage.cloudflareclient.com:2408",
+			errMsg:       "none of the 3 probed warp endpoints has responded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Application{logger: GetLogger(false)}
+			creds := CFCreds{
+				SecretKey: keys.PrivateKey,
+				PublicKey: fakeWarpPeerKey,
+				Reserved:  []int{1, 2, 3},
+				Endpoint:  "engage.cloudflareclient.com:2408",
+			}
+			scan := EndpointScan{
+				Ranges:      []string{"10.0.0.1/32"},
+				Ports:       []int{2408, 500},
+				Samples:     10,
+				Attempts:    3,
+				Timeout:     time.Second,
+				Concurrency: 4,
+			}
+			prober := &FakeEndpointProber{results: tt.results}
+
+			err := app.selectWarpEndpoint(context.Background(), scan, &creds, prober)
+			if tt.errMsg != "" {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			} else {
+				utils.AssertNoError(t, err)
+			}
+			utils.AssertCorrectString(t, tt.wantEndpoint, creds.Endpoint)
+			utils.AssertCorrectInt(t, 3, prober.probes["10.0.0.1:2408"])
+		})
+	}
+}
+
+func TestSelectWarpEndpointUDP(t *testing.T) {
+	// A local peer answering every handshake initiation
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	utils.AssertNoError(t, err)
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n == utils.WireguardInitiationSize {
+				response := make([]byte, utils.WireguardResponseSize)
+				response[0] = 2
+				conn.WriteTo(response, addr)
+			}
+		}
+	}()
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	keys, err := generateWireguardKeyPair()
+	utils.AssertNoError(t, err)
+	creds := CFCreds{SecretKey: keys.PrivateKey, PublicKey: fakeWarpPeerKey, Reserved: []int{1, 2, 3}}
+	scan := EndpointScan{
+		Ranges:      []string{"127.0.0.1/32"},
+		Ports:       []int{port},
+		Samples:     1,
+		Attempts:    2,
+		Timeout:     time.Second,
+		Concurrency: 1,
+	}
+
+	app := &Application{logger: GetLogger(false)}
+	err = app.selectWarpEndpoint(context.Background(), scan, &creds, UDPEndpointProber{})
+	utils.AssertNoError(t, err)
+	utils.AssertCorrectString(t, "127.0.0.1:"+strconv.Itoa(port), creds.Endpoint)
+}
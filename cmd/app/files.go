@@ -3,11 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/ilyakutilin/xray_maintainer/utils"
 )
@@ -24,6 +30,9 @@ type File struct {
 	repo           Repo
 	releaseChecker ReleaseChecker
 	downloader     FileDownloader
+	// Download and install the release even if the stored tag matches it, which is
+	// used to bring back a file that has been modified outside of the app
+	reinstall bool
 }
 
 type GithubReleaseChecker struct{}
@@ -38,57 +47,6 @@ func NewFile(repo Repo) File {
 	}
 }
 
-func getStoredReleaseTag(fileName string, versionFilePath string) (string, error) {
-	data, err := os.ReadFile(versionFilePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return "", nil // No stored version yet
-		}
-		return "", fmt.Errorf("failed to read the versions file: %w", err)
-	}
-
-	var versions map[string]string
-	if err := json.Unmarshal(data, &versions); err != nil {
-		return "", err
-	}
-
-	version, exists := versions[fileName]
-	if !exists {
-		return "", nil // File version not found
-	}
-
-	return version, nil
-}
-
-func updateStoredReleaseTag(fileName, newVersion, versionFilePath string) error {
-	if fileName == "" {
-		return fmt.Errorf("file name cannot be empty")
-	}
-
-	data, err := os.ReadFile(versionFilePath)
-	if err != nil && !os.IsNotExist(err) {
-		return err
-	}
-
-	var versions map[string]string
-	if len(data) > 0 {
-		if err := json.Unmarshal(data, &versions); err != nil {
-			return err
-		}
-	} else {
-		versions = make(map[string]string)
-	}
-
-	versions[fileName] = newVersion
-
-	newData, err := json.MarshalIndent(versions, "", "  ")
-	if err != nil {
-		return err
-	}
-
-	return os.WriteFile(versionFilePath, newData, 0644)
-}
-
 // Returns the tag name of the latest GitHub release
 func (rc GithubReleaseChecker) GetLatestReleaseTag(apiURL string) (string, error) {
 	resp, err := http.Get(apiURL)
@@ -154,14 +112,27 @@ func (d GitHubFileDownloader) Download(filePath string, url string) error {
 	return nil
 }
 
+// Reports whether the update (or the download) of the file has to wait for the
+// maintenance window, since the new file requires a restart of the xray service
+func (app *Application) fileUpdateDeferred(action string, fileName string) bool {
+	if app.debug || !app.restartDeferred() {
+		return false
+	}
+	app.logger.Info.Printf("Deferring the %s of %s to the maintenance window %s, "+
+		"since it requires a restart of %s\n", action, fileName,
+		app.applyStrategy.MaintenanceWindow, app.xrayServiceName)
+	return true
+}
+
 // Checks if the version of the file by the specified fullPath (including the filename)
 // can be updated to a newer version based on the latest release version from Github.
-// Updates the file if necessary.
-func (app *Application) updateFile(ctx context.Context, file File) error {
+// Updates the file if necessary and reports whether the new file has been installed.
+// The failures it recovers from are reported as warnings, not returned.
+func (app *Application) updateFile(ctx context.Context, file File) (bool, error) {
 	fileName := file.repo.Filename
 	fileDir := app.workdir
 	filePath := filepath.Join(fileDir, fileName)
-	versionFilePath := filepath.Join(fileDir, "versions.json")
+	versionFilePath := filepath.Join(fileDir, versionsFileName)
 
 	app.logger.Info.Printf("Starting to update the %s file...\n", fileName)
 
@@ -169,40 +140,59 @@ func (app *Application) updateFile(ctx context.Context, file File) error {
 	if err != nil {
 		app.warn(fmt.Sprintf("Failed to get the latest release tag for %s "+
 			"from github: %v. The file has not been updated.", fileName, err))
-		return nil
+		return false, nil
 	}
 	app.logger.Info.Printf("The latest release tag for %s: %s\n",
 		fileName, latestReleaseTag)
 
 	app.logger.Info.Printf("Looking for %s file in %s...\n", fileName, fileDir)
 	var backup string
+	// The backups are kept for the next run if they could not be restored
+	restoreFailed := false
+	// The update is journaled before anything is changed, so that the run after
+	// a crash amid it completes or rolls it back
+	op := Operation{Kind: operationFileUpdate, Path: filePath}
 	if utils.FileExists(filePath) {
 		app.logger.Info.Printf("%s file found in %s\n", fileName, fileDir)
-		storedTag, err := getStoredReleaseTag(fileName, versionFilePath)
+		versions, err := loadVersionsState(versionFilePath)
 		if err != nil {
 			app.warn(fmt.Sprintf("Error while getting the local stored release tag "+
 				"for %s: %v. The file has not been updated.", fileName, err))
-			return nil
+			return false, nil
 		}
 
-		if storedTag == latestReleaseTag {
+		storedTag := versions.tag(fileName)
+		if storedTag == latestReleaseTag && !file.reinstall {
 			app.logger.Info.Printf("%s file is already up-to-date (%s), "+
 				"no further action required\n", fileName, storedTag)
-			return nil
+			return false, nil
 		} else {
 			app.logger.Info.Printf("%s file is out-of-date: local version is %s, "+
 				"remote version is %s, updating...\n",
 				fileName, storedTag, latestReleaseTag)
+			if app.fileUpdateDeferred("update", fileName) {
+				return false, nil
+			}
+			op.Backup = filePath + ".backup"
+			if err := app.beginOperation(op); err != nil {
+				app.warn(fmt.Sprintf("Failed to record the update of %s in the "+
+					"journal: %v. The file has not been updated.", fileName, err))
+				return false, nil
+			}
 			app.logger.Info.Println("Creating a backup file just in case...")
 			backup, err = utils.BackupFile(filePath)
 			if err != nil {
+				app.endOperation(filePath)
 				app.warn(fmt.Sprintf("Failed to back up the file %s: %v. "+
 					"The file has not been updated.", fileName, err))
-				return nil
+				return false, nil
 			}
 			defer func() {
+				if restoreFailed {
+					return
+				}
 				err = os.Remove(backup)
-				if err != nil {
+				if err != nil && !os.IsNotExist(err) {
 					app.warn(fmt.Sprintf("could not remove the backup file by path "+
 						"%s: %v", backup, err))
 				}
@@ -211,76 +201,125 @@ func (app *Application) updateFile(ctx context.Context, file File) error {
 	} else {
 		app.logger.Info.Printf("%s file not found in %s, starting to download...\n",
 			fileName, fileDir)
+		if app.fileUpdateDeferred("download", fileName) {
+			return false, nil
+		}
+		if err := app.beginOperation(op); err != nil {
+			app.warn(fmt.Sprintf("Failed to record the download of %s in the "+
+				"journal: %v. The file has not been downloaded.", fileName, err))
+			return false, nil
+		}
+	}
+
+	// Backups of the other files extracted from the release archive alongside
+	// the main one, keyed by the path of the original file
+	var extraBackups map[string]string
+	defer func() {
+		if restoreFailed {
+			return
+		}
+		for _, b := range extraBackups {
+			if b != "" {
+				_ = os.Remove(b)
+			}
+		}
+	}()
+
+	// Brings the original file back (or removes the new one if there was none)
+	// when the update cannot be completed
+	restore := func() error {
+		app.logger.Info.Printf("Restoring file %s from backup...", fileName)
+		app.restoreExtraFiles(extraBackups)
+		if backup == "" {
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove the new file %s: %w", fileName, err)
+			}
+			app.endOperation(filePath)
+			return nil
+		}
+		if err := os.Rename(backup, filePath); err != nil {
+			restoreFailed = true
+			return fmt.Errorf("failed to restore file %s from backup: %w",
+				fileName, err)
+		}
+		app.endOperation(filePath)
+		return nil
 	}
 
 	err = file.downloader.Download(filePath, file.repo.DownloadURL)
 	if err != nil {
 		app.warn(fmt.Sprintf("Failed to download the file %s: %v. "+
 			"The file has not been updated.", fileName, err))
-		return nil
+		return false, restore()
 	}
 	app.logger.Info.Printf("File %s has been downloaded and is available at %s\n",
 		fileName, filePath)
 
-	fileIsZip, err := utils.IsZipFile(filePath)
+	archiveFormat, err := utils.DetectArchiveFormat(filePath)
 	if err != nil {
-		app.warn(fmt.Sprintf("Failed to check whether the file %s is a zip file"+
+		app.warn(fmt.Sprintf("Failed to check whether the file %s is an archive "+
 			"or not: %v. The file has not been updated.", fileName, err))
-		app.logger.Info.Printf("Restoring file %s from backup...", fileName)
-		if err := utils.RestoreFile(backup, filePath); err != nil {
-			return fmt.Errorf("failed to restore file %s from backup: %w",
-				fileName, err)
-		}
-		return nil
+		return false, restore()
 	}
-	if fileIsZip {
-		app.logger.Info.Printf("The downloaded file %s is a zip, so unzipping it...\n",
-			filepath.Base(filePath))
-		zipFilePath := filePath + ".zip"
-		err = os.Rename(filePath, zipFilePath)
+	if archiveFormat != utils.FormatNone {
+		app.logger.Info.Printf("The downloaded file %s is a %s archive, "+
+			"so extracting it...\n", fileName, archiveFormat)
+		extraBackups, err = app.extractArchive(file.repo, filePath, archiveFormat)
 		if err != nil {
-			app.warn(fmt.Sprintf("Failed to rename file %s to %s.zip: %v. "+
-				"The file has not been updated.", fileName, fileName, err))
-			return nil
+			app.warn(fmt.Sprintf("Failed to extract the necessary files from the "+
+				"%s archive: %v. The file has not been updated.", fileName, err))
+			return false, restore()
 		}
+	}
 
-		extractedFilePath, err := utils.ExtractFileFromZip(zipFilePath, fileName)
-		if err != nil {
-			app.warn(fmt.Sprintf("Failed to extract the necessary file %s "+
-				"from zip: %v. The file has not been updated.", fileName, err))
-			return nil
+	if file.repo.DataType != "" {
+		app.logger.Info.Printf("Validating the contents of the new %s...\n", fileName)
+		if err := app.validateGeoData(file.repo, filePath); err != nil {
+			app.warn(fmt.Sprintf("The new %s file (%s) failed validation: %v. "+
+				"The file has not been updated.", fileName, latestReleaseTag, err))
+			return false, restore()
 		}
-		app.logger.Info.Printf("File %s has been extracted from zip "+
-			"and is available at %s\n", fileName, extractedFilePath)
 	}
 
-	// TODO: Test executability
 	if file.repo.Executable {
 		app.logger.Info.Printf("Setting executable permissions for %s\n", fileName)
 		if err := utils.MakeExecutable(filePath); err != nil {
 			app.warn(fmt.Sprintf("Failed to set executable permissions for %s: %v. "+
 				"The file has not been updated. Restoring the file from backup...",
 				fileName, err))
-			if err := utils.RestoreFile(backup, filePath); err != nil {
-				return fmt.Errorf("failed to restore file %s from backup: %w",
-					fileName, err)
-			}
+			return false, restore()
+		}
+	}
+
+	var detectedVersion string
+	if file.repo.SmokeTest.isEnabled() {
+		app.logger.Info.Printf("Running the smoke test for the new %s...\n", fileName)
+		detectedVersion, err = runSmokeTest(ctx, filePath, file.repo.SmokeTest)
+		if err != nil {
+			app.warn(fmt.Sprintf("The new %s file (%s) failed the smoke test: %v. "+
+				"The file has not been updated. Restoring the file from backup...",
+				fileName, latestReleaseTag, err))
+			return false, restore()
+		}
+		if detectedVersion != "" {
+			app.logger.Info.Printf("The smoke test for %s passed, the detected "+
+				"version is %s\n", fileName, detectedVersion)
+		} else {
+			app.logger.Info.Printf("The smoke test for %s passed\n", fileName)
 		}
 	}
 
 	if !app.debug {
 		app.logger.Info.Printf("Checking operability of %s after the file update...\n",
 			app.xrayServiceName)
-		if err = utils.CheckOperability(ctx, app.xrayServiceName, nil); err != nil {
+		app.setOperationStage(filePath, stageApplying)
+		if err = app.refreshXrayService(ctx); err != nil {
 			app.warn(fmt.Sprintf("Service %s operability check failed after the "+
 				"file %s has been updated, while it was operational prior to the "+
 				"update. All the changes to this file will now be reverted, "+
 				"and the original file will be restored from backup. The file has not "+
 				"been updated.", app.xrayServiceName, fileName))
-			if err := utils.RestoreFile(backup, filePath); err != nil {
-				return fmt.Errorf("failed to restore file %s from backup: %w",
-					fileName, err)
-			}
+			return false, restore()
 		}
 		app.logger.Info.Printf("%s is active, updating the stored release tag...\n",
 			app.xrayServiceName)
@@ -288,18 +327,195 @@ func (app *Application) updateFile(ctx context.Context, file File) error {
 		app.logger.Info.Println("Updating the stored release tag...")
 	}
 
-	err = updateStoredReleaseTag(fileName, latestReleaseTag, versionFilePath)
+	checksum, size, err := utils.FileSHA256(filePath)
+	if err != nil {
+		app.warn(fmt.Sprintf("Failed to calculate the checksum of the new %s: %v",
+			fileName, err))
+	}
+	var mode string
+	if info, err := os.Stat(filePath); err == nil {
+		mode = formatFileMode(info.Mode())
+	}
+	var extras map[string]ExtractedFile
+	for _, extra := range slices.Sorted(maps.Keys(extraBackups)) {
+		checksum, size, err := utils.FileSHA256(extra)
+		if err != nil {
+			app.warn(fmt.Sprintf("Failed to calculate the checksum of %s extracted "+
+				"with %s: %v", extra, fileName, err))
+			continue
+		}
+		if extras == nil {
+			extras = make(map[string]ExtractedFile)
+		}
+		ef := ExtractedFile{SHA256: checksum, Size: size}
+		if info, err := os.Stat(extra); err == nil {
+			ef.Mode = formatFileMode(info.Mode())
+		}
+		extras[workdirRelativePath(fileDir, extra)] = ef
+	}
+	source := sourceUpdate
+	if file.reinstall {
+		source = sourceReinstall
+	}
+	err = recordInstalledVersion(versionFilePath, fileName, FileVersion{
+		Tag:             latestReleaseTag,
+		Repo:            file.repo.Name,
+		Source:          source,
+		DownloadURL:     pinnedDownloadURL(file.repo.DownloadURL, latestReleaseTag),
+		SHA256:          checksum,
+		Size:            size,
+		Mode:            mode,
+		InstalledAt:     time.Now().UTC(),
+		DetectedVersion: detectedVersion,
+		Extras:          extras,
+	})
 	if err != nil {
 		app.warn(fmt.Sprintf("Failed to update the locally stored release tag "+
-			"of %s. This will lead to the need of a repeated update of %s the next "+
-			"time this app runs, and will likely fail again until the reason is "+
+			"of %s: %v. This will lead to the need of a repeated update of %s the "+
+			"next time this app runs, and will likely fail again until the reason is "+
 			"investigated. However, the %s file update was NOT interrupted.",
-			fileName, fileName, fileName))
+			fileName, err, fileName, fileName))
 	}
+	app.endOperation(filePath)
 	app.logger.Info.Printf("The %s file has been successfully updated to version %s\n",
 		fileName, latestReleaseTag)
 
-	return nil
+	return true, nil
+}
+
+// Returns the archive members to extract for the repo. If there are no extraction
+// rules in the config, the only member is the file named after the repo Filename.
+func (r Repo) archiveMembers(workdir string) ([]utils.ArchiveMember, error) {
+	rules := r.Extract
+	if len(rules) == 0 {
+		rules = []ExtractRule{{Member: r.Filename, Destination: r.Filename}}
+	}
+
+	mainFilePath := filepath.Join(workdir, r.Filename)
+	mainFileFound := false
+
+	var members []utils.ArchiveMember
+	for _, rule := range rules {
+		dest := rule.Destination
+		if dest == "" {
+			dest = path.Base(strings.TrimSuffix(rule.Member, "/"))
+		}
+		if !filepath.IsAbs(dest) {
+			dest = filepath.Join(workdir, dest)
+		}
+		if dest == mainFilePath {
+			mainFileFound = true
+		}
+
+		var mode os.FileMode
+		if rule.Mode != "" {
+			var err error
+			mode, err = parseFileMode(rule.Mode)
+			if err != nil {
+				return nil, fmt.Errorf("%w for the archive member %s: an octal "+
+					"value like 0755 is expected", err, rule.Member)
+			}
+		}
+
+		members = append(members, utils.ArchiveMember{
+			Name:        rule.Member,
+			Destination: dest,
+			Mode:        mode,
+		})
+	}
+
+	if !mainFileFound {
+		return nil, fmt.Errorf("none of the extraction rules for %s has %s as its "+
+			"destination", r.Name, r.Filename)
+	}
+
+	return members, nil
+}
+
+// Extracts the members of the downloaded archive according to the repo extraction
+// rules. The existing files other than the main one (which has already been backed
+// up by the caller) are moved to backups before being overwritten, and the map of
+// their paths to the backup paths is returned so that the caller can roll them
+// back if the update fails later on. The files which did not exist before have
+// an empty backup path, so that the rollback removes them. If the extraction
+// itself fails, they are rolled back right away.
+func (app *Application) extractArchive(repo Repo, filePath string, format utils.ArchiveFormat) (map[string]string, error) {
+	members, err := repo.archiveMembers(app.workdir)
+	if err != nil {
+		return nil, err
+	}
+
+	archivePath := filePath + format.Extension()
+	if err := os.Rename(filePath, archivePath); err != nil {
+		return nil, fmt.Errorf("failed to rename %s to %s: %w",
+			filepath.Base(filePath), filepath.Base(archivePath), err)
+	}
+	// The archive is of no use once extracted (or failed to be extracted)
+	defer os.Remove(archivePath)
+
+	destinations, err := utils.ArchiveDestinations(archivePath, format, members)
+	if err != nil {
+		return nil, err
+	}
+	var extras []string
+	for _, dest := range destinations {
+		if dest != filePath {
+			extras = append(extras, dest)
+		}
+	}
+	app.setOperationExtras(filePath, extras)
+
+	backups := make(map[string]string)
+	for _, dest := range extras {
+		if _, ok := backups[dest]; ok {
+			continue
+		}
+		info, err := os.Stat(dest)
+		if os.IsNotExist(err) {
+			backups[dest] = ""
+			continue
+		}
+		if err == nil && info.IsDir() {
+			err = errors.New("a directory is in the way")
+		}
+		if err == nil {
+			backups[dest], err = utils.BackupFile(dest)
+		}
+		if err != nil {
+			app.restoreExtraFiles(backups)
+			return nil, fmt.Errorf("failed to back up %s: %w", dest, err)
+		}
+	}
+
+	extracted, err := utils.ExtractArchive(archivePath, format, members)
+	if err != nil {
+		app.restoreExtraFiles(backups)
+		return nil, err
+	}
+
+	for _, e := range extracted {
+		app.logger.Info.Printf("%s has been extracted from the %s archive\n",
+			e, format)
+	}
+
+	return backups, nil
+}
+
+// Moves the backups of the extracted files back to their original paths and
+// removes the extracted files which did not exist before
+func (app *Application) restoreExtraFiles(backups map[string]string) {
+	for orig, b := range backups {
+		if b == "" {
+			if err := os.Remove(orig); err != nil && !os.IsNotExist(err) {
+				app.warn(fmt.Sprintf("Failed to remove the extracted %s: %v", orig, err))
+			}
+			continue
+		}
+		if err := os.Rename(b, orig); err != nil {
+			app.warn(fmt.Sprintf("Failed to restore %s from its backup %s: %v",
+				orig, b, err))
+		}
+	}
 }
 
 func (app *Application) updateMultipleFiles(ctx context.Context, repos []Repo, fileCreator func(repo Repo) File) error {
@@ -307,7 +523,7 @@ func (app *Application) updateMultipleFiles(ctx context.Context, repos []Repo, f
 
 	for _, repo := range repos {
 		file := fileCreator(repo)
-		err := app.updateFile(ctx, file)
+		_, err := app.updateFile(ctx, file)
 		if err != nil {
 			errs.Append(err)
 			app.logger.Error.Printf("Error updating %s: %v\n", repo.Name, err)
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"errors"
@@ -22,152 +24,6 @@ import (
 // TODO: Unify cleanups (e.g. RemoveAll vs Remove)
 // TODO: Unify setups (e.g. create temp subdirs within the temp dir for diff tests)
 
-func TestGetStoredReleaseTag(t *testing.T) {
-	// Versions file does not exist
-	t.Run("Versions file does not exist", func(t *testing.T) {
-		tag, err := getStoredReleaseTag("testfile", "doesnotexist.json")
-		utils.AssertCorrectString(t, "", tag)
-		utils.AssertNoError(t, err)
-	})
-
-	versionsFile, cleanup := utils.CreateTempFile(t)
-
-	var tests = []struct {
-		name           string
-		fileContents   []byte
-		expectedReturn string
-		// errors.As does not work with struct / loop approach, so using reflect
-		expectedError reflect.Type
-	}{
-		{
-			name:           "Versions file exists and has correct structure",
-			fileContents:   []byte(`{"testfile": "1.2.3"}`),
-			expectedReturn: "1.2.3",
-			expectedError:  nil,
-		},
-		{
-			name:           "Versions file exists but is empty",
-			fileContents:   []byte("{}"),
-			expectedReturn: "",
-			expectedError:  nil,
-		},
-		{
-			name:           "Versions file exists but is malformed",
-			fileContents:   []byte(`{"testfile": `),
-			expectedReturn: "",
-			expectedError:  reflect.TypeOf((*json.SyntaxError)(nil)),
-		},
-		{
-			name:           "Versions file has wrong type of value",
-			fileContents:   []byte(`{"testfile": 5}`),
-			expectedReturn: "",
-			expectedError:  reflect.TypeOf((*json.UnmarshalTypeError)(nil)),
-		},
-	}
-
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			t.Cleanup(cleanup)
-			err := os.WriteFile(versionsFile, test.fileContents, os.ModePerm)
-			if err != nil {
-				t.Fatalf("Failed to write test data: %v", err)
-			}
-			tag, err := getStoredReleaseTag("testfile", versionsFile)
-			utils.AssertCorrectString(t, test.expectedReturn, tag)
-			if test.expectedError == nil {
-				utils.AssertNoError(t, err)
-			} else {
-				actualErrType := reflect.TypeOf(err)
-				if actualErrType != test.expectedError {
-					t.Errorf("Expected an error of type %v but got %v", test.expectedError, actualErrType)
-				}
-			}
-		})
-	}
-
-}
-
-func TestUpdateStoredReleaseTag(t *testing.T) {
-	t.Run("Versions file gets created if it does not exist", func(t *testing.T) {
-		err := updateStoredReleaseTag("testfile", "1.2.3", filepath.Join(os.TempDir(), "doesnotexist.json"))
-		utils.AssertNoError(t, err)
-		data, err := os.ReadFile(filepath.Join(os.TempDir(), "doesnotexist.json"))
-		utils.AssertNoError(t, err)
-		utils.AssertCorrectString(t, "{\n  \"testfile\": \"1.2.3\"\n}", string(data))
-	})
-
-	versionsFile, cleanup := utils.CreateTempFile(t)
-
-	var tests = []struct {
-		name            string
-		fileName        string
-		existingContent []byte
-		expectedMap     map[string]string
-		errorExpected   bool
-	}{
-		{
-			name:            "Change the existing tag",
-			fileName:        "testfile",
-			existingContent: []byte(`{"testfile": "1.2.3"}`),
-			expectedMap:     map[string]string{"testfile": "1.2.4"},
-			errorExpected:   false,
-		},
-		{
-			name:            "Add a new tag and preserve existing ones",
-			fileName:        "new_testfile",
-			existingContent: []byte(`{"testfile": "1.2.3"}`),
-			expectedMap:     map[string]string{"testfile": "1.2.3", "new_testfile": "1.2.4"},
-			errorExpected:   false,
-		},
-		{
-			name:            "Add a new tag to the empty JSON",
-			fileName:        "testfile",
-			existingContent: []byte(`{}`),
-			expectedMap:     map[string]string{"testfile": "1.2.4"},
-			errorExpected:   false,
-		},
-		{
-			name:            "Updating malformed JSON fails",
-			fileName:        "does_not_matter",
-			existingContent: []byte(`{"something": }`),
-			expectedMap:     map[string]string{},
-			errorExpected:   true,
-		},
-		{
-			name:            "Empty fileName",
-			fileName:        "",
-			existingContent: []byte(`{"testfile": "1.2.3"}`),
-			expectedMap:     map[string]string{},
-			errorExpected:   true,
-		},
-	}
-
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			t.Cleanup(cleanup)
-			err := os.WriteFile(versionsFile, test.existingContent, os.ModePerm)
-			if err != nil {
-				t.Fatalf("Failed to write test data: %v", err)
-			}
-			err = updateStoredReleaseTag(test.fileName, "1.2.4", versionsFile)
-			if test.errorExpected {
-				utils.AssertError(t, err)
-				return
-			} else {
-				utils.AssertNoError(t, err)
-			}
-			data, err := os.ReadFile(versionsFile)
-			utils.AssertNoError(t, err)
-			var actualMap map[string]string
-			err = json.Unmarshal(data, &actualMap)
-			utils.AssertNoError(t, err)
-			if !reflect.DeepEqual(actualMap, test.expectedMap) {
-				t.Errorf("Expected map %v but got %v", test.expectedMap, actualMap)
-			}
-		})
-	}
-}
-
 func TestGetLatestReleaseTag(t *testing.T) {
 	releaseChecker := GithubReleaseChecker{}
 
@@ -521,7 +377,7 @@ func TestUpdateFile(t *testing.T) {
 			file.releaseChecker = test.releaseChecker
 			file.downloader = test.downloader
 
-			_ = testApp.updateFile(ctx, file)
+			_, _ = testApp.updateFile(ctx, file)
 
 			if test.expectedWarning != "" {
 				if len(testApp.warnings) == 0 {
@@ -545,19 +401,25 @@ func TestUpdateFile(t *testing.T) {
 			utils.AssertCorrectString(t, "mock content", string(content))
 
 			// Check that the versions file is updated
-			versionsFilePath := filepath.Join(filepath.Dir(tempFile), "versions.json")
-			versionsContent, err := os.ReadFile(versionsFilePath)
+			versionsFilePath := filepath.Join(filepath.Dir(tempFile), versionsFileName)
+			versions, err := loadVersionsState(versionsFilePath)
 			if err != nil {
-				t.Fatalf("Failed to read versions file: %v", err)
+				t.Fatalf("Failed to load versions file: %v", err)
 			}
 
-			var versions map[string]string
-			err = json.Unmarshal(versionsContent, &versions)
-			if err != nil {
-				t.Fatalf("Failed to unmarshal versions file: %v", err)
+			fv := versions.Files[filepath.Base(tempFile)]
+			if fv == nil {
+				t.Fatalf("The file is missing from the versions file")
+			}
+			utils.AssertCorrectString(t, "1.2.3", fv.Tag)
+			utils.AssertCorrectString(t, sourceUpdate, fv.Source)
+			utils.AssertCorrectInt(t, len("mock content"), int(fv.Size))
+			if len(fv.SHA256) != 64 {
+				t.Errorf("Expected a sha256 checksum, got %q", fv.SHA256)
+			}
+			if fv.InstalledAt.IsZero() {
+				t.Errorf("The installation time has not been recorded")
 			}
-
-			utils.AssertCorrectString(t, "1.2.3", versions[filepath.Base(tempFile)])
 
 			// Check that there are no zip files in the folder
 			files, err := os.ReadDir(filepath.Dir(tempFile))
@@ -570,6 +432,11 @@ func TestUpdateFile(t *testing.T) {
 					t.Errorf("Found zip file %s in directory", f.Name())
 				}
 			}
+
+			// The completed update is not left in the journal
+			if utils.FileExists(filepath.Join(filepath.Dir(tempFile), journalFileName)) {
+				t.Errorf("Found the journal in the directory")
+			}
 		})
 	}
 
@@ -644,3 +511,278 @@ func TestUpdateMultipleFiles(t *testing.T) {
 		})
 	}
 }
+
+// Writes a tar.gz archive with the provided files (name -> content)
+type TarGzFileDownloader struct {
+	files map[string]string
+}
+
+func (d TarGzFileDownloader) Download(filePath string, url string) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	defer gz.Close()
+	tw := tar.NewWriter(gz)
+	defer tw.Close()
+
+	for name, content := range d.files {
+		hdr := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatUSTAR,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRepoArchiveMembers(t *testing.T) {
+	tests := []struct {
+		name        string
+		repo        Repo
+		want        []utils.ArchiveMember
+		errContains string
+	}{
+		{
+			name: "no rules",
+			repo: Repo{Name: "xray-core", Filename: "xray"},
+			want: []utils.ArchiveMember{
+				{Name: "xray", Destination: "/opt/xray/xray"},
+			},
+		},
+		{
+			name: "several rules",
+			repo: Repo{
+				Name:     "xray-core",
+				Filename: "xray",
+				Extract: []ExtractRule{
+					{Member: "xray", Mode: "0755"},
+					{Member: "geoip.dat", Destination: "xray-geoip.dat"},
+					{Member: "docs/", Destination: "/usr/share/doc/xray"},
+				},
+			},
+			want: []utils.ArchiveMember{
+				{Name: "xray", Destination: "/opt/xray/xray", Mode: 0755},
+				{Name: "geoip.dat", Destination: "/opt/xray/xray-geoip.dat"},
+				{Name: "docs/", Destination: "/usr/share/doc/xray"},
+			},
+		},
+		{
+			name: "invalid mode",
+			repo: Repo{
+				Name:     "xray-core",
+				Filename: "xray",
+				Extract:  []ExtractRule{{Member: "xray", Mode: "rwxr-xr-x"}},
+			},
+			errContains: "invalid mode",
+		},
+		{
+			name: "main file not among destinations",
+			repo: Repo{
+				Name:     "xray-core",
+				Filename: "xray",
+				Extract:  []ExtractRule{{Member: "geoip.dat"}},
+			},
+			errContains: "has xray as its destination",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.repo.archiveMembers("/opt/xray")
+			if tt.errContains != "" {
+				utils.AssertErrorContains(t, err, tt.errContains)
+				return
+			}
+			utils.AssertNoError(t, err)
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("Expected members %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUpdateFileDeferred(t *testing.T) {
+	tests := []struct {
+		name       string
+		oldContent string
+	}{
+		{"missing file is not downloaded", ""},
+		{"existing file is not updated", "old content"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workdir := t.TempDir()
+			filePath := filepath.Join(workdir, "xray")
+			if tt.oldContent != "" {
+				utils.AssertNoError(t, os.WriteFile(filePath, []byte(tt.oldContent), 0644))
+			}
+
+			testApp := &Application{
+				logger:        GetLogger(false),
+				workdir:       workdir,
+				applyStrategy: ApplyStrategy{Mode: applyRestart, MaintenanceWindow: "03:00-05:00"},
+				now:           func() time.Time { return time.Date(2025, 1, 1, 12, 0, 0, 0, time.Local) },
+			}
+			file := File{
+				repo:           Repo{Filename: "xray"},
+				releaseChecker: MockReleaseChecker{},
+				downloader:     OrdinaryFileDownloader{},
+			}
+
+			installed, err := testApp.updateFile(context.Background(), file)
+			utils.AssertNoError(t, err)
+			utils.AssertCorrectBool(t, false, installed)
+
+			content, err := os.ReadFile(filePath)
+			if tt.oldContent == "" {
+				if !os.IsNotExist(err) {
+					t.Errorf("Expected %s not to be downloaded, got %v", filePath, err)
+				}
+				return
+			}
+			utils.AssertNoError(t, err)
+			utils.AssertCorrectString(t, tt.oldContent, string(content))
+		})
+	}
+}
+
+func TestUpdateFileExtractRules(t *testing.T) {
+	archiveFiles := map[string]string{
+		"xray":      "new xray",
+		"geoip.dat": "new geoip",
+		"LICENSE":   "license",
+		"share/a":   "new a",
+		"share/b":   "new b",
+	}
+
+	tests := []struct {
+		name            string
+		rules           []ExtractRule
+		smokeTest       SmokeTest
+		wantInstalled   bool
+		wantFiles       map[string]string
+		wantMissing     []string
+		expectedWarning string
+	}{
+		{
+			name: "several members are extracted",
+			rules: []ExtractRule{
+				{Member: "xray", Mode: "0755"},
+				{Member: "geoip.dat", Destination: "xray-geoip.dat"},
+			},
+			wantInstalled: true,
+			wantFiles: map[string]string{
+				"xray":           "new xray",
+				"xray-geoip.dat": "new geoip",
+			},
+		},
+		{
+			name: "missing member keeps the old files",
+			rules: []ExtractRule{
+				{Member: "xray"},
+				{Member: "geosite.dat", Destination: "xray-geoip.dat"},
+			},
+			wantFiles: map[string]string{
+				"xray":           "old xray",
+				"xray-geoip.dat": "old geoip",
+			},
+			expectedWarning: "geosite.dat",
+		},
+		{
+			name: "directory member is rolled back",
+			rules: []ExtractRule{
+				{Member: "xray"},
+				{Member: "share/", Destination: "share"},
+			},
+			smokeTest: SmokeTest{Command: "false"},
+			wantFiles: map[string]string{
+				"xray":    "old xray",
+				"share/a": "old a",
+			},
+			wantMissing:     []string{"share/b", "share/a.backup"},
+			expectedWarning: "failed the smoke test",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workdir := t.TempDir()
+			testApp := &Application{
+				debug:   true,
+				logger:  GetLogger(false),
+				workdir: workdir,
+			}
+
+			for name, content := range map[string]string{
+				"xray":           "old xray",
+				"xray-geoip.dat": "old geoip",
+				"share/a":        "old a",
+			} {
+				path := filepath.Join(workdir, name)
+				utils.AssertNoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			file := File{
+				repo: Repo{Name: "xray-core", Filename: "xray", Extract: tt.rules,
+					SmokeTest: tt.smokeTest},
+				releaseChecker: MockReleaseChecker{},
+				downloader:     TarGzFileDownloader{files: archiveFiles},
+			}
+
+			installed, err := testApp.updateFile(context.Background(), file)
+			if err != nil {
+				t.Fatalf("updateFile() error = %v", err)
+			}
+			utils.AssertCorrectBool(t, tt.wantInstalled, installed)
+
+			if tt.expectedWarning != "" {
+				if len(testApp.warnings) == 0 ||
+					!strings.Contains(strings.Join(testApp.warnings, "\n"), tt.expectedWarning) {
+					t.Errorf("expected a warning containing %q, got %v",
+						tt.expectedWarning, testApp.warnings)
+				}
+			}
+
+			for name, want := range tt.wantFiles {
+				got, err := os.ReadFile(filepath.Join(workdir, name))
+				if err != nil {
+					t.Fatalf("Failed to read %s: %v", name, err)
+				}
+				utils.AssertCorrectString(t, want, string(got))
+			}
+			for _, name := range tt.wantMissing {
+				if utils.FileExists(filepath.Join(workdir, name)) {
+					t.Errorf("Expected %s to be removed", name)
+				}
+			}
+
+			entries, err := os.ReadDir(workdir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if strings.HasSuffix(e.Name(), ".tar.gz") ||
+					strings.HasSuffix(e.Name(), ".backup") ||
+					strings.HasSuffix(e.Name(), ".tmp") {
+					t.Errorf("Leftover file %s in the workdir", e.Name())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// Data types of the geo files that can be validated
+const (
+	dataTypeGeoIP   = "geoip"
+	dataTypeGeoSite = "geosite"
+)
+
+// A reference to a geo data category in the xray routing rules,
+// e.g. "geoip:!cn", "geosite:google@ads" or "ext:geosite.dat:category-ru"
+type geoRef struct {
+	raw      string
+	dataType string
+	// Name of the file the category is looked up in
+	fileName string
+	code     string
+	attrs    []string
+}
+
+func parseGeoRef(raw string, dataType string) (geoRef, bool) {
+	ref := geoRef{raw: raw, dataType: dataType}
+
+	var rest string
+	switch {
+	case strings.HasPrefix(raw, dataType+":"):
+		ref.fileName = dataType + ".dat"
+		rest = strings.TrimPrefix(raw, dataType+":")
+	case strings.HasPrefix(raw, "ext:"):
+		// ext:<file>:<code>
+		parts := strings.SplitN(strings.TrimPrefix(raw, "ext:"), ":", 2)
+		if len(parts) != 2 {
+			return ref, false
+		}
+		ref.fileName = parts[0]
+		rest = parts[1]
+	default:
+		return ref, false
+	}
+
+	rest = strings.TrimPrefix(rest, "!")
+	parts := strings.Split(rest, "@")
+	ref.code = parts[0]
+	for _, a := range parts[1:] {
+		if a != "" {
+			ref.attrs = append(ref.attrs, a)
+		}
+	}
+
+	return ref, ref.code != ""
+}
+
+// Collects the references to the geo data categories of the given data type
+// (geoip or geosite) from the routing rules that point to the file with
+// the provided name
+func collectGeoRefs(rules []SrvRoutingRule, dataType string, fileName string) []geoRef {
+	var refs []geoRef
+	for _, rule := range rules {
+		values := rule.Domain
+		if dataType == dataTypeGeoIP {
+			values = rule.IP
+		}
+		for _, v := range values {
+			ref, ok := parseGeoRef(v, dataType)
+			if ok && ref.fileName == fileName {
+				refs = append(refs, ref)
+			}
+		}
+	}
+	return refs
+}
+
+// Checks that the new geo data file by the filePath can be parsed and contains
+// all the categories referenced in the routing rules of the xray server config.
+func (app *Application) validateGeoData(repo Repo, filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	var geoData *utils.GeoData
+	switch repo.DataType {
+	case dataTypeGeoIP:
+		geoData, err = utils.ParseGeoIP(data)
+	case dataTypeGeoSite:
+		geoData, err = utils.ParseGeoSite(data)
+	default:
+		return fmt.Errorf("unknown data type %q: only %q and %q are supported",
+			repo.DataType, dataTypeGeoIP, dataTypeGeoSite)
+	}
+	if err != nil {
+		return fmt.Errorf("the file is not a valid %s data file: %w", repo.DataType, err)
+	}
+	app.logger.Info.Printf("%s is a valid %s data file with %d categories\n",
+		repo.Filename, repo.DataType, len(geoData.Categories))
+
+	if app.xrayServerConfigPath == "" {
+		return nil
+	}
+
+	var serverConfig ServerConfig
+	if err := utils.ParseJSONFile(app.xrayServerConfigPath, &serverConfig, false); err != nil {
+		app.warn(fmt.Sprintf("Could not parse the xray server config to check the "+
+			"categories of the new %s against its routing rules: %v. Only the format "+
+			"of the file has been checked.", repo.Filename, err))
+		return nil
+	}
+
+	var missing []string
+	seen := make(map[string]bool)
+	for _, ref := range collectGeoRefs(serverConfig.Routing.Rules, repo.DataType, repo.Filename) {
+		if seen[ref.raw] {
+			continue
+		}
+		seen[ref.raw] = true
+		if !geoData.Has(ref.code, ref.attrs...) {
+			missing = append(missing, ref.raw)
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return errors.New("the following categories referenced in the routing " +
+			"rules of " + filepath.Base(app.xrayServerConfigPath) + " are missing " +
+			"from the new file: " + strings.Join(missing, ", "))
+	}
+
+	return nil
+}
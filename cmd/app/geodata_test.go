@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestParseGeoRef(t *testing.T) {
+	tests := []struct {
+		raw      string
+		dataType string
+		want     geoRef
+		wantOK   bool
+	}{
+		{
+			raw:      "geoip:cn",
+			dataType: dataTypeGeoIP,
+			want:     geoRef{fileName: "geoip.dat", code: "cn"},
+			wantOK:   true,
+		},
+		{
+			raw:      "geoip:!private",
+			dataType: dataTypeGeoIP,
+			want:     geoRef{fileName: "geoip.dat", code: "private"},
+			wantOK:   true,
+		},
+		{
+			raw:      "geosite:google@ads",
+			dataType: dataTypeGeoSite,
+			want:     geoRef{fileName: "geosite.dat", code: "google", attrs: []string{"ads"}},
+			wantOK:   true,
+		},
+		{
+			raw:      "ext:custom.dat:category-ru",
+			dataType: dataTypeGeoSite,
+			want:     geoRef{fileName: "custom.dat", code: "category-ru"},
+			wantOK:   true,
+		},
+		{raw: "domain:example.com", dataType: dataTypeGeoSite},
+		{raw: "geosite:", dataType: dataTypeGeoSite},
+		{raw: "ext:custom.dat", dataType: dataTypeGeoSite},
+		{raw: "1.1.1.1/32", dataType: dataTypeGeoIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, ok := parseGeoRef(tt.raw, tt.dataType)
+			utils.AssertCorrectBool(t, tt.wantOK, ok)
+			if !tt.wantOK {
+				return
+			}
+			tt.want.raw = tt.raw
+			tt.want.dataType = tt.dataType
+			if !reflect.DeepEqual(tt.want, got) {
+				t.Errorf("Expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+type ContentFileDownloader struct {
+	content []byte
+}
+
+func (d ContentFileDownloader) Download(filePath string, url string) error {
+	return os.WriteFile(filePath, d.content, 0644)
+}
+
+func TestUpdateFileGeoDataValidation(t *testing.T) {
+	serverConfig := `{
+  "routing": {
+    "rules": [
+      {"type": "field", "outboundTag": "warp", "domain": ["geosite:google", "geosite:geolocation-!cn", "domain:example.com"]},
+      {"type": "field", "outboundTag": "block", "domain": ["geosite:category-ads-all@ads"], "ip": ["geoip:private"]}
+    ]
+  }
+}`
+
+	tests := []struct {
+		name        string
+		content     []byte
+		wantUpdated bool
+		wantWarning string
+	}{
+		{
+			name: "all referenced categories are present",
+			content: utils.BuildGeoSiteList(map[string][]string{
+				"GOOGLE":           {"google.com"},
+				"GEOLOCATION-!CN":  {"openai.com"},
+				"CATEGORY-ADS-ALL": {"doubleclick.net@ads"},
+			}),
+			wantUpdated: true,
+		},
+		{
+			name: "missing categories",
+			content: utils.BuildGeoSiteList(map[string][]string{
+				"GOOGLE":           {"google.com"},
+				"CATEGORY-ADS-ALL": {"doubleclick.net"},
+			}),
+			wantWarning: "geosite:category-ads-all@ads, geosite:geolocation-!cn",
+		},
+		{
+			name:        "html instead of the data file",
+			content:     []byte("<html><body>rate limit exceeded</body></html>"),
+			wantWarning: "not a valid geosite data file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workdir := t.TempDir()
+			configPath := filepath.Join(workdir, "config.json")
+			if err := os.WriteFile(configPath, []byte(serverConfig), 0644); err != nil {
+				t.Fatal(err)
+			}
+			filePath := filepath.Join(workdir, "geosite.dat")
+			if err := os.WriteFile(filePath, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			testApp := &Application{
+				debug:                true,
+				logger:               GetLogger(false),
+				workdir:              workdir,
+				xrayServerConfigPath: configPath,
+			}
+
+			file := File{
+				repo: Repo{
+					Name:     "geosite",
+					Filename: "geosite.dat",
+					DataType: dataTypeGeoSite,
+				},
+				releaseChecker: MockReleaseChecker{},
+				downloader:     ContentFileDownloader{content: tt.content},
+			}
+
+			if _, err := testApp.updateFile(context.Background(), file); err != nil {
+				t.Fatalf("updateFile() error = %v", err)
+			}
+
+			got, err := os.ReadFile(filePath)
+			utils.AssertNoError(t, err)
+			if tt.wantUpdated {
+				utils.AssertCorrectString(t, string(tt.content), string(got))
+			} else {
+				utils.AssertCorrectString(t, "old", string(got))
+			}
+
+			if tt.wantWarning != "" &&
+				!strings.Contains(strings.Join(testApp.warnings, "\n"), tt.wantWarning) {
+				t.Errorf("expected a warning containing %q, got %v",
+					tt.wantWarning, testApp.warnings)
+			}
+		})
+	}
+}
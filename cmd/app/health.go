@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+const (
+	// Layout of the timestamps the xray log lines start with
+	xrayLogTimeLayout = "2006/01/02 15:04:05"
+	// Only the tail of the log file is searched for the fatal errors
+	healthLogTailSize = 1 << 20
+)
+
+// HealthCheck verifies the xray service beyond it being active after every
+// restart, reload or outbound replacement
+type HealthCheck struct {
+	// How long the service shall stay active without fatal errors in its log
+	SettlePeriod time.Duration `koanf:"settle_period"`
+	// Makes sure every inbound accepts TCP connections
+	Inbounds bool `koanf:"inbounds"`
+	// Log of xray watched along with the one of the service manager, e.g. the
+	// error log of the server config. Relative to the workdir unless absolute.
+	LogFile string `koanf:"log_file"`
+	// Substrings of the log lines which mean that xray is broken
+	FatalPatterns []string `koanf:"fatal_patterns"`
+	// Requests the url through every inbound the verification client supports
+	ProxyRequests bool   `koanf:"proxy_requests"`
+	RequestURL    string `koanf:"request_url"`
+}
+
+func validateHealthCheck(hc HealthCheck) error {
+	if hc.SettlePeriod < 0 {
+		return fmt.Errorf("the settle period of the health check cannot be negative")
+	}
+	if hc.ProxyRequests && hc.RequestURL == "" {
+		return fmt.Errorf("the health check with the proxy requests shall have the request_url")
+	}
+	return nil
+}
+
+// Address of an inbound the health check connects to
+type inboundTarget struct {
+	tag     string
+	address string
+	err     error
+}
+
+// Returns the TCP addresses of the inbounds, reached via the loopback if they
+// listen on all the interfaces
+func inboundTargets(config *ServerConfig) []inboundTarget {
+	var targets []inboundTarget
+	for _, inbound := range config.Inbounds {
+		// Unix sockets and the UDP only inbounds are not checked
+		if inbound.Port == 0 || strings.HasPrefix(inbound.Listen, "/") ||
+			strings.HasPrefix(inbound.Listen, "@") {
+			continue
+		}
+		if inbound.Settings.Network != "" && !strings.Contains(inbound.Settings.Network, "tcp") {
+			continue
+		}
+		host := inbound.Listen
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "127.0.0.1"
+		}
+		targets = append(targets, inboundTarget{
+			tag:     inbound.Tag,
+			address: net.JoinHostPort(host, strconv.Itoa(inbound.Port)),
+		})
+	}
+	return targets
+}
+
+// Connects to the inbounds and returns the ones which have not accepted
+func dialInbounds(ctx context.Context, targets []inboundTarget) []inboundTarget {
+	var failed []inboundTarget
+	dialer := net.Dialer{Timeout: time.Second}
+	for _, target := range targets {
+		conn, err := dialer.DialContext(ctx, "tcp", target.address)
+		if err != nil {
+			target.err = err
+			failed = append(failed, target)
+			continue
+		}
+		conn.Close()
+	}
+	return failed
+}
+
+// Returns the lines of the log file written since the time. The lines without
+// a timestamp of their own belong to the last timestamped one.
+func readLogSince(path string, since time.Time) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil && info.Size() > healthLogTailSize {
+		if _, err := f.Seek(-healthLogTailSize, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+
+	since = since.Truncate(time.Second)
+	var lines []string
+	recent := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) >= len(xrayLogTimeLayout) {
+			if t, err := time.ParseInLocation(xrayLogTimeLayout, line[:len(xrayLogTimeLayout)], time.Local); err == nil {
+				recent = !t.Before(since)
+			}
+		}
+		if recent {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// Returns the lines of the logs of xray written since the time which match
+// any of the fatal patterns
+func (app *Application) fatalLogLines(ctx context.Context, since time.Time) []string {
+	hc := app.xray.Server.HealthCheck
+	if len(hc.FatalPatterns) == 0 {
+		return nil
+	}
+
+	var lines []string
+	logs, err := app.xrayService.Logs(ctx, since)
+	if err == nil {
+		lines = strings.Split(logs, "\n")
+	} else if !errors.Is(err, utils.ErrNoServiceLogs) {
+		app.logger.Warning.Printf("Failed to read the log of %s: %v\n",
+			app.xrayService.Name(), err)
+	}
+	if hc.LogFile != "" {
+		fileLines, err := readLogSince(providerFilePath(app.workdir, hc.LogFile), since)
+		if err != nil && !os.IsNotExist(err) {
+			app.logger.Warning.Printf("Failed to read the xray log file: %v\n", err)
+		}
+		lines = append(lines, fileLines...)
+	}
+
+	var fatal []string
+	for _, line := range lines {
+		for _, pattern := range hc.FatalPatterns {
+			if strings.Contains(line, pattern) {
+				fatal = append(fatal, strings.TrimSpace(line))
+				break
+			}
+		}
+	}
+	return fatal
+}
+
+// Attaches the logs of xray written since the time to the message: the one of
+// the service manager and the log files of the health check and the server config
+func (app *Application) attachXrayLogs(ctx context.Context, since time.Time) {
+	if app.logLines <= 0 {
+		return
+	}
+	logs, err := app.xrayService.Logs(ctx, since)
+	if err == nil {
+		app.attach(fmt.Sprintf("Log of %s", app.xrayService.Name()), logs)
+	} else if !errors.Is(err, utils.ErrNoServiceLogs) {
+		app.logger.Warning.Printf("Failed to read the log of %s: %v\n",
+			app.xrayService.Name(), err)
+	}
+
+	var paths []string
+	if hc := app.xray.Server.HealthCheck; hc.LogFile != "" {
+		paths = append(paths, hc.LogFile)
+	}
+	var config ServerConfig
+	if err := utils.ParseJSONFile(app.xray.Server.ConfigFilePath, &config, false); err == nil {
+		paths = append(paths, config.Log.Error, config.Log.Access)
+	}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		// xray does not log at all with none
+		if path == "" || path == "none" {
+			continue
+		}
+		path = providerFilePath(app.workdir, path)
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		lines, err := readLogSince(path, since)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				app.logger.Warning.Printf("Failed to read the xray log file: %v\n", err)
+			}
+			continue
+		}
+		app.attach(path, strings.Join(lines, "\n"))
+	}
+}
+
+// Requests the url through every inbound of the protocol the verification
+// client supports
+func (app *Application) checkInboundRequests(ctx context.Context, config *ServerConfig) error {
+	xray := app.xray
+	// The existing proxy leads through one inbound only
+	xray.Client.ProxyURL = ""
+
+	var errs utils.Errors
+	for _, inbound := range config.Inbounds {
+		if inbound.Protocol != xray.Client.ServerProtocol {
+			continue
+		}
+		clientConfig := getInboundClientConfig(&xray.Client, &xray.Server, inbound)
+		if err := prepareClientConfig(clientConfig, xray.Client); err != nil {
+			return err
+		}
+
+		err := func() error {
+			clientCtx, cancel := context.WithTimeout(ctx, 5*time.Second+ipCheckerTimeout)
+			defer cancel()
+			proxy, stopClient, err := app.openVerificationProxy(clientCtx, xray, clientConfig)
+			if err != nil {
+				return err
+			}
+			defer stopClient()
+			_, err = utils.GetRequestWithProxy(clientCtx, xray.Server.HealthCheck.RequestURL, proxy)
+			return err
+		}()
+		if err != nil {
+			errs.Append(fmt.Errorf("the request through the inbound %s has failed: %w",
+				inbound.Tag, err))
+		}
+	}
+	if !errs.IsEmpty() {
+		return errs
+	}
+	return nil
+}
+
+// Makes sure the xray service stays active through the settle period without
+// fatal errors in its log since the time, its inbounds accept the connections
+// and, if configured, pass the requests
+func (app *Application) checkXrayHealth(ctx context.Context, since time.Time) error {
+	hc := app.xray.Server.HealthCheck
+	if hc.SettlePeriod == 0 && !hc.Inbounds && !hc.ProxyRequests && len(hc.FatalPatterns) == 0 {
+		return nil
+	}
+
+	var config ServerConfig
+	if err := utils.ParseJSONFile(app.xray.Server.ConfigFilePath, &config, false); err != nil {
+		return fmt.Errorf("failed to parse the xray server config for the health check: %w", err)
+	}
+	var pending []inboundTarget
+	if hc.Inbounds {
+		pending = inboundTargets(&config)
+	}
+
+	app.logger.Info.Printf("Checking the health of %s for %s...\n",
+		app.xrayService.Name(), hc.SettlePeriod)
+	deadline := time.Now().Add(hc.SettlePeriod)
+	for {
+		active, err := app.xrayService.IsActive(ctx)
+		if err != nil {
+			return err
+		}
+		if !active {
+			return fmt.Errorf("%s has stopped within %s after the start", app.xrayService.Name(),
+				time.Since(since).Round(time.Second))
+		}
+		if fatal := app.fatalLogLines(ctx, since); len(fatal) > 0 {
+			return fmt.Errorf("the log of %s has fatal errors: %s", app.xrayService.Name(),
+				strings.Join(fatal, "; "))
+		}
+		pending = dialInbounds(ctx, pending)
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(min(wait, time.Second)):
+		}
+	}
+
+	if len(pending) > 0 {
+		var failed []string
+		for _, target := range pending {
+			failed = append(failed, fmt.Sprintf("%s (%s): %v", target.tag, target.address, target.err))
+		}
+		return fmt.Errorf("some inbounds do not accept the connections: %s",
+			strings.Join(failed, "; "))
+	}
+
+	if hc.ProxyRequests {
+		app.logger.Info.Println("Requesting through every inbound of the xray server...")
+		if err := app.checkInboundRequests(ctx, &config); err != nil {
+			return err
+		}
+	}
+	app.logger.Info.Printf("%s is healthy.\n", app.xrayService.Name())
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// Service which reports the preset state and logs and only counts the restarts
+type fakeService struct {
+	active   bool
+	logs     string
+	restarts int
+}
+
+func (s *fakeService) Name() string { return "xray.service" }
+func (s *fakeService) Restart(ctx context.Context) error {
+	s.restarts++
+	return nil
+}
+func (s *fakeService) Reload(ctx context.Context) error { return nil }
+func (s *fakeService) IsActive(ctx context.Context) (bool, error) {
+	return s.active, nil
+}
+func (s *fakeService) Logs(ctx context.Context, since time.Time) (string, error) {
+	if s.logs == "" {
+		return "", utils.ErrNoServiceLogs
+	}
+	return s.logs, nil
+}
+
+func TestInboundTargets(t *testing.T) {
+	config := &ServerConfig{Inbounds: []SrvInbound{
+		{Tag: "all", Port: 443},
+		{Tag: "v6", Port: 8443, Listen: "::"},
+		{Tag: "local", Port: 1080, Listen: "127.0.0.2", Settings: SrvInbSettings{Network: "tcp,udp"}},
+		{Tag: "udp", Port: 53, Settings: SrvInbSettings{Network: "udp"}},
+		{Tag: "socket", Listen: "/run/xray.sock"},
+	}}
+
+	var got []string
+	for _, target := range inboundTargets(config) {
+		got = append(got, target.tag+"="+target.address)
+	}
+	utils.AssertCorrectString(t, "all=127.0.0.1:443 v6=127.0.0.1:8443 local=127.0.0.2:1080",
+		strings.Join(got, " "))
+}
+
+func TestReadLogSince(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "error.log")
+	log := "2025/01/01 11:59:59 [Warning] old\n" +
+		"2025/01/01 12:00:00.123456 [Error] Failed to start: new\n" +
+		"goroutine 1 [running]:\n" +
+		"2025/01/01 12:00:05 [Info] newer\n"
+	utils.AssertNoError(t, os.WriteFile(path, []byte(log), 0644))
+
+	lines, err := readLogSince(path, time.Date(2025, 1, 1, 12, 0, 0, 500, time.Local))
+	utils.AssertNoError(t, err)
+	utils.AssertCorrectInt(t, 3, len(lines))
+	utils.AssertCorrectString(t, "goroutine 1 [running]:", lines[1])
+
+	_, err = readLogSince(filepath.Join(t.TempDir(), "absent.log"), time.Now())
+	utils.AssertError(t, err)
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	utils.AssertNoError(t, validateHealthCheck(HealthCheck{SettlePeriod: time.Second, Inbounds: true}))
+	utils.AssertErrorContains(t, validateHealthCheck(HealthCheck{SettlePeriod: -time.Second}), "cannot be negative")
+	utils.AssertErrorContains(t, validateHealthCheck(HealthCheck{ProxyRequests: true}), "shall have the request_url")
+}
+
+func TestCheckXrayHealth(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.AssertNoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	listening := listener.Addr().(*net.TCPAddr).Port
+	closed := freePort(t)
+
+	tests := []struct {
+		name    string
+		service *fakeService
+		ports   []int
+		logFile string
+		errMsg  string
+	}{
+		{name: "healthy", service: &fakeService{active: true, logs: "started\n"}, ports: []int{listening}},
+		{name: "stopped", service: &fakeService{}, errMsg: "xray.service has stopped"},
+		{
+			name:    "fatal error in the journal",
+			service: &fakeService{active: true, logs: "started\npanic: runtime error\n"},
+			errMsg:  "the log of xray.service has fatal errors: panic: runtime error",
+		},
+		{
+			name:    "fatal error in the log file",
+			service: &fakeService{active: true},
+			logFile: time.Now().Format(xrayLogTimeLayout) + " [Error] Failed to start: bad config\n",
+			errMsg:  "[Error] Failed to start: bad config",
+		},
+		{
+			name:    "inbound does not accept",
+			service: &fakeService{active: true},
+			ports:   []int{listening, closed},
+			errMsg:  "some inbounds do not accept the connections: in-1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workdir := t.TempDir()
+			var config ServerConfig
+			for i, port := range tt.ports {
+				config.Inbounds = append(config.Inbounds, SrvInbound{Tag: "in-" + strconv.Itoa(i), Port: port})
+			}
+			configPath := filepath.Join(workdir, "config.json")
+			utils.AssertNoError(t, utils.WriteStructToJSONFile(&config, configPath))
+			if tt.logFile != "" {
+				utils.AssertNoError(t, os.WriteFile(filepath.Join(workdir, "error.log"), []byte(tt.logFile), 0644))
+			}
+
+			app := &Application{
+				logger:      GetLogger(false),
+				workdir:     workdir,
+				xrayService: tt.service,
+				xray: Xray{Server: XrayServer{
+					ConfigFilePath: configPath,
+					HealthCheck: HealthCheck{
+						SettlePeriod:  100 * time.Millisecond,
+						Inbounds:      true,
+						LogFile:       "error.log",
+						FatalPatterns: []string{"Failed to start", "panic:"},
+					},
+				}},
+			}
+			err := app.checkXrayHealth(context.Background(), time.Now().Add(-time.Second))
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		app := &Application{xrayService: &fakeService{}}
+		utils.AssertNoError(t, app.checkXrayHealth(context.Background(), time.Now()))
+	})
+}
+
+func TestAttachXrayLogs(t *testing.T) {
+	workdir := t.TempDir()
+	now := time.Now().Format(xrayLogTimeLayout)
+	errorLog := "2020/01/01 00:00:00 [Error] old\n" +
+		now + " [Error] first\n" + now + " [Error] second\n" + now + " [Error] third\n"
+	utils.AssertNoError(t, os.WriteFile(filepath.Join(workdir, "error.log"), []byte(errorLog), 0644))
+	configPath := filepath.Join(workdir, "config.json")
+	utils.AssertNoError(t, utils.WriteStructToJSONFile(&ServerConfig{
+		Log: Log{Loglevel: "warning", Error: "error.log", Access: "none"},
+	}, configPath))
+
+	app := &Application{
+		logger:      GetLogger(false),
+		workdir:     workdir,
+		xrayService: &fakeService{logs: "started\npanic: runtime error\n"},
+		xray: Xray{Server: XrayServer{
+			ConfigFilePath: configPath,
+			// The same file is attached once
+			HealthCheck: HealthCheck{LogFile: filepath.Join(workdir, "error.log")},
+		}},
+		logLines: 2,
+	}
+	app.attachXrayLogs(context.Background(), time.Now().Add(-time.Second))
+
+	utils.AssertCorrectInt(t, 2, len(app.attachments))
+	utils.AssertCorrectString(t, "Log of xray.service", app.attachments[0].Name)
+	utils.AssertCorrectString(t, "started\npanic: runtime error", app.attachments[0].Content)
+	utils.AssertCorrectString(t, filepath.Join(workdir, "error.log"), app.attachments[1].Name)
+	utils.AssertCorrectString(t, now+" [Error] second\n"+now+" [Error] third",
+		app.attachments[1].Content)
+
+	t.Run("disabled", func(t *testing.T) {
+		app.attachments, app.logLines = nil, 0
+		app.attachXrayLogs(context.Background(), time.Now().Add(-time.Second))
+		utils.AssertCorrectInt(t, 0, len(app.attachments))
+	})
+}
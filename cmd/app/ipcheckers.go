@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// Supported formats of the ip checker responses
+const (
+	ipCheckerIPAPI    = "ip-api"
+	ipCheckerIPInfo   = "ipinfo"
+	ipCheckerIfconfig = "ifconfig.co"
+	ipCheckerTrace    = "trace"
+)
+
+// Ways to reach the verdict from the answers of several ip checkers
+const (
+	// All the checkers are queried and the most common answer wins
+	ipCheckerDecisionMajority = "majority"
+	// The checkers are queried in turn until one of them answers definitively
+	ipCheckerDecisionFirst = "first"
+)
+
+// Timeout of a single request to an ip checker
+const ipCheckerTimeout = 5 * time.Second
+
+// Cloudflare's autonomous system which the warp traffic egresses from
+const cloudflareASN = "13335"
+
+// IPChecker is a service reporting the address the request comes from
+type IPChecker struct {
+	// One of "ip-api", "ipinfo", "ifconfig.co" or "trace"
+	Type string `koanf:"type"`
+	URL  string `koanf:"url"`
+}
+
+// Classifies the response of an ip checker of a certain type
+type ipCheckerAdapter func(body []byte, xrayServerIP string) WarpDiagnosis
+
+var ipCheckerAdapters = map[string]ipCheckerAdapter{
+	ipCheckerIPAPI:    classifyIPCheckerResponse,
+	ipCheckerIPInfo:   classifyIPInfoResponse,
+	ipCheckerIfconfig: classifyIfconfigResponse,
+	ipCheckerTrace:    classifyTraceResponse,
+}
+
+// Makes sure every checker has a known type and a URL
+func validateIPCheckers(client XrayClient) error {
+	if len(client.IPCheckers) == 0 {
+		return errors.New("no ip checkers have been configured")
+	}
+	for i, c := range client.IPCheckers {
+		if _, ok := ipCheckerAdapters[c.Type]; !ok {
+			return fmt.Errorf("unknown type %q of ip checker #%d: only %s are "+
+				"supported", c.Type, i+1, strings.Join([]string{ipCheckerIPAPI,
+				ipCheckerIPInfo, ipCheckerIfconfig, ipCheckerTrace}, ", "))
+		}
+		if c.URL == "" {
+			return fmt.Errorf("ip checker #%d (%s) has no url", i+1, c.Type)
+		}
+	}
+	for name, c := range map[string]IPChecker{familyIPv4: client.FamilyCheckers.IPv4,
+		familyIPv6: client.FamilyCheckers.IPv6} {
+		if _, ok := ipCheckerAdapters[c.Type]; c.URL != "" && !ok {
+			return fmt.Errorf("unknown type %q of the %s family checker", c.Type, name)
+		}
+	}
+	switch client.IPCheckerDecision {
+	case ipCheckerDecisionMajority, ipCheckerDecisionFirst:
+	default:
+		return fmt.Errorf("unknown ip checker decision %q: only %s and %s are "+
+			"supported", client.IPCheckerDecision, ipCheckerDecisionMajority,
+			ipCheckerDecisionFirst)
+	}
+	return nil
+}
+
+// Classifies the egress reported by a checker
+func classifyEgress(ip string, provider string, cloudflare bool, xrayServerIP string) WarpDiagnosis {
+	d := WarpDiagnosis{Status: WarpOK, EgressIP: ip}
+	switch {
+	case ip == xrayServerIP:
+		d.Status = WarpEgressServerIP
+		d.Err = fmt.Errorf("ip address detected by the ip checker is %s which is "+
+			"the address of the xray server machine", ip)
+	case !cloudflare:
+		d.Status = WarpEgressNotCloudflare
+		d.Err = fmt.Errorf("ip checker could not detect Cloudflare as the provider "+
+			"of %s: %s", ip, provider)
+	}
+	return d
+}
+
+func isCloudflare(provider string) bool {
+	provider = strings.ToLower(provider)
+	return strings.Contains(provider, "cloudflare") || strings.Contains(provider, "as"+cloudflareASN)
+}
+
+// Classifies the response of ipinfo.io/json
+func classifyIPInfoResponse(body []byte, xrayServerIP string) WarpDiagnosis {
+	var r struct {
+		IP  string `json:"ip"`
+		Org string `json:"org"`
+	}
+	if err := utils.ParseJSON(body, &r, false); err != nil || r.IP == "" {
+		return WarpDiagnosis{Status: WarpCheckerUnavailable, Err: fmt.Errorf("unexpected "+
+			"response of ipinfo: %q", truncate(string(body), 200))}
+	}
+	return classifyEgress(r.IP, r.Org, isCloudflare(r.Org), xrayServerIP)
+}
+
+// Classifies the response of ifconfig.co/json
+func classifyIfconfigResponse(body []byte, xrayServerIP string) WarpDiagnosis {
+	var r struct {
+		IP     string `json:"ip"`
+		ASN    string `json:"asn"`
+		ASNOrg string `json:"asn_org"`
+	}
+	if err := utils.ParseJSON(body, &r, false); err != nil || r.IP == "" {
+		return WarpDiagnosis{Status: WarpCheckerUnavailable, Err: fmt.Errorf("unexpected "+
+			"response of ifconfig.co: %q", truncate(string(body), 200))}
+	}
+	provider := strings.TrimSpace(r.ASN + " " + r.ASNOrg)
+	return classifyEgress(r.IP, provider, isCloudflare(provider), xrayServerIP)
+}
+
+// CloudflareTrace is the response of Cloudflare's /cdn-cgi/trace
+type CloudflareTrace struct {
+	// Address the request has come from
+	IP string
+	// Cloudflare data center that has served the request
+	Colo string
+	// Country of the address
+	Loc string
+	// "on" or "plus" if the request has come through warp, "off" otherwise
+	Warp string
+	// All the key=value pairs of the trace
+	Fields map[string]string
+}
+
+// Parses the key=value lines of the trace
+func parseCloudflareTrace(body []byte) (CloudflareTrace, error) {
+	trace := CloudflareTrace{Fields: make(map[string]string)}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return trace, fmt.Errorf("invalid trace line %q", truncate(line, 100))
+		}
+		trace.Fields[key] = value
+	}
+
+	trace.IP = trace.Fields["ip"]
+	trace.Colo = trace.Fields["colo"]
+	trace.Loc = trace.Fields["loc"]
+	trace.Warp = trace.Fields["warp"]
+
+	if trace.IP == "" || trace.Warp == "" {
+		return trace, errors.New("the trace has no ip or warp field")
+	}
+	return trace, nil
+}
+
+// Classifies the response of Cloudflare's /cdn-cgi/trace, which tells directly
+// whether the request has come through warp
+func classifyTraceResponse(body []byte, xrayServerIP string) WarpDiagnosis {
+	trace, err := parseCloudflareTrace(body)
+	if err != nil {
+		return WarpDiagnosis{Status: WarpCheckerUnavailable, Err: fmt.Errorf("unexpected "+
+			"response of the trace: %w", err)}
+	}
+	d := classifyEgress(trace.IP, "warp="+trace.Warp, trace.Warp == "on" || trace.Warp == "plus", xrayServerIP)
+	d.Colo = trace.Colo
+	return d
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// Answer of a single ip checker
+type ipCheckerResult struct {
+	checker   IPChecker
+	diagnosis WarpDiagnosis
+	// Set if the checker could not be requested through the proxy at all
+	requestErr error
+}
+
+func (r ipCheckerResult) definitive() bool {
+	return r.requestErr == nil && r.diagnosis.Status != WarpCheckerUnavailable
+}
+
+func queryIPChecker(ctx context.Context, checker IPChecker, proxy *utils.Proxy, xrayServerIP string) ipCheckerResult {
+	ctx, cancel := context.WithTimeout(ctx, ipCheckerTimeout)
+	defer cancel()
+
+	result := ipCheckerResult{checker: checker}
+	body, err := utils.GetRequestWithProxy(ctx, checker.URL, proxy)
+	if err != nil {
+		result.requestErr = err
+		result.diagnosis = WarpDiagnosis{Status: WarpCheckerUnavailable, Err: err}
+		return result
+	}
+	result.diagnosis = ipCheckerAdapters[checker.Type](body, xrayServerIP)
+	return result
+}
+
+// Queries the checkers through the proxy according to the decision
+func queryIPCheckers(ctx context.Context, checkers []IPChecker, decision string, proxy *utils.Proxy, xrayServerIP string) []ipCheckerResult {
+	results := make([]ipCheckerResult, len(checkers))
+
+	if decision == ipCheckerDecisionFirst {
+		for i, c := range checkers {
+			results[i] = queryIPChecker(ctx, c, proxy, xrayServerIP)
+			if results[i].definitive() {
+				return results[:i+1]
+			}
+		}
+		return results
+	}
+
+	var wg sync.WaitGroup
+	for i, c := range checkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = queryIPChecker(ctx, c, proxy, xrayServerIP)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// Reaches the verdict from the answers of the checkers: the most common
+// definitive answer wins, a tie is resolved in favour of the checker listed
+// first. Returns false if none of the checkers could be requested through
+// the proxy, in which case the verdict is left to diagnoseRequestFailure.
+func decideWarpStatus(results []ipCheckerResult) (WarpDiagnosis, bool) {
+	counts := make(map[WarpStatus]int)
+	first := make(map[WarpStatus]WarpDiagnosis)
+	var order []WarpStatus
+	var definitive int
+	var errs utils.Errors
+	requested := false
+
+	for _, r := range results {
+		if r.requestErr == nil {
+			requested = true
+		}
+		if !r.definitive() {
+			errs.Append(fmt.Errorf("%s: %w", r.checker.Type, r.diagnosis.Err))
+			continue
+		}
+		definitive++
+		if counts[r.diagnosis.Status] == 0 {
+			order = append(order, r.diagnosis.Status)
+			first[r.diagnosis.Status] = r.diagnosis
+		}
+		counts[r.diagnosis.Status]++
+	}
+
+	if !requested {
+		return WarpDiagnosis{Status: WarpCheckerUnavailable, Err: errs}, false
+	}
+	if definitive == 0 {
+		return WarpDiagnosis{Status: WarpCheckerUnavailable, Err: fmt.Errorf("none "+
+			"of the ip checkers provided a definitive answer: %w", errs)}, true
+	}
+
+	best := order[0]
+	for _, s := range order[1:] {
+		if counts[s] > counts[best] {
+			best = s
+		}
+	}
+
+	diagnosis := first[best]
+	// Not every checker reports the egress details
+	for _, r := range results {
+		if !r.definitive() || r.diagnosis.Status != best {
+			continue
+		}
+		if diagnosis.EgressIP == "" {
+			diagnosis.EgressIP = r.diagnosis.EgressIP
+		}
+		if diagnosis.Colo == "" {
+			diagnosis.Colo = r.diagnosis.Colo
+		}
+	}
+	if diagnosis.Err != nil && definitive > 1 {
+		diagnosis.Err = fmt.Errorf("%w (%d of %d checkers agree)", diagnosis.Err,
+			counts[best], definitive)
+	}
+	return diagnosis, true
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestIPCheckerAdapters(t *testing.T) {
+	tests := []struct {
+		name     string
+		checker  string
+		response string
+		status   WarpStatus
+	}{
+		{"ipinfo cloudflare", ipCheckerIPInfo, `{"ip": "104.28.1.1", "org": "AS13335 Cloudflare, Inc."}`, WarpOK},
+		{"ipinfo server ip", ipCheckerIPInfo, `{"ip": "1.2.3.4", "org": "AS24940 Hetzner Online GmbH"}`, WarpEgressServerIP},
+		{"ipinfo other provider", ipCheckerIPInfo, `{"ip": "5.6.7.8", "org": "AS24940 Hetzner Online GmbH"}`, WarpEgressNotCloudflare},
+		{"ipinfo rate limited", ipCheckerIPInfo, `{"status": 429, "error": {"title": "Rate limit exceeded"}}`, WarpCheckerUnavailable},
+		{"ifconfig cloudflare", ipCheckerIfconfig, `{"ip": "104.28.1.1", "asn": "AS13335", "asn_org": "CLOUDFLARENET"}`, WarpOK},
+		{"ifconfig other provider", ipCheckerIfconfig, `{"ip": "5.6.7.8", "asn": "AS24940", "asn_org": "Hetzner Online GmbH"}`, WarpEgressNotCloudflare},
+		{"ifconfig invalid", ipCheckerIfconfig, `not json`, WarpCheckerUnavailable},
+		{"trace warp on", ipCheckerTrace, "fl=1\nip=104.28.1.1\ncolo=FRA\nwarp=on\n", WarpOK},
+		{"trace warp plus", ipCheckerTrace, "ip=104.28.1.1\nwarp=plus\n", WarpOK},
+		{"trace warp off", ipCheckerTrace, "ip=5.6.7.8\nwarp=off\n", WarpEgressNotCloudflare},
+		{"trace server ip", ipCheckerTrace, "ip=1.2.3.4\nwarp=off\n", WarpEgressServerIP},
+		{"trace without warp", ipCheckerTrace, "ip=5.6.7.8\n", WarpCheckerUnavailable},
+		{"ip-api cloudflare", ipCheckerIPAPI, `{"status": "success", "isp": "Cloudflare", "org": "Cloudflare", "query": "104.28.1.1"}`, WarpOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := ipCheckerAdapters[tt.checker]([]byte(tt.response), "1.2.3.4")
+			utils.AssertCorrectString(t, tt.status.String(), d.Status.String())
+		})
+	}
+}
+
+func TestParseCloudflareTrace(t *testing.T) {
+	body := "fl=29f123\nh=www.cloudflare.com\nip=104.28.1.1\nts=1700000000.123\n" +
+		"visit_scheme=https\nuag=Go-http-client/1.1\ncolo=FRA\nsliver=none\n" +
+		"http=http/1.1\nloc=DE\ntls=TLSv1.3\nsni=plaintext\nwarp=plus\ngateway=off\n" +
+		"rbi=off\nkex=X25519\n"
+
+	trace, err := parseCloudflareTrace([]byte(body))
+	utils.AssertNoError(t, err)
+	utils.AssertCorrectString(t, "104.28.1.1", trace.IP)
+	utils.AssertCorrectString(t, "FRA", trace.Colo)
+	utils.AssertCorrectString(t, "DE", trace.Loc)
+	utils.AssertCorrectString(t, "plus", trace.Warp)
+	utils.AssertCorrectString(t, "X25519", trace.Fields["kex"])
+
+	d := classifyTraceResponse([]byte(body), "1.2.3.4")
+	utils.AssertCorrectString(t, WarpOK.String(), d.Status.String())
+	utils.AssertCorrectString(t, "104.28.1.1 via the Cloudflare FRA data center", d.Egress())
+
+	_, err = parseCloudflareTrace([]byte("<html>blocked</html>"))
+	utils.AssertErrorContains(t, err, "invalid trace line")
+
+	_, err = parseCloudflareTrace([]byte("ip=104.28.1.1\ncolo=FRA\n"))
+	utils.AssertErrorContains(t, err, "no ip or warp field")
+}
+
+func TestValidateIPCheckers(t *testing.T) {
+	valid := []IPChecker{{Type: ipCheckerTrace, URL: "https://www.cloudflare.com/cdn-cgi/trace"}}
+
+	tests := []struct {
+		name   string
+		client XrayClient
+		errMsg string
+	}{
+		{"valid", XrayClient{IPCheckers: valid, IPCheckerDecision: ipCheckerDecisionFirst}, ""},
+		{"no checkers", XrayClient{IPCheckerDecision: ipCheckerDecisionMajority}, "no ip checkers"},
+		{"unknown type", XrayClient{IPCheckers: []IPChecker{{Type: "whatismyip", URL: "http://x"}},
+			IPCheckerDecision: ipCheckerDecisionMajority}, `unknown type "whatismyip"`},
+		{"no url", XrayClient{IPCheckers: []IPChecker{{Type: ipCheckerTrace}},
+			IPCheckerDecision: ipCheckerDecisionMajority}, "has no url"},
+		{"unknown decision", XrayClient{IPCheckers: valid, IPCheckerDecision: "all"}, `unknown ip checker decision "all"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateIPCheckers(tt.client)
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestDecideWarpStatus(t *testing.T) {
+	result := func(status WarpStatus) ipCheckerResult {
+		var err error
+		if status != WarpOK {
+			err = errors.New(status.String())
+		}
+		return ipCheckerResult{checker: IPChecker{Type: "test"}, diagnosis: WarpDiagnosis{Status: status, Err: err}}
+	}
+	requestFailed := ipCheckerResult{
+		checker:    IPChecker{Type: "test"},
+		diagnosis:  WarpDiagnosis{Status: WarpCheckerUnavailable, Err: errors.New("timeout")},
+		requestErr: errors.New("timeout"),
+	}
+
+	tests := []struct {
+		name      string
+		results   []ipCheckerResult
+		status    WarpStatus
+		requested bool
+	}{
+		{"majority is ok", []ipCheckerResult{result(WarpEgressNotCloudflare), result(WarpOK), result(WarpOK)}, WarpOK, true},
+		{"majority is not cloudflare", []ipCheckerResult{result(WarpOK), result(WarpEgressNotCloudflare), result(WarpEgressNotCloudflare)}, WarpEgressNotCloudflare, true},
+		{"tie goes to the first checker", []ipCheckerResult{result(WarpEgressServerIP), result(WarpOK)}, WarpEgressServerIP, true},
+		{"unavailable checkers are ignored", []ipCheckerResult{result(WarpCheckerUnavailable), requestFailed, result(WarpOK)}, WarpOK, true},
+		{"no definitive answer", []ipCheckerResult{result(WarpCheckerUnavailable), requestFailed}, WarpCheckerUnavailable, true},
+		{"no checker requested", []ipCheckerResult{requestFailed, requestFailed}, WarpCheckerUnavailable, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, requested := decideWarpStatus(tt.results)
+			utils.AssertCorrectString(t, tt.status.String(), d.Status.String())
+			if requested != tt.requested {
+				t.Errorf("Expected requested to be %v, got %v", tt.requested, requested)
+			}
+		})
+	}
+}
+
+func TestQueryIPCheckers(t *testing.T) {
+	var requests atomic.Int32
+	newChecker := func(checkerType string, status int, body string) IPChecker {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+		}))
+		t.Cleanup(server.Close)
+		return IPChecker{Type: checkerType, URL: server.URL}
+	}
+
+	rateLimited := newChecker(ipCheckerIPAPI, http.StatusTooManyRequests, "")
+	trace := newChecker(ipCheckerTrace, http.StatusOK, "ip=104.28.1.1\ncolo=AMS\nwarp=on\n")
+	ipinfo := newChecker(ipCheckerIPInfo, http.StatusOK, `{"ip": "104.28.1.1", "org": "AS13335 Cloudflare, Inc."}`)
+	checkers := []IPChecker{rateLimited, trace, ipinfo}
+
+	t.Run("first definitive answer", func(t *testing.T) {
+		requests.Store(0)
+		results := queryIPCheckers(context.Background(), checkers, ipCheckerDecisionFirst, nil, "1.2.3.4")
+		utils.AssertCorrectInt(t, 2, len(results))
+		utils.AssertCorrectInt(t, 2, int(requests.Load()))
+		d, _ := decideWarpStatus(results)
+		utils.AssertCorrectString(t, WarpOK.String(), d.Status.String())
+	})
+
+	t.Run("majority", func(t *testing.T) {
+		requests.Store(0)
+		results := queryIPCheckers(context.Background(), checkers, ipCheckerDecisionMajority, nil, "1.2.3.4")
+		utils.AssertCorrectInt(t, 3, len(results))
+		utils.AssertCorrectInt(t, 3, int(requests.Load()))
+		if results[0].requestErr == nil {
+			t.Error("Expected the rate limited checker to fail")
+		}
+		d, requested := decideWarpStatus(results)
+		utils.AssertCorrectString(t, WarpOK.String(), d.Status.String())
+		utils.AssertCorrectString(t, "104.28.1.1 via the Cloudflare AMS data center", d.Egress())
+		if !requested {
+			t.Error("Expected some checkers to have been requested")
+		}
+	})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+const (
+	// Keeps a single instance of the app running on the workdir
+	lockFileName = "xray-maintainer.lock"
+	// Records the operations in progress, so that the run following a crash can
+	// complete or roll them back
+	journalFileName = "journal.json"
+)
+
+// Kinds of the operations recorded in the journal
+const (
+	operationFileUpdate   = "file_update"
+	operationServerConfig = "server_config"
+)
+
+// Stages of an operation
+const (
+	// The new file is being put in place and checked
+	stageReplacing = "replacing"
+	// The xray service is being restarted, reloaded or updated through the API
+	// with the new file
+	stageApplying = "applying"
+)
+
+// Operation is a replacement of a file in progress
+type Operation struct {
+	Kind  string `json:"kind"`
+	Stage string `json:"stage"`
+	// The file being replaced and its backup, none if there was no file before.
+	// The backup is made after the operation is recorded, so it may be missing.
+	Path   string `json:"path"`
+	Backup string `json:"backup,omitempty"`
+	// Other files the operation may replace, backed up alongside with the
+	// .backup suffix
+	Extras    []string  `json:"extras,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Journal is the contents of the journal file in the workdir, the operations
+// are keyed by the path
+type Journal struct {
+	Operations map[string]*Operation `json:"operations"`
+}
+
+func loadJournal(path string) (*Journal, error) {
+	journal := &Journal{}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read the journal: %w", err)
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, journal); err != nil {
+			return nil, fmt.Errorf("failed to parse the journal: %w", err)
+		}
+	}
+	if journal.Operations == nil {
+		journal.Operations = make(map[string]*Operation)
+	}
+	return journal, nil
+}
+
+// Changes the journal with the function and writes it atomically
+func (app *Application) updateJournal(change func(j *Journal)) error {
+	path := filepath.Join(app.workdir, journalFileName)
+	journal, err := loadJournal(path)
+	if err != nil {
+		return err
+	}
+	change(journal)
+	if len(journal.Operations) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove the journal: %w", err)
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomically(path, bytes.NewReader(data), 0644)
+}
+
+// Records the operation before anything is changed
+func (app *Application) beginOperation(op Operation) error {
+	op.Stage = stageReplacing
+	op.StartedAt = time.Now().UTC()
+	return app.updateJournal(func(j *Journal) {
+		j.Operations[op.Path] = &op
+	})
+}
+
+// Records the stage the operation on the path has reached. The journal is only
+// a safety net, so the failure to write it is not fatal.
+func (app *Application) setOperationStage(path, stage string) {
+	err := app.updateJournal(func(j *Journal) {
+		if op, ok := j.Operations[path]; ok {
+			op.Stage = stage
+		}
+	})
+	if err != nil {
+		app.logger.Warning.Printf("Failed to record the stage of the operation on %s: %v\n",
+			path, err)
+	}
+}
+
+// Records the other files the operation on the path replaces once they are
+// known, before they are backed up
+func (app *Application) setOperationExtras(path string, extras []string) {
+	err := app.updateJournal(func(j *Journal) {
+		if op, ok := j.Operations[path]; ok {
+			op.Extras = extras
+		}
+	})
+	if err != nil {
+		app.logger.Warning.Printf("Failed to record the files replaced by the operation "+
+			"on %s: %v\n", path, err)
+	}
+}
+
+// Removes the operation on the path from the journal once it has been completed
+// or rolled back
+func (app *Application) endOperation(path string) {
+	err := app.updateJournal(func(j *Journal) {
+		delete(j.Operations, path)
+	})
+	if err != nil {
+		app.logger.Warning.Printf("Failed to remove the operation on %s from the journal: %v\n",
+			path, err)
+	}
+}
+
+// Reports whether the file update has reached its commit point, i.e. the new
+// file has been recorded in the versions file
+func (app *Application) fileUpdateCommitted(op *Operation) bool {
+	state, err := loadVersionsState(filepath.Join(app.workdir, versionsFileName))
+	if err != nil {
+		return false
+	}
+	fv, ok := state.Files[filepath.Base(op.Path)]
+	if !ok || fv.SHA256 == "" || fv.InstalledAt.Before(op.StartedAt) {
+		return false
+	}
+	checksum, _, err := utils.FileSHA256(op.Path)
+	return err == nil && checksum == fv.SHA256
+}
+
+// Removes the archives the downloaded file could have been renamed to
+func removeArchives(path string) {
+	for format := utils.FormatZip; format <= utils.FormatXz; format++ {
+		_ = os.Remove(path + format.Extension())
+	}
+}
+
+// Completes the operation interrupted after its commit point or rolls it back
+// otherwise. A rolled back operation interrupted while being applied restarts
+// the xray service, since it may be running with the new file.
+func (app *Application) recoverOperation(ctx context.Context, op *Operation) error {
+	name := filepath.Base(op.Path)
+	removeArchives(op.Path)
+
+	if op.Kind == operationFileUpdate && app.fileUpdateCommitted(op) {
+		for _, path := range append(slices.Clone(op.Extras), op.Path) {
+			if err := os.Remove(path + ".backup"); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove the backup of %s: %w", path, err)
+			}
+		}
+		app.endOperation(op.Path)
+		app.note(fmt.Sprintf("The update of %s interrupted by the previous run "+
+			"has been completed.", name))
+		return nil
+	}
+
+	// The server config backup is only removed once the config has been either
+	// applied or restored, so whatever config is in place has to stay
+	configKept := op.Kind == operationServerConfig && op.Backup != "" &&
+		!utils.FileExists(op.Backup)
+
+	for _, path := range op.Extras {
+		backup := path + ".backup"
+		if !utils.FileExists(backup) {
+			continue
+		}
+		if err := os.Rename(backup, path); err != nil {
+			return fmt.Errorf("failed to restore %s from its backup: %w", path, err)
+		}
+	}
+	switch {
+	case op.Backup == "":
+		if err := os.Remove(op.Path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove the new file %s: %w", name, err)
+		}
+	case utils.FileExists(op.Backup):
+		if err := os.Rename(op.Backup, op.Path); err != nil {
+			return fmt.Errorf("failed to restore %s from its backup: %w", name, err)
+		}
+	}
+	// Otherwise the crash came before the backup, so the file is the original one
+
+	outcome := "restored"
+	if configKept {
+		outcome = "kept"
+	}
+	if op.Stage == stageApplying && !app.debug {
+		if err := app.cycleXrayService(ctx, false); err != nil {
+			return fmt.Errorf("%s has been %s, but the xray service is "+
+				"inoperable with it: %w", name, outcome, err)
+		}
+	}
+	app.endOperation(op.Path)
+
+	if configKept {
+		app.warn(fmt.Sprintf("The change of the xray server config was interrupted "+
+			"by the previous run at the %s stage after its backup had been removed, "+
+			"so the config in place has been kept.", op.Stage))
+		return nil
+	}
+	what := "update of " + name
+	if op.Kind == operationServerConfig {
+		what = "change of the xray server config"
+	}
+	app.warn(fmt.Sprintf("The %s was interrupted by the previous run at the %s stage "+
+		"and has been rolled back.", what, op.Stage))
+	return nil
+}
+
+// Deals with the leftovers of a crashed run: the operations of the journal are
+// completed or rolled back, and the files the journal does not account for are
+// cleaned up
+func (app *Application) recoverInterruptedOperations(ctx context.Context, repos []Repo, serverConfigPath string) error {
+	journal, err := loadJournal(filepath.Join(app.workdir, journalFileName))
+	if err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(journal.Operations))
+	for path := range journal.Operations {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+
+	var errs utils.Errors
+	for _, path := range paths {
+		if err := app.recoverOperation(ctx, journal.Operations[path]); err != nil {
+			errs.Append(err)
+		}
+	}
+
+	// The partial files of the atomic writes
+	temps, _ := filepath.Glob(filepath.Join(app.workdir, ".*.tmp"))
+	for _, temp := range temps {
+		_ = os.Remove(temp)
+	}
+
+	state, err := loadVersionsState(filepath.Join(app.workdir, versionsFileName))
+	if err != nil {
+		state = newVersionsState()
+	}
+	for _, repo := range repos {
+		path := filepath.Join(app.workdir, repo.Filename)
+		removeArchives(path)
+		backup := path + ".backup"
+		if !utils.FileExists(backup) {
+			continue
+		}
+		fv := state.Files[repo.Filename]
+		checksum, _, _ := utils.FileSHA256(path)
+		switch {
+		case !utils.FileExists(path):
+			err = os.Rename(backup, path)
+		case fv != nil && fv.SHA256 != "" && checksum == fv.SHA256:
+			// The file is the recorded one, so the backup is of the previous version
+			err = os.Remove(backup)
+		default:
+			app.warn(fmt.Sprintf("%s has been left by an earlier run, and it is unknown "+
+				"whether %s is complete. Both have been left as is.", backup, repo.Filename))
+			continue
+		}
+		if err != nil {
+			errs.Append(fmt.Errorf("failed to clean up %s: %w", backup, err))
+		}
+	}
+	if backup := serverConfigPath + ".backup"; utils.FileExists(backup) {
+		if !utils.FileExists(serverConfigPath) {
+			if err := os.Rename(backup, serverConfigPath); err != nil {
+				errs.Append(fmt.Errorf("failed to restore the xray server config: %w", err))
+			}
+		} else {
+			app.warn(fmt.Sprintf("%s has been left by an earlier run and has been left "+
+				"as is.", backup))
+		}
+	}
+
+	if !errs.IsEmpty() {
+		return errs
+	}
+	return nil
+}
+
+// Takes the lock of the workdir, so that the overlapping runs do not change the
+// same files or start the verification clients at once
+func (app *Application) lockWorkdir() (*utils.FileLock, error) {
+	lock, err := utils.LockFile(filepath.Join(app.workdir, lockFileName))
+	if errors.Is(err, utils.ErrLocked) {
+		return nil, fmt.Errorf("another instance is running on the workdir %s: %w",
+			app.workdir, err)
+	}
+	return lock, err
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestRecoverInterruptedOperations(t *testing.T) {
+	type file struct {
+		path    string
+		content string
+	}
+
+	tests := []struct {
+		name string
+		op   Operation
+		// The new file is recorded in the versions file after the operation start
+		committed bool
+		files     []file
+		expected  []file
+		missing   []string
+		restarts  int
+		message   string
+	}{
+		{
+			name: "partial download is replaced by the backup",
+			op: Operation{Kind: operationFileUpdate, Stage: stageReplacing, Path: "geoip.dat",
+				Backup: "geoip.dat.backup"},
+			files:    []file{{"geoip.dat", "partial"}, {"geoip.dat.backup", "old"}, {"geoip.dat.zip", "archive"}},
+			expected: []file{{"geoip.dat", "old"}},
+			missing:  []string{"geoip.dat.backup", "geoip.dat.zip"},
+			message:  "The update of geoip.dat was interrupted by the previous run at the replacing stage",
+		},
+		{
+			name: "extracted files are restored",
+			op: Operation{Kind: operationFileUpdate, Stage: stageReplacing, Path: "xray",
+				Backup: "xray.backup", Extras: []string{"LICENSE"}},
+			files: []file{{"xray", "new"}, {"xray.backup", "old"}, {"LICENSE", "new license"},
+				{"LICENSE.backup", "old license"}},
+			expected: []file{{"xray", "old"}, {"LICENSE", "old license"}},
+			missing:  []string{"xray.backup", "LICENSE.backup"},
+		},
+		{
+			name:    "new file without a previous one is removed",
+			op:      Operation{Kind: operationFileUpdate, Stage: stageReplacing, Path: "geosite.dat"},
+			files:   []file{{"geosite.dat", "partial"}},
+			missing: []string{"geosite.dat"},
+		},
+		{
+			name: "crash before the backup keeps the file",
+			op: Operation{Kind: operationFileUpdate, Stage: stageReplacing, Path: "geoip.dat",
+				Backup: "geoip.dat.backup"},
+			files:    []file{{"geoip.dat", "old"}},
+			expected: []file{{"geoip.dat", "old"}},
+		},
+		{
+			name: "applied file is rolled back with a restart",
+			op: Operation{Kind: operationFileUpdate, Stage: stageApplying, Path: "xray",
+				Backup: "xray.backup"},
+			files:    []file{{"xray", "new"}, {"xray.backup", "old"}},
+			expected: []file{{"xray", "old"}},
+			restarts: 1,
+			message:  "at the applying stage and has been rolled back",
+		},
+		{
+			name: "committed update is completed",
+			op: Operation{Kind: operationFileUpdate, Stage: stageApplying, Path: "xray",
+				Backup: "xray.backup", Extras: []string{"LICENSE"}},
+			committed: true,
+			files:     []file{{"xray", "new"}, {"xray.backup", "old"}, {"LICENSE.backup", "old license"}},
+			expected:  []file{{"xray", "new"}},
+			missing:   []string{"xray.backup", "LICENSE.backup"},
+			message:   "The update of xray interrupted by the previous run has been completed.",
+		},
+		{
+			name: "server config is rolled back",
+			op: Operation{Kind: operationServerConfig, Stage: stageApplying, Path: "config.json",
+				Backup: "config.json.backup"},
+			files:    []file{{"config.json", "new"}, {"config.json.backup", "old"}},
+			expected: []file{{"config.json", "old"}},
+			missing:  []string{"config.json.backup"},
+			restarts: 1,
+			message:  "The change of the xray server config was interrupted",
+		},
+		{
+			name: "server config without the backup is kept",
+			op: Operation{Kind: operationServerConfig, Stage: stageApplying, Path: "config.json",
+				Backup: "config.json.backup"},
+			files:    []file{{"config.json", "new"}},
+			expected: []file{{"config.json", "new"}},
+			restarts: 1,
+			message:  "so the config in place has been kept",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workdir := t.TempDir()
+			abs := func(path string) string { return filepath.Join(workdir, path) }
+			for _, f := range tt.files {
+				utils.AssertNoError(t, os.WriteFile(abs(f.path), []byte(f.content), 0644))
+			}
+			service := &fakeService{active: true}
+			app := &Application{logger: GetLogger(false), workdir: workdir, xrayService: service}
+
+			op := tt.op
+			op.Path = abs(op.Path)
+			if op.Backup != "" {
+				op.Backup = abs(op.Backup)
+			}
+			for i, extra := range op.Extras {
+				op.Extras[i] = abs(extra)
+			}
+			stage := op.Stage
+			utils.AssertNoError(t, app.beginOperation(op))
+			app.setOperationStage(op.Path, stage)
+			if tt.committed {
+				checksum, size, err := utils.FileSHA256(op.Path)
+				utils.AssertNoError(t, err)
+				utils.AssertNoError(t, recordInstalledVersion(abs(versionsFileName),
+					filepath.Base(op.Path), FileVersion{Tag: "v2", SHA256: checksum, Size: size,
+						InstalledAt: time.Now().UTC()}))
+			}
+
+			err := app.recoverInterruptedOperations(context.Background(), nil, abs("config.json"))
+			utils.AssertNoError(t, err)
+
+			for _, f := range tt.expected {
+				content, err := os.ReadFile(abs(f.path))
+				utils.AssertNoError(t, err)
+				utils.AssertCorrectString(t, f.content, string(content))
+			}
+			for _, path := range append(tt.missing, journalFileName) {
+				if utils.FileExists(abs(path)) {
+					t.Errorf("Expected %s to be removed", path)
+				}
+			}
+			utils.AssertCorrectInt(t, tt.restarts, service.restarts)
+			messages := strings.Join(append(app.notes, app.warnings...), "\n")
+			if !strings.Contains(messages, tt.message) {
+				t.Errorf("Expected the messages to contain %q, got %q", tt.message, messages)
+			}
+		})
+	}
+}
+
+func TestRecoverLeftovers(t *testing.T) {
+	workdir := t.TempDir()
+	write := func(path, content string) {
+		utils.AssertNoError(t, os.WriteFile(filepath.Join(workdir, path), []byte(content), 0644))
+	}
+	write("geoip.dat", "recorded")
+	write("geoip.dat.backup", "previous")
+	write("geosite.dat.backup", "previous")
+	write("xray", "unknown")
+	write("xray.backup", "previous")
+	write("xray.tar.gz", "archive")
+	write(".versions.json.123.tmp", "partial")
+	write("config.json.backup", "previous")
+
+	checksum, size, err := utils.FileSHA256(filepath.Join(workdir, "geoip.dat"))
+	utils.AssertNoError(t, err)
+	utils.AssertNoError(t, recordInstalledVersion(filepath.Join(workdir, versionsFileName),
+		"geoip.dat", FileVersion{Tag: "v1", SHA256: checksum, Size: size}))
+
+	app := &Application{logger: GetLogger(false), workdir: workdir}
+	repos := []Repo{{Filename: "geoip.dat"}, {Filename: "geosite.dat"}, {Filename: "xray"}}
+	err = app.recoverInterruptedOperations(context.Background(), repos,
+		filepath.Join(workdir, "config.json"))
+	utils.AssertNoError(t, err)
+
+	for path, expected := range map[string]string{
+		// The backup of the recorded file is removed
+		"geoip.dat": "recorded",
+		// The backup of a missing file is restored
+		"geosite.dat": "previous",
+		// Whether the file is complete is unknown
+		"xray":        "unknown",
+		"xray.backup": "previous",
+		"config.json": "previous",
+	} {
+		content, err := os.ReadFile(filepath.Join(workdir, path))
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectString(t, expected, string(content))
+	}
+	for _, path := range []string{"geoip.dat.backup", "geosite.dat.backup", "xray.tar.gz",
+		".versions.json.123.tmp", "config.json.backup"} {
+		if utils.FileExists(filepath.Join(workdir, path)) {
+			t.Errorf("Expected %s to be removed", path)
+		}
+	}
+	utils.AssertCorrectInt(t, 1, len(app.warnings))
+	if !strings.Contains(app.warnings[0], "xray.backup has been left by an earlier run") {
+		t.Errorf("Expected the warning about xray.backup, got %q", app.warnings[0])
+	}
+}
+
+func TestLockWorkdir(t *testing.T) {
+	app := &Application{logger: GetLogger(false), workdir: t.TempDir()}
+
+	lock, err := app.lockWorkdir()
+	utils.AssertNoError(t, err)
+	_, err = app.lockWorkdir()
+	utils.AssertErrorContains(t, err, "another instance is running on the workdir")
+
+	utils.AssertNoError(t, lock.Unlock())
+	lock, err = app.lockWorkdir()
+	utils.AssertNoError(t, err)
+	utils.AssertNoError(t, lock.Unlock())
+}
@@ -6,22 +6,42 @@ import (
 	"log"
 	"os"
 	"runtime/debug"
+	"time"
 
+	"github.com/ilyakutilin/xray_maintainer/messages"
 	"github.com/ilyakutilin/xray_maintainer/utils"
 )
 
 type Application struct {
-	debug           bool
-	logger          *Logger
-	workdir         string
-	xrayServiceName string
-	notes           []string
-	warnings        []string
+	debug                bool
+	logger               *Logger
+	workdir              string
+	xrayServiceName      string
+	xrayServerConfigPath string
+	endpointProber       EndpointProber
+	notes                []string
+	warnings             []string
+	// Log excerpts sent along with the notes and the warnings
+	attachments []messages.Attachment
+	// Number of the last lines of a log kept in an attachment, none are kept if 0
+	logLines int
+
+	// Restarts the xray service and reports whether it is running
+	xrayService   utils.ServiceManager
+	applyStrategy ApplyStrategy
+	// Runs the xray executable for the API commands, directly if nil
+	fileExecutor func(ctx context.Context, filePath string, args ...string) (string, error)
+	// Settings of xray the health check of the service relies on
+	xray Xray
+	// Returns the current time, time.Now if nil
+	now func() time.Time
+	// Looks up the country the requests originate from, ip-api.com if nil
+	countryCode func(context.Context) (string, error)
 }
 
 func (app *Application) note(txt string) {
 	app.logger.Info.Println(txt)
-	app.warnings = append(app.notes, txt)
+	app.notes = append(app.notes, txt)
 }
 
 func (app *Application) warn(txt string) {
@@ -29,17 +49,51 @@ func (app *Application) warn(txt string) {
 	app.warnings = append(app.warnings, txt)
 }
 
+// Runs one of the auxiliary commands instead of the regular maintenance run
+func (app *Application) runCommand(name string, args []string, cfg *Config) error {
+	switch name {
+	case "versions":
+		return app.runVersionsCommand(args, cfg.Repos, NewFile, os.Stdout)
+	case "doctor":
+		return app.runDoctorCommand(context.Background(), cfg, nil, os.Stdout)
+	default:
+		return fmt.Errorf("unknown command %q. Supported commands: versions, doctor", name)
+	}
+}
+
 func main() {
+	// The helper is run by root with sudo and does not need the config
+	if len(os.Args) > 1 && os.Args[1] == serviceHelperCommand {
+		if err := runServiceHelper(context.Background(), os.Args[2:], nil); err != nil {
+			log.Fatalf("Error running the service helper: %v", err)
+		}
+		return
+	}
+
 	cfg, err := loadConfig()
 	if err != nil {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
 	app := Application{
-		debug:           cfg.Debug,
-		logger:          GetLogger(cfg.Debug),
-		workdir:         cfg.Workdir,
-		xrayServiceName: cfg.Xray.Server.ServiceName,
+		debug:                cfg.Debug,
+		logger:               GetLogger(cfg.Debug),
+		workdir:              cfg.Workdir,
+		xrayServiceName:      cfg.Xray.Server.ServiceName,
+		xrayServerConfigPath: cfg.Xray.Server.ConfigFilePath,
+		endpointProber:       UDPEndpointProber{},
+		applyStrategy:        cfg.Xray.Server.Apply,
+		xray:                 cfg.Xray,
+		logLines:             cfg.Messages.LogLines,
+	}
+
+	if err := app.dropPrivileges(cfg.Privileges); err != nil {
+		log.Fatalf("Error dropping the privileges: %v", err)
+	}
+
+	app.xrayService, err = newXrayService(cfg.Xray, cfg.Privileges, cfg.Workdir, nil)
+	if err != nil {
+		log.Fatalf("Error setting up the xray service manager: %v", err)
 	}
 
 	defer func() {
@@ -55,7 +109,14 @@ func main() {
 		}
 	}()
 
-	if !app.debug {
+	if len(os.Args) > 1 {
+		if err := app.runCommand(os.Args[1], os.Args[2:], cfg); err != nil {
+			app.logger.Error.Fatal(err)
+		}
+		return
+	}
+
+	if !app.debug && cfg.Privileges.Mode == privilegeRoot {
 		if err := utils.CheckSudo(); err != nil {
 			app.logger.Error.Fatal(err)
 		}
@@ -73,8 +134,35 @@ func main() {
 		app.logger.Error.Fatalf("Error creating workdir: %v", err)
 	}
 
+	lock, err := app.lockWorkdir()
+	if err != nil {
+		// The overlapping run is not a failure, the other instance does the job
+		app.logger.Warning.Printf("Exiting: %v\n", err)
+		return
+	}
+	defer lock.Unlock()
+
 	ctx := context.Background()
 
+	if err := app.recoverInterruptedOperations(ctx, cfg.Repos, cfg.Xray.Server.ConfigFilePath); err != nil {
+		app.sendMsg(
+			cfg.Messages,
+			"Error recovering from the interrupted run",
+			fmt.Sprintf("Failed to complete or roll back the operations interrupted "+
+				"by the previous run: %v", err),
+		)
+		app.logger.Error.Fatalf("Error recovering from the interrupted run: %v", err)
+	}
+
+	if err := app.checkDrift(ctx, cfg.Repos, cfg.ReconcileDrift, NewFile); err != nil {
+		app.sendMsg(
+			cfg.Messages,
+			"Error checking the managed files",
+			fmt.Sprintf("Failed to check the managed files for modifications: %v", err),
+		)
+		app.logger.Error.Fatalf("Error checking the managed files: %v", err)
+	}
+
 	if err := app.updateMultipleFiles(ctx, cfg.Repos, NewFile); err != nil {
 		app.sendMsg(
 			cfg.Messages,
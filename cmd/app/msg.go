@@ -1,6 +1,8 @@
 package main
 
 import (
+	"strings"
+
 	"github.com/ilyakutilin/xray_maintainer/messages"
 )
 
@@ -41,10 +43,11 @@ func (app *Application) sendMsg(msgCfg Messages, subject, body string) {
 	sender := app.getSender(msgCfg)
 
 	message := messages.Message{
-		Subject:  subject,
-		Body:     body,
-		Notes:    app.notes,
-		Warnings: app.warnings,
+		Subject:     subject,
+		Body:        body,
+		Notes:       app.notes,
+		Warnings:    app.warnings,
+		Attachments: app.attachments,
 	}
 
 	if err := sender.Send(message); err != nil {
@@ -52,3 +55,19 @@ func (app *Application) sendMsg(msgCfg Messages, subject, body string) {
 			"%s\nReason: %v", message, err)
 	}
 }
+
+// Attaches the last lines of the log to the message the run ends with. Empty logs
+// are not attached.
+func (app *Application) attach(name, log string) {
+	if app.logLines <= 0 || strings.TrimSpace(log) == "" {
+		return
+	}
+	lines := strings.Split(strings.TrimRight(log, "\n"), "\n")
+	if len(lines) > app.logLines {
+		lines = lines[len(lines)-app.logLines:]
+	}
+	app.attachments = append(app.attachments, messages.Attachment{
+		Name:    name,
+		Content: strings.Join(lines, "\n"),
+	})
+}
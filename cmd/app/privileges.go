@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+	"golang.org/x/sys/unix"
+)
+
+// How the app gets the privileges to control the xray service
+const (
+	privilegeRoot   = "root"
+	privilegeSudo   = "sudo"
+	privilegePolkit = "polkit"
+	privilegeHelper = "helper"
+)
+
+// Command of the executable re-run with sudo to restart or reload the service
+const serviceHelperCommand = "service-helper"
+
+// Privileges lets the app run as an unprivileged user owning the workdir, with
+// only the control of the xray service granted to it
+type Privileges struct {
+	// root: the app shall run as root; sudo: the commands of the service manager
+	// are run with sudo -n, so a sudoers rule shall allow them; polkit: they are
+	// run as is, so the service manager shall authorize the user itself (a polkit
+	// rule with systemd, the docker group with docker); helper: only the restart
+	// and the reload are made by this executable re-run with sudo -n as the
+	// service helper
+	Mode string `koanf:"mode"`
+	// The user the app switches to for the whole run if started as root
+	User string `koanf:"user"`
+}
+
+func validatePrivileges(p Privileges) error {
+	switch p.Mode {
+	case privilegeRoot:
+		if p.User != "" {
+			return errors.New("the privileges can only be dropped to the user in a mode other than root")
+		}
+	case privilegeSudo, privilegePolkit, privilegeHelper:
+	default:
+		return fmt.Errorf("unknown privileges mode %q, expected %s, %s, %s or %s", p.Mode,
+			privilegeRoot, privilegeSudo, privilegePolkit, privilegeHelper)
+	}
+	return nil
+}
+
+// Switches to the configured user if the app has been started as root
+func (app *Application) dropPrivileges(p Privileges) error {
+	if p.User == "" || os.Geteuid() != 0 {
+		return nil
+	}
+	if err := utils.DropPrivileges(p.User); err != nil {
+		return err
+	}
+	app.logger.Info.Printf("Dropped the root privileges to the user %s.\n", p.User)
+	return nil
+}
+
+// Restarts and reloads the service through the service helper run with sudo, so
+// that nothing else runs with the privileges. The rest of the commands of the
+// service manager are run as is.
+type helperService struct {
+	utils.ServiceManager
+	// This executable, the sudoers rule shall allow it with the exact arguments
+	executable string
+	kind       string
+	name       string
+	executor   utils.CommandExecutor
+}
+
+func (s *helperService) Restart(ctx context.Context) error {
+	return s.call(ctx, "restart")
+}
+
+func (s *helperService) Reload(ctx context.Context) error {
+	return s.call(ctx, "reload")
+}
+
+// Returns the command line of the helper for the action without sudo
+func (s *helperService) commandLine(action string) string {
+	return strings.Join([]string{utils.ShellQuote(s.executable), serviceHelperCommand, action,
+		s.kind, utils.ShellQuote(s.name)}, " ")
+}
+
+func (s *helperService) call(ctx context.Context, action string) error {
+	executor := s.executor
+	if executor == nil {
+		executor = utils.ExecuteCommand
+	}
+	out, err := executor(ctx, "sudo -n "+s.commandLine(action))
+	if err != nil {
+		return fmt.Errorf("the service helper has failed to %s %s: %w: %s", action, s.name,
+			err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// Restarts or reloads the service with the args "action kind name" on behalf of
+// the unprivileged app. It runs without the config, so the sudoers rule pinning
+// the arguments is all that decides what it may do.
+func runServiceHelper(ctx context.Context, args []string, executor utils.CommandExecutor) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: %s restart|reload <service manager> <service name>",
+			serviceHelperCommand)
+	}
+	action, kind, name := args[0], args[1], args[2]
+	if kind == utils.ServiceDirect {
+		return errors.New("the direct service manager does not need the service helper")
+	}
+	service, err := utils.NewCommandService(kind, name, executor)
+	if err != nil {
+		return err
+	}
+	// The helper itself is run by root
+	service.SetPrivilegePrefix("")
+
+	switch action {
+	case "restart":
+		return service.Restart(ctx)
+	case "reload":
+		return service.Reload(ctx)
+	default:
+		return fmt.Errorf("unknown action %q, expected restart or reload", action)
+	}
+}
+
+// Outcome of a check of the doctor command
+type doctorCheck struct {
+	title string
+	// Empty if the check has passed
+	problem string
+	// How to fix the problem or what to verify by hand
+	hint string
+	// The check cannot be made automatically
+	manual bool
+}
+
+func (c doctorCheck) String() string {
+	status := "OK"
+	switch {
+	case c.manual:
+		status = "CHECK"
+	case c.problem != "":
+		status = "FAIL"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "[%s] %s", status, c.title)
+	if c.problem != "" {
+		fmt.Fprintf(&b, ": %s", c.problem)
+	}
+	for _, line := range strings.Split(c.hint, "\n") {
+		if line != "" {
+			fmt.Fprintf(&b, "\n    %s", line)
+		}
+	}
+	return b.String()
+}
+
+// Checks that the current user may write the path, a directory or a file
+func checkWritable(title, path, username string) doctorCheck {
+	check := doctorCheck{title: title}
+	if err := unix.Access(path, unix.W_OK); err != nil {
+		check.problem = fmt.Sprintf("%s is not writable: %v", path, err)
+		check.hint = fmt.Sprintf("sudo chown -R %s %s", username, path)
+	}
+	return check
+}
+
+// Checks that the service helper and its directory can only be changed by root,
+// since the sudoers rule lets the user run the helper as root
+func checkHelperExecutable(executable string) doctorCheck {
+	check := doctorCheck{title: "the service helper can only be changed by root"}
+	var problems []string
+	for _, path := range []string{executable, filepath.Dir(executable)} {
+		info, err := os.Stat(path)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Uid != 0 {
+			problems = append(problems, fmt.Sprintf("%s is owned by the uid %d", path, stat.Uid))
+		}
+		if unix.Access(path, unix.W_OK) == nil {
+			problems = append(problems, fmt.Sprintf("%s is writable by the user", path))
+		}
+	}
+	if len(problems) > 0 {
+		check.problem = strings.Join(problems, "; ")
+		check.hint = fmt.Sprintf("Install the app to a directory owned by root, e.g.:\n"+
+			"sudo install -o root -g root -m 755 %s /usr/local/bin/", executable)
+	}
+	return check
+}
+
+// Checks with sudo -l that the commands may be run with sudo without a password
+func checkSudoRule(ctx context.Context, commands []string, username string, executor utils.CommandExecutor) doctorCheck {
+	check := doctorCheck{title: "sudo allows the service commands"}
+	var denied, rules []string
+	for _, cmd := range commands {
+		if _, err := executor(ctx, "sudo -n -l "+cmd); err != nil {
+			denied = append(denied, cmd)
+		}
+		// The sudoers rules require the absolute paths
+		fields := strings.SplitN(cmd, " ", 2)
+		if path, err := exec.LookPath(strings.Trim(fields[0], "'")); err == nil {
+			fields[0] = path
+		}
+		rules = append(rules, strings.ReplaceAll(strings.Join(fields, " "), "'", ""))
+	}
+	if len(denied) > 0 {
+		check.problem = fmt.Sprintf("not allowed without a password: %s", strings.Join(denied, "; "))
+		check.hint = fmt.Sprintf("Add to /etc/sudoers.d/xray-maintainer with visudo:\n"+
+			"%s ALL=(root) NOPASSWD: %s", username, strings.Join(rules, ", "))
+	}
+	return check
+}
+
+// Returns the polkit rule allowing the user to restart and reload the unit
+func polkitRule(unit, username string) string {
+	return fmt.Sprintf(`polkit.addRule(function(action, subject) {
+    if (action.id == "org.freedesktop.systemd1.manage-units" &&
+        action.lookup("unit") == %q &&
+        (action.lookup("verb") == "restart" || action.lookup("verb") == "reload") &&
+        subject.user == %q) {
+        return polkit.Result.YES;
+    }
+});`, unit, username)
+}
+
+// Explains which permissions the app lacks to run with the privileges of the
+// config. The commands are run by the executor, the shell if nil.
+func (app *Application) runDoctorCommand(ctx context.Context, cfg *Config, executor utils.CommandExecutor, out io.Writer) error {
+	if executor == nil {
+		executor = utils.ExecuteCommand
+	}
+	username := fmt.Sprint(os.Geteuid())
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	server := cfg.Xray.Server
+	mode := cfg.Privileges.Mode
+
+	identity := doctorCheck{title: fmt.Sprintf("running as %s with the %s privileges mode",
+		username, mode)}
+	if mode == privilegeRoot && os.Geteuid() != 0 {
+		identity.problem = "the root mode requires root"
+		identity.hint = "Run the app as root or set privileges.mode to sudo, polkit or helper."
+	}
+	checks := []doctorCheck{
+		identity,
+		checkWritable("the workdir is writable", cfg.Workdir, username),
+		checkWritable("the xray server config is writable", server.ConfigFilePath, username),
+	}
+	for _, repo := range cfg.Repos {
+		path := filepath.Join(cfg.Workdir, repo.Filename)
+		if _, err := os.Stat(path); err == nil {
+			checks = append(checks, checkWritable(fmt.Sprintf("the %s file is writable", repo.Name),
+				path, username))
+		}
+	}
+
+	switch {
+	case server.ServiceManager == utils.ServiceDirect:
+		checks = append(checks, checkWritable("the directory of the xray pid file is writable",
+			filepath.Dir(providerFilePath(cfg.Workdir, server.Process.PIDFile)), username))
+	case mode == privilegeSudo:
+		if service, ok := app.xrayService.(*utils.CommandService); ok {
+			checks = append(checks, checkSudoRule(ctx, service.PrivilegedCommands(), username, executor))
+		}
+	case mode == privilegeHelper:
+		if service, ok := app.xrayService.(*helperService); ok {
+			checks = append(checks, checkHelperExecutable(service.executable),
+				checkSudoRule(ctx, []string{service.commandLine("restart"),
+					service.commandLine("reload")}, username, executor))
+		}
+	case mode == privilegePolkit:
+		check := doctorCheck{title: "the service manager authorizes the restart and the reload",
+			manual: true}
+		switch server.ServiceManager {
+		case utils.ServiceSystemd:
+			check.hint = "Cannot be verified without a restart. Make sure a rule like this is in " +
+				"/etc/polkit-1/rules.d/50-xray-maintainer.rules:\n" +
+				polkitRule(server.ServiceName, username)
+		case utils.ServiceDocker:
+			check.hint = fmt.Sprintf("Cannot be verified without a restart. Make sure the user "+
+				"is in the docker group: sudo usermod -aG docker %s", username)
+		default:
+			check.hint = fmt.Sprintf("Cannot be verified without a restart. Make sure %s "+
+				"allows the user to control the service.", server.ServiceManager)
+		}
+		checks = append(checks, check)
+	}
+
+	status := doctorCheck{title: "the status of the xray service is available"}
+	if _, err := app.xrayService.IsActive(ctx); err != nil {
+		status.problem = err.Error()
+		status.hint = fmt.Sprintf("The user shall be able to run the status command of %s.",
+			server.ServiceManager)
+	}
+	logs := doctorCheck{title: "the log of the xray service is readable"}
+	if _, err := app.xrayService.Logs(ctx, time.Now()); err != nil &&
+		!errors.Is(err, utils.ErrNoServiceLogs) {
+		logs.problem = err.Error()
+		if server.ServiceManager == utils.ServiceSystemd {
+			logs.hint = fmt.Sprintf("sudo usermod -aG systemd-journal %s", username)
+		}
+	}
+	checks = append(checks, status, logs)
+
+	failed := 0
+	for _, check := range checks {
+		if check.problem != "" {
+			failed++
+		}
+		fmt.Fprintln(out, check)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of the checks have failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestValidatePrivileges(t *testing.T) {
+	tests := []struct {
+		name       string
+		privileges Privileges
+		errMsg     string
+	}{
+		{"root", Privileges{Mode: privilegeRoot}, ""},
+		{"sudo with user", Privileges{Mode: privilegeSudo, User: "xray"}, ""},
+		{"helper", Privileges{Mode: privilegeHelper}, ""},
+		{"root with user", Privileges{Mode: privilegeRoot, User: "xray"}, "mode other than root"},
+		{"unknown", Privileges{Mode: "setuid"}, `unknown privileges mode "setuid"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePrivileges(tt.privileges)
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestNewXrayServicePrivileges(t *testing.T) {
+	executable, err := os.Executable()
+	utils.AssertNoError(t, err)
+	xray := Xray{Server: XrayServer{ServiceName: "xray.service", ServiceManager: utils.ServiceSystemd}}
+
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{privilegeRoot, "sudo systemctl restart xray.service; systemctl is-active xray.service"},
+		{privilegeSudo, "sudo -n systemctl restart xray.service; systemctl is-active xray.service"},
+		{privilegePolkit, "systemctl restart xray.service; systemctl is-active xray.service"},
+		{privilegeHelper, "sudo -n '" + executable + "' service-helper restart systemd 'xray.service'; " +
+			"systemctl is-active xray.service"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			var commands []string
+			executor := func(ctx context.Context, cmd string) (string, error) {
+				commands = append(commands, cmd)
+				return "active\n", nil
+			}
+			service, err := newXrayService(xray, Privileges{Mode: tt.mode}, "/opt/xray", executor)
+			utils.AssertNoError(t, err)
+			utils.AssertNoError(t, service.Restart(context.Background()))
+			active, err := service.IsActive(context.Background())
+			utils.AssertNoError(t, err)
+			utils.AssertCorrectBool(t, true, active)
+			utils.AssertCorrectString(t, tt.expected, strings.Join(commands, "; "))
+		})
+	}
+
+	t.Run("helper failure", func(t *testing.T) {
+		executor := func(ctx context.Context, cmd string) (string, error) {
+			return "sudo: a password is required\n", errors.New("exit status 1")
+		}
+		service, err := newXrayService(xray, Privileges{Mode: privilegeHelper}, "/opt/xray", executor)
+		utils.AssertNoError(t, err)
+		utils.AssertErrorContains(t, service.Reload(context.Background()),
+			"the service helper has failed to reload xray.service: exit status 1: "+
+				"sudo: a password is required")
+	})
+}
+
+func TestRunServiceHelper(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		expected string
+		errMsg   string
+	}{
+		{"restart", []string{"restart", "systemd", "xray.service"}, "systemctl restart xray.service", ""},
+		{"reload", []string{"reload", "runit", "xray"}, "sv hup xray", ""},
+		{"unknown action", []string{"stop", "systemd", "xray.service"}, "", `unknown action "stop"`},
+		{"direct", []string{"restart", "direct", "xray"}, "", "does not need the service helper"},
+		{"unknown manager", []string{"restart", "upstart", "xray"}, "", `unknown service manager "upstart"`},
+		{"missing args", []string{"restart"}, "", "usage: service-helper"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var commands []string
+			executor := func(ctx context.Context, cmd string) (string, error) {
+				commands = append(commands, cmd)
+				return "", nil
+			}
+			err := runServiceHelper(context.Background(), tt.args, executor)
+			if tt.errMsg != "" {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+				return
+			}
+			utils.AssertNoError(t, err)
+			utils.AssertCorrectString(t, tt.expected, strings.Join(commands, "; "))
+		})
+	}
+}
+
+func TestCheckHelperExecutable(t *testing.T) {
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "xray-maintainer")
+	utils.AssertNoError(t, os.WriteFile(executable, []byte("#!/bin/sh\n"), 0755))
+
+	tests := []struct {
+		name    string
+		path    string
+		problem string
+	}{
+		{"writable executable", executable, executable + " is writable by the user"},
+		{"writable directory", executable, dir + " is writable by the user"},
+		{"missing executable", filepath.Join(dir, "missing"), "no such file or directory"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := checkHelperExecutable(tt.path)
+			if !strings.Contains(check.problem, tt.problem) {
+				t.Errorf("Expected the problem to contain %q, got %q", tt.problem, check.problem)
+			}
+		})
+	}
+}
+
+func TestRunDoctorCommand(t *testing.T) {
+	newConfig := func(t *testing.T, mode string) *Config {
+		workdir := t.TempDir()
+		configPath := filepath.Join(workdir, "config.json")
+		utils.AssertNoError(t, os.WriteFile(configPath, []byte("{}"), 0644))
+		return &Config{
+			Workdir:    workdir,
+			Privileges: Privileges{Mode: mode},
+			Xray: Xray{Server: XrayServer{
+				ServiceName:    "xray.service",
+				ServiceManager: utils.ServiceSystemd,
+				ConfigFilePath: configPath,
+			}},
+		}
+	}
+	// Allows the commands containing the substring only
+	executorAllowing := func(allowed string) utils.CommandExecutor {
+		return func(ctx context.Context, cmd string) (string, error) {
+			if strings.HasPrefix(cmd, "sudo -n -l") && !strings.Contains(cmd, allowed) {
+				return "", errors.New("exit status 1")
+			}
+			return "active\n", nil
+		}
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		allowed  string
+		contains []string
+		errMsg   string
+	}{
+		{
+			name:     "sudo rule in place",
+			mode:     privilegeSudo,
+			allowed:  "systemctl",
+			contains: []string{"[OK] sudo allows the service commands", "[OK] the workdir is writable"},
+		},
+		{
+			name:    "sudo rule missing the reload",
+			mode:    privilegeSudo,
+			allowed: "restart",
+			contains: []string{
+				"[FAIL] sudo allows the service commands: not allowed without a password: " +
+					"systemctl reload xray.service",
+				"ALL=(root) NOPASSWD: ",
+				"systemctl restart xray.service, ",
+			},
+			errMsg: "1 of the checks have failed",
+		},
+		{
+			name:    "helper rule missing",
+			mode:    privilegeHelper,
+			allowed: "nothing",
+			contains: []string{
+				"[FAIL] the service helper can only be changed by root",
+				"service-helper restart systemd xray.service, ",
+			},
+			errMsg: "2 of the checks have failed",
+		},
+		{
+			name:     "polkit",
+			mode:     privilegePolkit,
+			contains: []string{"[CHECK] the service manager authorizes", `action.lookup("unit") == "xray.service"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := newConfig(t, tt.mode)
+			executor := executorAllowing(tt.allowed)
+			service, err := newXrayService(cfg.Xray, cfg.Privileges, cfg.Workdir, executor)
+			utils.AssertNoError(t, err)
+			app := &Application{logger: GetLogger(false), xrayService: service}
+
+			var out bytes.Buffer
+			err = app.runDoctorCommand(context.Background(), cfg, executor, &out)
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+			for _, s := range tt.contains {
+				if !strings.Contains(out.String(), s) {
+					t.Errorf("Expected the output to contain %q, got:\n%s", s, out.String())
+				}
+			}
+		})
+	}
+
+	t.Run("missing config", func(t *testing.T) {
+		cfg := newConfig(t, privilegePolkit)
+		cfg.Xray.Server.ConfigFilePath = filepath.Join(cfg.Workdir, "missing.json")
+		service, err := newXrayService(cfg.Xray, cfg.Privileges, cfg.Workdir, executorAllowing(""))
+		utils.AssertNoError(t, err)
+		app := &Application{logger: GetLogger(false), xrayService: service}
+
+		var out bytes.Buffer
+		err = app.runDoctorCommand(context.Background(), cfg, executorAllowing(""), &out)
+		utils.AssertErrorContains(t, err, "1 of the checks have failed")
+		if !strings.Contains(out.String(), "[FAIL] the xray server config is writable") {
+			t.Errorf("Expected the config check to fail, got:\n%s", out.String())
+		}
+	})
+}
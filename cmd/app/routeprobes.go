@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// RouteProbe is a destination that shall leave the xray server through a certain
+// outbound according to the routing rules. The URL shall report the egress in
+// one of the ip checker formats, e.g. https://<domain>/cdn-cgi/trace for
+// a domain proxied by Cloudflare.
+type RouteProbe struct {
+	URL string `koanf:"url"`
+	// ip checker type of the response, trace if empty
+	Type string `koanf:"type"`
+	// Tag of the outbound the destination is expected to be routed to
+	Outbound string `koanf:"outbound"`
+}
+
+func (p RouteProbe) checker() IPChecker {
+	if p.Type == "" {
+		return IPChecker{Type: ipCheckerTrace, URL: p.URL}
+	}
+	return IPChecker{Type: p.Type, URL: p.URL}
+}
+
+// Makes sure every probe has a URL, a known type and an expected outbound
+func validateRouteProbes(probes []RouteProbe) error {
+	for i, p := range probes {
+		if p.URL == "" || p.Outbound == "" {
+			return fmt.Errorf("route probe #%d shall have both url and outbound", i+1)
+		}
+		if _, ok := ipCheckerAdapters[p.checker().Type]; !ok {
+			return fmt.Errorf("unknown type %q of route probe #%d", p.Type, i+1)
+		}
+	}
+	return nil
+}
+
+// A route probe along with the protocol of the expected outbound
+type routeTarget struct {
+	Probe    RouteProbe
+	Protocol string
+}
+
+// Looks up the protocols of the expected outbounds in the server config.
+// Returns the errors for the probes that cannot be verified.
+func routeTargets(probes []RouteProbe, xrayServerConfig *ServerConfig) ([]routeTarget, error) {
+	protocols := make(map[string]string)
+	for _, outb := range xrayServerConfig.Outbounds {
+		protocols[outb.Tag] = outb.Protocol
+	}
+
+	var targets []routeTarget
+	var errs utils.Errors
+	for _, p := range probes {
+		protocol, ok := protocols[p.Outbound]
+		if !ok {
+			errs.Append(fmt.Errorf("route probe %s expects the outbound %q which is "+
+				"absent from the server config", p.URL, p.Outbound))
+			continue
+		}
+		targets = append(targets, routeTarget{Probe: p, Protocol: protocol})
+	}
+
+	if len(errs) > 0 {
+		return targets, errs
+	}
+	return targets, nil
+}
+
+// Result of a single route probe
+type RouteStatus struct {
+	Target routeTarget
+	// Set if the destination has not left through the expected outbound
+	Err error
+}
+
+func (s RouteStatus) OK() bool {
+	return s.Err == nil
+}
+
+func (s RouteStatus) String() string {
+	if s.OK() {
+		return fmt.Sprintf("%s: ok via %s", s.Target.Probe.URL, s.Target.Probe.Outbound)
+	}
+	return fmt.Sprintf("%s: %v", s.Target.Probe.URL, s.Err)
+}
+
+// Tells whether the answer of the probe matches the protocol of the outbound:
+// wireguard shall egress through warp, freedom from the xray server itself,
+// blackhole shall not let the request through, and the rest of the protocols
+// shall egress from some other address.
+func matchRoute(target routeTarget, r ipCheckerResult) error {
+	expected := fmt.Sprintf("expected to leave through %s (%s)", target.Probe.Outbound,
+		target.Protocol)
+
+	if target.Protocol == "blackhole" {
+		if r.requestErr == nil {
+			return fmt.Errorf("%s, but the request went through", expected)
+		}
+		return nil
+	}
+	if r.requestErr != nil {
+		return fmt.Errorf("%s, but the request failed: %w", expected, r.requestErr)
+	}
+
+	d := r.diagnosis
+	if d.Status == WarpCheckerUnavailable {
+		return fmt.Errorf("%s, but the egress could not be determined: %w", expected, d.Err)
+	}
+
+	var ok bool
+	switch target.Protocol {
+	case "wireguard":
+		ok = d.Status == WarpOK
+	case "freedom":
+		ok = d.Status == WarpEgressServerIP
+	default:
+		ok = d.Status == WarpEgressNotCloudflare
+	}
+	if !ok {
+		return fmt.Errorf("%s, but the egress is %s", expected, describeEgress(d))
+	}
+	return nil
+}
+
+func describeEgress(d WarpDiagnosis) string {
+	switch d.Status {
+	case WarpOK:
+		return "warp " + d.Egress()
+	case WarpEgressServerIP:
+		return "the xray server address " + d.EgressIP
+	default:
+		return d.Egress()
+	}
+}
+
+// Requests every probe through the proxy and checks the outbound it has used
+func checkRoutes(ctx context.Context, targets []routeTarget, proxy *utils.Proxy, xrayServerIP string) []RouteStatus {
+	var statuses []RouteStatus
+	for _, t := range targets {
+		r := queryIPChecker(ctx, t.Probe.checker(), proxy, xrayServerIP)
+		statuses = append(statuses, RouteStatus{Target: t, Err: matchRoute(t, r)})
+	}
+	return statuses
+}
+
+// Marks an operational diagnosis as misrouted if any of the probes has left
+// through an unexpected outbound
+func applyRouteStatuses(d WarpDiagnosis, statuses []RouteStatus) WarpDiagnosis {
+	d.Routes = statuses
+	if !d.OK() {
+		return d
+	}
+
+	var wrong []string
+	for _, s := range statuses {
+		if !s.OK() {
+			wrong = append(wrong, s.String())
+		}
+	}
+	if len(wrong) > 0 {
+		d.Status = WarpMisrouted
+		d.Err = fmt.Errorf("%s", strings.Join(wrong, "; "))
+	}
+	return d
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestValidateRouteProbes(t *testing.T) {
+	tests := []struct {
+		name   string
+		probes []RouteProbe
+		errMsg string
+	}{
+		{"valid", []RouteProbe{{URL: "https://example.com/cdn-cgi/trace", Outbound: "warp"}}, ""},
+		{"no probes", nil, ""},
+		{"no outbound", []RouteProbe{{URL: "https://example.com/cdn-cgi/trace"}}, "shall have both url and outbound"},
+		{"unknown type", []RouteProbe{{URL: "https://example.com", Type: "whois", Outbound: "direct"}}, `unknown type "whois"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRouteProbes(tt.probes)
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestRouteTargets(t *testing.T) {
+	config := ServerConfig{Outbounds: []SrvOutbound{
+		{Protocol: "wireguard", Tag: "warp"},
+		{Protocol: "freedom", Tag: "direct"},
+	}}
+	probes := []RouteProbe{
+		{URL: "https://a.example/cdn-cgi/trace", Outbound: "warp"},
+		{URL: "https://b.example/cdn-cgi/trace", Outbound: "proxy"},
+		{URL: "https://c.example/cdn-cgi/trace", Outbound: "direct"},
+	}
+
+	targets, err := routeTargets(probes, &config)
+	utils.AssertErrorContains(t, err, `expects the outbound "proxy"`)
+	utils.AssertCorrectInt(t, 2, len(targets))
+	utils.AssertCorrectString(t, "wireguard", targets[0].Protocol)
+	utils.AssertCorrectString(t, "freedom", targets[1].Protocol)
+}
+
+func TestMatchRoute(t *testing.T) {
+	warp := ipCheckerResult{diagnosis: WarpDiagnosis{Status: WarpOK, EgressIP: "104.28.1.1"}}
+	server := ipCheckerResult{diagnosis: WarpDiagnosis{Status: WarpEgressServerIP, EgressIP: "1.2.3.4"}}
+	other := ipCheckerResult{diagnosis: WarpDiagnosis{Status: WarpEgressNotCloudflare, EgressIP: "5.6.7.8"}}
+	failed := ipCheckerResult{requestErr: errors.New("connection reset")}
+	unknown := ipCheckerResult{diagnosis: WarpDiagnosis{Status: WarpCheckerUnavailable, Err: errors.New("not a trace")}}
+
+	tests := []struct {
+		name     string
+		protocol string
+		result   ipCheckerResult
+		errMsg   string
+	}{
+		{"warp via wireguard", "wireguard", warp, ""},
+		{"direct via wireguard", "wireguard", server, "but the egress is the xray server address 1.2.3.4"},
+		{"direct via freedom", "freedom", server, ""},
+		{"warp via freedom", "freedom", warp, "but the egress is warp 104.28.1.1"},
+		{"blocked via blackhole", "blackhole", failed, ""},
+		{"passed via blackhole", "blackhole", warp, "but the request went through"},
+		{"other proxy", "vless", other, ""},
+		{"request failure", "wireguard", failed, "connection reset"},
+		{"egress unknown", "freedom", unknown, "could not be determined"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := routeTarget{Probe: RouteProbe{URL: "https://example.com", Outbound: "out"}, Protocol: tt.protocol}
+			err := matchRoute(target, tt.result)
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestCheckRoutes(t *testing.T) {
+	viaWarp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ip=104.28.1.1\ncolo=FRA\nwarp=on\n")
+	}))
+	defer viaWarp.Close()
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ip=1.2.3.4\ncolo=FRA\nwarp=off\n")
+	}))
+	defer direct.Close()
+
+	targets := []routeTarget{
+		{RouteProbe{URL: viaWarp.URL, Outbound: "warp"}, "wireguard"},
+		// Geosite update has moved the domain out of the warp rule
+		{RouteProbe{URL: direct.URL, Outbound: "warp"}, "wireguard"},
+		{RouteProbe{URL: direct.URL, Outbound: "direct"}, "freedom"},
+	}
+
+	statuses := checkRoutes(context.Background(), targets, nil, "1.2.3.4")
+	utils.AssertCorrectInt(t, 3, len(statuses))
+	if !statuses[0].OK() || statuses[1].OK() || !statuses[2].OK() {
+		t.Errorf("Unexpected route statuses: %v", statuses)
+	}
+
+	d := applyRouteStatuses(WarpDiagnosis{Status: WarpOK}, statuses)
+	utils.AssertCorrectString(t, WarpMisrouted.String(), d.Status.String())
+	utils.AssertCorrectString(t, statuses[1].String(), d.RouteReport())
+	if d.NeedsNewCredentials() {
+		t.Error("Expected misrouting not to need new credentials")
+	}
+
+	d = applyRouteStatuses(WarpDiagnosis{Status: WarpDegraded}, statuses)
+	utils.AssertCorrectString(t, WarpDegraded.String(), d.Status.String())
+	utils.AssertCorrectInt(t, 3, len(d.Routes))
+}
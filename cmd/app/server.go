@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/ilyakutilin/xray_maintainer/utils"
@@ -11,6 +12,9 @@ import (
 
 type Log struct {
 	Loglevel string `json:"loglevel"`
+	// Paths of the log files, xray logs to the stdout if empty
+	Access string `json:"access,omitempty"`
+	Error  string `json:"error,omitempty"`
 }
 
 func (l *Log) Validate() error {
@@ -583,8 +587,25 @@ func (r *SrvRouting) Validate() error {
 	return nil
 }
 
+// SrvAPI is the gRPC API of the xray server. Its HandlerService lets the warp
+// outbound be replaced without a restart.
+type SrvAPI struct {
+	Tag      string   `json:"tag"`
+	Listen   string   `json:"listen,omitempty"`
+	Services []string `json:"services"`
+}
+
+// Returns the address of the HandlerService, empty if it is not served
+func (a *SrvAPI) handlerAddress() string {
+	if a == nil || a.Listen == "" || !slices.Contains(a.Services, "HandlerService") {
+		return ""
+	}
+	return a.Listen
+}
+
 type ServerConfig struct {
 	Log       Log           `json:"log"`
+	API       *SrvAPI       `json:"api,omitempty"`
 	Inbounds  []SrvInbound  `json:"inbounds"`
 	Outbounds []SrvOutbound `json:"outbounds"`
 	Routing   SrvRouting    `json:"routing"`
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// XrayProcess is the command line of xray run by the direct service manager
+type XrayProcess struct {
+	// Arguments of the xray executable, run -c with the server config if empty
+	Args []string `koanf:"args"`
+	// Paths relative to the workdir unless absolute
+	PIDFile string `koanf:"pid_file"`
+	LogFile string `koanf:"log_file"`
+}
+
+func validateServiceManager(server XrayServer) error {
+	managers := []string{utils.ServiceSystemd, utils.ServiceOpenRC, utils.ServiceRunit,
+		utils.ServiceSupervisord, utils.ServiceDocker, utils.ServiceDirect}
+	if !slices.Contains(managers, server.ServiceManager) {
+		return fmt.Errorf("unknown service_manager %q, expected one of %v",
+			server.ServiceManager, managers)
+	}
+	if server.ServiceManager == utils.ServiceDirect && server.Process.PIDFile == "" {
+		return fmt.Errorf("the direct service manager shall have the pid_file")
+	}
+	return nil
+}
+
+// Returns the manager of the xray service controlled with the privileges. The
+// executor runs the commands of the init system or the supervisor, the shell if
+// nil.
+func newXrayService(xray Xray, privileges Privileges, workdir string, executor utils.CommandExecutor) (utils.ServiceManager, error) {
+	kind, name := xray.Server.ServiceManager, xray.Server.ServiceName
+	if kind != utils.ServiceDirect {
+		service, err := utils.NewCommandService(kind, name, executor)
+		if err != nil {
+			return nil, err
+		}
+		switch privileges.Mode {
+		case privilegeSudo:
+			// Fails instead of asking for the password
+			service.SetPrivilegePrefix("sudo -n")
+		case privilegePolkit, privilegeHelper:
+			service.SetPrivilegePrefix("")
+		}
+		if privileges.Mode != privilegeHelper {
+			return service, nil
+		}
+		executable, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the executable for the service helper: %w", err)
+		}
+		return &helperService{
+			ServiceManager: service,
+			executable:     executable,
+			kind:           kind,
+			name:           name,
+			executor:       executor,
+		}, nil
+	}
+
+	args := xray.Server.Process.Args
+	if len(args) == 0 {
+		args = []string{"run", "-c", xray.Server.ConfigFilePath}
+	}
+	return &utils.DirectProcess{
+		Executable: xray.ExecutableFilePath,
+		Args:       args,
+		PIDFile:    providerFilePath(workdir, xray.Server.Process.PIDFile),
+		LogFile:    providerFilePath(workdir, xray.Server.Process.LogFile),
+	}, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestValidateServiceManager(t *testing.T) {
+	tests := []struct {
+		name   string
+		server XrayServer
+		errMsg string
+	}{
+		{"systemd", XrayServer{ServiceManager: utils.ServiceSystemd}, ""},
+		{"docker", XrayServer{ServiceManager: utils.ServiceDocker}, ""},
+		{"direct", XrayServer{ServiceManager: utils.ServiceDirect, Process: XrayProcess{PIDFile: "xray.pid"}}, ""},
+		{"direct without pid file", XrayServer{ServiceManager: utils.ServiceDirect}, "shall have the pid_file"},
+		{"unknown", XrayServer{ServiceManager: "upstart"}, `unknown service_manager "upstart"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateServiceManager(tt.server)
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestNewXrayService(t *testing.T) {
+	xray := Xray{
+		Server: XrayServer{
+			ServiceName:    "xray",
+			ServiceManager: utils.ServiceRunit,
+			ConfigFilePath: "/opt/xray/config.json",
+			Process:        XrayProcess{PIDFile: "xray.pid", LogFile: "/var/log/xray.log"},
+		},
+		ExecutableFilePath: "/opt/xray/xray",
+	}
+
+	t.Run("command", func(t *testing.T) {
+		service, err := newXrayService(xray, Privileges{Mode: privilegeRoot}, "/opt/xray", nil)
+		utils.AssertNoError(t, err)
+		if _, ok := service.(*utils.CommandService); !ok {
+			t.Fatalf("Expected a command service, got %T", service)
+		}
+		utils.AssertCorrectString(t, "xray", service.Name())
+	})
+
+	t.Run("direct", func(t *testing.T) {
+		xray := xray
+		xray.Server.ServiceManager = utils.ServiceDirect
+		service, err := newXrayService(xray, Privileges{Mode: privilegeRoot}, "/opt/xray", nil)
+		utils.AssertNoError(t, err)
+		p, ok := service.(*utils.DirectProcess)
+		if !ok {
+			t.Fatalf("Expected a direct process, got %T", service)
+		}
+		utils.AssertCorrectString(t, "/opt/xray/xray", p.Executable)
+		utils.AssertCorrectString(t, "run -c /opt/xray/config.json", strings.Join(p.Args, " "))
+		utils.AssertCorrectString(t, "/opt/xray/xray.pid", p.PIDFile)
+		utils.AssertCorrectString(t, "/var/log/xray.log", p.LogFile)
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// Reports whether there is anything to check for the smoke test
+func (st SmokeTest) isEnabled() bool {
+	return st.CheckArch || len(st.Args) > 0 || st.Command != ""
+}
+
+// Compiles the regular expressions of the smoke test. A nil regexp is returned
+// for the one that is not set.
+func (st SmokeTest) compile() (expectedOutput, versionRegex *regexp.Regexp, err error) {
+	if st.ExpectedOutput != "" {
+		expectedOutput, err = regexp.Compile(st.ExpectedOutput)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid expected output regex %q: %w",
+				st.ExpectedOutput, err)
+		}
+	}
+	if st.VersionRegex != "" {
+		versionRegex, err = regexp.Compile(st.VersionRegex)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid version regex %q: %w",
+				st.VersionRegex, err)
+		}
+		if versionRegex.NumSubexp() < 1 {
+			return nil, nil, fmt.Errorf("version regex %q shall have a capture group",
+				st.VersionRegex)
+		}
+	}
+	return expectedOutput, versionRegex, nil
+}
+
+// Makes sure the smoke tests of the repos are consistent, so that a broken one
+// fails at startup rather than in the middle of an update
+func validateSmokeTests(repos []Repo) error {
+	for _, repo := range repos {
+		if _, _, err := repo.SmokeTest.compile(); err != nil {
+			return fmt.Errorf("smoke test of %s: %w", repo.Name, err)
+		}
+	}
+	return nil
+}
+
+// Runs the smoke test against the executable by the filePath. Returns the version
+// reported by the executable if the VersionRegex is set, or an empty string otherwise.
+func runSmokeTest(ctx context.Context, filePath string, st SmokeTest) (string, error) {
+	expectedOutput, versionRegex, err := st.compile()
+	if err != nil {
+		return "", err
+	}
+
+	if st.CheckArch {
+		if err := utils.CheckELFArch(filePath); err != nil {
+			return "", err
+		}
+	}
+
+	if len(st.Args) == 0 && st.Command == "" {
+		if st.ExpectedOutput != "" || st.VersionRegex != "" {
+			return "", errors.New("the smoke test expects some output but neither " +
+				"the args nor the command to run are set")
+		}
+		return "", nil
+	}
+
+	var output string
+	if st.Command != "" {
+		output, err = utils.ExecuteCommand(ctx, strings.ReplaceAll(st.Command, "{file}", filePath))
+	} else {
+		output, err = utils.ExecuteFile(ctx, filePath, st.Args...)
+	}
+	if err != nil {
+		return "", fmt.Errorf("the smoke test run failed: %w. Output: %s",
+			err, strings.TrimSpace(output))
+	}
+
+	if expectedOutput != nil {
+		if !expectedOutput.MatchString(output) {
+			return "", fmt.Errorf("the output of the smoke test run does not match "+
+				"%q. Output: %s", st.ExpectedOutput, strings.TrimSpace(output))
+		}
+	}
+
+	if versionRegex == nil {
+		return "", nil
+	}
+
+	matches := versionRegex.FindStringSubmatch(output)
+	if len(matches) < 2 {
+		return "", fmt.Errorf("could not detect the version in the output of the "+
+			"smoke test run using %q. Output: %s",
+			st.VersionRegex, strings.TrimSpace(output))
+	}
+
+	return matches[1], nil
+}
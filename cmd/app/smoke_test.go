@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+const fakeXrayVersionScript = `#!/bin/sh
+echo "Xray 25.4.30 (Xray, Penetrates Everything.) 8d4e5d5 (go1.24.2 linux/amd64)"
+echo "A unified platform for anti-censorship."
+`
+
+func writeScript(t testing.TB, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "xray")
+	if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatalf("Failed to write the script: %v", err)
+	}
+	return path
+}
+
+func TestRunSmokeTest(t *testing.T) {
+	tests := []struct {
+		name        string
+		script      string
+		smokeTest   SmokeTest
+		wantVersion string
+		errContains string
+	}{
+		{
+			name:        "version is detected",
+			script:      fakeXrayVersionScript,
+			smokeTest:   SmokeTest{Args: []string{"version"}, VersionRegex: `Xray (\d+\.\d+\.\d+)`},
+			wantVersion: "25.4.30",
+		},
+		{
+			name:   "expected output matches",
+			script: fakeXrayVersionScript,
+			smokeTest: SmokeTest{
+				Args:           []string{"version"},
+				ExpectedOutput: `anti-censorship`,
+			},
+		},
+		{
+			name:        "expected output does not match",
+			script:      fakeXrayVersionScript,
+			smokeTest:   SmokeTest{Args: []string{"version"}, ExpectedOutput: `^V2Ray`},
+			errContains: "does not match",
+		},
+		{
+			name:        "version not found",
+			script:      "#!/bin/sh\necho hello\n",
+			smokeTest:   SmokeTest{Args: []string{"version"}, VersionRegex: `Xray (\d+\.\d+\.\d+)`},
+			errContains: "could not detect the version",
+		},
+		{
+			name:        "executable fails",
+			script:      "#!/bin/sh\necho 'segmentation fault' >&2\nexit 139\n",
+			smokeTest:   SmokeTest{Args: []string{"version"}},
+			errContains: "segmentation fault",
+		},
+		{
+			name:   "custom command",
+			script: fakeXrayVersionScript,
+			smokeTest: SmokeTest{
+				Command:      "{file} version | head -n 1",
+				VersionRegex: `Xray (\d+\.\d+\.\d+)`,
+			},
+			wantVersion: "25.4.30",
+		},
+		{
+			name:        "script is not an ELF file",
+			script:      fakeXrayVersionScript,
+			smokeTest:   SmokeTest{CheckArch: true, Args: []string{"version"}},
+			errContains: "not a valid ELF file",
+		},
+		{
+			name:        "output expected without anything to run",
+			script:      fakeXrayVersionScript,
+			smokeTest:   SmokeTest{VersionRegex: `Xray (\d+\.\d+\.\d+)`},
+			errContains: "neither the args nor the command",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeScript(t, tt.script)
+			version, err := runSmokeTest(context.Background(), path, tt.smokeTest)
+			if tt.errContains != "" {
+				utils.AssertErrorContains(t, err, tt.errContains)
+				return
+			}
+			utils.AssertNoError(t, err)
+			utils.AssertCorrectString(t, tt.wantVersion, version)
+		})
+	}
+}
+
+func TestValidateSmokeTests(t *testing.T) {
+	tests := []struct {
+		name      string
+		smokeTest SmokeTest
+		errMsg    string
+	}{
+		{"valid", SmokeTest{Args: []string{"version"}, ExpectedOutput: `^Xray`, VersionRegex: `Xray (\d+\.\d+\.\d+)`}, ""},
+		{"no smoke test", SmokeTest{}, ""},
+		{"bad expected output", SmokeTest{Args: []string{"version"}, ExpectedOutput: `^Xray (`}, "invalid expected output regex"},
+		{"bad version regex", SmokeTest{Args: []string{"version"}, VersionRegex: `Xray [`}, "invalid version regex"},
+		{"version regex without a group", SmokeTest{Args: []string{"version"}, VersionRegex: `Xray \d+`}, "shall have a capture group"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSmokeTests([]Repo{{Name: "xray-core", SmokeTest: tt.smokeTest}})
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+type ScriptFileDownloader struct {
+	script string
+}
+
+func (d ScriptFileDownloader) Download(filePath string, url string) error {
+	return os.WriteFile(filePath, []byte(d.script), 0644)
+}
+
+func TestUpdateFileSmokeTest(t *testing.T) {
+	tests := []struct {
+		name        string
+		script      string
+		wantContent string
+		wantWarning string
+		wantVersion string
+	}{
+		{
+			name:        "passing smoke test records the version",
+			script:      fakeXrayVersionScript,
+			wantContent: fakeXrayVersionScript,
+			wantVersion: "25.4.30",
+		},
+		{
+			name:        "failing smoke test restores the old file",
+			script:      "<html>502 Bad Gateway</html>",
+			wantContent: "old xray",
+			wantWarning: "failed the smoke test",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workdir := t.TempDir()
+			filePath := filepath.Join(workdir, "xray")
+			if err := os.WriteFile(filePath, []byte("old xray"), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			testApp := &Application{
+				debug:   true,
+				logger:  GetLogger(false),
+				workdir: workdir,
+			}
+
+			file := File{
+				repo: Repo{
+					Name:       "xray-core",
+					Filename:   "xray",
+					Executable: true,
+					SmokeTest: SmokeTest{
+						Args:         []string{"version"},
+						VersionRegex: `Xray (\d+\.\d+\.\d+)`,
+					},
+				},
+				releaseChecker: MockReleaseChecker{},
+				downloader:     ScriptFileDownloader{script: tt.script},
+			}
+
+			if _, err := testApp.updateFile(context.Background(), file); err != nil {
+				t.Fatalf("updateFile() error = %v", err)
+			}
+
+			content, err := os.ReadFile(filePath)
+			utils.AssertNoError(t, err)
+			utils.AssertCorrectString(t, tt.wantContent, string(content))
+
+			if tt.wantWarning != "" &&
+				!strings.Contains(strings.Join(testApp.warnings, "\n"), tt.wantWarning) {
+				t.Errorf("expected a warning containing %q, got %v",
+					tt.wantWarning, testApp.warnings)
+			}
+
+			versions, err := loadVersionsState(filepath.Join(workdir, versionsFileName))
+			utils.AssertNoError(t, err)
+			var version string
+			if fv, ok := versions.Files["xray"]; ok {
+				version = fv.DetectedVersion
+			}
+			utils.AssertCorrectString(t, tt.wantVersion, version)
+
+			if utils.FileExists(filePath + ".backup") {
+				t.Errorf("The backup file has not been removed")
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+// A stand-in for the xray executable in the end-to-end tests. Reads the client
+// config passed with -c, prints the startup banner and serves an HTTP proxy on
+// the port of the http or socks inbound, forwarding every request to the address
+// of the first outbound server, which in the tests is an HTTP proxy as well. The
+// API inbound only accepts the connections, which "api statsquery" dials.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+type account struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+type config struct {
+	Inbounds []struct {
+		Port     int    `json:"port"`
+		Protocol string `json:"protocol"`
+		Settings struct {
+			Accounts []account `json:"accounts"`
+			UDP      bool      `json:"udp"`
+		} `json:"settings"`
+	} `json:"inbounds"`
+	Outbounds []struct {
+		Settings struct {
+			Servers []struct {
+				Address string `json:"address"`
+				Port    int    `json:"port"`
+			} `json:"servers"`
+		} `json:"settings"`
+	} `json:"outbounds"`
+}
+
+func main() {
+	configPath := flag.String("c", "", "path to the config")
+	flag.Parse()
+
+	if len(flag.Args()) > 0 && flag.Arg(0) == "version" {
+		fmt.Println("Xray 25.1.1 (Xray, Penetrates Everything.) fake (go1.24 linux/amd64)")
+		return
+	}
+	if len(flag.Args()) > 1 && flag.Arg(0) == "api" {
+		statsQuery(flag.Args()[2:])
+		return
+	}
+
+	raw, err := os.ReadFile(*configPath)
+	if err != nil {
+		fmt.Printf("Failed to start: %v\n", err)
+		os.Exit(23)
+	}
+	var cfg config
+	if err := json.Unmarshal(raw, &cfg); err != nil || len(cfg.Inbounds) == 0 ||
+		len(cfg.Outbounds) == 0 || len(cfg.Outbounds[0].Settings.Servers) == 0 {
+		fmt.Printf("Failed to start: invalid config %s\n", *configPath)
+		os.Exit(23)
+	}
+
+	server := cfg.Outbounds[0].Settings.Servers[0]
+	upstream := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(server.Address, strconv.Itoa(server.Port)),
+	}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(upstream)}}
+
+	var proxy func()
+	for _, inbound := range cfg.Inbounds {
+		l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(inbound.Port)))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start: %v\n", err)
+			os.Exit(23)
+		}
+		accounts, udp := inbound.Settings.Accounts, inbound.Settings.UDP
+		switch inbound.Protocol {
+		case "http":
+			proxy = func() { log.Fatal(http.Serve(l, httpProxy(client, accounts))) }
+		case "socks":
+			proxy = func() { log.Fatal(serveSOCKS(l, client, accounts, udp)) }
+		default:
+			go acceptAndClose(l)
+		}
+	}
+	if proxy == nil {
+		fmt.Fprintln(os.Stderr, "Failed to start: no proxy inbound")
+		os.Exit(23)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		os.Exit(0)
+	}()
+
+	fmt.Println("Xray 25.1.1 started")
+	proxy()
+}
+
+// Passes the request to the upstream and returns its response
+func forward(client *http.Client, r *http.Request) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, r.URL.String(), r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+func httpProxy(client *http.Client, accounts []account) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(accounts) > 0 {
+			user, pass, ok := proxyCredentials(r)
+			if !ok || !authorized(accounts, user, pass) {
+				w.Header().Set("Proxy-Authenticate", "Basic")
+				http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+				return
+			}
+		}
+		resp, err := forward(client, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	})
+}
+
+func proxyCredentials(r *http.Request) (string, string, bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return "", "", false
+	}
+	req := http.Request{Header: http.Header{"Authorization": {auth}}}
+	return req.BasicAuth()
+}
+
+func authorized(accounts []account, user, pass string) bool {
+	for _, a := range accounts {
+		if a.User == user && a.Pass == pass {
+			return true
+		}
+	}
+	return false
+}
+func acceptAndClose(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}
+}
+
+// Succeeds if the API inbound passed with --server accepts the connections
+func statsQuery(args []string) {
+	flags := flag.NewFlagSet("statsquery", flag.ExitOnError)
+	server := flags.String("server", "127.0.0.1:8080", "address of the API")
+	flags.Parse(args)
+
+	conn, err := net.Dial("tcp", *server)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	conn.Close()
+	fmt.Println("{}")
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Serves SOCKS5 CONNECT and, if enabled, UDP ASSOCIATE. The connections are
+// expected to carry plain HTTP, whose requests are passed to the upstream the
+// same way the http inbound does. The datagrams go to the destinations directly.
+func serveSOCKS(l net.Listener, client *http.Client, accounts []account, udp bool) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			command, target, err := socksHandshake(r, conn, accounts)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "socks:", err)
+				return
+			}
+			switch {
+			case command == 0x01:
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+				relayHTTP(r, conn, client, target)
+			case command == 0x03 && udp:
+				associateUDP(r, conn)
+			default:
+				conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			}
+		}()
+	}
+}
+
+// Negotiates the authentication and reads the request. Returns the command and
+// the requested destination.
+func socksHandshake(r *bufio.Reader, w io.Writer, accounts []account) (byte, string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return 0, "", err
+	}
+
+	method := byte(0x00)
+	if len(accounts) > 0 {
+		method = 0x02
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == method
+	}
+	if !offered {
+		w.Write([]byte{0x05, 0xff})
+		return 0, "", errors.New("no acceptable authentication method")
+	}
+	w.Write([]byte{0x05, method})
+
+	if method == 0x02 {
+		if _, err := r.ReadByte(); err != nil {
+			return 0, "", err
+		}
+		user, err := readSOCKSString(r)
+		if err != nil {
+			return 0, "", err
+		}
+		pass, err := readSOCKSString(r)
+		if err != nil {
+			return 0, "", err
+		}
+		if !authorized(accounts, user, pass) {
+			w.Write([]byte{0x01, 0x01})
+			return 0, "", errors.New("wrong credentials")
+		}
+		w.Write([]byte{0x01, 0x00})
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return 0, "", err
+	}
+	target, err := readSOCKSAddr(r)
+	if err != nil {
+		return 0, "", err
+	}
+	return request[1], target, nil
+}
+
+func readSOCKSString(r *bufio.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+// Reads the address type, the address and the port
+func readSOCKSAddr(r *bufio.Reader) (string, error) {
+	atyp, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	var host string
+	switch atyp {
+	case 0x01, 0x04:
+		ip := make([]byte, 4)
+		if atyp == 0x04 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		if host, err = readSOCKSString(r); err != nil {
+			return "", err
+		}
+	default:
+		return "", fmt.Errorf("unsupported address type %d", atyp)
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// Passes the HTTP requests read from the connection to the upstream
+func relayHTTP(r *bufio.Reader, conn net.Conn, client *http.Client, target string) {
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		req.URL.Scheme = "http"
+		req.URL.Host = target
+		resp, err := forward(client, req)
+		if err != nil {
+			resp = &http.Response{
+				StatusCode: http.StatusBadGateway,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{},
+				Body:       http.NoBody,
+			}
+		}
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Relays the datagrams of the client for as long as the control connection lives
+func associateUDP(r *bufio.Reader, conn net.Conn) {
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer relay.Close()
+	addr := relay.LocalAddr().(*net.UDPAddr)
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, byte(addr.Port >> 8), byte(addr.Port)})
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, client, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			datagram := bufio.NewReader(bytes.NewReader(buf[3:n]))
+			target, err := readSOCKSAddr(datagram)
+			if err != nil {
+				continue
+			}
+			payload, _ := io.ReadAll(datagram)
+			header := append([]byte{0x00, 0x00, 0x00}, buf[3:n-len(payload)]...)
+			go exchangeUDP(relay, client, target, header, payload)
+		}
+	}()
+	io.Copy(io.Discard, r)
+}
+
+// Sends the payload to the target and the reply back to the client
+func exchangeUDP(relay *net.UDPConn, client *net.UDPAddr, target string, header, payload []byte) {
+	conn, err := net.Dial("udp", target)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(payload); err != nil {
+		return
+	}
+	reply := make([]byte, 65535)
+	n, err := conn.Read(reply)
+	if err != nil {
+		return
+	}
+	relay.WriteToUDP(append(header, reply[:n]...), client)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+const (
+	udpProbeDNS  = "dns"
+	udpProbeEcho = "echo"
+
+	udpProbeTimeout = 3 * time.Second
+	// Sent by the echo probe if no query is set
+	udpProbeEchoPayload = "xray_maintainer udp probe"
+)
+
+// UDPProbe is a UDP exchange made through the verification client, since QUIC
+// and DNS may break under warp while TCP works. Requires the socks proxy.
+type UDPProbe struct {
+	// dns or echo
+	Type string `koanf:"type"`
+	// host:port of the DNS server or of the UDP echo service
+	Address string `koanf:"address"`
+	// Name resolved by the dns probe, payload sent by the echo probe
+	Query string `koanf:"query"`
+}
+
+func (p UDPProbe) String() string {
+	return fmt.Sprintf("%s %s", p.Type, p.Address)
+}
+
+// Makes sure every probe has a known type and a valid address
+func validateUDPProbes(probes []UDPProbe) error {
+	for i, p := range probes {
+		if p.Type != udpProbeDNS && p.Type != udpProbeEcho {
+			return fmt.Errorf("unknown type %q of udp probe #%d, expected %s or %s",
+				p.Type, i+1, udpProbeDNS, udpProbeEcho)
+		}
+		if _, _, err := net.SplitHostPort(p.Address); err != nil {
+			return fmt.Errorf("invalid address of udp probe #%d: %w", i+1, err)
+		}
+		if p.Type == udpProbeDNS && p.Query == "" {
+			return fmt.Errorf("udp probe #%d shall have the name to resolve as the query", i+1)
+		}
+	}
+	return nil
+}
+
+// Sends the datagram and returns the reply
+type udpExchange func(ctx context.Context, payload []byte) ([]byte, error)
+
+// Exchanges the datagrams with the address via the UDP relay of the proxy
+func proxiedUDPExchange(proxy *utils.Proxy, addr string) udpExchange {
+	return func(ctx context.Context, payload []byte) ([]byte, error) {
+		conn, err := utils.DialSOCKS5UDP(ctx, proxy)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+
+		if err := conn.WriteTo(payload, addr); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// Exchanges the datagrams with the address directly
+func directUDPExchange(addr string) udpExchange {
+	return func(ctx context.Context, payload []byte) ([]byte, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+
+		if _, err := conn.Write(payload); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// Makes the exchange of the probe and checks the reply
+func (p UDPProbe) run(ctx context.Context, exchange udpExchange) error {
+	ctx, cancel := context.WithTimeout(ctx, udpProbeTimeout)
+	defer cancel()
+
+	switch p.Type {
+	case udpProbeDNS:
+		id := uint16(rand.Uint32())
+		query, err := utils.BuildDNSQuery(id, p.Query, utils.DNSTypeA)
+		if err != nil {
+			return err
+		}
+		reply, err := exchange(ctx, query)
+		if err != nil {
+			return err
+		}
+		answers, err := utils.ParseDNSResponse(id, reply)
+		if err != nil {
+			return err
+		}
+		if answers == 0 {
+			return fmt.Errorf("no records for %s", p.Query)
+		}
+		return nil
+	default:
+		payload := []byte(p.Query)
+		if len(payload) == 0 {
+			payload = []byte(udpProbeEchoPayload)
+		}
+		reply, err := exchange(ctx, payload)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(payload, reply) {
+			return fmt.Errorf("the echo reply %q does not match", truncate(string(reply), 64))
+		}
+		return nil
+	}
+}
+
+// Result of a single UDP probe
+type UDPStatus struct {
+	Probe UDPProbe
+	// Set if the exchange through the proxy has failed
+	Err error
+	// The exchange fails without the proxy as well, so the failure says
+	// nothing about warp
+	Inconclusive bool
+}
+
+func (s UDPStatus) OK() bool {
+	return s.Err == nil
+}
+
+func (s UDPStatus) String() string {
+	switch {
+	case s.OK():
+		return fmt.Sprintf("%s: ok", s.Probe)
+	case s.Inconclusive:
+		return fmt.Sprintf("%s: inconclusive, fails without the proxy as well: %v", s.Probe, s.Err)
+	default:
+		return fmt.Sprintf("%s: %v", s.Probe, s.Err)
+	}
+}
+
+// Makes every probe through the proxy. A failed probe is repeated without the
+// proxy to tell a broken tunnel from an unavailable destination.
+func checkUDPProbes(ctx context.Context, probes []UDPProbe, proxy *utils.Proxy) []UDPStatus {
+	var statuses []UDPStatus
+	for _, p := range probes {
+		s := UDPStatus{Probe: p, Err: p.run(ctx, proxiedUDPExchange(proxy, p.Address))}
+		if s.Err != nil && p.run(ctx, directUDPExchange(p.Address)) != nil {
+			s.Inconclusive = true
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// Marks an operational diagnosis as passing TCP only if any of the conclusive
+// probes has failed
+func applyUDPStatuses(d WarpDiagnosis, statuses []UDPStatus) WarpDiagnosis {
+	d.UDP = statuses
+	if !d.OK() {
+		return d
+	}
+
+	var failed []string
+	for _, s := range statuses {
+		if !s.OK() && !s.Inconclusive {
+			failed = append(failed, s.String())
+		}
+	}
+	if len(failed) > 0 {
+		d.Status = WarpUDPBroken
+		d.Err = fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return d
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestValidateUDPProbes(t *testing.T) {
+	tests := []struct {
+		name   string
+		probes []UDPProbe
+		errMsg string
+	}{
+		{"valid", []UDPProbe{{Type: udpProbeDNS, Address: "1.1.1.1:53", Query: "cloudflare.com"},
+			{Type: udpProbeEcho, Address: "[::1]:7"}}, ""},
+		{"no probes", nil, ""},
+		{"unknown type", []UDPProbe{{Type: "quic", Address: "1.1.1.1:443"}}, `unknown type "quic"`},
+		{"no port", []UDPProbe{{Type: udpProbeEcho, Address: "1.1.1.1"}}, "invalid address"},
+		{"dns without the name", []UDPProbe{{Type: udpProbeDNS, Address: "1.1.1.1:53"}}, "name to resolve"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUDPProbes(tt.probes)
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+// Answers every DNS query with the number of the records
+func dnsReply(answers uint16) udpExchange {
+	return func(ctx context.Context, query []byte) ([]byte, error) {
+		reply := append([]byte(nil), query[:12]...)
+		binary.BigEndian.PutUint16(reply[2:4], 0x8180)
+		binary.BigEndian.PutUint16(reply[6:8], answers)
+		return reply, nil
+	}
+}
+
+func TestUDPProbeRun(t *testing.T) {
+	echo := func(ctx context.Context, payload []byte) ([]byte, error) { return payload, nil }
+	garbage := func(ctx context.Context, payload []byte) ([]byte, error) { return []byte("garbage"), nil }
+	timeout := func(ctx context.Context, payload []byte) ([]byte, error) {
+		return nil, errors.New("i/o timeout")
+	}
+	dns := UDPProbe{Type: udpProbeDNS, Address: "1.1.1.1:53", Query: "cloudflare.com"}
+	echoProbe := UDPProbe{Type: udpProbeEcho, Address: "127.0.0.1:7"}
+
+	tests := []struct {
+		name     string
+		probe    UDPProbe
+		exchange udpExchange
+		errMsg   string
+	}{
+		{"dns answered", dns, dnsReply(1), ""},
+		{"dns without records", dns, dnsReply(0), "no records for cloudflare.com"},
+		{"dns garbage", dns, garbage, "too short"},
+		{"echo", echoProbe, echo, ""},
+		{"echo mismatch", echoProbe, garbage, "does not match"},
+		{"timeout", echoProbe, timeout, "i/o timeout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.probe.run(context.Background(), tt.exchange)
+			if tt.errMsg == "" {
+				utils.AssertNoError(t, err)
+			} else {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+// Serves the UDP stand-in answering with the reply function
+func startUDPServer(t *testing.T, reply func([]byte) []byte) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	utils.AssertNoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(reply(buf[:n]), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func startUDPStandIns(t *testing.T) (echo string, dns string) {
+	echo = startUDPServer(t, func(b []byte) []byte { return b })
+	dns = startUDPServer(t, func(query []byte) []byte {
+		reply, _ := dnsReply(1)(context.Background(), query)
+		return reply
+	})
+	return echo, dns
+}
+
+func TestCheckUDPProbes(t *testing.T) {
+	fakeXray := buildFakeXray(t)
+	echo, dns := startUDPStandIns(t)
+	// Nothing listens on the port, so the probe fails without the proxy as well
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	utils.AssertNoError(t, err)
+	closed := listener.LocalAddr().String()
+	listener.Close()
+	probes := []UDPProbe{
+		{Type: udpProbeEcho, Address: echo},
+		{Type: udpProbeDNS, Address: dns, Query: "cloudflare.com"},
+	}
+
+	tests := []struct {
+		name string
+		udp  bool
+		ok   bool
+	}{
+		{"udp passes", true, true},
+		{"udp is not relayed", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testClientConfig(t)
+			config.Inbounds[0].Protocol = "socks"
+			config.Inbounds[0].Settings = &ClientInboundSettings{UDP: tt.udp}
+			config.setProxyAccount("user", "pass")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			client, err := startVerificationClient(ctx, fakeXray, config)
+			utils.AssertNoError(t, err)
+			defer client.stop()
+			utils.AssertNoError(t, client.waitReady(ctx))
+
+			statuses := checkUDPProbes(ctx, probes, config.proxy())
+			utils.AssertCorrectInt(t, 2, len(statuses))
+			for _, s := range statuses {
+				utils.AssertCorrectBool(t, tt.ok, s.OK())
+				if s.Inconclusive {
+					t.Errorf("Expected %s to be conclusive", s)
+				}
+			}
+
+			d := applyUDPStatuses(WarpDiagnosis{Status: WarpOK}, statuses)
+			if tt.ok {
+				utils.AssertCorrectString(t, WarpOK.String(), d.Status.String())
+			} else {
+				utils.AssertCorrectString(t, WarpUDPBroken.String(), d.Status.String())
+				utils.AssertCorrectString(t, d.Err.Error(), d.UDPReport())
+			}
+		})
+	}
+
+	t.Run("unavailable destination is inconclusive", func(t *testing.T) {
+		config := testClientConfig(t)
+		config.Inbounds[0].Protocol = "socks"
+		config.Inbounds[0].Settings = &ClientInboundSettings{UDP: true}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		client, err := startVerificationClient(ctx, fakeXray, config)
+		utils.AssertNoError(t, err)
+		defer client.stop()
+		utils.AssertNoError(t, client.waitReady(ctx))
+
+		statuses := checkUDPProbes(ctx, []UDPProbe{{Type: udpProbeEcho, Address: closed}}, config.proxy())
+		if statuses[0].OK() || !statuses[0].Inconclusive {
+			t.Errorf("Expected the probe to be inconclusive, got %s", statuses[0])
+		}
+		d := applyUDPStatuses(WarpDiagnosis{Status: WarpOK}, statuses)
+		utils.AssertCorrectString(t, WarpOK.String(), d.Status.String())
+	})
+}
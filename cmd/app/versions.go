@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+const (
+	versionsFileName = "versions.json"
+	// Format version of the versions file. The first format had no version and was
+	// a plain map of the file names to their release tags.
+	versionsFormat = 2
+)
+
+// How a managed file ended up in the workdir
+const (
+	sourceUpdate    = "update"
+	sourceMigrated  = "migrated"
+	sourceReinstall = "reinstall"
+)
+
+// FileVersion is what is known about an installed managed file
+type FileVersion struct {
+	Tag         string    `json:"tag"`
+	PreviousTag string    `json:"previous_tag,omitempty"`
+	Repo        string    `json:"repo,omitempty"`
+	Source      string    `json:"source"`
+	DownloadURL string    `json:"download_url,omitempty"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Mode        string    `json:"mode,omitempty"`
+	InstalledAt time.Time `json:"installed_at,omitzero"`
+	// The version reported by the executable itself during the smoke test
+	DetectedVersion string `json:"detected_version,omitempty"`
+	// The other files extracted from the release archive, keyed by the path
+	// relative to the workdir unless outside of it
+	Extras map[string]ExtractedFile `json:"extras,omitempty"`
+}
+
+// ExtractedFile is the record of a file extracted from a release archive
+// alongside with the main one
+type ExtractedFile struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+	Mode   string `json:"mode,omitempty"`
+}
+
+// Returns the path relative to the workdir if it is inside of it, as is otherwise
+func workdirRelativePath(workdir string, path string) string {
+	rel, err := filepath.Rel(workdir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return rel
+}
+
+// VersionsState is the contents of the versions file in the workdir
+type VersionsState struct {
+	Format int                     `json:"format"`
+	Files  map[string]*FileVersion `json:"files"`
+}
+
+func newVersionsState() *VersionsState {
+	return &VersionsState{
+		Format: versionsFormat,
+		Files:  make(map[string]*FileVersion),
+	}
+}
+
+// Converts the contents of the first (unversioned) format of the versions file
+func migrateLegacyVersions(legacy map[string]string) *VersionsState {
+	state := newVersionsState()
+
+	for fileName, tag := range legacy {
+		state.Files[fileName] = &FileVersion{Tag: tag, Source: sourceMigrated}
+	}
+
+	return state
+}
+
+// Reads the versions file, migrating it from the older format if necessary.
+// A missing file results in an empty state.
+func loadVersionsState(versionFilePath string) (*VersionsState, error) {
+	data, err := os.ReadFile(versionFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return newVersionsState(), nil
+		}
+		return nil, fmt.Errorf("failed to read the versions file: %w", err)
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return newVersionsState(), nil
+	}
+
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, fmt.Errorf("failed to parse the versions file: %w", err)
+	}
+
+	// A file named "format" could have been tracked by the legacy format,
+	// but then its value is a string rather than a number
+	if raw, ok := probe["format"]; !ok || bytes.HasPrefix(raw, []byte(`"`)) {
+		var legacy map[string]string
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, fmt.Errorf("failed to parse the versions file of the legacy "+
+				"format: %w", err)
+		}
+		return migrateLegacyVersions(legacy), nil
+	}
+
+	state := newVersionsState()
+	if err := utils.ParseJSON(data, state, false); err != nil {
+		return nil, fmt.Errorf("failed to parse the versions file: %w", err)
+	}
+	if state.Format > versionsFormat {
+		return nil, fmt.Errorf("the versions file has format %d which is newer than "+
+			"the supported format %d", state.Format, versionsFormat)
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]*FileVersion)
+	}
+	state.Format = versionsFormat
+
+	return state, nil
+}
+
+// Writes the versions file atomically so that an interrupted write never leaves
+// a corrupted file behind
+func (s *VersionsState) save(versionFilePath string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomically(versionFilePath, bytes.NewReader(data), 0644)
+}
+
+// Returns the release tag of the installed file, or an empty string if unknown
+func (s *VersionsState) tag(fileName string) string {
+	if fv, ok := s.Files[fileName]; ok {
+		return fv.Tag
+	}
+	return ""
+}
+
+// Records the newly installed file in the versions file
+func recordInstalledVersion(versionFilePath string, fileName string, fv FileVersion) error {
+	if fileName == "" {
+		return errors.New("file name cannot be empty")
+	}
+
+	state, err := loadVersionsState(versionFilePath)
+	if err != nil {
+		return err
+	}
+
+	if old, ok := state.Files[fileName]; ok && old.Tag != fv.Tag {
+		fv.PreviousTag = old.Tag
+	} else if ok {
+		fv.PreviousTag = old.PreviousTag
+	}
+
+	state.Files[fileName] = &fv
+	return state.save(versionFilePath)
+}
+
+// Turns the GitHub "latest release" download URL into the URL of the asset
+// of the specific release, so that exactly the same file can be downloaded again
+func pinnedDownloadURL(downloadURL string, tag string) string {
+	const latest = "/releases/latest/download/"
+	if tag == "" || !strings.Contains(downloadURL, latest) {
+		return downloadURL
+	}
+	return strings.Replace(downloadURL, latest, "/releases/download/"+tag+"/", 1)
+}
+
+// Comparison of an installed managed file with the latest available release
+type versionReport struct {
+	File            string    `json:"file"`
+	Repo            string    `json:"repo"`
+	Installed       string    `json:"installed"`
+	Latest          string    `json:"latest"`
+	Status          string    `json:"status"`
+	DetectedVersion string    `json:"detected_version,omitempty"`
+	InstalledAt     time.Time `json:"installed_at,omitzero"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// Compares the installed versions of the files managed by the repos with
+// the latest available releases
+func (app *Application) versionsReport(repos []Repo, fileCreator func(repo Repo) File) ([]versionReport, error) {
+	state, err := loadVersionsState(filepath.Join(app.workdir, versionsFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []versionReport
+	for _, repo := range repos {
+		r := versionReport{File: repo.Filename, Repo: repo.Name}
+
+		installed := utils.FileExists(filepath.Join(app.workdir, repo.Filename))
+		if fv, ok := state.Files[repo.Filename]; ok && installed {
+			r.Installed = fv.Tag
+			r.DetectedVersion = fv.DetectedVersion
+			r.InstalledAt = fv.InstalledAt
+		}
+
+		latest, err := fileCreator(repo).releaseChecker.GetLatestReleaseTag(repo.ReleaseInfoURL)
+		if err != nil {
+			r.Error = err.Error()
+		}
+		r.Latest = latest
+
+		switch {
+		case !installed:
+			r.Status = "not installed"
+		case r.Installed == "" || r.Latest == "":
+			r.Status = "unknown"
+		case r.Installed == r.Latest:
+			r.Status = "up-to-date"
+		default:
+			r.Status = "outdated"
+		}
+
+		reports = append(reports, r)
+	}
+
+	return reports, nil
+}
+
+func writeVersionsTable(w io.Writer, reports []versionReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "FILE\tINSTALLED\tLATEST\tSTATUS\tDETECTED\tINSTALLED AT")
+
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	for _, r := range reports {
+		installedAt := "-"
+		if !r.InstalledAt.IsZero() {
+			installedAt = r.InstalledAt.Local().Format("2006-01-02 15:04")
+		}
+		latest := dash(r.Latest)
+		if r.Error != "" {
+			latest = "error: " + r.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", r.File, dash(r.Installed),
+			latest, r.Status, dash(r.DetectedVersion), installedAt)
+	}
+
+	return tw.Flush()
+}
+
+// Implements the "versions" command which prints the installed versions
+// of the managed files along with the latest available ones
+func (app *Application) runVersionsCommand(args []string, repos []Repo, fileCreator func(repo Repo) File, out io.Writer) error {
+	fs := flag.NewFlagSet("versions", flag.ContinueOnError)
+	fs.SetOutput(out)
+	asJSON := fs.Bool("json", false, "print the versions in JSON format")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	reports, err := app.versionsReport(repos, fileCreator)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	}
+
+	return writeVersionsTable(out, reports)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestLoadVersionsState(t *testing.T) {
+	t.Run("Versions file does not exist", func(t *testing.T) {
+		state, err := loadVersionsState(filepath.Join(t.TempDir(), "doesnotexist.json"))
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 0, len(state.Files))
+		utils.AssertCorrectInt(t, versionsFormat, state.Format)
+	})
+
+	tests := []struct {
+		name          string
+		fileContents  string
+		wantTags      map[string]string
+		wantDetected  map[string]string
+		wantSource    string
+		errorExpected bool
+	}{
+		{
+			name:         "Legacy format is migrated",
+			fileContents: `{"xray": "v25.4.30", "geoip.dat": "202505050146"}`,
+			wantTags:     map[string]string{"xray": "v25.4.30", "geoip.dat": "202505050146"},
+			wantSource:   sourceMigrated,
+		},
+		{
+			name:         "Legacy format with a file named format",
+			fileContents: `{"format": "1.0"}`,
+			wantTags:     map[string]string{"format": "1.0"},
+			wantSource:   sourceMigrated,
+		},
+		{
+			name:         "Empty legacy file",
+			fileContents: `{}`,
+			wantTags:     map[string]string{},
+		},
+		{
+			name:         "Empty file",
+			fileContents: ``,
+			wantTags:     map[string]string{},
+		},
+		{
+			name: "Current format",
+			fileContents: `{"format": 2, "files": {"xray": {"tag": "v25.4.30", ` +
+				`"source": "update", "detected_version": "25.4.30"}}}`,
+			wantTags:     map[string]string{"xray": "v25.4.30"},
+			wantDetected: map[string]string{"xray": "25.4.30"},
+			wantSource:   sourceUpdate,
+		},
+		{
+			name:          "Newer format",
+			fileContents:  `{"format": 3, "files": {}}`,
+			errorExpected: true,
+		},
+		{
+			name:          "Malformed file",
+			fileContents:  `{"xray": `,
+			errorExpected: true,
+		},
+		{
+			name:          "Legacy format with wrong type of value",
+			fileContents:  `{"xray": 5}`,
+			errorExpected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versionsFile := utils.CreateTempFilePath(t)
+			if err := os.WriteFile(versionsFile, []byte(tt.fileContents), 0644); err != nil {
+				t.Fatalf("Failed to write test data: %v", err)
+			}
+
+			state, err := loadVersionsState(versionsFile)
+			if tt.errorExpected {
+				utils.AssertError(t, err)
+				return
+			}
+			utils.AssertNoError(t, err)
+
+			utils.AssertCorrectInt(t, len(tt.wantTags), len(state.Files))
+			for fileName, tag := range tt.wantTags {
+				utils.AssertCorrectString(t, tag, state.tag(fileName))
+				utils.AssertCorrectString(t, tt.wantDetected[fileName],
+					state.Files[fileName].DetectedVersion)
+				utils.AssertCorrectString(t, tt.wantSource, state.Files[fileName].Source)
+			}
+		})
+	}
+}
+
+func TestRecordInstalledVersion(t *testing.T) {
+	versionsFile := filepath.Join(t.TempDir(), versionsFileName)
+	if err := os.WriteFile(versionsFile, []byte(`{"xray": "v1", "geoip.dat": "202501"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := recordInstalledVersion(versionsFile, "xray", FileVersion{
+		Tag:         "v2",
+		Source:      sourceUpdate,
+		InstalledAt: time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC),
+	})
+	utils.AssertNoError(t, err)
+
+	// Reinstalling the same tag keeps the previous tag
+	err = recordInstalledVersion(versionsFile, "xray", FileVersion{Tag: "v2", Source: sourceUpdate})
+	utils.AssertNoError(t, err)
+
+	err = recordInstalledVersion(versionsFile, "", FileVersion{Tag: "v2"})
+	utils.AssertError(t, err)
+
+	data, err := os.ReadFile(versionsFile)
+	utils.AssertNoError(t, err)
+
+	var raw struct {
+		Format int                     `json:"format"`
+		Files  map[string]*FileVersion `json:"files"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatalf("The versions file is not valid JSON: %v", err)
+	}
+	utils.AssertCorrectInt(t, versionsFormat, raw.Format)
+	utils.AssertCorrectString(t, "v2", raw.Files["xray"].Tag)
+	utils.AssertCorrectString(t, "v1", raw.Files["xray"].PreviousTag)
+	utils.AssertCorrectString(t, "202501", raw.Files["geoip.dat"].Tag)
+
+	// No temporary files are left behind by the atomic write
+	entries, err := os.ReadDir(filepath.Dir(versionsFile))
+	utils.AssertNoError(t, err)
+	utils.AssertCorrectInt(t, 1, len(entries))
+}
+
+func TestPinnedDownloadURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		tag  string
+		want string
+	}{
+		{
+			url:  "https://github.com/XTLS/Xray-core/releases/latest/download/Xray-linux-64.zip",
+			tag:  "v25.4.30",
+			want: "https://github.com/XTLS/Xray-core/releases/download/v25.4.30/Xray-linux-64.zip",
+		},
+		{
+			url:  "https://example.com/xray.zip",
+			tag:  "v25.4.30",
+			want: "https://example.com/xray.zip",
+		},
+		{
+			url:  "https://github.com/XTLS/Xray-core/releases/latest/download/Xray-linux-64.zip",
+			tag:  "",
+			want: "https://github.com/XTLS/Xray-core/releases/latest/download/Xray-linux-64.zip",
+		},
+	}
+
+	for _, tt := range tests {
+		utils.AssertCorrectString(t, tt.want, pinnedDownloadURL(tt.url, tt.tag))
+	}
+}
+
+func TestRunVersionsCommand(t *testing.T) {
+	workdir := t.TempDir()
+	for _, name := range []string{"xray", "geoip.dat", "geosite.dat"} {
+		if err := os.WriteFile(filepath.Join(workdir, name), []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions := `{"xray": "1.2.3", "geoip.dat": "1.0.0"}`
+	if err := os.WriteFile(filepath.Join(workdir, versionsFileName), []byte(versions), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testApp := &Application{
+		debug:   true,
+		logger:  GetLogger(false),
+		workdir: workdir,
+	}
+
+	repos := []Repo{
+		{Name: "xray-core", Filename: "xray"},
+		{Name: "geoip", Filename: "geoip.dat"},
+		{Name: "geosite", Filename: "geosite.dat"},
+		{Name: "cf_cred_generator", Filename: "cf_cred_generator"},
+	}
+
+	fileCreator := func(repo Repo) File {
+		return File{repo: repo, releaseChecker: MockReleaseChecker{}}
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		err := testApp.runVersionsCommand([]string{"-json"}, repos, fileCreator, &out)
+		utils.AssertNoError(t, err)
+
+		var reports []versionReport
+		if err := json.Unmarshal(out.Bytes(), &reports); err != nil {
+			t.Fatalf("The output is not valid JSON: %v\n%s", err, out.String())
+		}
+
+		want := map[string]string{
+			"xray":              "up-to-date",
+			"geoip.dat":         "outdated",
+			"geosite.dat":       "unknown",
+			"cf_cred_generator": "not installed",
+		}
+		utils.AssertCorrectInt(t, len(want), len(reports))
+		for _, r := range reports {
+			utils.AssertCorrectString(t, want[r.File], r.Status)
+			utils.AssertCorrectString(t, "1.2.3", r.Latest)
+		}
+	})
+
+	t.Run("table", func(t *testing.T) {
+		var out bytes.Buffer
+		err := testApp.runVersionsCommand(nil, repos, fileCreator, &out)
+		utils.AssertNoError(t, err)
+
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		utils.AssertCorrectInt(t, 5, len(lines))
+		if !strings.HasPrefix(lines[0], "FILE") {
+			t.Errorf("Expected a header line, got %q", lines[0])
+		}
+		if !strings.Contains(lines[2], "geoip.dat") || !strings.Contains(lines[2], "outdated") {
+			t.Errorf("Unexpected line for geoip.dat: %q", lines[2])
+		}
+	})
+
+	t.Run("unknown flag", func(t *testing.T) {
+		var out bytes.Buffer
+		err := testApp.runVersionsCommand([]string{"-yaml"}, repos, fileCreator, &out)
+		utils.AssertError(t, err)
+	})
+}
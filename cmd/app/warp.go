@@ -7,8 +7,8 @@ import (
 	"os"
 	"regexp"
 	"strings"
-	"time"
 
+	"github.com/google/uuid"
 	"github.com/ilyakutilin/xray_maintainer/utils"
 )
 
@@ -21,23 +21,14 @@ type CFCreds struct {
 	Endpoint  string
 }
 
-func (app Application) getCFCreds(ctx context.Context, cfCredFilePath string) (string, error) {
-	if app.debug {
-		return `device_id: abcdefab-0123-01ab-23cd-0123abcd4567
-token: deadbeef-0000-cafe-babe-0000feedface
-account_id: abcdef12-3456-aaaa-bbbb-cccc12345678
-account_type: free
-license: ExamplE1-Fake1234-DemoTest
-private_key: FAKEFAKE/DEMO1234+NOTREALDATA==EXAMPLE12/==
-public_key: ZZZZ0000/FAKEYFAK+12345678/DEMODEMO==TEST
-client_id: a1o2
-reserved: [ 100, 200, 300 ]
-v4: 172.16.0.2
-v6: 2001:db8::1
-endpoint: engage.cloudflareclient.com:2408`, nil
+// Makes sure that the registration of a new WARP device is not requested from
+// a region where Cloudflare blocks it
+func (app *Application) checkWarpRegion(ctx context.Context) error {
+	getCountryCode := app.countryCode
+	if getCountryCode == nil {
+		getCountryCode = utils.GetCountryCode
 	}
-
-	countryCode, err := utils.GetCountryCode(ctx)
+	countryCode, err := getCountryCode(ctx)
 	if err != nil {
 		app.warn(fmt.Sprintf("Failed to get the country that the request for "+
 			"the Cloudflare credentials originates from: %v. If such a request hits a "+
@@ -45,12 +36,30 @@ endpoint: engage.cloudflareclient.com:2408`, nil
 			"execution and the request will be sent anyway.", err))
 	}
 	if countryCode == "RU" {
-		return "", errors.New("the Clouflare credentials generator has been " +
+		return errors.New("the Clouflare credentials generator has been " +
 			"launched from Russia. This will inevitably result in the request timeout" +
 			"due to a region block, so there is no point in trying. Warp update " +
 			"process will now be terminated")
 	}
+	return nil
+}
 
+// Output of the Cloudflare generator the debug runs use instead of asking any of
+// the providers, so that they never register a device
+const debugCFCredsOutput = `device_id: abcdefab-0123-01ab-23cd-0123abcd4567
+token: deadbeef-0000-cafe-babe-0000feedface
+account_id: abcdef12-3456-aaaa-bbbb-cccc12345678
+account_type: free
+license: ExamplE1-Fake1234-DemoTest
+private_key: FAKEFAKE/DEMO1234+NOTREALDATA/EXAMPLE12/abc=
+public_key: ZZZZ0000/FAKEYFAK+12345678/DEMODEMO/TEST0aY=
+client_id: a1o2
+reserved: [ 100, 200, 30 ]
+v4: 172.16.0.2
+v6: 2001:db8::1
+endpoint: engage.cloudflareclient.com:2408`
+
+func (app Application) getCFCreds(ctx context.Context, cfCredFilePath string) (string, error) {
 	return utils.ExecuteCommand(ctx, cfCredFilePath)
 }
 
@@ -98,31 +107,15 @@ func parseCFCreds(output string) (CFCreds, error) {
 }
 
 func getClientConfig(xrayClient *XrayClient, xrayServer *XrayServer, xrayServerConfig *ServerConfig) *ClientConfig {
-	var clientConfig ClientConfig
-
-	clientConfig.Log = Log{Loglevel: "warning"}
-
-	clientInbound := ClientInbound{
-		Port:     xrayClient.Port,
-		Protocol: "http",
-	}
-	clientConfig.Inbounds = append(clientConfig.Inbounds, clientInbound)
-
-	var cs ClientOutboundSettingsServer
-
 	// Loop through the server inbounds to find the one with the protocol that
 	// the warp verification client will use
 	// !!! For the moment this works only with shadowsocks !!!
 	var found bool
-	var routingRuleNetwork string
+	var serverInbound SrvInbound
 	for _, inbound := range xrayServerConfig.Inbounds {
 		if inbound.Protocol == xrayClient.ServerProtocol {
 			found = true
-			cs.Address = xrayServer.IP
-			cs.Port = inbound.Port
-			cs.Method = inbound.Settings.Method
-			cs.Password = inbound.Settings.Password
-			routingRuleNetwork = inbound.Settings.Network
+			serverInbound = inbound
 			break
 		}
 	}
@@ -134,6 +127,36 @@ func getClientConfig(xrayClient *XrayClient, xrayServer *XrayServer, xrayServerC
 			"client operation is supported.", xrayClient.ServerProtocol))
 	}
 
+	return getInboundClientConfig(xrayClient, xrayServer, serverInbound)
+}
+
+// Generates the config of the verification client connecting to the inbound of
+// the xray server
+func getInboundClientConfig(xrayClient *XrayClient, xrayServer *XrayServer, inbound SrvInbound) *ClientConfig {
+	var clientConfig ClientConfig
+
+	clientConfig.Log = Log{Loglevel: "warning"}
+
+	clientInbound := ClientInbound{
+		Listen:   "127.0.0.1",
+		Port:     xrayClient.Port,
+		Protocol: "http",
+		Tag:      clientProxyTag,
+	}
+	if xrayClient.ProxyProtocol == "socks" {
+		clientInbound.Protocol = "socks"
+		clientInbound.Settings = &ClientInboundSettings{Auth: "noauth", UDP: true, IP: "127.0.0.1"}
+	}
+	clientConfig.Inbounds = append(clientConfig.Inbounds, clientInbound)
+
+	cs := ClientOutboundSettingsServer{
+		Address:  xrayServer.IP,
+		Port:     inbound.Port,
+		Method:   inbound.Settings.Method,
+		Password: inbound.Settings.Password,
+	}
+	routingRuleNetwork := inbound.Settings.Network
+
 	if cs.Method == "" || cs.Password == "" {
 		panic(fmt.Sprintf("protocol %s is present in the xray server config inbounds, "+
 			"but it still did not provide the required credentials for the client "+
@@ -166,81 +189,19 @@ func getClientConfig(xrayClient *XrayClient, xrayServer *XrayServer, xrayServerC
 	return &clientConfig
 }
 
-func checkIPCheckerResponse(ipCheckerResponseJSON []byte, xrayServerIP string) error {
-	type IPCheckerResponse struct {
-		Status  string `json:"status"`
-		Message string `json:"message"`
-		ISP     string `json:"isp"`
-		Org     string `json:"org"`
-		Query   string `json:"query"`
-	}
-
-	var r IPCheckerResponse
-
-	if err := utils.ParseJSON(ipCheckerResponseJSON, &r, false); err != nil {
-		return fmt.Errorf("could not parse the JSON response provided by the ip "+
-			"checker into a struct: %w", err)
-	}
-
-	if r.Status != "success" {
-		return fmt.Errorf("the ip checker failed to get the ISP/Org status for IP %s "+
-			"and provided the following message: %s", r.Query, r.Message)
-	}
-
-	if r.Query == xrayServerIP {
-		return fmt.Errorf("ip address detected by the ip checker is %s which is "+
-			"the address of the xray server machine, which means that Warp is not "+
-			"active", r.Query)
-	}
-
-	if !strings.Contains(strings.ToLower(r.ISP), "cloudflare") || !strings.Contains(strings.ToLower(r.Org), "cloudflare") {
-		return fmt.Errorf("ip checker could not detect Cloudflare in ISP or Org "+
-			"which means that Warp is not active. ISP: %s; Org: %s. Full response: %v", r.ISP, r.Org, r)
-	}
-
-	return nil
-}
-
-func (app *Application) isWarpOK(ctx context.Context, xray Xray) (bool, error) {
-	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	defer cancel()
-
-	cmd, stdout, err := startXrayClient(ctx, xray)
-	if err != nil {
-		return false, err
-	}
-
-	ready := make(chan struct{})
-	go watchXrayStartup(stdout, ready)
-
-	if err := waitForXrayReady(ctx, ready, xray.Client.Port); err != nil {
-		terminateProcess(cmd)
-		return false, fmt.Errorf("xray verification client failed to start: %w", err)
-	}
-
-	app.logger.Info.Println("xray started successfully. Requesting a detailed " +
-		"information about the IP address and the provider...")
-	proxy := utils.HTTPProxy{IP: "127.0.0.1", Port: xray.Client.Port}
-	apiResponse, err := utils.GetRequestWithProxy(ctx, xray.Client.IPCheckerURL, &proxy)
-
+// Picks the ports of the verification client and protects its proxy with random
+// credentials if configured
+func prepareClientConfig(clientConfig *ClientConfig, xrayClient XrayClient) error {
+	proxyPort, apiPort, err := pickClientPorts(xrayClient.Port)
 	if err != nil {
-		terminateProcess(cmd)
-		return false, nil
+		return fmt.Errorf("failed to pick the ports for the verification client: %w", err)
 	}
-
-	app.logger.Info.Println("Response received, shutting down the xray verification " +
-		"client...")
-	if err := terminateProcess(cmd); err != nil {
-		return false, err
-	}
-
-	app.logger.Info.Println("Analyzing the response to make sure that the provider " +
-		"is Cloudflare...")
-	if err := checkIPCheckerResponse(apiResponse, xray.Server.IP); err != nil {
-		return false, nil
+	clientConfig.proxyInbound().Port = proxyPort
+	clientConfig.enableAPI(apiPort)
+	if xrayClient.ProxyAuth {
+		clientConfig.setProxyAccount(uuid.NewString(), uuid.NewString())
 	}
-
-	return true, nil
+	return nil
 }
 
 func updateServerWarpConfig(xrayServerConfig *ServerConfig, cfCreds *CFCreds) error {
@@ -289,80 +250,303 @@ func (app *Application) updateWarp(ctx context.Context, xray Xray) error {
 	app.logger.Info.Println("Generating a config for the temporary warp verification " +
 		"xray client...")
 	clientConfig := getClientConfig(&xray.Client, &xray.Server, &xrayServerConfig)
-	if err := utils.WriteStructToJSONFile(clientConfig, xray.Client.ConfigFilePath); err != nil {
-		return fmt.Errorf("error writing client config to %q: %w", xray.Client.ConfigFilePath, err)
+	if err := prepareClientConfig(clientConfig, xray.Client); err != nil {
+		return err
 	}
-	app.logger.Info.Println("Client config has successfully been generated " +
-		"and saved to a file in the main working directory.")
+	app.logger.Info.Printf("Client config has successfully been generated: the proxy "+
+		"listens on port %d, the API on port %d.\n", clientConfig.proxyInbound().Port,
+		clientConfig.apiPort())
 	app.logger.Info.Println("Starting to check if the warp is active and responsive " +
 		"using the temporary verification client...")
-	warpOK, err := app.isWarpOK(ctx, xray)
+	var checks warpChecks
+	if settings := warpOutboundSettings(&xrayServerConfig); settings != nil {
+		checks.families = warpFamilies(settings, xray.Client.FamilyCheckers)
+	}
+	routes, err := routeTargets(xray.Client.RouteProbes, &xrayServerConfig)
+	if err != nil {
+		app.warn(fmt.Sprintf("Some route probes cannot be verified: %v", err))
+	}
+	checks.routes = routes
+	diagnosis, err := app.diagnoseWarp(ctx, xray, clientConfig, checks)
 	if err != nil {
 		return fmt.Errorf("failed to obtain the warp status: %w", err)
 	}
+	var currentEndpoint string
+	if settings := warpOutboundSettings(&xrayServerConfig); settings != nil && len(settings.Peers) > 0 {
+		currentEndpoint = settings.Peers[0].Endpoint
+	}
+	historyPath := providerFilePath(app.workdir, xray.Client.Benchmark.HistoryFile)
+	if err := appendWarpHistory(historyPath, xray.Client.Benchmark.HistoryLimit, diagnosis,
+		currentEndpoint); err != nil {
+		app.logger.Warning.Printf("Failed to record the warp benchmark: %v\n", err)
+	}
 
-	if warpOK {
-		app.logger.Info.Println("Warp is active, so its update is not required.")
+	if diagnosis.OK() {
+		app.logger.Info.Printf("Warp is active with the egress %s, so its update "+
+			"is not required.\n", diagnosis.Egress())
+		if len(diagnosis.Families) > 0 {
+			app.logger.Info.Printf("Address families: %s\n", diagnosis.FamilyReport())
+		}
+		if diagnosis.Benchmark != nil {
+			app.logger.Info.Printf("Benchmark: %s\n", diagnosis.Benchmark)
+		}
 		return nil
 	}
 
-	app.logger.Warning.Println("Warp is not active, so its update is required.")
+	switch {
+	case diagnosis.Status == WarpDegraded:
+		app.warn(fmt.Sprintf("Warp is operational with the egress %s, but an "+
+			"address family it relies on is broken: %s. The warp config has been "+
+			"left as it is.", diagnosis.Egress(), diagnosis.FamilyReport()))
+		if report := diagnosis.RouteReport(); report != "" {
+			app.warn(fmt.Sprintf("Some destinations are misrouted: %s.", report))
+		}
+		if report := diagnosis.UDPReport(); report != "" {
+			app.warn(fmt.Sprintf("Some UDP probes have failed: %s.", report))
+		}
+		return nil
+	case diagnosis.Status == WarpMisrouted:
+		app.warn(fmt.Sprintf("Warp is operational with the egress %s, but some "+
+			"destinations leave the xray server through an unexpected outbound, "+
+			"check the routing rules and the geo files: %s.", diagnosis.Egress(),
+			diagnosis.RouteReport()))
+		if report := diagnosis.UDPReport(); report != "" {
+			app.warn(fmt.Sprintf("Some UDP probes have failed: %s.", report))
+		}
+		return nil
+	case diagnosis.Status == WarpUDPBroken:
+		app.warn(fmt.Sprintf("Warp passes TCP with the egress %s, but the UDP "+
+			"exchanges through it fail, so QUIC and DNS may be broken for the "+
+			"users: %s. The warp config has been left as it is.", diagnosis.Egress(),
+			diagnosis.UDPReport()))
+		return nil
+	case diagnosis.Status == WarpSlow && xray.Client.Benchmark.OnSlow == onSlowReport:
+		app.warn(fmt.Sprintf("Warp is operational with the egress %s, but too slow: "+
+			"%s. The warp config has been left as it is.", diagnosis.Egress(),
+			diagnosis.Benchmark))
+		return nil
+	case diagnosis.Status == WarpSlow && xray.Client.Benchmark.OnSlow == onSlowEndpoint:
+		return app.replaceWarpEndpoint(ctx, xray, &xrayServerConfig, diagnosis)
+	case diagnosis.Status == WarpCheckerUnavailable:
+		app.warn(fmt.Sprintf("The warp status could not be verified: %s. The warp "+
+			"config has been left as it is.", diagnosis))
+		return nil
+	case !diagnosis.NeedsNewCredentials() && diagnosis.Status != WarpSlow:
+		return fmt.Errorf("warp is not operational: %s. New credentials would not "+
+			"fix this, so the warp config has been left as it is", diagnosis)
+	}
 
-	app.logger.Info.Println("Launching Cloudflare credential generator to capture " +
-		"its output")
-	cfCredOutput, err := app.getCFCreds(ctx, xray.CFCredFilePath)
+	app.logger.Warning.Printf("Warp is not operational: %s. Its update is "+
+		"required.\n", diagnosis)
+
+	var currentSecretKey string
+	for _, outb := range xrayServerConfig.Outbounds {
+		if outb.Protocol == "wireguard" && outb.Settings != nil {
+			currentSecretKey = outb.Settings.SecretKey
+		}
+	}
+	providers, err := app.newCredentialProviders(xray, currentSecretKey)
 	if err != nil {
-		return fmt.Errorf("error while launching the Cloudflare credentials "+
-			"generator: %w", err)
+		return err
 	}
 
-	app.logger.Info.Println("Obtained the Cloudflare credentials, parsing...")
-	cfCreds, err := parseCFCreds(cfCredOutput)
+	if !app.debug {
+		if err := app.checkWarpRegion(ctx); err != nil {
+			return err
+		}
+	}
+
+	cfCreds, providerName, err := app.obtainCredentials(ctx, providers)
 	if err != nil {
-		return fmt.Errorf("error while parsing the generated Cloudflare "+
-			"credentials: %w", err)
+		return err
+	}
+
+	if xray.Warp.EndpointScan.Enabled {
+		err := app.selectWarpEndpoint(ctx, xray.Warp.EndpointScan, &cfCreds, app.endpointProber)
+		if err != nil {
+			app.warn(fmt.Sprintf("Failed to pick the best warp endpoint: %v. The "+
+				"endpoint %s provided with the credentials is used.", err,
+				cfCreds.Endpoint))
+		}
 	}
 
-	app.logger.Info.Println("Successfully parsed the credentials. Updating the xray " +
-		"server config with new Warp settings...")
+	app.logger.Info.Printf("Successfully obtained the credentials from the %s "+
+		"provider. Updating the xray server config with new Warp settings...\n",
+		providerName)
 	if err := updateServerWarpConfig(&xrayServerConfig, &cfCreds); err != nil {
 		return fmt.Errorf("error updating the xray server config: %w", err)
 	}
 
+	err = app.applyServerConfig(ctx, xray, &xrayServerConfig)
+	if errors.Is(err, errServerConfigDeferred) {
+		app.warn(fmt.Sprintf("Warp is not operational (%s). The credentials from "+
+			"the %s provider are ready, but %v %s, so the warp config has been left "+
+			"as it is.", diagnosis, providerName, err, app.applyStrategy.MaintenanceWindow))
+		return nil
+	}
+	if errors.Is(err, errServerConfigRestored) {
+		return fmt.Errorf("warp was not operational (%s), but the %s was not "+
+			"operable with the credentials from the %s provider, so %w", diagnosis,
+			app.xrayServiceName, providerName, err)
+	}
+	if err != nil {
+		return err
+	}
+	if !app.debug {
+		app.note(fmt.Sprintf("Warp was not operational (%s). Its config was "+
+			"updated with the credentials from the %s provider and now the %s is "+
+			"operational with the updated server config.", diagnosis, providerName,
+			app.xrayServiceName))
+	}
+
+	return nil
+}
+
+var errServerConfigRestored = errors.New("the previous server config has been restored")
+
+// Writes the server config and applies it according to the apply strategy. If
+// the service is not operable with the new config, the previous one is restored
+// and errServerConfigRestored is returned. If the config requires a restart
+// outside of the maintenance window, nothing is written and
+// errServerConfigDeferred is returned.
+func (app *Application) applyServerConfig(ctx context.Context, xray Xray, xrayServerConfig *ServerConfig) error {
+	if !app.debug && app.applyStrategy.Mode == applyRestart && app.restartDeferred() {
+		return errServerConfigDeferred
+	}
+
 	app.logger.Info.Println("Writing the new xray server config to file...")
-	srvBackupFile, err := utils.BackupFile(xray.Server.ConfigFilePath)
+	configPath := xray.Server.ConfigFilePath
+	if err := app.beginOperation(Operation{Kind: operationServerConfig, Path: configPath,
+		Backup: configPath + ".backup"}); err != nil {
+		return fmt.Errorf("failed to record the change of the xray server config in "+
+			"the journal: %w", err)
+	}
+	// The operation stays in the journal if the previous config could not be
+	// restored, so that the next run restores it
+	restoreFailed := false
+	defer func() {
+		if !restoreFailed {
+			app.endOperation(configPath)
+		}
+	}()
+	srvBackupFile, err := utils.BackupFile(configPath)
 	if err != nil {
 		return fmt.Errorf("failed to back up the xray server config file: %w", err)
 	}
-	if err := utils.WriteStructToJSONFile(&xrayServerConfig, xray.Server.ConfigFilePath); err != nil {
+	if err := utils.WriteStructToJSONFile(xrayServerConfig, configPath); err != nil {
+		if err := utils.RestoreFile(srvBackupFile, configPath); err != nil {
+			restoreFailed = true
+			return fmt.Errorf("error restoring the backup of the xray server "+
+				"config file to its original path: %w", err)
+		}
 		_ = os.Remove(srvBackupFile)
 		return fmt.Errorf("error writing the new xray server config to file: %w", err)
 	}
 
-	if !app.debug {
-		app.logger.Info.Println("Restarting the xray server service...")
-		if err := utils.CheckOperability(ctx, app.xrayServiceName, nil); err != nil {
-			app.logger.Info.Println("Xray server service is not operable after " +
-				"restart, so reverting the config file to its previous state and " +
-				"checking the xray server service operability again...")
+	if app.debug {
+		_ = os.Remove(srvBackupFile)
+		app.logger.Info.Printf("The app is in debug mode, so the %s will not be restarted.", app.xrayServiceName)
+		return nil
+	}
+
+	app.setOperationStage(configPath, stageApplying)
+	refresh := app.refreshXrayService
+	if app.applyStrategy.Mode == applyAPI {
+		app.logger.Info.Println("Replacing the warp outbound through the xray API...")
+		removed, err := app.hotSwapWarpOutbound(ctx, xray, xrayServerConfig)
+		if err == nil {
+			_ = os.Remove(srvBackupFile)
+			return nil
+		}
+		// The running server without its warp outbound cannot wait for the window
+		if !removed && app.restartDeferred() {
+			app.logger.Warning.Printf("Failed to replace the warp outbound through "+
+				"the xray API: %v\n", err)
 			if err := utils.RestoreFile(srvBackupFile, xray.Server.ConfigFilePath); err != nil {
+				restoreFailed = true
 				return fmt.Errorf("error restoring the backup of the xray server "+
 					"config file to its original path: %w", err)
 			}
 			_ = os.Remove(srvBackupFile)
-			if err := utils.CheckOperability(ctx, app.xrayServiceName, nil); err != nil {
-				return fmt.Errorf("even after restoring the original xray server "+
-					"config the service is still inoperable. Further investigation "+
-					"is required: %w", err)
-			}
+			return errServerConfigDeferred
+		}
+		app.logger.Warning.Printf("Failed to replace the warp outbound through the "+
+			"xray API: %v. Restarting the xray server service instead...\n", err)
+		refresh = func(ctx context.Context) error {
+			return app.cycleXrayService(ctx, false)
+		}
+	}
+
+	app.logger.Info.Println("Applying the config to the xray server service...")
+	if err := refresh(ctx); err != nil {
+		app.logger.Info.Println("Xray server service is not operable after " +
+			"applying the config, so reverting the config file to its previous " +
+			"state and checking the xray server service operability again...")
+		if err := utils.RestoreFile(srvBackupFile, xray.Server.ConfigFilePath); err != nil {
+			restoreFailed = true
+			return fmt.Errorf("error restoring the backup of the xray server "+
+				"config file to its original path: %w", err)
 		}
 		_ = os.Remove(srvBackupFile)
-		app.note(fmt.Sprintf("Warp config was corrput. It was updated and now"+
-			"the %s is operational with the updated server config.", app.xrayServiceName))
-	} else {
-		_ = os.Remove(srvBackupFile)
-		app.logger.Info.Printf("The app is in debug mode, so the %s will not be restarted.", app.xrayServiceName)
+		if err := app.cycleXrayService(ctx, false); err != nil {
+			return fmt.Errorf("even after restoring the original xray server "+
+				"config the service is still inoperable. Further investigation "+
+				"is required: %w", err)
+		}
+		return errServerConfigRestored
+	}
+	_ = os.Remove(srvBackupFile)
+	return nil
+}
+
+// Picks the best endpoint for the current credentials of the warp outbound when
+// warp is operational but slow, and applies it if it differs from the current one
+func (app *Application) replaceWarpEndpoint(ctx context.Context, xray Xray, xrayServerConfig *ServerConfig, diagnosis WarpDiagnosis) error {
+	settings := warpOutboundSettings(xrayServerConfig)
+	if settings == nil || len(settings.Peers) == 0 {
+		return fmt.Errorf("warp is slow (%s), but the server config has no warp "+
+			"peer to pick another endpoint for", diagnosis.Benchmark)
+	}
+	current := settings.Peers[0].Endpoint
+	creds := CFCreds{
+		SecretKey: settings.SecretKey,
+		PublicKey: settings.Peers[0].PublicKey,
+		Reserved:  settings.Reserved,
+		Endpoint:  current,
+	}
+
+	app.logger.Warning.Printf("Warp is slow: %s. Looking for a better endpoint...\n",
+		diagnosis.Benchmark)
+	if err := app.selectWarpEndpoint(ctx, xray.Warp.EndpointScan, &creds, app.endpointProber); err != nil {
+		app.warn(fmt.Sprintf("Warp is operational with the egress %s, but too slow "+
+			"(%s), and no other endpoint could be picked: %v.", diagnosis.Egress(),
+			diagnosis.Benchmark, err))
+		return nil
+	}
+	if creds.Endpoint == current {
+		app.warn(fmt.Sprintf("Warp is operational with the egress %s, but too slow "+
+			"(%s), while its endpoint %s is still the best one.", diagnosis.Egress(),
+			diagnosis.Benchmark, current))
+		return nil
 	}
 
+	settings.Peers[0].Endpoint = creds.Endpoint
+	err := app.applyServerConfig(ctx, xray, xrayServerConfig)
+	if errors.Is(err, errServerConfigDeferred) {
+		app.warn(fmt.Sprintf("Warp is slow (%s). The endpoint %s is faster than %s, "+
+			"but %v %s, so the warp config has been left as it is.", diagnosis.Benchmark,
+			creds.Endpoint, current, err, app.applyStrategy.MaintenanceWindow))
+		return nil
+	}
+	if errors.Is(err, errServerConfigRestored) {
+		return fmt.Errorf("warp was slow (%s), but the %s was not operable with the "+
+			"endpoint %s, so %w", diagnosis.Benchmark, app.xrayServiceName,
+			creds.Endpoint, err)
+	}
+	if err != nil {
+		return err
+	}
+	app.note(fmt.Sprintf("Warp was slow (%s), so its endpoint %s was replaced with %s.",
+		diagnosis.Benchmark, current, creds.Endpoint))
 	return nil
 }
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// WarpAccount is what is needed to reuse a registered WARP device
+type WarpAccount struct {
+	DeviceID    string    `json:"device_id"`
+	Token       string    `json:"token"`
+	AccountID   string    `json:"account_id"`
+	AccountType string    `json:"account_type"`
+	License     string    `json:"license"`
+	PrivateKey  string    `json:"private_key"`
+	PublicKey   string    `json:"public_key"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Keeps the registered WARP account in a file encrypted with the key
+// from a separate file
+type warpAccountStore struct {
+	Path    string
+	KeyPath string
+}
+
+// Returns nil if no account has been stored yet
+func (s *warpAccountStore) load() (*WarpAccount, error) {
+	if !utils.FileExists(s.Path) {
+		return nil, nil
+	}
+
+	key, err := utils.LoadOrCreateSecretKey(s.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err := utils.ReadEncryptedFile(s.Path, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", s.Path, err)
+	}
+
+	var account WarpAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", s.Path, err)
+	}
+	if account.DeviceID == "" || account.Token == "" || account.PrivateKey == "" {
+		return nil, fmt.Errorf("%s lacks the device ID, token or private key", s.Path)
+	}
+	return &account, nil
+}
+
+func (s *warpAccountStore) save(account *WarpAccount) error {
+	key, err := utils.LoadOrCreateSecretKey(s.KeyPath)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	return utils.WriteEncryptedFile(s.Path, key, data)
+}
+
+// Reports whether the API no longer accepts the device, so that reusing it is
+// pointless, as opposed to a failure which may go away on a retry
+func isAccountRejected(err error) bool {
+	var apiErr *warpAPIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.Status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	}
+	return false
+}
+
+// Fetches the current config of the stored device, applying the configured
+// license key first if the account does not have it yet
+func (p *WarpAPIProvider) accountCredentials(ctx context.Context, account *WarpAccount) (CFCreds, error) {
+	if p.License != "" && p.License != account.License {
+		p.applyLicense(ctx, account)
+	}
+
+	device, err := p.getDevice(ctx, account.DeviceID, account.Token)
+	if err != nil {
+		return CFCreds{}, err
+	}
+	creds, err := credsFromRegResponse(device)
+	if err != nil {
+		return CFCreds{}, fmt.Errorf("the WARP API returned an unusable config of "+
+			"the device %s: %w", account.DeviceID, err)
+	}
+	creds.SecretKey = account.PrivateKey
+
+	if device.Account.ID != "" {
+		account.AccountType = device.Account.AccountType
+		account.License = device.Account.License
+		p.saveAccount(account)
+	}
+
+	return creds, nil
+}
+
+// Applies the WARP+ license key to the account. A failure is only reported
+// since the account keeps working without it.
+func (p *WarpAPIProvider) applyLicense(ctx context.Context, account *WarpAccount) {
+	var resp struct {
+		AccountType string `json:"account_type"`
+		License     string `json:"license"`
+	}
+	body := map[string]string{"license": p.License}
+	err := p.do(ctx, http.MethodPut, "/reg/"+account.DeviceID+"/account", account.Token, body, &resp)
+	if err != nil {
+		p.warn(fmt.Sprintf("Failed to apply the WARP+ license key to the WARP "+
+			"device %s: %v. The %s account is used as is.", account.DeviceID, err,
+			account.AccountType))
+		return
+	}
+
+	account.AccountType = resp.AccountType
+	account.License = p.License
+	p.saveAccount(account)
+}
+
+func (p *WarpAPIProvider) saveAccount(account *WarpAccount) {
+	if p.Store == nil {
+		return
+	}
+	if err := p.Store.save(account); err != nil {
+		p.warn(fmt.Sprintf("Failed to save the WARP account to %s: %v. A new "+
+			"device will have to be registered next time.", p.Store.Path, err))
+	}
+}
+
+func (p *WarpAPIProvider) warn(txt string) {
+	if p.Warn != nil {
+		p.Warn(txt)
+	}
+}
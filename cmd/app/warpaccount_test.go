@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// A fake WARP client API keeping track of the registered devices
+type fakeWarpAPI struct {
+	mu            sync.Mutex
+	devices       map[string]string // device ID -> token
+	licenses      map[string]string // device ID -> license
+	registrations int
+	rejectLicense bool
+}
+
+func newFakeWarpAPI(t *testing.T) (*fakeWarpAPI, *httptest.Server) {
+	api := &fakeWarpAPI{devices: map[string]string{}, licenses: map[string]string{}}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	return api, server
+}
+
+func (api *fakeWarpAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	if r.Method == http.MethodPost && r.URL.Path == "/reg" {
+		api.registrations++
+		id := fmt.Sprintf("device-%d", api.registrations)
+		api.devices[id] = "token-" + id
+		response := fakeWarpRegResponse("AQID", "engage.cloudflareclient.com:2408")
+		response = strings.Replace(response, `"device-id"`, fmt.Sprintf("%q", id), 1)
+		response = strings.Replace(response, `"device-token"`, fmt.Sprintf("%q", api.devices[id]), 1)
+		fmt.Fprint(w, response)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/reg/"), "/")
+	token, ok := api.devices[parts[0]]
+	if !ok || r.Header.Get("Authorization") != "Bearer "+token {
+		http.Error(w, `{"success": false}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1:
+		response := fakeWarpRegResponse("BAUG", "engage.cloudflareclient.com:2408")
+		response = strings.Replace(response, `"license-key"`, fmt.Sprintf("%q", api.licenses[parts[0]]), 1)
+		fmt.Fprint(w, response)
+	case r.Method == http.MethodPut && len(parts) == 2 && parts[1] == "account":
+		if api.rejectLicense {
+			http.Error(w, `{"success": false, "errors": [{"message": "Invalid license"}]}`,
+				http.StatusBadRequest)
+			return
+		}
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		api.licenses[parts[0]] = body["license"]
+		fmt.Fprintf(w, `{"account_type": "limited", "license": %q}`, body["license"])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestWarpAPIProviderAccountReuse(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	newProvider := func(server *httptest.Server, dir string, warnings *[]string) *WarpAPIProvider {
+		return &WarpAPIProvider{
+			APIURL:     server.URL,
+			HTTPClient: server.Client(),
+			Store: &warpAccountStore{
+				Path:    filepath.Join(dir, "warp-account.enc"),
+				KeyPath: filepath.Join(dir, "warp-account.key"),
+			},
+			Warn: func(txt string) { *warnings = append(*warnings, txt) },
+		}
+	}
+
+	t.Run("account is stored encrypted and reused", func(t *testing.T) {
+		api, server := newFakeWarpAPI(t)
+		dir := t.TempDir()
+		var warnings []string
+		p := newProvider(server, dir, &warnings)
+
+		first, err := p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 1, api.registrations)
+		utils.AssertCorrectString(t, "[1 2 3]", fmt.Sprint(first.Reserved))
+
+		raw, err := os.ReadFile(filepath.Join(dir, "warp-account.enc"))
+		utils.AssertNoError(t, err)
+		if strings.Contains(string(raw), "token-device-1") || strings.Contains(string(raw), first.SecretKey) {
+			t.Error("Expected the stored account to be encrypted")
+		}
+
+		// The device config is fetched again instead of registering a new device
+		second, err := p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 1, api.registrations)
+		utils.AssertCorrectString(t, first.SecretKey, second.SecretKey)
+		utils.AssertCorrectString(t, "[4 5 6]", fmt.Sprint(second.Reserved))
+		utils.AssertCorrectInt(t, 0, len(warnings))
+	})
+
+	t.Run("rejected account is replaced with a new device", func(t *testing.T) {
+		api, server := newFakeWarpAPI(t)
+		dir := t.TempDir()
+		var warnings []string
+		p := newProvider(server, dir, &warnings)
+
+		first, err := p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+
+		api.mu.Lock()
+		delete(api.devices, "device-1")
+		api.mu.Unlock()
+
+		second, err := p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 2, api.registrations)
+		if first.SecretKey == second.SecretKey {
+			t.Error("Expected a new key pair for the new device")
+		}
+		utils.AssertCorrectInt(t, 1, len(warnings))
+		if !strings.Contains(warnings[0], "device-1 has been rejected") {
+			t.Errorf("Expected the warning to contain %q, got %q", "device-1 has been rejected", warnings[0])
+		}
+
+		account, err := p.Store.load()
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectString(t, "device-2", account.DeviceID)
+	})
+
+	t.Run("license is applied to the account", func(t *testing.T) {
+		api, server := newFakeWarpAPI(t)
+		dir := t.TempDir()
+		var warnings []string
+		p := newProvider(server, dir, &warnings)
+
+		_, err := p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+
+		p.License = "WARP-PLUS-KEY"
+		_, err = p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 1, api.registrations)
+		utils.AssertCorrectString(t, "WARP-PLUS-KEY", api.licenses["device-1"])
+
+		account, err := p.Store.load()
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectString(t, "WARP-PLUS-KEY", account.License)
+		utils.AssertCorrectInt(t, 0, len(warnings))
+	})
+
+	t.Run("rejected license is reported", func(t *testing.T) {
+		api, server := newFakeWarpAPI(t)
+		api.rejectLicense = true
+		dir := t.TempDir()
+		var warnings []string
+		p := newProvider(server, dir, &warnings)
+		p.License = "WARP-PLUS-KEY"
+
+		_, err := p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 1, len(warnings))
+		if !strings.Contains(warnings[0], "Invalid license") {
+			t.Errorf("Expected the warning to contain %q, got %q", "Invalid license", warnings[0])
+		}
+	})
+
+	t.Run("device in use is replaced with a new device", func(t *testing.T) {
+		api, server := newFakeWarpAPI(t)
+		dir := t.TempDir()
+		var warnings []string
+		p := newProvider(server, dir, &warnings)
+
+		first, err := p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+
+		p.CurrentSecretKey = first.SecretKey
+		second, err := p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 2, api.registrations)
+		if first.SecretKey == second.SecretKey {
+			t.Error("Expected a new key pair for the new device")
+		}
+		utils.AssertCorrectInt(t, 1, len(warnings))
+		if !strings.Contains(warnings[0], "device-1 is the one the server config already uses") {
+			t.Errorf("Expected the warning about the device in use, got %q", warnings[0])
+		}
+
+		account, err := p.Store.load()
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectString(t, "device-2", account.DeviceID)
+	})
+
+	t.Run("unreadable store is replaced with a new device", func(t *testing.T) {
+		api, server := newFakeWarpAPI(t)
+		dir := t.TempDir()
+		var warnings []string
+		p := newProvider(server, dir, &warnings)
+		utils.AssertNoError(t, os.WriteFile(p.Store.Path, []byte("garbage"), 0600))
+
+		_, err := p.GetCredentials(ctx)
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectInt(t, 1, api.registrations)
+		utils.AssertCorrectInt(t, 1, len(warnings))
+		if !strings.Contains(warnings[0], "Failed to load the stored WARP account") {
+			t.Errorf("Expected the warning about the store, got %q", warnings[0])
+		}
+
+		account, err := p.Store.load()
+		utils.AssertNoError(t, err)
+		utils.AssertCorrectString(t, "device-1", account.DeviceID)
+	})
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The WARP client API requires these to accept the registration
+const (
+	warpClientVersion = "a-6.10-2158"
+	warpUserAgent     = "okhttp/3.12.1"
+	// The port used if the endpoint returned by the API has none
+	warpDefaultPort = "2408"
+)
+
+// WarpAPIProvider registers a new WARP device directly with the Cloudflare
+// client API
+type WarpAPIProvider struct {
+	// Base URL of the API, e.g. https://api.cloudflareclient.com/v0a2158
+	APIURL string
+	// If nil, a client suitable for the Cloudflare API is created
+	HTTPClient *http.Client
+	// Where the registered account is kept for reuse. If nil, a new device
+	// is registered every time.
+	Store *warpAccountStore
+	// WARP+ license key to apply to the account, optional
+	License string
+	// Private key of the warp outbound being replaced. The stored device using
+	// it is not reused, since its config is the one that has stopped working.
+	CurrentSecretKey string
+	// Reports the problems that do not prevent obtaining the credentials
+	Warn func(string)
+}
+
+func (p *WarpAPIProvider) Name() string {
+	return warpProviderAPI
+}
+
+// WireGuard key pair encoded in base64 as WireGuard and xray configs expect
+type wireguardKeyPair struct {
+	PrivateKey string
+	PublicKey  string
+}
+
+func generateWireguardKeyPair() (wireguardKeyPair, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return wireguardKeyPair{}, err
+	}
+	// Clamp the scalar the same way "wg genkey" does
+	key[0] &= 248
+	key[31] = (key[31] & 127) | 64
+
+	private, err := ecdh.X25519().NewPrivateKey(key)
+	if err != nil {
+		return wireguardKeyPair{}, err
+	}
+
+	return wireguardKeyPair{
+		PrivateKey: base64.StdEncoding.EncodeToString(private.Bytes()),
+		PublicKey:  base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()),
+	}, nil
+}
+
+type warpRegRequest struct {
+	InstallID string `json:"install_id"`
+	TOS       string `json:"tos"`
+	Key       string `json:"key"`
+	FCMToken  string `json:"fcm_token"`
+	Type      string `json:"type"`
+	Locale    string `json:"locale"`
+}
+
+// The relevant part of the response of the registration endpoint
+type warpRegResponse struct {
+	ID      string `json:"id"`
+	Token   string `json:"token"`
+	Account struct {
+		ID          string `json:"id"`
+		AccountType string `json:"account_type"`
+		License     string `json:"license"`
+	} `json:"account"`
+	Config struct {
+		ClientID string `json:"client_id"`
+		Peers    []struct {
+			PublicKey string `json:"public_key"`
+			Endpoint  struct {
+				V4   string `json:"v4"`
+				V6   string `json:"v6"`
+				Host string `json:"host"`
+			} `json:"endpoint"`
+		} `json:"peers"`
+		Interface struct {
+			Addresses struct {
+				V4 string `json:"v4"`
+				V6 string `json:"v6"`
+			} `json:"addresses"`
+		} `json:"interface"`
+	} `json:"config"`
+}
+
+func (p *WarpAPIProvider) httpClient() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return &http.Client{
+		Timeout: 15 * time.Second,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			// The API rejects the TLS 1.3 handshakes of the non-official clients
+			TLSClientConfig: &tls.Config{
+				MinVersion: tls.VersionTLS12,
+				MaxVersion: tls.VersionTLS12,
+			},
+		},
+	}
+}
+
+// An unsuccessful response of the WARP client API
+type warpAPIError struct {
+	Method string
+	Path   string
+	Status int
+	Body   string
+}
+
+func (e *warpAPIError) Error() string {
+	return fmt.Sprintf("WARP API request %s %s failed with status %d: %s",
+		e.Method, e.Path, e.Status, e.Body)
+}
+
+// Sends a request to the WARP client API and decodes the JSON response into result
+func (p *WarpAPIProvider) do(ctx context.Context, method string, path string, token string, body any, result any) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	url := strings.TrimSuffix(p.APIURL, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create the request to %s: %w", url, err)
+	}
+	req.Header.Set("User-Agent", warpUserAgent)
+	req.Header.Set("CF-Client-Version", warpClientVersion)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := p.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("request to the WARP API failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read the WARP API response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &warpAPIError{Method: method, Path: path, Status: resp.StatusCode,
+			Body: strings.TrimSpace(string(data))}
+	}
+
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("failed to parse the WARP API response: %w", err)
+	}
+	return nil
+}
+
+// Reuses the stored WARP account if there is one, it is not the one in use and
+// the API still accepts it, otherwise registers a new device
+func (p *WarpAPIProvider) GetCredentials(ctx context.Context) (CFCreds, error) {
+	if p.Store != nil {
+		account, err := p.Store.load()
+		if err != nil {
+			p.warn(fmt.Sprintf("Failed to load the stored WARP account (%v), so a new "+
+				"device is registered.", err))
+			account = nil
+		}
+		if account != nil && p.CurrentSecretKey != "" && account.PrivateKey == p.CurrentSecretKey {
+			p.warn(fmt.Sprintf("The stored WARP device %s is the one the server config "+
+				"already uses, so a new device is registered.", account.DeviceID))
+			account = nil
+		}
+		if account != nil {
+			creds, err := p.accountCredentials(ctx, account)
+			if err == nil {
+				return creds, nil
+			}
+			if !isAccountRejected(err) {
+				return CFCreds{}, err
+			}
+			p.warn(fmt.Sprintf("The stored WARP device %s has been rejected by "+
+				"the API (%v), so a new device is registered.", account.DeviceID, err))
+		}
+	}
+
+	return p.register(ctx)
+}
+
+// Registers a new WARP device with a freshly generated key pair
+func (p *WarpAPIProvider) register(ctx context.Context) (CFCreds, error) {
+	keys, err := generateWireguardKeyPair()
+	if err != nil {
+		return CFCreds{}, fmt.Errorf("failed to generate the WireGuard key pair: %w", err)
+	}
+
+	req := warpRegRequest{
+		TOS:    time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+		Key:    keys.PublicKey,
+		Type:   "Android",
+		Locale: "en_US",
+	}
+	var resp warpRegResponse
+	if err := p.do(ctx, http.MethodPost, "/reg", "", req, &resp); err != nil {
+		return CFCreds{}, fmt.Errorf("failed to register a new WARP device: %w", err)
+	}
+
+	creds, err := credsFromRegResponse(&resp)
+	if err != nil {
+		return CFCreds{}, fmt.Errorf("the WARP API returned an unusable device "+
+			"config: %w", err)
+	}
+	creds.SecretKey = keys.PrivateKey
+
+	account := &WarpAccount{
+		DeviceID:    resp.ID,
+		Token:       resp.Token,
+		AccountID:   resp.Account.ID,
+		AccountType: resp.Account.AccountType,
+		License:     resp.Account.License,
+		PrivateKey:  keys.PrivateKey,
+		PublicKey:   keys.PublicKey,
+		CreatedAt:   time.Now().UTC(),
+	}
+	p.saveAccount(account)
+	if p.License != "" {
+		p.applyLicense(ctx, account)
+	}
+
+	return creds, nil
+}
+
+// Fetches the config of the registered device
+func (p *WarpAPIProvider) getDevice(ctx context.Context, deviceID string, token string) (*warpRegResponse, error) {
+	var resp warpRegResponse
+	if err := p.do(ctx, http.MethodGet, "/reg/"+deviceID, token, nil, &resp); err != nil {
+		return nil, fmt.Errorf("failed to fetch the config of the WARP device %s: %w",
+			deviceID, err)
+	}
+	return &resp, nil
+}
+
+// Converts the device config returned by the WARP API into the credentials.
+// The private key is not part of the response and has to be set by the caller.
+func credsFromRegResponse(resp *warpRegResponse) (CFCreds, error) {
+	var creds CFCreds
+
+	if len(resp.Config.Peers) == 0 {
+		return creds, errors.New("no peers in the device config")
+	}
+	peer := resp.Config.Peers[0]
+
+	publicKey, err := base64.StdEncoding.DecodeString(peer.PublicKey)
+	if err != nil || len(publicKey) != 32 {
+		return creds, fmt.Errorf("peer public key %q is not a valid WireGuard key",
+			peer.PublicKey)
+	}
+	creds.PublicKey = peer.PublicKey
+
+	creds.Endpoint = peer.Endpoint.Host
+	if creds.Endpoint == "" {
+		return creds, errors.New("no peer endpoint in the device config")
+	}
+	if _, _, err := net.SplitHostPort(creds.Endpoint); err != nil {
+		creds.Endpoint = net.JoinHostPort(creds.Endpoint, warpDefaultPort)
+	}
+
+	addrs := resp.Config.Interface.Addresses
+	if net.ParseIP(addrs.V4) == nil || net.ParseIP(addrs.V4).To4() == nil {
+		return creds, fmt.Errorf("interface address %q is not a valid IPv4 address",
+			addrs.V4)
+	}
+	if net.ParseIP(addrs.V6) == nil || net.ParseIP(addrs.V6).To4() != nil {
+		return creds, fmt.Errorf("interface address %q is not a valid IPv6 address",
+			addrs.V6)
+	}
+	creds.V4 = addrs.V4
+	creds.V6 = addrs.V6
+
+	creds.Reserved, err = reservedFromClientID(resp.Config.ClientID)
+	if err != nil {
+		return creds, err
+	}
+
+	return creds, nil
+}
+
+// The client_id of the device config is the base64 encoded 3 bytes that
+// xray sends in the reserved field of the WireGuard packets
+func reservedFromClientID(clientID string) ([]int, error) {
+	decoded, err := base64.StdEncoding.DecodeString(clientID)
+	if err != nil || len(decoded) != 3 {
+		return nil, fmt.Errorf("client_id %q is not 3 bytes encoded in base64", clientID)
+	}
+
+	reserved := make([]int, len(decoded))
+	for i, b := range decoded {
+		reserved[i] = int(b)
+	}
+	return reserved, nil
+}
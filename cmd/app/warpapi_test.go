@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestGenerateWireguardKeyPair(t *testing.T) {
+	keys, err := generateWireguardKeyPair()
+	utils.AssertNoError(t, err)
+
+	private, err := base64.StdEncoding.DecodeString(keys.PrivateKey)
+	utils.AssertNoError(t, err)
+	utils.AssertCorrectInt(t, 32, len(private))
+	if private[0]&7 != 0 || private[31]&128 != 0 || private[31]&64 == 0 {
+		t.Errorf("Private key %s is not clamped", keys.PrivateKey)
+	}
+
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	utils.AssertNoError(t, err)
+	utils.AssertCorrectString(t, keys.PublicKey,
+		base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()))
+}
+
+const fakeWarpPeerKey = "bmXOC+F1FxEMF9dyiK2H5/1SUtzH0JuVo51h2wPfgyo="
+
+// Returns a registration response the way the WARP client API does
+func fakeWarpRegResponse(clientID string, host string) string {
+	return fmt.Sprintf(`{
+  "id": "device-id",
+  "type": "a",
+  "token": "device-token",
+  "account": {"id": "account-id", "account_type": "free", "license": "license-key"},
+  "config": {
+    "client_id": %q,
+    "peers": [{
+      "public_key": %q,
+      "endpoint": {"v4": "162.159.192.1:0", "v6": "[2606:4700:d0::a29f:c001]:0", "host": %q}
+    }],
+    "interface": {"addresses": {"v4": "172.16.0.2", "v6": "2606:4700:110:8a36::1"}}
+  }
+}`, clientID, fakeWarpPeerKey, host)
+}
+
+func TestWarpAPIProviderGetCredentials(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		response     string
+		wantEndpoint string
+		wantReserved []int
+		errMsg       string
+	}{
+		{
+			name:         "successful registration",
+			status:       http.StatusOK,
+			response:     fakeWarpRegResponse("AQID", "engage.cloudflareclient.com:2408"),
+			wantEndpoint: "engage.cloudflareclient.com:2408",
+			wantReserved: []int{1, 2, 3},
+		},
+		{
+			name:         "endpoint without a port",
+			status:       http.StatusOK,
+			response:     fakeWarpRegResponse("AQID", "engage.cloudflareclient.com"),
+			wantEndpoint: "engage.cloudflareclient.com:2408",
+			wantReserved: []int{1, 2, 3},
+		},
+		{
+			name:     "registration rejected",
+			status:   http.StatusTooManyRequests,
+			response: `{"success": false}`,
+			errMsg:   "failed with status 429",
+		},
+		{
+			name:     "invalid client_id",
+			status:   http.StatusOK,
+			response: fakeWarpRegResponse("AQIDBA==", "engage.cloudflareclient.com:2408"),
+			errMsg:   "is not 3 bytes encoded in base64",
+		},
+		{
+			name:     "no peers",
+			status:   http.StatusOK,
+			response: `{"config": {"client_id": "AQID", "peers": []}}`,
+			errMsg:   "no peers in the device config",
+		},
+		{
+			name:     "malformed response",
+			status:   http.StatusOK,
+			response: `<html>`,
+			errMsg:   "failed to parse the WARP API response",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sentKey string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/v0a2158/reg" {
+					http.NotFound(w, r)
+					return
+				}
+				if r.Header.Get("CF-Client-Version") == "" {
+					http.Error(w, "missing client version", http.StatusBadRequest)
+					return
+				}
+				var req warpRegRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				sentKey = req.Key
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.response)
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			provider := &WarpAPIProvider{
+				APIURL:     server.URL + "/v0a2158",
+				HTTPClient: server.Client(),
+			}
+			creds, err := provider.GetCredentials(ctx)
+
+			if tt.errMsg != "" {
+				utils.AssertErrorContains(t, err, tt.errMsg)
+				return
+			}
+			utils.AssertNoError(t, err)
+
+			// The public key sent to the API must belong to the returned private key
+			private, err := base64.StdEncoding.DecodeString(creds.SecretKey)
+			utils.AssertNoError(t, err)
+			key, err := ecdh.X25519().NewPrivateKey(private)
+			utils.AssertNoError(t, err)
+			utils.AssertCorrectString(t, sentKey,
+				base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()))
+
+			utils.AssertCorrectString(t, fakeWarpPeerKey, creds.PublicKey)
+			utils.AssertCorrectString(t, tt.wantEndpoint, creds.Endpoint)
+			utils.AssertCorrectString(t, "172.16.0.2", creds.V4)
+			utils.AssertCorrectString(t, "2606:4700:110:8a36::1", creds.V6)
+			utils.AssertCorrectString(t, fmt.Sprint(tt.wantReserved), fmt.Sprint(creds.Reserved))
+		})
+	}
+}
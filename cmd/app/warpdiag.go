@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+// WarpStatus is the outcome of the warp check performed via the verification client
+type WarpStatus int
+
+const (
+	WarpOK WarpStatus = iota
+	// The temporary xray verification client could not be started
+	WarpClientFailed
+	// The inbound of the xray server the verification client connects to
+	// is not reachable
+	WarpUpstreamUnreachable
+	// The request through the xray server has failed while both the server and
+	// the ip checker are reachable, i.e. the warp tunnel does not pass the traffic
+	WarpTunnelDown
+	// The traffic leaves the xray server directly instead of going through warp
+	WarpEgressServerIP
+	// The traffic leaves through some provider other than Cloudflare
+	WarpEgressNotCloudflare
+	// The ip checker could not be reached or did not provide the information
+	WarpCheckerUnavailable
+	// Warp is operational, but an address family the outbound relies on is broken
+	WarpDegraded
+	// Warp is operational, but some destinations leave the xray server through
+	// an outbound other than the expected one
+	WarpMisrouted
+	// Warp passes TCP, but the UDP exchanges through it fail
+	WarpUDPBroken
+	// Warp is operational, but its benchmark is below the thresholds
+	WarpSlow
+)
+
+func (s WarpStatus) String() string {
+	switch s {
+	case WarpOK:
+		return "warp is operational"
+	case WarpClientFailed:
+		return "the verification client failed to start"
+	case WarpUpstreamUnreachable:
+		return "the upstream xray server inbound is unreachable"
+	case WarpTunnelDown:
+		return "the warp tunnel does not pass the traffic"
+	case WarpEgressServerIP:
+		return "the egress address is the xray server address"
+	case WarpEgressNotCloudflare:
+		return "the egress provider is not Cloudflare"
+	case WarpCheckerUnavailable:
+		return "the ip checker is unavailable"
+	case WarpDegraded:
+		return "warp is degraded"
+	case WarpMisrouted:
+		return "some destinations are misrouted"
+	case WarpUDPBroken:
+		return "warp passes TCP but not UDP"
+	case WarpSlow:
+		return "warp is too slow"
+	default:
+		return fmt.Sprintf("unknown warp status %d", int(s))
+	}
+}
+
+// WarpDiagnosis explains the status of warp with the details of the failure if any
+type WarpDiagnosis struct {
+	Status WarpStatus
+	Err    error
+	// Address the traffic leaves from, if an ip checker has reported it
+	EgressIP string
+	// Cloudflare data center serving the traffic, if the trace has reported it
+	Colo string
+	// Results of the verification of the separate address families
+	Families []FamilyStatus
+	// Results of the route probes
+	Routes []RouteStatus
+	// Results of the UDP probes
+	UDP []UDPStatus
+	// Result of the benchmark, if it has been run
+	Benchmark *BenchmarkResult
+}
+
+func (d WarpDiagnosis) OK() bool {
+	return d.Status == WarpOK
+}
+
+// NeedsNewCredentials reports whether the failure may be fixed by replacing
+// the warp credentials. The rest of the failures are caused either by the
+// verification setup or by the xray server routing and persist with any
+// credentials.
+func (d WarpDiagnosis) NeedsNewCredentials() bool {
+	return d.Status == WarpTunnelDown
+}
+
+// Egress describes where the traffic leaves from, if known
+func (d WarpDiagnosis) Egress() string {
+	switch {
+	case d.EgressIP != "" && d.Colo != "":
+		return fmt.Sprintf("%s via the Cloudflare %s data center", d.EgressIP, d.Colo)
+	case d.EgressIP != "":
+		return d.EgressIP
+	default:
+		return "unknown"
+	}
+}
+
+// FamilyReport lists the status of every verified address family
+func (d WarpDiagnosis) FamilyReport() string {
+	var report []string
+	for _, f := range d.Families {
+		report = append(report, f.String())
+	}
+	return strings.Join(report, "; ")
+}
+
+// RouteReport lists the route probes that have failed
+func (d WarpDiagnosis) RouteReport() string {
+	var report []string
+	for _, r := range d.Routes {
+		if !r.OK() {
+			report = append(report, r.String())
+		}
+	}
+	return strings.Join(report, "; ")
+}
+
+// UDPReport lists the UDP probes that have failed
+func (d WarpDiagnosis) UDPReport() string {
+	var report []string
+	for _, s := range d.UDP {
+		if !s.OK() {
+			report = append(report, s.String())
+		}
+	}
+	return strings.Join(report, "; ")
+}
+
+func (d WarpDiagnosis) String() string {
+	if d.Err == nil {
+		return d.Status.String()
+	}
+	return fmt.Sprintf("%s: %v", d.Status, d.Err)
+}
+
+// Classifies the response of the ip checker. Tailored for the response of ip-api.com.
+func classifyIPCheckerResponse(ipCheckerResponseJSON []byte, xrayServerIP string) WarpDiagnosis {
+	type IPCheckerResponse struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		ISP     string `json:"isp"`
+		Org     string `json:"org"`
+		Query   string `json:"query"`
+	}
+
+	var r IPCheckerResponse
+
+	if err := utils.ParseJSON(ipCheckerResponseJSON, &r, false); err != nil {
+		return WarpDiagnosis{Status: WarpCheckerUnavailable, Err: fmt.Errorf("could not parse "+
+			"the JSON response provided by the ip checker into a struct: %w", err)}
+	}
+
+	if r.Status != "success" {
+		return WarpDiagnosis{Status: WarpCheckerUnavailable, Err: fmt.Errorf("the ip checker "+
+			"failed to get the ISP/Org status for IP %s and provided the following "+
+			"message: %s", r.Query, r.Message)}
+	}
+
+	provider := fmt.Sprintf("ISP: %s; Org: %s", r.ISP, r.Org)
+	cloudflare := strings.Contains(strings.ToLower(r.ISP), "cloudflare") &&
+		strings.Contains(strings.ToLower(r.Org), "cloudflare")
+	return classifyEgress(r.Query, provider, cloudflare, xrayServerIP)
+}
+
+// Finds out why none of the ip checkers could be requested through the xray
+// server: checks whether the xray server inbound and any of the ip checkers are
+// reachable directly. If they are, the failure is attributed to the warp tunnel.
+func diagnoseRequestFailure(ctx context.Context, requestErr error, upstream string, checkers []IPChecker) WarpDiagnosis {
+	dialer := net.Dialer{Timeout: 3 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", upstream)
+	if err != nil {
+		return WarpDiagnosis{Status: WarpUpstreamUnreachable, Err: fmt.Errorf("%s: %w", upstream, err)}
+	}
+	conn.Close()
+
+	var errs utils.Errors
+	for _, c := range checkers {
+		reqCtx, cancel := context.WithTimeout(ctx, ipCheckerTimeout)
+		_, err := utils.GetRequestWithProxy(reqCtx, c.URL, nil)
+		cancel()
+		if err == nil {
+			return WarpDiagnosis{Status: WarpTunnelDown, Err: requestErr}
+		}
+		errs.Append(fmt.Errorf("%s: %w", c.Type, err))
+	}
+
+	return WarpDiagnosis{Status: WarpCheckerUnavailable, Err: fmt.Errorf("the requests "+
+		"without the proxy have failed as well: %w", errs)}
+}
+
+// Verifications performed once warp has been found operational
+type warpChecks struct {
+	families []warpFamily
+	routes   []routeTarget
+}
+
+// Returns the proxy leading through the xray server: the existing one if
+// configured, otherwise the one of a temporary verification client started with
+// the config. The returned function stops the client.
+func (app *Application) openVerificationProxy(ctx context.Context, xray Xray, clientConfig *ClientConfig) (*utils.Proxy, func(), error) {
+	if xray.Client.ProxyURL != "" {
+		proxy, err := utils.ParseProxyURL(xray.Client.ProxyURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		app.logger.Info.Printf("Verifying through the existing proxy %s.\n", proxy)
+		return proxy, func() {}, nil
+	}
+
+	client, err := startVerificationClient(ctx, xray.ExecutableFilePath, clientConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	startupCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := client.waitReady(startupCtx); err != nil {
+		app.attach("Output of the verification client", client.output.tail(app.logLines))
+		client.stop()
+		return nil, nil, err
+	}
+	app.logger.Info.Println("xray started successfully.")
+	return clientConfig.proxy(), client.stop, nil
+}
+
+// Checks warp by requesting the ip checkers through the xray server using
+// the temporary verification client. The error is only returned if the check
+// itself could not be completed properly.
+func (app *Application) diagnoseWarp(ctx context.Context, xray Xray, clientConfig *ClientConfig, checks warpChecks) (WarpDiagnosis, error) {
+	// The verification client lives until the checkers have answered
+	clientCtx, cancel := context.WithTimeout(ctx, 5*time.Second+
+		time.Duration(len(xray.Client.IPCheckers)+len(checks.families)+
+			len(checks.routes))*ipCheckerTimeout+
+		time.Duration(2*len(xray.Client.UDPProbes))*udpProbeTimeout+
+		benchmarkBudget(xray.Client.Benchmark))
+	defer cancel()
+
+	proxy, stopClient, err := app.openVerificationProxy(clientCtx, xray, clientConfig)
+	if err != nil {
+		return WarpDiagnosis{Status: WarpClientFailed, Err: err}, nil
+	}
+	// Stops the client and removes its directory on every return path and panic
+	defer stopClient()
+
+	app.logger.Info.Printf("Asking %d ip checkers about the IP address and the "+
+		"provider...\n", len(xray.Client.IPCheckers))
+	results := queryIPCheckers(clientCtx, xray.Client.IPCheckers,
+		xray.Client.IPCheckerDecision, proxy, xray.Server.IP)
+	for _, r := range results {
+		app.logger.Info.Printf("ip checker %s (%s): %s\n", r.checker.Type,
+			r.checker.URL, r.diagnosis)
+	}
+
+	diagnosis, requested := decideWarpStatus(results)
+	if diagnosis.OK() && len(checks.families) > 0 {
+		app.logger.Info.Println("Verifying the egress over every address family...")
+		statuses := checkWarpFamilies(clientCtx, checks.families, proxy, xray.Server.IP)
+		for _, s := range statuses {
+			app.logger.Info.Println(s)
+		}
+		diagnosis = applyFamilyStatuses(diagnosis, statuses)
+	}
+	if (diagnosis.OK() || diagnosis.Status == WarpDegraded) && len(checks.routes) > 0 {
+		app.logger.Info.Println("Verifying the routes of the probe destinations...")
+		statuses := checkRoutes(clientCtx, checks.routes, proxy, xray.Server.IP)
+		for _, s := range statuses {
+			app.logger.Info.Println(s)
+		}
+		diagnosis = applyRouteStatuses(diagnosis, statuses)
+	}
+	// The UDP is only worth checking if warp passes TCP
+	tcpPasses := diagnosis.OK() || diagnosis.Status == WarpDegraded ||
+		diagnosis.Status == WarpMisrouted
+	if tcpPasses && len(xray.Client.UDPProbes) > 0 {
+		if proxy.Protocol == utils.ProxySOCKS5 {
+			app.logger.Info.Println("Verifying the UDP exchanges through warp...")
+			statuses := checkUDPProbes(clientCtx, xray.Client.UDPProbes, proxy)
+			for _, s := range statuses {
+				app.logger.Info.Println(s)
+			}
+			diagnosis = applyUDPStatuses(diagnosis, statuses)
+		} else {
+			app.logger.Warning.Printf("The UDP probes are skipped since the proxy %s "+
+				"does not support UDP.\n", proxy)
+		}
+	}
+
+	if diagnosis.OK() && xray.Client.Benchmark.Enabled {
+		app.logger.Info.Printf("Benchmarking warp with %d downloads of %s...\n",
+			xray.Client.Benchmark.Requests, xray.Client.Benchmark.URL)
+		result := runBenchmark(clientCtx, xray.Client.Benchmark, proxy)
+		app.logger.Info.Printf("Benchmark: %s\n", result)
+		diagnosis = applyBenchmark(diagnosis, result)
+	}
+
+	app.logger.Info.Println("Shutting down the xray verification client...")
+	stopClient()
+
+	if !requested {
+		app.logger.Warning.Println("None of the ip checkers could be requested " +
+			"through the xray server. Checking the reachability of the server and " +
+			"the ip checkers...")
+		server := clientConfig.Outbounds[0].Settings.Servers[0]
+		upstream := net.JoinHostPort(server.Address, strconv.Itoa(server.Port))
+		return diagnoseRequestFailure(ctx, diagnosis.Err, upstream, xray.Client.IPCheckers), nil
+	}
+
+	return diagnosis, nil
+}
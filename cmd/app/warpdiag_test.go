@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestClassifyIPCheckerResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		status   WarpStatus
+		errMsg   string
+	}{
+		{
+			name:     "cloudflare",
+			response: `{"status": "success", "isp": "Cloudflare, Inc.", "org": "Cloudflare WARP", "query": "104.28.1.1"}`,
+			status:   WarpOK,
+		},
+		{
+			name:     "server ip",
+			response: `{"status": "success", "isp": "Hetzner", "org": "Hetzner", "query": "1.2.3.4"}`,
+			status:   WarpEgressServerIP,
+			errMsg:   "address of the xray server machine",
+		},
+		{
+			name:     "other provider",
+			response: `{"status": "success", "isp": "Hetzner", "org": "Hetzner", "query": "5.6.7.8"}`,
+			status:   WarpEgressNotCloudflare,
+			errMsg:   "ISP: Hetzner",
+		},
+		{
+			name:     "checker failure",
+			response: `{"status": "fail", "message": "reserved range", "query": "5.6.7.8"}`,
+			status:   WarpCheckerUnavailable,
+			errMsg:   "reserved range",
+		},
+		{
+			name:     "invalid json",
+			response: `<html></html>`,
+			status:   WarpCheckerUnavailable,
+			errMsg:   "could not parse",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := classifyIPCheckerResponse([]byte(tt.response), "1.2.3.4")
+			utils.AssertCorrectString(t, tt.status.String(), d.Status.String())
+			if tt.errMsg != "" {
+				utils.AssertErrorContains(t, d.Err, tt.errMsg)
+			} else {
+				utils.AssertNoError(t, d.Err)
+			}
+		})
+	}
+}
+
+func TestDiagnoseRequestFailure(t *testing.T) {
+	requestErr := errors.New("proxy request failed")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.AssertNoError(t, err)
+	defer listener.Close()
+	upstream := listener.Addr().String()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	utils.AssertNoError(t, err)
+	unreachable := closed.Addr().String()
+	closed.Close()
+
+	checker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"status": "success"}`)
+	}))
+	defer checker.Close()
+	brokenChecker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer brokenChecker.Close()
+
+	working := IPChecker{Type: ipCheckerIPAPI, URL: checker.URL}
+	broken := IPChecker{Type: ipCheckerIPInfo, URL: brokenChecker.URL}
+
+	tests := []struct {
+		name         string
+		upstream     string
+		checkers     []IPChecker
+		status       WarpStatus
+		newCreds     bool
+		wantWrapping bool
+	}{
+		{"tunnel down", upstream, []IPChecker{working}, WarpTunnelDown, true, true},
+		{"one of the checkers is reachable", upstream, []IPChecker{broken, working}, WarpTunnelDown, true, true},
+		{"upstream unreachable", unreachable, []IPChecker{working}, WarpUpstreamUnreachable, false, false},
+		{"checkers unavailable", upstream, []IPChecker{broken}, WarpCheckerUnavailable, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := diagnoseRequestFailure(context.Background(), requestErr, tt.upstream, tt.checkers)
+			utils.AssertCorrectString(t, tt.status.String(), d.Status.String())
+			if d.NeedsNewCredentials() != tt.newCreds {
+				t.Errorf("Expected NeedsNewCredentials to be %v", tt.newCreds)
+			}
+			if errors.Is(d.Err, requestErr) != tt.wantWrapping {
+				t.Errorf("Unexpected diagnosis error: %v", d.Err)
+			}
+			if d.OK() {
+				t.Error("Expected the diagnosis not to be OK")
+			}
+		})
+	}
+}
+
+func TestWarpDiagnosisString(t *testing.T) {
+	utils.AssertCorrectString(t, "warp is operational", WarpDiagnosis{}.String())
+	utils.AssertCorrectString(t, "the warp tunnel does not pass the traffic: timeout",
+		WarpDiagnosis{Status: WarpTunnelDown, Err: errors.New("timeout")}.String())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+const (
+	familyIPv4 = "IPv4"
+	familyIPv6 = "IPv6"
+)
+
+// FamilyCheckers are the ip checkers reachable over a single address family,
+// e.g. by the literal address, which makes the xray server use that family for
+// the warp outbound. An empty URL disables the check of the family.
+type FamilyCheckers struct {
+	IPv4 IPChecker `koanf:"ipv4"`
+	IPv6 IPChecker `koanf:"ipv6"`
+}
+
+// How much the warp outbound depends on an address family
+type familyPolicy int
+
+const (
+	// The outbound does not use the family
+	familyUnused familyPolicy = iota
+	// The family is only used when the preferred one is not available
+	familyFallback
+	// The outbound relies on the family
+	familyRequired
+)
+
+// An address family of the warp outbound to be verified
+type warpFamily struct {
+	Name    string
+	Checker IPChecker
+	Policy  familyPolicy
+}
+
+// Result of the verification of a single address family
+type FamilyStatus struct {
+	Family    string
+	Required  bool
+	Diagnosis WarpDiagnosis
+}
+
+func (s FamilyStatus) String() string {
+	if s.Diagnosis.OK() {
+		return fmt.Sprintf("%s: ok, egress %s", s.Family, s.Diagnosis.Egress())
+	}
+	return fmt.Sprintf("%s: %s", s.Family, s.Diagnosis)
+}
+
+// Works out which address families the wireguard outbound relies on from its
+// addresses and domain strategy. A family without an address is not used at all.
+func warpFamilies(settings *SrvOutbSettings, checkers FamilyCheckers) []warpFamily {
+	var hasV4, hasV6 bool
+	for _, a := range settings.Address {
+		addr, err := netip.ParseAddr(strings.Split(a, "/")[0])
+		if err != nil {
+			continue
+		}
+		if addr.Is4() {
+			hasV4 = true
+		} else {
+			hasV6 = true
+		}
+	}
+
+	v4, v6 := familyRequired, familyRequired
+	switch settings.DomainStrategy {
+	case "ForceIPv4":
+		v6 = familyUnused
+	case "ForceIPv6":
+		v4 = familyUnused
+	case "ForceIPv4v6":
+		v6 = familyFallback
+	case "ForceIPv6v4":
+		v4 = familyFallback
+	}
+	if !hasV4 {
+		v4 = familyUnused
+	}
+	if !hasV6 {
+		v6 = familyUnused
+	}
+
+	var families []warpFamily
+	if v4 != familyUnused && checkers.IPv4.URL != "" {
+		families = append(families, warpFamily{familyIPv4, checkers.IPv4, v4})
+	}
+	if v6 != familyUnused && checkers.IPv6.URL != "" {
+		families = append(families, warpFamily{familyIPv6, checkers.IPv6, v6})
+	}
+	return families
+}
+
+// Returns the settings of the wireguard outbound of the server config
+func warpOutboundSettings(xrayServerConfig *ServerConfig) *SrvOutbSettings {
+	for _, outb := range xrayServerConfig.Outbounds {
+		if outb.Protocol == "wireguard" && outb.Settings != nil {
+			return outb.Settings
+		}
+	}
+	return nil
+}
+
+// Verifies the egress over every family through the proxy. The families are
+// checked only after the warp has been found operational, so a failed request
+// is attributed to the warp tunnel over that family.
+func checkWarpFamilies(ctx context.Context, families []warpFamily, proxy *utils.Proxy, xrayServerIP string) []FamilyStatus {
+	var statuses []FamilyStatus
+	for _, f := range families {
+		r := queryIPChecker(ctx, f.Checker, proxy, xrayServerIP)
+		d := r.diagnosis
+		if r.requestErr != nil {
+			d = WarpDiagnosis{Status: WarpTunnelDown, Err: r.requestErr}
+		}
+		statuses = append(statuses, FamilyStatus{
+			Family:    f.Name,
+			Required:  f.Policy == familyRequired,
+			Diagnosis: d,
+		})
+	}
+	return statuses
+}
+
+// Downgrades an operational diagnosis if a family the outbound relies on is
+// broken. A broken fallback family is only reported.
+func applyFamilyStatuses(d WarpDiagnosis, statuses []FamilyStatus) WarpDiagnosis {
+	d.Families = statuses
+	if !d.OK() {
+		return d
+	}
+
+	var broken []string
+	for _, s := range statuses {
+		// An unavailable checker says nothing about the family
+		if s.Required && !s.Diagnosis.OK() && s.Diagnosis.Status != WarpCheckerUnavailable {
+			broken = append(broken, s.String())
+		}
+	}
+	if len(broken) > 0 {
+		d.Status = WarpDegraded
+		d.Err = fmt.Errorf("%s", strings.Join(broken, "; "))
+	}
+	return d
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ilyakutilin/xray_maintainer/utils"
+)
+
+func TestWarpFamilies(t *testing.T) {
+	checkers := FamilyCheckers{
+		IPv4: IPChecker{Type: ipCheckerTrace, URL: "https://1.1.1.1/cdn-cgi/trace"},
+		IPv6: IPChecker{Type: ipCheckerTrace, URL: "https://[2606:4700:4700::1111]/cdn-cgi/trace"},
+	}
+	dualStack := []string{"172.16.0.2/32", "2606:4700:110:8a36::1/128"}
+
+	tests := []struct {
+		name     string
+		address  []string
+		strategy string
+		checkers FamilyCheckers
+		expected string
+	}{
+		{"force ip", dualStack, "ForceIP", checkers, "IPv4:required IPv6:required"},
+		{"prefer v6", dualStack, "ForceIPv6v4", checkers, "IPv4:fallback IPv6:required"},
+		{"prefer v4", dualStack, "ForceIPv4v6", checkers, "IPv4:required IPv6:fallback"},
+		{"only v4", dualStack, "ForceIPv4", checkers, "IPv4:required"},
+		{"only v6", dualStack, "ForceIPv6", checkers, "IPv6:required"},
+		{"no v6 address", []string{"172.16.0.2"}, "ForceIPv6v4", checkers, "IPv4:fallback"},
+		{"v6 check disabled", dualStack, "ForceIP", FamilyCheckers{IPv4: checkers.IPv4}, "IPv4:required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := SrvOutbSettings{Address: tt.address, DomainStrategy: tt.strategy}
+			var actual string
+			for i, f := range warpFamilies(&settings, tt.checkers) {
+				if i > 0 {
+					actual += " "
+				}
+				policy := map[familyPolicy]string{familyRequired: "required", familyFallback: "fallback"}[f.Policy]
+				actual += f.Name + ":" + policy
+			}
+			utils.AssertCorrectString(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestApplyFamilyStatuses(t *testing.T) {
+	ok := WarpDiagnosis{Status: WarpOK, EgressIP: "104.28.1.1"}
+	broken := WarpDiagnosis{Status: WarpTunnelDown, Err: errors.New("timeout")}
+	unavailable := WarpDiagnosis{Status: WarpCheckerUnavailable, Err: errors.New("bad response")}
+
+	tests := []struct {
+		name     string
+		base     WarpDiagnosis
+		statuses []FamilyStatus
+		status   WarpStatus
+	}{
+		{"all families work", ok, []FamilyStatus{{familyIPv4, true, ok}, {familyIPv6, true, ok}}, WarpOK},
+		{"broken required v6", ok, []FamilyStatus{{familyIPv4, false, ok}, {familyIPv6, true, broken}}, WarpDegraded},
+		{"broken fallback v6", ok, []FamilyStatus{{familyIPv4, true, ok}, {familyIPv6, false, broken}}, WarpOK},
+		{"unavailable checker", ok, []FamilyStatus{{familyIPv6, true, unavailable}}, WarpOK},
+		{"failure is kept", broken, []FamilyStatus{{familyIPv4, true, ok}}, WarpTunnelDown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := applyFamilyStatuses(tt.base, tt.statuses)
+			utils.AssertCorrectString(t, tt.status.String(), d.Status.String())
+			utils.AssertCorrectInt(t, len(tt.statuses), len(d.Families))
+			if d.Status == WarpDegraded {
+				utils.AssertErrorContains(t, d.Err, "IPv6: the warp tunnel does not pass the traffic")
+			}
+		})
+	}
+}
+
+func TestCheckWarpFamilies(t *testing.T) {
+	v4 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ip=104.28.1.1\ncolo=FRA\nwarp=on\n")
+	}))
+	defer v4.Close()
+	v6 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}))
+	defer v6.Close()
+
+	families := []warpFamily{
+		{familyIPv4, IPChecker{Type: ipCheckerTrace, URL: v4.URL}, familyFallback},
+		{familyIPv6, IPChecker{Type: ipCheckerTrace, URL: v6.URL}, familyRequired},
+	}
+
+	statuses := checkWarpFamilies(context.Background(), families, nil, "1.2.3.4")
+	utils.AssertCorrectInt(t, 2, len(statuses))
+	utils.AssertCorrectString(t, "IPv4: ok, egress 104.28.1.1 via the Cloudflare FRA data center",
+		statuses[0].String())
+	utils.AssertCorrectString(t, WarpTunnelDown.String(), statuses[1].Diagnosis.Status.String())
+
+	d := applyFamilyStatuses(WarpDiagnosis{Status: WarpOK}, statuses)
+	utils.AssertCorrectString(t, WarpDegraded.String(), d.Status.String())
+	if d.NeedsNewCredentials() {
+		t.Error("Expected a degraded warp not to need new credentials")
+	}
+}
@@ -2,16 +2,25 @@ package messages
 
 import (
 	"fmt"
+	"html"
 	"strings"
 
 	"github.com/ilyakutilin/xray_maintainer/utils"
 )
 
+// Attachment is a log excerpt or another file relevant to the message, rendered
+// at the end of the body
+type Attachment struct {
+	Name    string
+	Content string
+}
+
 type Message struct {
-	Subject  string
-	Body     string
-	Notes    []string
-	Warnings []string
+	Subject     string
+	Body        string
+	Notes       []string
+	Warnings    []string
+	Attachments []Attachment
 }
 
 func (m Message) getFullBody(html bool) string {
@@ -57,6 +66,10 @@ func (m Message) getFullBody(html bool) string {
 		bs = append(bs, strings.Join(warnings, "\n"))
 	}
 
+	for _, a := range m.Attachments {
+		bs = append(bs, a.inline(html))
+	}
+
 	res := strings.Join(bs, "\n\n")
 
 	if res != "" && res[len(res)-1] != '\n' {
@@ -65,6 +78,16 @@ func (m Message) getFullBody(html bool) string {
 	return res
 }
 
+// Renders the attachment as a section of the body
+func (a Attachment) inline(isHTML bool) string {
+	content := strings.TrimRight(a.Content, "\n")
+	if isHTML {
+		return fmt.Sprintf("<b>%s</b>:\n<pre>%s</pre>", html.EscapeString(a.Name),
+			html.EscapeString(content))
+	}
+	return fmt.Sprintf("%s:\n%s", a.Name, content)
+}
+
 func (m Message) GetFullBodyText() string {
 	return m.getFullBody(false)
 }
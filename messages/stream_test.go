@@ -157,6 +157,31 @@ Notes:
 Warnings:
 1) First Warning
 2) Second Warning
+`,
+		},
+		{
+			name: "warning with attachments",
+			message: Message{
+				Subject:  "Test Subject",
+				Body:     "Test Body",
+				Warnings: []string{"Test Warning"},
+				Attachments: []Attachment{
+					{Name: "journal", Content: "first line\nsecond line\n"},
+					{Name: "error.log", Content: "panic: <nil>"},
+				},
+			},
+			expected: `The following message would be sent:
+Subject: Test Subject
+Body: Test Body
+
+Warning: Test Warning
+
+journal:
+first line
+second line
+
+error.log:
+panic: <nil>
 `,
 		},
 		{
@@ -202,3 +227,15 @@ Body: [empty body]
 		})
 	}
 }
+
+func TestMessage_GetFullBodyHTML(t *testing.T) {
+	msg := Message{
+		Body:        "Test Body",
+		Attachments: []Attachment{{Name: "error.log", Content: "panic: <nil>\n"}},
+	}
+
+	expected := "Test Body\n\n<b>error.log</b>:\n<pre>panic: &lt;nil&gt;</pre>\n"
+	if got := msg.GetFullBodyHTML(); got != expected {
+		t.Errorf("GetFullBodyHTML() = %q, want %q", got, expected)
+	}
+}
@@ -0,0 +1,523 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ulikunitz/xz"
+)
+
+type ArchiveFormat int
+
+const (
+	FormatNone ArchiveFormat = iota
+	FormatZip
+	FormatTar
+	FormatTarGz
+	FormatTarXz
+	FormatGzip
+	FormatXz
+)
+
+func (f ArchiveFormat) String() string {
+	switch f {
+	case FormatZip:
+		return "zip"
+	case FormatTar:
+		return "tar"
+	case FormatTarGz:
+		return "tar.gz"
+	case FormatTarXz:
+		return "tar.xz"
+	case FormatGzip:
+		return "gzip"
+	case FormatXz:
+		return "xz"
+	default:
+		return "none"
+	}
+}
+
+// Extension returns the conventional file extension for the archive format
+// including the leading dot, or an empty string if the format is FormatNone.
+func (f ArchiveFormat) Extension() string {
+	switch f {
+	case FormatGzip:
+		return ".gz"
+	case FormatNone:
+		return ""
+	default:
+		return "." + f.String()
+	}
+}
+
+// IsCompressedStream reports whether the format is a single compressed file
+// rather than an archive with named members.
+func (f ArchiveFormat) IsCompressedStream() bool {
+	return f == FormatGzip || f == FormatXz
+}
+
+var (
+	zipMagic  = []byte{0x50, 0x4B, 0x03, 0x04}
+	zipEmpty  = []byte{0x50, 0x4B, 0x05, 0x06}
+	gzipMagic = []byte{0x1F, 0x8B}
+	xzMagic   = []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}
+	tarMagic  = []byte("ustar")
+)
+
+// The "ustar" magic is located at offset 257 of the first tar header block
+const tarMagicOffset = 257
+
+func hasTarMagic(header []byte) bool {
+	if len(header) < tarMagicOffset+len(tarMagic) {
+		return false
+	}
+	return bytes.Equal(header[tarMagicOffset:tarMagicOffset+len(tarMagic)], tarMagic)
+}
+
+// DetectArchiveFormat identifies the archive format of a file by its magic bytes.
+// For gzip and xz streams the beginning of the decompressed data is inspected
+// as well to tell a compressed tarball from a single compressed file.
+// Returns FormatNone if the file is not a supported archive.
+func DetectArchiveFormat(filePath string) (ArchiveFormat, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return FormatNone, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return FormatNone, err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, zipMagic), bytes.HasPrefix(header, zipEmpty):
+		return FormatZip, nil
+	case bytes.HasPrefix(header, gzipMagic):
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return FormatNone, err
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return FormatNone, fmt.Errorf("corrupt gzip stream: %w", err)
+		}
+		defer gz.Close()
+		if isTarStream(gz) {
+			return FormatTarGz, nil
+		}
+		return FormatGzip, nil
+	case bytes.HasPrefix(header, xzMagic):
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return FormatNone, err
+		}
+		xzr, err := xz.NewReader(file)
+		if err != nil {
+			return FormatNone, fmt.Errorf("corrupt xz stream: %w", err)
+		}
+		if isTarStream(xzr) {
+			return FormatTarXz, nil
+		}
+		return FormatXz, nil
+	case hasTarMagic(header):
+		return FormatTar, nil
+	}
+
+	return FormatNone, nil
+}
+
+func isTarStream(r io.Reader) bool {
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(r, header)
+	return hasTarMagic(header[:n])
+}
+
+// ArchiveMember describes a single extraction rule: which entry of an archive
+// shall be extracted and where to.
+type ArchiveMember struct {
+	// Path of the entry inside the archive. A trailing slash denotes a directory,
+	// in which case all the entries below it are extracted recursively.
+	// Ignored for the compressed single file formats (gzip, xz).
+	Name string
+	// Full path to the destination file (or directory if Name is a directory)
+	Destination string
+	// Permissions of the extracted file(s). If zero, the mode stored in the
+	// archive is used, falling back to 0644.
+	Mode os.FileMode
+}
+
+func (m ArchiveMember) isDir() bool {
+	return strings.HasSuffix(m.Name, "/")
+}
+
+// Reports whether the (cleaned) name of an archive entry is selected by the member
+func (m ArchiveMember) matches(entryName string) bool {
+	name := cleanEntryName(m.Name)
+	if m.isDir() {
+		return strings.HasPrefix(entryName, name)
+	}
+	return entryName == name
+}
+
+// SafeJoin joins the relative path name to the base directory and makes sure that
+// the result does not escape the base directory (e.g. via "../" elements or
+// an absolute path). This protects against the "zip slip" vulnerability.
+func SafeJoin(baseDir, name string) (string, error) {
+	if name == "" {
+		return "", errors.New("empty path")
+	}
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) {
+		return "", fmt.Errorf("path %q is absolute", name)
+	}
+
+	joined := filepath.Join(baseDir, name)
+	rel, err := filepath.Rel(baseDir, joined)
+	if err != nil {
+		return "", fmt.Errorf("path %q cannot be resolved against %s: %w",
+			name, baseDir, err)
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %q escapes the destination directory %s",
+			name, baseDir)
+	}
+
+	return joined, nil
+}
+
+// archiveEntry is a format independent view of a regular file or a directory
+// inside an archive
+type archiveEntry struct {
+	name  string
+	mode  os.FileMode
+	isDir bool
+	open  func() (io.ReadCloser, error)
+}
+
+// The largest file extracted from an archive or decompressed from a gzip or xz
+// file. A bigger one is rather a decompression bomb than a release file.
+var maxExtractedFileSize int64 = 512 << 20
+
+// Fails the read once more than n bytes have been read from r
+type sizeLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, fmt.Errorf("the file is larger than %d bytes", maxExtractedFileSize)
+	}
+	return n, err
+}
+
+func checkArchiveMembers(format ArchiveFormat, members []ArchiveMember) error {
+	if len(members) == 0 {
+		return errors.New("no archive members to extract have been specified")
+	}
+	if format.IsCompressedStream() && len(members) != 1 {
+		return fmt.Errorf("a %s file contains exactly one file, while %d "+
+			"extraction rules have been specified", format, len(members))
+	}
+	return nil
+}
+
+// Lists the regular files and the directories of a zip or tar archive. Only the
+// contents of the tar entries selected by the members are read, so none are read
+// if there are no members. The returned function releases the archive once the
+// entries are no longer needed.
+func readArchiveEntries(archivePath string, format ArchiveFormat, members []ArchiveMember) ([]archiveEntry, func(), error) {
+	switch format {
+	case FormatZip:
+		r, err := zip.OpenReader(archivePath)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var entries []archiveEntry
+		for _, f := range r.File {
+			mode := f.Mode()
+			if !mode.IsRegular() && !mode.IsDir() {
+				// Symlinks and other special files are never extracted
+				continue
+			}
+			entries = append(entries, archiveEntry{
+				name:  f.Name,
+				mode:  mode.Perm(),
+				isDir: mode.IsDir(),
+				open:  f.Open,
+			})
+		}
+		return entries, func() { r.Close() }, nil
+	case FormatTar, FormatTarGz, FormatTarXz:
+		// Tar archives can only be read sequentially, so the (relatively small)
+		// selected entries are read into memory to allow random member access
+		entries, err := readTarEntries(archivePath, format, members)
+		if err != nil {
+			return nil, nil, err
+		}
+		return entries, func() {}, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported archive format: %s", format)
+}
+
+// ExtractArchive extracts the members described by the rules from the archive
+// at archivePath of the given format. Every member must be present in the archive,
+// otherwise an error listing the missing ones is returned and nothing is extracted.
+// Files are first written next to their destination and then renamed into place,
+// so a failed extraction never leaves a half-written destination file behind.
+// Returns the list of the full paths to all the extracted files.
+func ExtractArchive(archivePath string, format ArchiveFormat, members []ArchiveMember) ([]string, error) {
+	if err := checkArchiveMembers(format, members); err != nil {
+		return nil, err
+	}
+	if format.IsCompressedStream() {
+		return extractCompressedStream(archivePath, format, members[0])
+	}
+
+	entries, release, err := readArchiveEntries(archivePath, format, members)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return extractEntries(entries, members)
+}
+
+// ArchiveDestinations returns the full paths of the files ExtractArchive would
+// write for the members, without extracting anything, so that the existing
+// files can be backed up beforehand
+func ArchiveDestinations(archivePath string, format ArchiveFormat, members []ArchiveMember) ([]string, error) {
+	if err := checkArchiveMembers(format, members); err != nil {
+		return nil, err
+	}
+	if format.IsCompressedStream() {
+		return []string{members[0].Destination}, nil
+	}
+
+	entries, release, err := readArchiveEntries(archivePath, format, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	plan, err := planExtraction(entries, members)
+	if err != nil {
+		return nil, err
+	}
+
+	destinations := make([]string, 0, len(plan))
+	for _, p := range plan {
+		destinations = append(destinations, p.destination)
+	}
+	return destinations, nil
+}
+
+func openDecompressed(file io.Reader, format ArchiveFormat) (io.Reader, error) {
+	switch format {
+	case FormatTarGz, FormatGzip:
+		return gzip.NewReader(file)
+	case FormatTarXz, FormatXz:
+		return xz.NewReader(bufio.NewReader(file))
+	case FormatTar:
+		return file, nil
+	}
+	return nil, fmt.Errorf("%s is not a tar or a compressed stream format", format)
+}
+
+func readTarEntries(archivePath string, format ArchiveFormat, members []ArchiveMember) ([]archiveEntry, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := openDecompressed(file, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the %s archive %s: %w",
+			format, filepath.Base(archivePath), err)
+	}
+
+	var entries []archiveEntry
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the %s archive %s: %w",
+				format, filepath.Base(archivePath), err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			entries = append(entries, archiveEntry{name: hdr.Name, isDir: true})
+		case tar.TypeReg:
+			entry := archiveEntry{name: hdr.Name, mode: os.FileMode(hdr.Mode).Perm()}
+			if selected(members, cleanEntryName(hdr.Name)) {
+				if hdr.Size > maxExtractedFileSize {
+					return nil, fmt.Errorf("%s in the archive %s is larger than %d bytes",
+						hdr.Name, filepath.Base(archivePath), maxExtractedFileSize)
+				}
+				data, err := io.ReadAll(io.LimitReader(tr, maxExtractedFileSize))
+				if err != nil {
+					return nil, fmt.Errorf("failed to read %s from the archive %s: %w",
+						hdr.Name, filepath.Base(archivePath), err)
+				}
+				entry.open = func() (io.ReadCloser, error) {
+					return io.NopCloser(bytes.NewReader(data)), nil
+				}
+			}
+			entries = append(entries, entry)
+		default:
+			// Symlinks, hardlinks, devices etc. are never extracted
+		}
+	}
+
+	return entries, nil
+}
+
+func selected(members []ArchiveMember, entryName string) bool {
+	for _, m := range members {
+		if m.matches(entryName) {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanEntryName normalizes the name of an archive entry: strips the leading "./"
+// and converts the backslashes some zip tools produce to forward slashes
+func cleanEntryName(name string) string {
+	name = strings.ReplaceAll(name, `\`, "/")
+	name = strings.TrimPrefix(name, "./")
+	return name
+}
+
+type extraction struct {
+	entry       archiveEntry
+	destination string
+	mode        os.FileMode
+}
+
+// Matches the members against the entries of the archive and works out where
+// every entry shall be extracted to
+func planExtraction(entries []archiveEntry, members []ArchiveMember) ([]extraction, error) {
+	var plan []extraction
+	var missing []string
+
+	for _, m := range members {
+		name := cleanEntryName(m.Name)
+		found := false
+
+		for _, e := range entries {
+			if e.isDir {
+				continue
+			}
+			entryName := cleanEntryName(e.name)
+			if !m.matches(entryName) {
+				continue
+			}
+			found = true
+
+			if !m.isDir() {
+				plan = append(plan, extraction{e, m.Destination, m.Mode})
+				break
+			}
+
+			rel := path.Clean(strings.TrimPrefix(entryName, name))
+			dest, err := SafeJoin(m.Destination, filepath.FromSlash(rel))
+			if err != nil {
+				return nil, fmt.Errorf("refusing to extract %s: %w", e.name, err)
+			}
+			plan = append(plan, extraction{e, dest, m.Mode})
+		}
+
+		if !found {
+			missing = append(missing, m.Name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("the following members have not been found in the "+
+			"archive: %s", strings.Join(missing, ", "))
+	}
+
+	return plan, nil
+}
+
+func extractEntries(entries []archiveEntry, members []ArchiveMember) ([]string, error) {
+	plan, err := planExtraction(entries, members)
+	if err != nil {
+		return nil, err
+	}
+
+	var extracted []string
+	for _, p := range plan {
+		mode := p.mode
+		if mode == 0 {
+			mode = p.entry.mode
+		}
+		if mode == 0 {
+			mode = 0644
+		}
+
+		rc, err := p.entry.open()
+		if err != nil {
+			return extracted, fmt.Errorf("failed to open %s inside the archive: %w",
+				p.entry.name, err)
+		}
+		err = WriteFileAtomically(p.destination,
+			&sizeLimitReader{r: rc, n: maxExtractedFileSize}, mode)
+		rc.Close()
+		if err != nil {
+			return extracted, fmt.Errorf("failed to extract %s: %w", p.entry.name, err)
+		}
+		extracted = append(extracted, p.destination)
+	}
+
+	return extracted, nil
+}
+
+func extractCompressedStream(archivePath string, format ArchiveFormat, member ArchiveMember) ([]string, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := openDecompressed(file, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the %s file %s: %w",
+			format, filepath.Base(archivePath), err)
+	}
+
+	mode := member.Mode
+	if mode == 0 {
+		mode = 0644
+	}
+
+	limited := &sizeLimitReader{r: r, n: maxExtractedFileSize}
+	if err := WriteFileAtomically(member.Destination, limited, mode); err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w",
+			filepath.Base(archivePath), err)
+	}
+
+	return []string{member.Destination}, nil
+}
@@ -0,0 +1,388 @@
+package utils
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+type testArchiveEntry struct {
+	name    string
+	content string
+	mode    int64
+}
+
+func createTestTar(t testing.TB, w io.Writer, entries []testArchiveEntry) {
+	t.Helper()
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		hdr := &tar.Header{
+			Name:     e.name,
+			Mode:     mode,
+			Size:     int64(len(e.content)),
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatUSTAR,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		if _, err := io.WriteString(tw, e.content); err != nil {
+			t.Fatalf("Failed to write tar entry: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to close tar writer: %v", err)
+	}
+}
+
+func createTestArchive(t testing.TB, format ArchiveFormat, entries []testArchiveEntry) string {
+	t.Helper()
+	var buf bytes.Buffer
+
+	switch format {
+	case FormatZip:
+		zw := zip.NewWriter(&buf)
+		for _, e := range entries {
+			w, err := zw.Create(e.name)
+			if err != nil {
+				t.Fatalf("Failed to create file in zip: %v", err)
+			}
+			if _, err := io.WriteString(w, e.content); err != nil {
+				t.Fatalf("Failed to write to zip: %v", err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Failed to close zip writer: %v", err)
+		}
+	case FormatTar:
+		createTestTar(t, &buf, entries)
+	case FormatTarGz:
+		gz := gzip.NewWriter(&buf)
+		createTestTar(t, gz, entries)
+		gz.Close()
+	case FormatTarXz:
+		xzw, err := xz.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("Failed to create xz writer: %v", err)
+		}
+		createTestTar(t, xzw, entries)
+		xzw.Close()
+	case FormatGzip:
+		gz := gzip.NewWriter(&buf)
+		io.WriteString(gz, entries[0].content)
+		gz.Close()
+	case FormatXz:
+		xzw, err := xz.NewWriter(&buf)
+		if err != nil {
+			t.Fatalf("Failed to create xz writer: %v", err)
+		}
+		io.WriteString(xzw, entries[0].content)
+		xzw.Close()
+	default:
+		buf.WriteString(entries[0].content)
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "archive"+RandomString(6))
+	if err := os.WriteFile(archivePath, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+	return archivePath
+}
+
+func TestDetectArchiveFormat(t *testing.T) {
+	entries := []testArchiveEntry{{name: "xray", content: "binary content"}}
+
+	formats := []ArchiveFormat{
+		FormatNone, FormatZip, FormatTar, FormatTarGz, FormatTarXz, FormatGzip, FormatXz,
+	}
+
+	for _, format := range formats {
+		t.Run(format.String(), func(t *testing.T) {
+			archivePath := createTestArchive(t, format, entries)
+			got, err := DetectArchiveFormat(archivePath)
+			AssertNoError(t, err)
+			AssertCorrectString(t, format.String(), got.String())
+		})
+	}
+
+	t.Run("empty file", func(t *testing.T) {
+		path := CreateTempFilePath(t)
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := DetectArchiveFormat(path)
+		AssertNoError(t, err)
+		AssertCorrectString(t, FormatNone.String(), got.String())
+	})
+
+	t.Run("non-existent file", func(t *testing.T) {
+		_, err := DetectArchiveFormat("/nonexistent/file")
+		AssertError(t, err)
+	})
+}
+
+func TestSafeJoin(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain file", input: "geoip.dat", want: "/base/geoip.dat"},
+		{name: "nested file", input: "bin/xray", want: "/base/bin/xray"},
+		{name: "harmless dots", input: "bin/../xray", want: "/base/xray"},
+		{name: "parent escape", input: "../etc/passwd", wantErr: true},
+		{name: "nested escape", input: "bin/../../etc/passwd", wantErr: true},
+		{name: "absolute path", input: "/etc/passwd", wantErr: true},
+		{name: "empty path", input: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := SafeJoin("/base", tt.input)
+			if tt.wantErr {
+				AssertError(t, err)
+				return
+			}
+			AssertNoError(t, err)
+			AssertCorrectString(t, tt.want, got)
+		})
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	entries := []testArchiveEntry{
+		{name: "xray", content: "xray binary", mode: 0755},
+		{name: "geoip.dat", content: "geoip data"},
+		{name: "LICENSE", content: "license text"},
+		{name: "docs/README.md", content: "readme"},
+		{name: "docs/sub/guide.md", content: "guide"},
+	}
+
+	for _, format := range []ArchiveFormat{FormatZip, FormatTar, FormatTarGz, FormatTarXz} {
+		t.Run(format.String(), func(t *testing.T) {
+			archivePath := createTestArchive(t, format, entries)
+			destDir := t.TempDir()
+
+			members := []ArchiveMember{
+				{Name: "xray", Destination: filepath.Join(destDir, "xray"), Mode: 0750},
+				{Name: "geoip.dat", Destination: filepath.Join(destDir, "data", "geoip.dat")},
+				{Name: "docs/", Destination: filepath.Join(destDir, "docs")},
+			}
+
+			extracted, err := ExtractArchive(archivePath, format, members)
+			if err != nil {
+				t.Fatalf("ExtractArchive() error = %v", err)
+			}
+			AssertCorrectInt(t, 4, len(extracted))
+
+			want := map[string]string{
+				"xray":              "xray binary",
+				"data/geoip.dat":    "geoip data",
+				"docs/README.md":    "readme",
+				"docs/sub/guide.md": "guide",
+			}
+			for rel, content := range want {
+				got, err := os.ReadFile(filepath.Join(destDir, rel))
+				if err != nil {
+					t.Errorf("Failed to read extracted file %s: %v", rel, err)
+					continue
+				}
+				AssertCorrectString(t, content, string(got))
+			}
+
+			if FileExists(filepath.Join(destDir, "LICENSE")) {
+				t.Errorf("LICENSE was extracted although no rule asked for it")
+			}
+
+			info, err := os.Stat(filepath.Join(destDir, "xray"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0750 {
+				t.Errorf("Expected mode 0750, got %o", info.Mode().Perm())
+			}
+		})
+	}
+
+	for _, format := range []ArchiveFormat{FormatGzip, FormatXz} {
+		t.Run(format.String(), func(t *testing.T) {
+			archivePath := createTestArchive(t, format,
+				[]testArchiveEntry{{content: "compressed content"}})
+			dest := filepath.Join(t.TempDir(), "tool")
+
+			_, err := ExtractArchive(archivePath, format,
+				[]ArchiveMember{{Destination: dest, Mode: 0755}})
+			if err != nil {
+				t.Fatalf("ExtractArchive() error = %v", err)
+			}
+
+			got, err := os.ReadFile(dest)
+			AssertNoError(t, err)
+			AssertCorrectString(t, "compressed content", string(got))
+
+			_, err = ExtractArchive(archivePath, format, []ArchiveMember{
+				{Destination: dest}, {Destination: dest + "2"},
+			})
+			AssertErrorContains(t, err, "contains exactly one file")
+		})
+	}
+
+	t.Run("missing members", func(t *testing.T) {
+		archivePath := createTestArchive(t, FormatZip, entries)
+		destDir := t.TempDir()
+
+		_, err := ExtractArchive(archivePath, FormatZip, []ArchiveMember{
+			{Name: "xray", Destination: filepath.Join(destDir, "xray")},
+			{Name: "geosite.dat", Destination: filepath.Join(destDir, "geosite.dat")},
+			{Name: "bin/", Destination: filepath.Join(destDir, "bin")},
+		})
+		AssertErrorContains(t, err, "geosite.dat, bin/")
+
+		if FileExists(filepath.Join(destDir, "xray")) {
+			t.Errorf("Nothing shall be extracted if any of the members is missing")
+		}
+	})
+
+	t.Run("zip slip", func(t *testing.T) {
+		for _, format := range []ArchiveFormat{FormatZip, FormatTarGz} {
+			archivePath := createTestArchive(t, format, []testArchiveEntry{
+				{name: "docs/../../evil.sh", content: "evil"},
+			})
+			destDir := filepath.Join(t.TempDir(), "nested")
+
+			_, err := ExtractArchive(archivePath, format, []ArchiveMember{
+				{Name: "docs/", Destination: filepath.Join(destDir, "docs")},
+			})
+			AssertErrorContains(t, err, "escapes the destination directory")
+
+			if FileExists(filepath.Join(filepath.Dir(destDir), "evil.sh")) {
+				t.Errorf("%s: the file escaped the destination directory", format)
+			}
+		}
+	})
+
+	t.Run("no members", func(t *testing.T) {
+		archivePath := createTestArchive(t, FormatZip, entries)
+		_, err := ExtractArchive(archivePath, FormatZip, nil)
+		AssertError(t, err)
+	})
+
+	t.Run("leading dot slash in entry names", func(t *testing.T) {
+		archivePath := createTestArchive(t, FormatTarGz, []testArchiveEntry{
+			{name: "./xray", content: "xray binary"},
+		})
+		dest := filepath.Join(t.TempDir(), "xray")
+
+		_, err := ExtractArchive(archivePath, FormatTarGz,
+			[]ArchiveMember{{Name: "xray", Destination: dest}})
+		AssertNoError(t, err)
+
+		got, err := os.ReadFile(dest)
+		AssertNoError(t, err)
+		if !strings.Contains(string(got), "xray binary") {
+			t.Errorf("Unexpected content: %q", got)
+		}
+	})
+
+	t.Run("size limit", func(t *testing.T) {
+		limit := maxExtractedFileSize
+		maxExtractedFileSize = 16
+		t.Cleanup(func() { maxExtractedFileSize = limit })
+
+		for _, format := range []ArchiveFormat{FormatZip, FormatTarGz, FormatGzip, FormatXz} {
+			archivePath := createTestArchive(t, format, []testArchiveEntry{
+				{name: "xray", content: strings.Repeat("x", 64)},
+			})
+			dest := filepath.Join(t.TempDir(), "xray")
+
+			_, err := ExtractArchive(archivePath, format,
+				[]ArchiveMember{{Name: "xray", Destination: dest}})
+			AssertErrorContains(t, err, "larger than 16 bytes")
+
+			if FileExists(dest) {
+				t.Errorf("%s: a file over the limit shall not be extracted", format)
+			}
+		}
+	})
+}
+
+func TestReadTarEntries(t *testing.T) {
+	archivePath := createTestArchive(t, FormatTarGz, []testArchiveEntry{
+		{name: "xray", content: "xray binary"},
+		{name: "LICENSE", content: "license text"},
+		{name: "docs/README.md", content: "readme"},
+	})
+
+	entries, err := readTarEntries(archivePath, FormatTarGz, []ArchiveMember{
+		{Name: "xray"}, {Name: "docs/"},
+	})
+	AssertNoError(t, err)
+	AssertCorrectInt(t, 3, len(entries))
+
+	for _, e := range entries {
+		if want := e.name != "LICENSE"; want != (e.open != nil) {
+			t.Errorf("%s: expected the contents to be read only for the selected "+
+				"entries", e.name)
+		}
+	}
+}
+
+func TestArchiveDestinations(t *testing.T) {
+	entries := []testArchiveEntry{
+		{name: "xray", content: "xray binary"},
+		{name: "docs/README.md", content: "readme"},
+		{name: "docs/sub/guide.md", content: "guide"},
+	}
+
+	for _, format := range []ArchiveFormat{FormatZip, FormatTarGz} {
+		t.Run(format.String(), func(t *testing.T) {
+			archivePath := createTestArchive(t, format, entries)
+			destDir := t.TempDir()
+
+			destinations, err := ArchiveDestinations(archivePath, format, []ArchiveMember{
+				{Name: "xray", Destination: filepath.Join(destDir, "xray")},
+				{Name: "docs/", Destination: filepath.Join(destDir, "docs")},
+			})
+			AssertNoError(t, err)
+			slices.Sort(destinations)
+			AssertCorrectString(t, fmt.Sprint([]string{
+				filepath.Join(destDir, "docs", "README.md"),
+				filepath.Join(destDir, "docs", "sub", "guide.md"),
+				filepath.Join(destDir, "xray"),
+			}), fmt.Sprint(destinations))
+
+			if FileExists(filepath.Join(destDir, "xray")) {
+				t.Errorf("Nothing shall be extracted while listing the destinations")
+			}
+
+			_, err = ArchiveDestinations(archivePath, format, []ArchiveMember{
+				{Name: "geosite.dat", Destination: filepath.Join(destDir, "geosite.dat")},
+			})
+			AssertErrorContains(t, err, "geosite.dat")
+		})
+	}
+
+	t.Run("compressed stream", func(t *testing.T) {
+		archivePath := createTestArchive(t, FormatGzip, []testArchiveEntry{{content: "content"}})
+		dest := filepath.Join(t.TempDir(), "tool")
+
+		destinations, err := ArchiveDestinations(archivePath, FormatGzip, []ArchiveMember{{Destination: dest}})
+		AssertNoError(t, err)
+		AssertCorrectString(t, fmt.Sprint([]string{dest}), fmt.Sprint(destinations))
+	})
+}
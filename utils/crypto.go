@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const secretKeySize = 32
+
+// LoadOrCreateSecretKey reads the base64 encoded 256-bit key from the file
+// at keyPath. If the file does not exist, a random key is generated and written
+// to it readable by the owner only.
+func LoadOrCreateSecretKey(keyPath string) ([]byte, error) {
+	data, err := os.ReadFile(keyPath)
+	if err == nil {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != secretKeySize {
+			return nil, fmt.Errorf("%s does not contain a base64 encoded %d-byte key",
+				keyPath, secretKeySize)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key := make([]byte, secretKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := WriteFileAtomically(keyPath, strings.NewReader(encoded), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write the new key to %s: %w", keyPath, err)
+	}
+	return key, nil
+}
+
+// Encrypt encrypts the plaintext with AES-256-GCM. The random nonce is prepended
+// to the returned ciphertext.
+func Encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt reverses Encrypt. An error is returned if the data has been encrypted
+// with another key or tampered with.
+func Decrypt(key []byte, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt the data: wrong key or corrupted data")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WriteEncryptedFile encrypts the data and writes it atomically to the file
+// readable by the owner only
+func WriteEncryptedFile(filePath string, key []byte, data []byte) error {
+	encrypted, err := Encrypt(key, data)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomically(filePath, bytes.NewReader(encrypted), 0600)
+}
+
+// ReadEncryptedFile reads and decrypts the file written by WriteEncryptedFile
+func ReadEncryptedFile(filePath string, key []byte) ([]byte, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return Decrypt(key, data)
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateSecretKey(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "secret.key")
+
+	key, err := LoadOrCreateSecretKey(keyPath)
+	AssertNoError(t, err)
+	AssertCorrectInt(t, secretKeySize, len(key))
+
+	info, err := os.Stat(keyPath)
+	AssertNoError(t, err)
+	AssertCorrectInt(t, 0600, int(info.Mode().Perm()))
+
+	again, err := LoadOrCreateSecretKey(keyPath)
+	AssertNoError(t, err)
+	if !bytes.Equal(key, again) {
+		t.Error("Expected the existing key to be loaded rather than a new one generated")
+	}
+
+	AssertNoError(t, os.WriteFile(keyPath, []byte("not a key"), 0600))
+	_, err = LoadOrCreateSecretKey(keyPath)
+	AssertErrorContains(t, err, "does not contain a base64 encoded 32-byte key")
+}
+
+func TestEncryptedFile(t *testing.T) {
+	dir := t.TempDir()
+	key, err := LoadOrCreateSecretKey(filepath.Join(dir, "secret.key"))
+	AssertNoError(t, err)
+	otherKey, err := LoadOrCreateSecretKey(filepath.Join(dir, "other.key"))
+	AssertNoError(t, err)
+
+	filePath := filepath.Join(dir, "secret.enc")
+	plaintext := []byte(`{"token": "very secret"}`)
+	AssertNoError(t, WriteEncryptedFile(filePath, key, plaintext))
+
+	raw, err := os.ReadFile(filePath)
+	AssertNoError(t, err)
+	if bytes.Contains(raw, []byte("very secret")) {
+		t.Error("Expected the file contents to be encrypted")
+	}
+
+	got, err := ReadEncryptedFile(filePath, key)
+	AssertNoError(t, err)
+	AssertCorrectString(t, string(plaintext), string(got))
+
+	_, err = ReadEncryptedFile(filePath, otherKey)
+	AssertErrorContains(t, err, "wrong key or corrupted data")
+
+	raw[len(raw)-1] ^= 0xFF
+	AssertNoError(t, os.WriteFile(filePath, raw, 0600))
+	_, err = ReadEncryptedFile(filePath, key)
+	AssertErrorContains(t, err, "wrong key or corrupted data")
+
+	_, err = Decrypt(key, []byte{1, 2, 3})
+	AssertErrorContains(t, err, "too short")
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	DNSTypeA    uint16 = 1
+	DNSTypeAAAA uint16 = 28
+)
+
+// BuildDNSQuery encodes a recursive query of the type for the name
+func BuildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	// ID, flags with the recursion desired bit, one question
+	msg := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil, errors.New("empty DNS name")
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return nil, fmt.Errorf("invalid DNS name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	// Class IN
+	return binary.BigEndian.AppendUint16(msg, 1), nil
+}
+
+// ParseDNSResponse checks that the message answers the query with the ID
+// successfully and returns the number of the answer records
+func ParseDNSResponse(id uint16, msg []byte) (int, error) {
+	if len(msg) < 12 {
+		return 0, fmt.Errorf("DNS response of %d bytes is too short", len(msg))
+	}
+	if got := binary.BigEndian.Uint16(msg[0:2]); got != id {
+		return 0, fmt.Errorf("DNS response ID %d does not match the query ID %d", got, id)
+	}
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	if flags&0x8000 == 0 {
+		return 0, errors.New("the DNS message is not a response")
+	}
+	if rcode := flags & 0x000f; rcode != 0 {
+		return 0, fmt.Errorf("DNS response code %d", rcode)
+	}
+	return int(binary.BigEndian.Uint16(msg[6:8])), nil
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBuildDNSQuery(t *testing.T) {
+	query, err := BuildDNSQuery(0x1234, "cloudflare.com.", DNSTypeA)
+	AssertNoError(t, err)
+	want := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0,
+		10, 'c', 'l', 'o', 'u', 'd', 'f', 'l', 'a', 'r', 'e', 3, 'c', 'o', 'm', 0,
+		0, 1, 0, 1}
+	if !bytes.Equal(want, query) {
+		t.Errorf("Expected %v, got %v", want, query)
+	}
+
+	for _, name := range []string{"", "a..b", string(bytes.Repeat([]byte("a"), 64)) + ".com"} {
+		_, err := BuildDNSQuery(1, name, DNSTypeA)
+		if err == nil {
+			t.Errorf("Expected an error for the name %q", name)
+		}
+	}
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	header := func(id uint16, flags uint16, answers uint16) []byte {
+		return []byte{byte(id >> 8), byte(id), byte(flags >> 8), byte(flags), 0, 1,
+			byte(answers >> 8), byte(answers), 0, 0, 0, 0}
+	}
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		answers int
+		errMsg  string
+	}{
+		{"answered", header(7, 0x8180, 2), 2, ""},
+		{"too short", []byte{0, 7}, 0, "too short"},
+		{"other ID", header(8, 0x8180, 1), 0, "does not match"},
+		{"query", header(7, 0x0100, 0), 0, "not a response"},
+		{"servfail", header(7, 0x8182, 0), 0, "response code 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answers, err := ParseDNSResponse(7, tt.msg)
+			if tt.errMsg != "" {
+				AssertErrorContains(t, err, tt.errMsg)
+				return
+			}
+			AssertNoError(t, err)
+			AssertCorrectInt(t, tt.answers, answers)
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package utils
+
+import (
+	"debug/elf"
+	"fmt"
+	"runtime"
+)
+
+// Maps GOARCH values to the ELF machine, class and byte order of the binaries
+// built for them
+var elfArchs = map[string]struct {
+	machine elf.Machine
+	class   elf.Class
+	data    elf.Data
+}{
+	"386":      {elf.EM_386, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"amd64":    {elf.EM_X86_64, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"arm":      {elf.EM_ARM, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"arm64":    {elf.EM_AARCH64, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"loong64":  {elf.EM_LOONGARCH, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"mips":     {elf.EM_MIPS, elf.ELFCLASS32, elf.ELFDATA2MSB},
+	"mipsle":   {elf.EM_MIPS, elf.ELFCLASS32, elf.ELFDATA2LSB},
+	"mips64":   {elf.EM_MIPS, elf.ELFCLASS64, elf.ELFDATA2MSB},
+	"mips64le": {elf.EM_MIPS, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"ppc64":    {elf.EM_PPC64, elf.ELFCLASS64, elf.ELFDATA2MSB},
+	"ppc64le":  {elf.EM_PPC64, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"riscv64":  {elf.EM_RISCV, elf.ELFCLASS64, elf.ELFDATA2LSB},
+	"s390x":    {elf.EM_S390, elf.ELFCLASS64, elf.ELFDATA2MSB},
+}
+
+// CheckELFArch makes sure that the file by the filePath is an ELF executable
+// built for the architecture of the host the app is running on.
+func CheckELFArch(filePath string) error {
+	return checkELFArch(filePath, runtime.GOARCH)
+}
+
+func checkELFArch(filePath string, goarch string) error {
+	f, err := elf.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid ELF file: %w", filePath, err)
+	}
+	defer f.Close()
+
+	want, ok := elfArchs[goarch]
+	if !ok {
+		return fmt.Errorf("the host architecture %s is not supported by the ELF "+
+			"architecture check", goarch)
+	}
+
+	if f.Machine != want.machine || f.Class != want.class || f.Data != want.data {
+		return fmt.Errorf("%s is built for %s (%s, %s), while the host architecture "+
+			"is %s (%s, %s, %s)", filePath, f.Machine, f.Class, f.Data,
+			goarch, want.machine, want.class, want.data)
+	}
+
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return fmt.Errorf("%s is an ELF file of type %s, not an executable",
+			filePath, f.Type)
+	}
+
+	return nil
+}
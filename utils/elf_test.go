@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestCheckELFArch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("ELF binaries are only produced on linux")
+	}
+
+	testBinary, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Failed to get the path to the test binary: %v", err)
+	}
+
+	t.Run("host executable", func(t *testing.T) {
+		AssertNoError(t, CheckELFArch(testBinary))
+	})
+
+	t.Run("foreign architecture", func(t *testing.T) {
+		other := "arm64"
+		if runtime.GOARCH == "arm64" {
+			other = "amd64"
+		}
+		AssertErrorContains(t, checkELFArch(testBinary, other), "host architecture")
+	})
+
+	t.Run("unsupported host architecture", func(t *testing.T) {
+		AssertErrorContains(t, checkELFArch(testBinary, "wasm"), "not supported")
+	})
+
+	t.Run("not an ELF file", func(t *testing.T) {
+		path := CreateTempFilePath(t)
+		if err := os.WriteFile(path, []byte("<html>Not Found</html>"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		AssertErrorContains(t, CheckELFArch(path), "not a valid ELF file")
+	})
+
+	t.Run("foreign byte order", func(t *testing.T) {
+		path := writeELFHeader(t, elf.EM_MIPS, binary.BigEndian)
+		AssertNoError(t, checkELFArch(path, "mips"))
+		AssertErrorContains(t, checkELFArch(path, "mipsle"), "host architecture")
+	})
+}
+
+// Writes a bare 32-bit ELF executable header for the machine in the byte order
+func writeELFHeader(t *testing.T, machine elf.Machine, order binary.ByteOrder) string {
+	t.Helper()
+
+	data := elf.ELFDATA2LSB
+	if order == binary.BigEndian {
+		data = elf.ELFDATA2MSB
+	}
+
+	hdr := elf.Header32{
+		Type:    uint16(elf.ET_EXEC),
+		Machine: uint16(machine),
+		Version: uint32(elf.EV_CURRENT),
+		Ehsize:  uint16(binary.Size(elf.Header32{})),
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+	hdr.Ident[elf.EI_DATA] = byte(data)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, order, hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	path := CreateTempFilePath(t)
+	if err := os.WriteFile(path, buf.Bytes(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -3,6 +3,8 @@ package utils
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -190,3 +192,54 @@ func RestoreFile(src, dst string) error {
 	// Ensure data is written to disk
 	return dstFile.Sync()
 }
+
+// WriteFileAtomically writes the contents of r to a temporary file in the directory
+// of filePath and then renames it to filePath, so that readers never see a partially
+// written file and a failed write leaves the original file (if any) intact.
+func WriteFileAtomically(filePath string, r io.Reader, mode os.FileMode) error {
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filePath)
+}
+
+// FileSHA256 returns the hex encoded SHA-256 checksum and the size of the file
+func FileSHA256(filePath string) (string, int64, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read %s: %w", filePath, err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,308 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Protobuf wire types, see https://protobuf.dev/programming-guides/encoding/
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+type protoField struct {
+	num      int
+	wireType int
+	varint   uint64
+	bytes    []byte
+}
+
+// Walks through the top level fields of a protobuf message calling fn for each one.
+// Only the wire format is validated, the semantics are up to the caller.
+func readProtoFields(data []byte, fn func(f protoField) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errors.New("malformed field key")
+		}
+		data = data[n:]
+
+		f := protoField{num: int(key >> 3), wireType: int(key & 7)}
+		if f.num == 0 {
+			return errors.New("invalid field number 0")
+		}
+
+		switch f.wireType {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("malformed varint in field %d", f.num)
+			}
+			f.varint = v
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return fmt.Errorf("truncated fixed64 in field %d", f.num)
+			}
+			data = data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return fmt.Errorf("truncated fixed32 in field %d", f.num)
+			}
+			data = data[4:]
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("malformed length in field %d", f.num)
+			}
+			data = data[n:]
+			if uint64(len(data)) < l {
+				return fmt.Errorf("truncated field %d: %d bytes declared, %d left",
+					f.num, l, len(data))
+			}
+			f.bytes = data[:l]
+			data = data[l:]
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", f.wireType, f.num)
+		}
+
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expectWireType(f protoField, wireType int, name string) error {
+	if f.wireType != wireType {
+		return fmt.Errorf("%s has wire type %d instead of %d", name, f.wireType, wireType)
+	}
+	return nil
+}
+
+// GeoData is a summary of the contents of a v2ray geoip.dat or geosite.dat file.
+type GeoData struct {
+	// The categories (country codes) in upper case, as xray matches them
+	// case-insensitively, mapped to the set of the attributes used by their
+	// entries. Attributes are only present in geosite files.
+	Categories map[string]map[string]struct{}
+}
+
+// Has reports whether the category with the provided code (case-insensitive) exists
+// and has entries with all the provided attributes.
+func (g *GeoData) Has(code string, attrs ...string) bool {
+	catAttrs, ok := g.Categories[strings.ToUpper(code)]
+	if !ok {
+		return false
+	}
+	for _, a := range attrs {
+		if _, ok := catAttrs[strings.ToLower(a)]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func parseGeoList(data []byte, listName string, parseEntry func([]byte) (string, map[string]struct{}, error)) (*GeoData, error) {
+	g := &GeoData{Categories: make(map[string]map[string]struct{})}
+
+	err := readProtoFields(data, func(f protoField) error {
+		if f.num != 1 {
+			return fmt.Errorf("unexpected field %d in %s", f.num, listName)
+		}
+		if err := expectWireType(f, wireBytes, listName+".entry"); err != nil {
+			return err
+		}
+		code, attrs, err := parseEntry(f.bytes)
+		if err != nil {
+			return fmt.Errorf("entry #%d: %w", len(g.Categories)+1, err)
+		}
+		code = strings.ToUpper(code)
+		if _, exists := g.Categories[code]; !exists {
+			g.Categories[code] = make(map[string]struct{})
+		}
+		for a := range attrs {
+			g.Categories[code][a] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s: %w", listName, err)
+	}
+
+	if len(g.Categories) == 0 {
+		return nil, fmt.Errorf("%s contains no entries", listName)
+	}
+
+	return g, nil
+}
+
+func parseCountryCode(f protoField, msgName string) (string, error) {
+	if err := expectWireType(f, wireBytes, msgName+".country_code"); err != nil {
+		return "", err
+	}
+	if len(f.bytes) == 0 || !utf8.Valid(f.bytes) {
+		return "", fmt.Errorf("%s.country_code is empty or not a valid string", msgName)
+	}
+	return string(f.bytes), nil
+}
+
+// ParseGeoIP parses and validates the contents of a geoip.dat file (a GeoIPList
+// protobuf message) and returns the summary of its categories.
+func ParseGeoIP(data []byte) (*GeoData, error) {
+	return parseGeoList(data, "GeoIPList", func(entry []byte) (string, map[string]struct{}, error) {
+		var code string
+		cidrs := 0
+
+		err := readProtoFields(entry, func(f protoField) error {
+			switch f.num {
+			case 1:
+				var err error
+				code, err = parseCountryCode(f, "GeoIP")
+				return err
+			case 2:
+				if err := expectWireType(f, wireBytes, "GeoIP.cidr"); err != nil {
+					return err
+				}
+				cidrs++
+				return validateCIDR(f.bytes)
+			}
+			// Other fields (e.g. reverse_match) are irrelevant for the validation
+			return nil
+		})
+		if err != nil {
+			return "", nil, err
+		}
+
+		if code == "" {
+			return "", nil, errors.New("GeoIP entry without a country code")
+		}
+		if cidrs == 0 {
+			return "", nil, fmt.Errorf("GeoIP entry %s has no CIDRs", code)
+		}
+		return code, nil, nil
+	})
+}
+
+func validateCIDR(data []byte) error {
+	var ip []byte
+	var prefix uint64
+
+	err := readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			if err := expectWireType(f, wireBytes, "CIDR.ip"); err != nil {
+				return err
+			}
+			ip = f.bytes
+		case 2:
+			if err := expectWireType(f, wireVarint, "CIDR.prefix"); err != nil {
+				return err
+			}
+			prefix = f.varint
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(ip) != 4 && len(ip) != 16 {
+		return fmt.Errorf("CIDR has an IP of %d bytes", len(ip))
+	}
+	if prefix > uint64(len(ip)*8) {
+		return fmt.Errorf("CIDR prefix /%d is too long for an IP of %d bytes",
+			prefix, len(ip))
+	}
+
+	return nil
+}
+
+// ParseGeoSite parses and validates the contents of a geosite.dat file
+// (a GeoSiteList protobuf message) and returns the summary of its categories
+// including the attributes of their domains.
+func ParseGeoSite(data []byte) (*GeoData, error) {
+	return parseGeoList(data, "GeoSiteList", func(entry []byte) (string, map[string]struct{}, error) {
+		var code string
+		domains := 0
+		attrs := make(map[string]struct{})
+
+		err := readProtoFields(entry, func(f protoField) error {
+			switch f.num {
+			case 1:
+				var err error
+				code, err = parseCountryCode(f, "GeoSite")
+				return err
+			case 2:
+				if err := expectWireType(f, wireBytes, "GeoSite.domain"); err != nil {
+					return err
+				}
+				domains++
+				return parseDomain(f.bytes, attrs)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", nil, err
+		}
+
+		if code == "" {
+			return "", nil, errors.New("GeoSite entry without a country code")
+		}
+		if domains == 0 {
+			return "", nil, fmt.Errorf("GeoSite entry %s has no domains", code)
+		}
+		return code, attrs, nil
+	})
+}
+
+func parseDomain(data []byte, attrs map[string]struct{}) error {
+	var value string
+
+	err := readProtoFields(data, func(f protoField) error {
+		switch f.num {
+		case 1:
+			if err := expectWireType(f, wireVarint, "Domain.type"); err != nil {
+				return err
+			}
+			// Plain, Regex, Domain (RootDomain) and Full
+			if f.varint > 3 {
+				return fmt.Errorf("unknown domain type %d", f.varint)
+			}
+		case 2:
+			if err := expectWireType(f, wireBytes, "Domain.value"); err != nil {
+				return err
+			}
+			value = string(f.bytes)
+		case 3:
+			if err := expectWireType(f, wireBytes, "Domain.attribute"); err != nil {
+				return err
+			}
+			return readProtoFields(f.bytes, func(af protoField) error {
+				if af.num == 1 {
+					if err := expectWireType(af, wireBytes, "Attribute.key"); err != nil {
+						return err
+					}
+					attrs[strings.ToLower(string(af.bytes))] = struct{}{}
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if value == "" {
+		return errors.New("domain with an empty value")
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"testing"
+)
+
+func TestParseGeoIP(t *testing.T) {
+	valid := BuildGeoIPList(map[string][]string{
+		"CN":      {"1.0.1.0/24", "2001:250::/35"},
+		"private": {"10.0.0.0/8"},
+	})
+
+	t.Run("valid file", func(t *testing.T) {
+		g, err := ParseGeoIP(valid)
+		AssertNoError(t, err)
+		AssertCorrectInt(t, 2, len(g.Categories))
+		AssertCorrectBool(t, true, g.Has("cn"))
+		AssertCorrectBool(t, true, g.Has("PRIVATE"))
+		AssertCorrectBool(t, false, g.Has("ru"))
+	})
+
+	t.Run("truncated file", func(t *testing.T) {
+		_, err := ParseGeoIP(valid[:len(valid)-3])
+		AssertErrorContains(t, err, "malformed GeoIPList")
+	})
+
+	t.Run("html error page", func(t *testing.T) {
+		_, err := ParseGeoIP([]byte("<!DOCTYPE html><html><body>Not Found</body></html>"))
+		AssertError(t, err)
+	})
+
+	t.Run("empty file", func(t *testing.T) {
+		_, err := ParseGeoIP(nil)
+		AssertErrorContains(t, err, "no entries")
+	})
+
+	t.Run("invalid prefix", func(t *testing.T) {
+		var cidr, entry []byte
+		cidr = protoBytes(cidr, 1, []byte{1, 2, 3, 4})
+		cidr = protoVarint(cidr, 2, 33)
+		entry = protoBytes(entry, 1, []byte("XX"))
+		entry = protoBytes(entry, 2, cidr)
+		_, err := ParseGeoIP(protoBytes(nil, 1, entry))
+		AssertErrorContains(t, err, "prefix /33 is too long")
+	})
+
+	t.Run("entry without cidrs", func(t *testing.T) {
+		entry := protoBytes(nil, 1, []byte("XX"))
+		_, err := ParseGeoIP(protoBytes(nil, 1, entry))
+		AssertErrorContains(t, err, "has no CIDRs")
+	})
+}
+
+func TestParseGeoSite(t *testing.T) {
+	valid := BuildGeoSiteList(map[string][]string{
+		"GOOGLE":      {"google.com", "doubleclick.net@ads"},
+		"category-ru": {"yandex.ru"},
+	})
+
+	t.Run("valid file", func(t *testing.T) {
+		g, err := ParseGeoSite(valid)
+		AssertNoError(t, err)
+		AssertCorrectInt(t, 2, len(g.Categories))
+		AssertCorrectBool(t, true, g.Has("google"))
+		AssertCorrectBool(t, true, g.Has("google", "ads"))
+		AssertCorrectBool(t, false, g.Has("google", "cn"))
+		AssertCorrectBool(t, true, g.Has("CATEGORY-RU"))
+		AssertCorrectBool(t, false, g.Has("netflix"))
+	})
+
+	t.Run("truncated file", func(t *testing.T) {
+		_, err := ParseGeoSite(valid[:len(valid)/2])
+		AssertErrorContains(t, err, "malformed GeoSiteList")
+	})
+
+	t.Run("geoip file is not a valid geosite file", func(t *testing.T) {
+		_, err := ParseGeoSite(BuildGeoIPList(map[string][]string{"CN": {"1.0.1.0/24"}}))
+		AssertError(t, err)
+	})
+
+	t.Run("unknown domain type", func(t *testing.T) {
+		var domain, entry []byte
+		domain = protoVarint(domain, 1, 7)
+		domain = protoBytes(domain, 2, []byte("example.com"))
+		entry = protoBytes(entry, 1, []byte("XX"))
+		entry = protoBytes(entry, 2, domain)
+		_, err := ParseGeoSite(protoBytes(nil, 1, entry))
+		AssertErrorContains(t, err, "unknown domain type 7")
+	})
+}
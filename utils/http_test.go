@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -115,3 +116,96 @@ func TestGetRequestWithProxy_ReadBodyError(t *testing.T) {
 }
 
 // TODO: Test the proxy
+
+func TestGetRequestWithProxy_SOCKS5(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("via socks"))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name     string
+		server   [2]string
+		username string
+		password string
+		errMsg   string
+	}{
+		{"no authentication", [2]string{"", ""}, "", "", ""},
+		{"authentication", [2]string{"user", "secret"}, "user", "secret", ""},
+		{"wrong password", [2]string{"user", "secret"}, "user", "wrong", "authentication failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := startSOCKS5Server(t, tt.server[0], tt.server[1])
+			proxy.Username, proxy.Password = tt.username, tt.password
+
+			body, err := GetRequestWithProxy(context.Background(), ts.URL, proxy)
+			if tt.errMsg != "" {
+				AssertErrorContains(t, err, tt.errMsg)
+				return
+			}
+			AssertNoError(t, err)
+			AssertCorrectString(t, "via socks", string(body))
+		})
+	}
+}
+
+func TestParseProxyURL(t *testing.T) {
+	tests := []struct {
+		url    string
+		want   Proxy
+		errMsg string
+	}{
+		{"http://127.0.0.1:8080", Proxy{Protocol: ProxyHTTP, IP: "127.0.0.1", Port: 8080}, ""},
+		{"socks5://user:pa%3Ass@[::1]:1080", Proxy{Protocol: ProxySOCKS5, IP: "::1", Port: 1080,
+			Username: "user", Password: "pa:ss"}, ""},
+		{"socks4://127.0.0.1:1080", Proxy{}, "unsupported proxy scheme"},
+		{"socks5://127.0.0.1", Proxy{}, "invalid port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			p, err := ParseProxyURL(tt.url)
+			if tt.errMsg != "" {
+				AssertErrorContains(t, err, tt.errMsg)
+				return
+			}
+			AssertNoError(t, err)
+			if *p != tt.want {
+				t.Errorf("Expected %+v, got %+v", tt.want, *p)
+			}
+			if strings.Contains(p.String(), "pa:ss") {
+				t.Errorf("Expected the password to be redacted, got %s", p)
+			}
+		})
+	}
+}
+
+func TestMeasureDownload(t *testing.T) {
+	body := strings.Repeat("x", 100_000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	stats, err := MeasureDownload(context.Background(), ts.URL, nil)
+	AssertNoError(t, err)
+	AssertCorrectInt(t, len(body), int(stats.Bytes))
+	if stats.TTFB < 50*time.Millisecond {
+		t.Errorf("Expected the time to the first byte of at least 50ms, got %s", stats.TTFB)
+	}
+
+	proxy := startSOCKS5Server(t, "user", "secret")
+	stats, err = MeasureDownload(context.Background(), ts.URL, proxy)
+	AssertNoError(t, err)
+	AssertCorrectInt(t, len(body), int(stats.Bytes))
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer failing.Close()
+	_, err = MeasureDownload(context.Background(), failing.URL, nil)
+	AssertErrorContains(t, err, "429")
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrLocked is returned when the lock is held by another process
+var ErrLocked = errors.New("the lock is held by another process")
+
+// FileLock is an exclusive advisory lock on a file. The kernel releases it when
+// the process exits, however it exits.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile takes the exclusive lock on the file at the path without waiting,
+// creating the file if necessary. The PID of the process is written to the file,
+// so that ErrLocked can tell the holder.
+func LockFile(path string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the lock file %s: %w", path, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			holder := make([]byte, 32)
+			n, _ := f.ReadAt(holder, 0)
+			if pid := strings.TrimSpace(string(holder[:n])); pid != "" {
+				return nil, fmt.Errorf("%w (PID %s)", ErrLocked, pid)
+			}
+			return nil, ErrLocked
+		}
+		return nil, fmt.Errorf("failed to lock the file %s: %w", path, err)
+	}
+
+	// The PID is informational only, so failing to write it is not an error
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &FileLock{file: f}, nil
+}
+
+// Unlock releases the lock. The file is left in place, since removing it would
+// let another process lock a file which is no longer the one at the path.
+func (l *FileLock) Unlock() error {
+	defer l.file.Close()
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.lock")
+
+	lock, err := LockFile(path)
+	AssertNoError(t, err)
+	content, err := os.ReadFile(path)
+	AssertNoError(t, err)
+	AssertCorrectString(t, fmt.Sprint(os.Getpid()), strings.TrimSpace(string(content)))
+
+	// The locks of the separately opened files conflict within a process too
+	_, err = LockFile(path)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("Expected ErrLocked, got %v", err)
+	}
+	AssertErrorContains(t, err, fmt.Sprintf("(PID %d)", os.Getpid()))
+
+	AssertNoError(t, lock.Unlock())
+	lock, err = LockFile(path)
+	AssertNoError(t, err)
+	AssertNoError(t, lock.Unlock())
+
+	t.Run("missing directory", func(t *testing.T) {
+		_, err := LockFile(filepath.Join(path, "missing", "app.lock"))
+		AssertErrorContains(t, err, "failed to open the lock file")
+	})
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"fmt"
 	"net"
 	"time"
 )
@@ -21,3 +22,14 @@ func WaitForPort(addr string, timeout time.Duration) error {
 type timeoutErr string
 
 func (e timeoutErr) Error() string { return string(e) }
+
+// FreePort returns a TCP port on the loopback interface that is free at the moment
+// of the call
+func FreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
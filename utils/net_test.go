@@ -2,6 +2,7 @@ package utils
 
 import (
 	"net"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -31,3 +32,15 @@ func TestWaitForPort_ClosedPort(t *testing.T) {
 		t.Errorf("expected error due to port being closed, got nil")
 	}
 }
+
+func TestFreePort(t *testing.T) {
+	port, err := FreePort()
+	if err != nil {
+		t.Fatalf("expected a free port, got error: %v", err)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("expected port %d to be free, got error: %v", port, err)
+	}
+	listener.Close()
+}
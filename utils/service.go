@@ -0,0 +1,405 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Supported service managers
+const (
+	ServiceSystemd     = "systemd"
+	ServiceOpenRC      = "openrc"
+	ServiceRunit       = "runit"
+	ServiceSupervisord = "supervisord"
+	ServiceDocker      = "docker"
+	ServiceDirect      = "direct"
+)
+
+// How long the service is given to become active after the restart
+const (
+	serviceActiveAttempts = 5
+	serviceActiveInterval = 1 * time.Second
+)
+
+// ServiceManager restarts a service and reports whether it is running,
+// whatever supervises it
+type ServiceManager interface {
+	// Name of the service for the messages
+	Name() string
+	Restart(ctx context.Context) error
+	// Reload makes the service reread its config without a restart, if the
+	// service supports it
+	Reload(ctx context.Context) error
+	// IsActive reports whether the service is running right now
+	IsActive(ctx context.Context) (bool, error)
+	// Logs returns the log of the service written since the time, or
+	// ErrNoServiceLogs if the service manager does not keep it
+	Logs(ctx context.Context, since time.Time) (string, error)
+}
+
+var ErrNoServiceLogs = errors.New("the service manager does not provide the logs")
+
+// CommandService manages a service with the commands of its init system or
+// supervisor run through the executor
+type CommandService struct {
+	name       string
+	restartCmd string
+	reloadCmd  string
+	statusCmd  string
+	// Prints the log since the unix time passed to Sprintf, no logs if empty
+	logsCmd string
+	// Tells from the output of the status command whether the service is active
+	active func(output string) bool
+	// The status command exits with a non-zero code if the service is stopped,
+	// so such an exit is not an error
+	inactiveExits bool
+	// The status and the logs commands require the privileges along with the
+	// restart and the reload ones
+	privilegedQueries bool
+	// Command the privileged commands are run through
+	privilegePrefix string
+	executor        CommandExecutor
+}
+
+// NewCommandService returns the manager of the kind for the service name, which
+// is the unit, the service, the program or the container name depending on the
+// kind. The shell is used if the executor is nil.
+func NewCommandService(kind, name string, executor CommandExecutor) (*CommandService, error) {
+	if name == "" {
+		return nil, fmt.Errorf("the %s service shall have a name", kind)
+	}
+	if executor == nil {
+		executor = defaultExecutor
+	}
+	s := &CommandService{name: name, privilegePrefix: "sudo", executor: executor}
+
+	switch kind {
+	case ServiceSystemd:
+		s.restartCmd = fmt.Sprintf("systemctl restart %s", name)
+		s.reloadCmd = fmt.Sprintf("systemctl reload %s", name)
+		s.statusCmd = fmt.Sprintf("systemctl is-active %s", name)
+		s.logsCmd = fmt.Sprintf("journalctl -u %s --since @%%d --no-pager -o cat", name)
+		s.active = func(output string) bool { return strings.TrimSpace(output) == "active" }
+	case ServiceOpenRC:
+		s.restartCmd = fmt.Sprintf("rc-service %s restart", name)
+		s.reloadCmd = fmt.Sprintf("rc-service %s reload", name)
+		s.statusCmd = fmt.Sprintf("rc-service %s status", name)
+		s.active = func(output string) bool { return strings.Contains(output, "status: started") }
+		s.inactiveExits = true
+	case ServiceRunit:
+		s.restartCmd = fmt.Sprintf("sv restart %s", name)
+		s.reloadCmd = fmt.Sprintf("sv hup %s", name)
+		s.statusCmd = fmt.Sprintf("sv status %s", name)
+		s.active = func(output string) bool { return strings.HasPrefix(output, "run:") }
+	case ServiceSupervisord:
+		s.restartCmd = fmt.Sprintf("supervisorctl restart %s", name)
+		s.reloadCmd = fmt.Sprintf("supervisorctl signal HUP %s", name)
+		s.statusCmd = fmt.Sprintf("supervisorctl status %s", name)
+		s.active = func(output string) bool {
+			fields := strings.Fields(output)
+			return len(fields) > 1 && fields[1] == "RUNNING"
+		}
+		s.inactiveExits = true
+	case ServiceDocker:
+		s.restartCmd = fmt.Sprintf("docker restart %s", name)
+		s.reloadCmd = fmt.Sprintf("docker kill --signal HUP %s", name)
+		s.statusCmd = fmt.Sprintf("docker inspect --format '{{.State.Running}}' %s", name)
+		s.logsCmd = fmt.Sprintf("docker logs --since %%d %s 2>&1", name)
+		s.active = func(output string) bool { return strings.TrimSpace(output) == "true" }
+		s.privilegedQueries = true
+	default:
+		return nil, fmt.Errorf("unknown service manager %q", kind)
+	}
+	return s, nil
+}
+
+// SetPrivilegePrefix sets the command the commands requiring the privileges are
+// run through, sudo by default. They are run as is if the prefix is empty, e.g.
+// by root or when the service manager authorizes the user itself.
+func (s *CommandService) SetPrivilegePrefix(prefix string) {
+	s.privilegePrefix = prefix
+}
+
+// PrivilegedCommands returns the restart and the reload commands without the
+// privilege prefix, e.g. to be allowed by a sudoers rule
+func (s *CommandService) PrivilegedCommands() []string {
+	return []string{s.restartCmd, s.reloadCmd}
+}
+
+// Runs the command, through the privilege prefix if it is privileged
+func (s *CommandService) run(ctx context.Context, cmd string, privileged bool) (string, error) {
+	if privileged && s.privilegePrefix != "" {
+		cmd = s.privilegePrefix + " " + cmd
+	}
+	return s.executor(ctx, cmd)
+}
+
+func (s *CommandService) Name() string {
+	return s.name
+}
+
+func (s *CommandService) Restart(ctx context.Context) error {
+	_, err := s.run(ctx, s.restartCmd, true)
+	return err
+}
+
+func (s *CommandService) Reload(ctx context.Context) error {
+	_, err := s.run(ctx, s.reloadCmd, true)
+	return err
+}
+
+func (s *CommandService) Logs(ctx context.Context, since time.Time) (string, error) {
+	if s.logsCmd == "" {
+		return "", ErrNoServiceLogs
+	}
+	return s.run(ctx, fmt.Sprintf(s.logsCmd, since.Unix()), s.privilegedQueries)
+}
+
+func (s *CommandService) IsActive(ctx context.Context) (bool, error) {
+	output, err := s.run(ctx, s.statusCmd, s.privilegedQueries)
+	var exitErr *exec.ExitError
+	if err != nil && s.inactiveExits && errors.As(err, &exitErr) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return s.active(output), nil
+}
+
+// DirectProcess manages the service process itself, for the hosts where nothing
+// supervises it: the process is started detached and tracked by its PID file
+type DirectProcess struct {
+	Executable string
+	Args       []string
+	PIDFile    string
+	// The output of the process is appended to it, discarded if empty
+	LogFile string
+	// How long the process is given to exit on SIGTERM before it is killed
+	StopTimeout time.Duration
+
+	// Size of the log file when the process was started last
+	logOffset int64
+}
+
+func (p *DirectProcess) Name() string {
+	return filepath.Base(p.Executable)
+}
+
+// Restart stops the running process if any and starts a new one
+func (p *DirectProcess) Restart(ctx context.Context) error {
+	if err := p.stop(ctx); err != nil {
+		return err
+	}
+	return p.start()
+}
+
+// Reload sends SIGHUP to the running process
+func (p *DirectProcess) Reload(ctx context.Context) error {
+	pid, err := p.readPID()
+	if err != nil {
+		return err
+	}
+	if pid == 0 || !p.owns(pid) {
+		return fmt.Errorf("%s is not running", p.Name())
+	}
+	if err := syscall.Kill(pid, syscall.SIGHUP); err != nil {
+		return fmt.Errorf("failed to reload %s (PID %d): %w", p.Name(), pid, err)
+	}
+	return nil
+}
+
+// Logs returns the output of the process started last regardless of the time,
+// since the log file has no timestamps of its own
+func (p *DirectProcess) Logs(ctx context.Context, since time.Time) (string, error) {
+	if p.LogFile == "" {
+		return "", ErrNoServiceLogs
+	}
+	f, err := os.Open(p.LogFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to open the log file of %s: %w", p.Name(), err)
+	}
+	defer f.Close()
+	if _, err := f.Seek(p.logOffset, io.SeekStart); err != nil {
+		return "", err
+	}
+	raw, err := io.ReadAll(f)
+	return string(raw), err
+}
+
+func (p *DirectProcess) IsActive(ctx context.Context) (bool, error) {
+	pid, err := p.readPID()
+	if err != nil || pid == 0 {
+		return false, err
+	}
+	return p.owns(pid), nil
+}
+
+// Returns the PID from the PID file, 0 if there is no PID file
+func (p *DirectProcess) readPID() (int, error) {
+	raw, err := os.ReadFile(p.PIDFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the PID file: %w", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("the PID file %s does not contain a PID", p.PIDFile)
+	}
+	return pid, nil
+}
+
+// Reports whether the PID belongs to a live process of the executable, since a
+// stale PID file may point at a PID reused by some other process
+func (p *DirectProcess) owns(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+
+	// Without procfs the signal is the only evidence
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	// The state follows the parenthesized command name, a zombie has exited
+	if i := strings.LastIndexByte(string(stat), ')'); i >= 0 && i+2 < len(stat) && stat[i+2] == 'Z' {
+		return false
+	}
+
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return true
+	}
+	want, err := filepath.EvalSymlinks(p.Executable)
+	if err != nil {
+		want = p.Executable
+	}
+	// The executable may have been replaced by an update while running
+	if strings.TrimSuffix(exe, " (deleted)") == want {
+		return true
+	}
+	// A script runs as its interpreter with the script as the first argument
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return false
+	}
+	args := strings.Split(string(cmdline), "\x00")
+	return len(args) > 1 && (args[1] == p.Executable || args[1] == want)
+}
+
+func (p *DirectProcess) stop(ctx context.Context) error {
+	pid, err := p.readPID()
+	if err != nil {
+		return err
+	}
+	if pid == 0 || !p.owns(pid) {
+		return nil
+	}
+
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return fmt.Errorf("failed to stop %s (PID %d): %w", p.Name(), pid, err)
+	}
+	timeout := p.StopTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	for p.owns(pid) {
+		if time.Now().After(deadline) {
+			_ = syscall.Kill(pid, syscall.SIGKILL)
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+func (p *DirectProcess) start() error {
+	cmd := exec.Command(p.Executable, p.Args...)
+	cmd.Dir = filepath.Dir(p.Executable)
+	// The process shall outlive the app
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if p.LogFile != "" {
+		log, err := os.OpenFile(p.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open the log file of %s: %w", p.Name(), err)
+		}
+		defer log.Close()
+		if info, err := log.Stat(); err == nil {
+			p.logOffset = info.Size()
+		}
+		cmd.Stdout = log
+		cmd.Stderr = log
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", p.Name(), err)
+	}
+	pid := cmd.Process.Pid
+	if err := os.WriteFile(p.PIDFile, []byte(strconv.Itoa(pid)+"\n"), 0644); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("failed to write the PID file of %s: %w", p.Name(), err)
+	}
+	return cmd.Process.Release()
+}
+
+// Waits for the service to become active
+func waitServiceActive(ctx context.Context, service ServiceManager) (bool, error) {
+	for range serviceActiveAttempts {
+		active, err := service.IsActive(ctx)
+		if err != nil {
+			return false, err
+		}
+		if active {
+			return true, nil
+		}
+		time.Sleep(serviceActiveInterval)
+	}
+	return false, nil
+}
+
+// CheckServiceOperability restarts the service and makes sure it is active
+func CheckServiceOperability(ctx context.Context, service ServiceManager) error {
+	if err := service.Restart(ctx); err != nil {
+		return err
+	}
+	isActive, err := waitServiceActive(ctx, service)
+	if err != nil {
+		return err
+	}
+	if !isActive {
+		return fmt.Errorf("%s service is not active", service.Name())
+	}
+	return nil
+}
+
+// CheckServiceReload reloads the service and makes sure it is still active
+func CheckServiceReload(ctx context.Context, service ServiceManager) error {
+	if err := service.Reload(ctx); err != nil {
+		return err
+	}
+	isActive, err := waitServiceActive(ctx, service)
+	if err != nil {
+		return err
+	}
+	if !isActive {
+		return fmt.Errorf("%s service is not active after the reload", service.Name())
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandService(t *testing.T) {
+	ctx := context.Background()
+	exitErr := func() error {
+		return fmt.Errorf("command execution failed: %w", exec.Command("false").Run())
+	}()
+
+	tests := []struct {
+		kind       string
+		restartCmd string
+		reloadCmd  string
+		statusCmd  string
+		output     string
+		statusErr  error
+		wantActive bool
+		wantErr    bool
+	}{
+		{ServiceSystemd, "sudo systemctl restart xray", "sudo systemctl reload xray", "systemctl is-active xray", "active\n", nil, true, false},
+		{ServiceSystemd, "sudo systemctl restart xray", "sudo systemctl reload xray", "systemctl is-active xray", "", exitErr, false, true},
+		{ServiceOpenRC, "sudo rc-service xray restart", "sudo rc-service xray reload", "rc-service xray status", " * status: started\n", nil, true, false},
+		{ServiceOpenRC, "sudo rc-service xray restart", "sudo rc-service xray reload", "rc-service xray status", " * status: stopped\n", exitErr, false, false},
+		{ServiceRunit, "sudo sv restart xray", "sudo sv hup xray", "sv status xray", "run: xray: (pid 123) 5s\n", nil, true, false},
+		{ServiceRunit, "sudo sv restart xray", "sudo sv hup xray", "sv status xray", "down: xray: 3s, normally up\n", nil, false, false},
+		{ServiceSupervisord, "sudo supervisorctl restart xray", "sudo supervisorctl signal HUP xray", "supervisorctl status xray", "xray   RUNNING   pid 123, uptime 0:00:05\n", nil, true, false},
+		{ServiceSupervisord, "sudo supervisorctl restart xray", "sudo supervisorctl signal HUP xray", "supervisorctl status xray", "", exitErr, false, false},
+		{ServiceDocker, "sudo docker restart xray", "sudo docker kill --signal HUP xray", "sudo docker inspect --format '{{.State.Running}}' xray", "true\n", nil, true, false},
+		{ServiceDocker, "sudo docker restart xray", "sudo docker kill --signal HUP xray", "sudo docker inspect --format '{{.State.Running}}' xray", "", fmt.Errorf("no such container"), false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %q", tt.kind, tt.output), func(t *testing.T) {
+			var commands []string
+			executor := func(ctx context.Context, cmd string) (string, error) {
+				commands = append(commands, cmd)
+				if cmd == tt.statusCmd {
+					return tt.output, tt.statusErr
+				}
+				return "", nil
+			}
+
+			service, err := NewCommandService(tt.kind, "xray", executor)
+			AssertNoError(t, err)
+			AssertCorrectString(t, "xray", service.Name())
+			AssertNoError(t, service.Restart(ctx))
+			AssertNoError(t, service.Reload(ctx))
+			active, err := service.IsActive(ctx)
+			if tt.wantErr {
+				AssertError(t, err)
+			} else {
+				AssertNoError(t, err)
+			}
+			AssertCorrectBool(t, tt.wantActive, active)
+			AssertCorrectString(t, tt.restartCmd+"; "+tt.reloadCmd+"; "+tt.statusCmd,
+				strings.Join(commands, "; "))
+		})
+	}
+
+	t.Run("logs", func(t *testing.T) {
+		since := time.Unix(1700000000, 0)
+		var commands []string
+		executor := func(ctx context.Context, cmd string) (string, error) {
+			commands = append(commands, cmd)
+			return "log line\n", nil
+		}
+		for _, kind := range []string{ServiceSystemd, ServiceDocker, ServiceRunit} {
+			service, err := NewCommandService(kind, "xray", executor)
+			AssertNoError(t, err)
+			logs, err := service.Logs(ctx, since)
+			if kind == ServiceRunit {
+				if !errors.Is(err, ErrNoServiceLogs) {
+					t.Errorf("Expected ErrNoServiceLogs, got %v", err)
+				}
+				continue
+			}
+			AssertNoError(t, err)
+			AssertCorrectString(t, "log line\n", logs)
+		}
+		AssertCorrectString(t, "journalctl -u xray --since @1700000000 --no-pager -o cat; "+
+			"sudo docker logs --since 1700000000 xray 2>&1", strings.Join(commands, "; "))
+	})
+
+	t.Run("privilege prefix", func(t *testing.T) {
+		tests := []struct {
+			kind     string
+			prefix   string
+			expected string
+		}{
+			{ServiceSystemd, "sudo -n", "sudo -n systemctl restart xray; systemctl is-active xray"},
+			{ServiceSystemd, "", "systemctl restart xray; systemctl is-active xray"},
+			{ServiceDocker, "sudo -n", "sudo -n docker restart xray; sudo -n docker inspect --format '{{.State.Running}}' xray"},
+			{ServiceDocker, "", "docker restart xray; docker inspect --format '{{.State.Running}}' xray"},
+		}
+		for _, tt := range tests {
+			var commands []string
+			executor := func(ctx context.Context, cmd string) (string, error) {
+				commands = append(commands, cmd)
+				return "", nil
+			}
+			service, err := NewCommandService(tt.kind, "xray", executor)
+			AssertNoError(t, err)
+			service.SetPrivilegePrefix(tt.prefix)
+			AssertNoError(t, service.Restart(ctx))
+			service.IsActive(ctx)
+			AssertCorrectString(t, tt.expected, strings.Join(commands, "; "))
+		}
+
+		service, err := NewCommandService(ServiceRunit, "xray", nil)
+		AssertNoError(t, err)
+		AssertCorrectString(t, "sv restart xray; sv hup xray",
+			strings.Join(service.PrivilegedCommands(), "; "))
+	})
+
+	t.Run("unknown kind", func(t *testing.T) {
+		_, err := NewCommandService("upstart", "xray", nil)
+		AssertErrorContains(t, err, `unknown service manager "upstart"`)
+	})
+
+	t.Run("no name", func(t *testing.T) {
+		_, err := NewCommandService(ServiceRunit, "", nil)
+		AssertErrorContains(t, err, "shall have a name")
+	})
+}
+
+func TestDirectProcess(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	executable := filepath.Join(dir, "xray")
+	script := "#!/bin/sh\ntrap 'echo stopping; exit 0' TERM\ntrap 'echo reloaded' HUP\necho started \"$@\"\nwhile true; do sleep 0.1; done\n"
+	AssertNoError(t, os.WriteFile(executable, []byte(script), 0755))
+
+	p := &DirectProcess{
+		Executable:  executable,
+		Args:        []string{"run", "-c", "config.json"},
+		PIDFile:     filepath.Join(dir, "xray.pid"),
+		LogFile:     filepath.Join(dir, "xray.log"),
+		StopTimeout: 2 * time.Second,
+	}
+	readPID := func() int {
+		pid, err := p.readPID()
+		AssertNoError(t, err)
+		return pid
+	}
+	// The process writes to the log asynchronously
+	waitLog := func(want string) {
+		var log []byte
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); {
+			var err error
+			log, err = os.ReadFile(p.LogFile)
+			AssertNoError(t, err)
+			if string(log) == want {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		AssertCorrectString(t, want, string(log))
+	}
+
+	active, err := p.IsActive(ctx)
+	AssertNoError(t, err)
+	AssertCorrectBool(t, false, active)
+
+	AssertNoError(t, CheckServiceOperability(ctx, p))
+	first := readPID()
+	waitLog("started run -c config.json\n")
+	t.Cleanup(func() {
+		if pid, _ := p.readPID(); pid != 0 {
+			_ = exec.Command("kill", "-KILL", strconv.Itoa(pid)).Run()
+		}
+	})
+
+	AssertNoError(t, p.Restart(ctx))
+	second := readPID()
+	if second == first {
+		t.Fatalf("Expected a new process, got the same PID %d", first)
+	}
+	AssertCorrectBool(t, false, p.owns(first))
+	active, err = p.IsActive(ctx)
+	AssertNoError(t, err)
+	AssertCorrectBool(t, true, active)
+
+	waitLog("started run -c config.json\nstopping\nstarted run -c config.json\n")
+
+	AssertNoError(t, CheckServiceReload(ctx, p))
+	AssertCorrectInt(t, second, readPID())
+	waitLog("started run -c config.json\nstopping\nstarted run -c config.json\nreloaded\n")
+	logs, err := p.Logs(ctx, time.Now())
+	AssertNoError(t, err)
+	AssertCorrectString(t, "started run -c config.json\nreloaded\n", logs)
+
+	t.Run("stale pid file", func(t *testing.T) {
+		other := &DirectProcess{Executable: "/nonexistent/xray", PIDFile: p.PIDFile}
+		active, err := other.IsActive(ctx)
+		AssertNoError(t, err)
+		AssertCorrectBool(t, false, active)
+		AssertErrorContains(t, other.Reload(ctx), "xray is not running")
+	})
+
+	t.Run("exited process", func(t *testing.T) {
+		exiting := filepath.Join(dir, "exiting")
+		AssertNoError(t, os.WriteFile(exiting, []byte("#!/bin/sh\nexit 1\n"), 0755))
+		p := &DirectProcess{Executable: exiting, PIDFile: filepath.Join(dir, "exiting.pid")}
+		AssertNoError(t, p.Restart(ctx))
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			active, err := p.IsActive(ctx)
+			AssertNoError(t, err)
+			if !active {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Expected the exited process to be inactive")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+}
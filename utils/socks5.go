@@ -0,0 +1,231 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version        = 0x05
+	socks5NoAuth         = 0x00
+	socks5PasswordAuth   = 0x02
+	socks5NoAcceptable   = 0xff
+	socks5CmdUDP         = 0x03
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+	socks5ReplySucceeded = 0x00
+)
+
+// SOCKS5UDPConn sends and receives the UDP datagrams via the relay of a SOCKS5
+// proxy obtained with UDP ASSOCIATE. The association lives as long as the
+// control connection.
+type SOCKS5UDPConn struct {
+	control net.Conn
+	relay   *net.UDPConn
+}
+
+// DialSOCKS5UDP asks the SOCKS5 proxy to associate a UDP relay
+func DialSOCKS5UDP(ctx context.Context, proxy *Proxy) (*SOCKS5UDPConn, error) {
+	if proxy.Protocol != ProxySOCKS5 {
+		return nil, fmt.Errorf("UDP requires a SOCKS5 proxy, got %s", proxy)
+	}
+	proxyAddr := net.JoinHostPort(proxy.IP, strconv.Itoa(proxy.Port))
+
+	var d net.Dialer
+	control, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the SOCKS5 proxy %s: %w", proxy, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		control.SetDeadline(deadline)
+	}
+
+	relayAddr, err := socks5Associate(control, proxy)
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("UDP ASSOCIATE via %s failed: %w", proxy, err)
+	}
+	control.SetDeadline(time.Time{})
+
+	// A relay bound to the unspecified address is reachable at the proxy address
+	if relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = net.ParseIP(proxy.IP)
+	}
+	relay, err := net.DialUDP("udp", nil, relayAddr)
+	if err != nil {
+		control.Close()
+		return nil, fmt.Errorf("failed to connect to the UDP relay %s: %w", relayAddr, err)
+	}
+	return &SOCKS5UDPConn{control: control, relay: relay}, nil
+}
+
+// Negotiates the authentication and requests the UDP association
+func socks5Associate(conn net.Conn, proxy *Proxy) (*net.UDPAddr, error) {
+	method := byte(socks5NoAuth)
+	if proxy.Username != "" {
+		method = socks5PasswordAuth
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(r, reply); err != nil {
+		return nil, err
+	}
+	if reply[1] == socks5NoAcceptable || reply[1] != method {
+		return nil, errors.New("the proxy has not accepted the authentication method")
+	}
+
+	if method == socks5PasswordAuth {
+		auth := []byte{0x01, byte(len(proxy.Username))}
+		auth = append(auth, proxy.Username...)
+		auth = append(auth, byte(len(proxy.Password)))
+		auth = append(auth, proxy.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(r, reply); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0x00 {
+			return nil, errors.New("username/password authentication failed")
+		}
+	}
+
+	// The client address is not known in advance, hence the zeros
+	request := []byte{socks5Version, socks5CmdUDP, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[1] != socks5ReplySucceeded {
+		return nil, fmt.Errorf("the proxy has replied with code %d", header[1])
+	}
+	host, port, err := readSOCKS5Addr(r)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("the proxy has returned the relay address %q", host)
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// Reads the address type, the address and the port
+func readSOCKS5Addr(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+	var host string
+	switch atyp[0] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if atyp[0] == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", 0, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", 0, err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", 0, err
+		}
+		host = string(name)
+	default:
+		return "", 0, fmt.Errorf("unknown address type %d", atyp[0])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// Encodes the address in the SOCKS5 format
+func appendSOCKS5Addr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q is too long", host)
+		}
+		b = append(b, socks5AddrDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// WriteTo sends the datagram to the address (host:port) via the relay
+func (c *SOCKS5UDPConn) WriteTo(payload []byte, addr string) error {
+	// Reserved, fragment number and the destination
+	datagram, err := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, addr)
+	if err != nil {
+		return err
+	}
+	_, err = c.relay.Write(append(datagram, payload...))
+	return err
+}
+
+// ReadFrom receives a datagram via the relay and returns its payload along with
+// the address it has come from
+func (c *SOCKS5UDPConn) ReadFrom(b []byte) (int, string, error) {
+	buf := make([]byte, 65535)
+	n, err := c.relay.Read(buf)
+	if err != nil {
+		return 0, "", err
+	}
+	if n < 4 || buf[2] != 0x00 {
+		return 0, "", errors.New("malformed or fragmented datagram from the relay")
+	}
+	r := bytes.NewReader(buf[3:n])
+	host, port, err := readSOCKS5Addr(r)
+	if err != nil {
+		return 0, "", err
+	}
+	payload := buf[n-r.Len() : n]
+	return copy(b, payload), net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// SetDeadline sets the deadline of the reads and the writes
+func (c *SOCKS5UDPConn) SetDeadline(t time.Time) error {
+	return c.relay.SetDeadline(t)
+}
+
+// Close ends the association
+func (c *SOCKS5UDPConn) Close() error {
+	return errors.Join(c.relay.Close(), c.control.Close())
+}
@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Serves a minimal SOCKS5 proxy supporting CONNECT and UDP ASSOCIATE with the
+// username/password authentication if the username is set, and no
+// authentication otherwise
+func startSOCKS5Server(t *testing.T, username, password string) *Proxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	AssertNoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, username, password)
+		}
+	}()
+
+	return &Proxy{
+		Protocol: ProxySOCKS5,
+		IP:       "127.0.0.1",
+		Port:     l.Addr().(*net.TCPAddr).Port,
+		Username: username,
+		Password: password,
+	}
+}
+
+func serveSOCKS5(conn net.Conn, username, password string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	// Greeting: version, number of methods, methods
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	method := byte(0x00)
+	if username != "" {
+		method = 0x02
+	}
+	if !bytes.Contains(methods, []byte{method}) {
+		conn.Write([]byte{0x05, 0xff})
+		return
+	}
+	conn.Write([]byte{0x05, method})
+
+	if method == 0x02 {
+		readField := func() string {
+			n, _ := r.ReadByte()
+			b := make([]byte, n)
+			io.ReadFull(r, b)
+			return string(b)
+		}
+		r.ReadByte() // version of the subnegotiation
+		user, pass := readField(), readField()
+		if user != username || pass != password {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	// Request: version, command, reserved, address type, address, port
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return
+	}
+	host, port, err := readSOCKS5Addr(r)
+	if err != nil {
+		return
+	}
+
+	switch request[1] {
+	case 0x01:
+		target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer target.Close()
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+		go io.Copy(target, r)
+		io.Copy(conn, target)
+	case 0x03:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		reply, _ := appendSOCKS5Addr([]byte{0x05, 0x00, 0x00}, relay.LocalAddr().String())
+		conn.Write(reply)
+
+		go relaySOCKS5UDP(relay)
+		// The association lives as long as the control connection
+		io.Copy(io.Discard, r)
+	default:
+		conn.Write([]byte{0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+// Passes every datagram of the client to its destination and the single reply
+// back to the client
+func relaySOCKS5UDP(relay *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		r := bytes.NewReader(buf[3:n])
+		host, port, err := readSOCKS5Addr(r)
+		if err != nil {
+			continue
+		}
+		payload := append([]byte(nil), buf[n-r.Len():n]...)
+		target := net.JoinHostPort(host, strconv.Itoa(port))
+
+		go func() {
+			conn, err := net.Dial("udp", target)
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			if _, err := conn.Write(payload); err != nil {
+				return
+			}
+			answer := make([]byte, 65535)
+			m, err := conn.Read(answer)
+			if err != nil {
+				return
+			}
+			datagram, _ := appendSOCKS5Addr([]byte{0x00, 0x00, 0x00}, target)
+			relay.WriteToUDP(append(datagram, answer[:m]...), client)
+		}()
+	}
+}
+
+// Echoes every datagram back to the sender
+func startUDPEchoServer(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	AssertNoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestSOCKS5UDPConn(t *testing.T) {
+	echo := startUDPEchoServer(t)
+
+	tests := []struct {
+		name     string
+		server   [2]string
+		username string
+		password string
+		errMsg   string
+	}{
+		{"no authentication", [2]string{"", ""}, "", "", ""},
+		{"authentication", [2]string{"user", "secret"}, "user", "secret", ""},
+		{"wrong password", [2]string{"user", "secret"}, "user", "wrong", "authentication failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := startSOCKS5Server(t, tt.server[0], tt.server[1])
+			proxy.Username, proxy.Password = tt.username, tt.password
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			conn, err := DialSOCKS5UDP(ctx, proxy)
+			if tt.errMsg != "" {
+				AssertErrorContains(t, err, tt.errMsg)
+				return
+			}
+			AssertNoError(t, err)
+			defer conn.Close()
+
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			AssertNoError(t, conn.WriteTo([]byte("ping"), echo))
+			buf := make([]byte, 64)
+			n, from, err := conn.ReadFrom(buf)
+			AssertNoError(t, err)
+			AssertCorrectString(t, "ping", string(buf[:n]))
+			AssertCorrectString(t, echo, from)
+		})
+	}
+}
+
+func TestDialSOCKS5UDPRequiresSOCKS5(t *testing.T) {
+	_, err := DialSOCKS5UDP(context.Background(), &Proxy{Protocol: ProxyHTTP, IP: "127.0.0.1", Port: 8080})
+	AssertErrorContains(t, err, "UDP requires a SOCKS5 proxy")
+}
+
+func TestAppendSOCKS5Addr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		want   []byte
+		errMsg string
+	}{
+		{"1.2.3.4:53", []byte{0x01, 1, 2, 3, 4, 0, 53}, ""},
+		{"example.com:443", append(append([]byte{0x03, 11}, "example.com"...), 1, 187), ""},
+		{"[::1]:53", append(append([]byte{0x04}, net.IPv6loopback...), 0, 53), ""},
+		{"1.2.3.4", nil, "missing port"},
+		{"1.2.3.4:0", nil, "invalid port"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := appendSOCKS5Addr(nil, tt.addr)
+			if tt.errMsg != "" {
+				AssertErrorContains(t, err, tt.errMsg)
+				return
+			}
+			AssertNoError(t, err)
+			if !bytes.Equal(tt.want, got) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+
+			host, port, err := readSOCKS5Addr(bytes.NewReader(got))
+			AssertNoError(t, err)
+			AssertCorrectString(t, tt.addr, net.JoinHostPort(host, strconv.Itoa(port)))
+		})
+	}
+}
@@ -7,7 +7,10 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"os/user"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -20,6 +23,52 @@ func CheckSudo() error {
 	return nil
 }
 
+// Switches the process to the user and its groups for good, so that the rest
+// of the run does not have the root privileges
+func DropPrivileges(username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("failed to look up the user %s: %w", username, err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q of the user %s", u.Uid, username)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q of the user %s", u.Gid, username)
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return fmt.Errorf("failed to look up the groups of the user %s: %w", username, err)
+	}
+	var groups []int
+	for _, g := range groupIDs {
+		if id, err := strconv.Atoi(g); err == nil {
+			groups = append(groups, id)
+		}
+	}
+
+	// The groups go first, since they cannot be changed without root
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("failed to set the groups of the user %s: %w", username, err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set the gid of the user %s: %w", username, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set the uid of the user %s: %w", username, err)
+	}
+	os.Setenv("HOME", u.HomeDir)
+	os.Setenv("USER", u.Username)
+	return nil
+}
+
+// Quotes the string as a single argument of a shell command
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 // Runs a shell command and returns its output or an error.
 func ExecuteCommand(ctx context.Context, cmdStr string) (string, error) {
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
@@ -43,49 +92,56 @@ func ExecuteCommand(ctx context.Context, cmdStr string) (string, error) {
 	return out.String(), nil
 }
 
+// Runs the executable file by the filePath with the provided arguments directly,
+// without a shell, and returns its combined stdout and stderr output.
+func ExecuteFile(ctx context.Context, filePath string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, filePath, args...)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return out.String(), fmt.Errorf("command timed out: %w", ctx.Err())
+	}
+	if err != nil {
+		return out.String(), fmt.Errorf("command execution failed: %w", err)
+	}
+
+	return out.String(), nil
+}
+
 type CommandExecutor func(context.Context, string) (string, error)
 
 var defaultExecutor CommandExecutor = ExecuteCommand
 
+// RestartService restarts the systemd unit
 func RestartService(ctx context.Context, serviceName string, executor CommandExecutor) error {
-	if executor == nil {
-		executor = defaultExecutor
+	service, err := NewCommandService(ServiceSystemd, serviceName, executor)
+	if err != nil {
+		return err
 	}
-
-	_, err := executor(ctx, fmt.Sprintf("sudo systemctl restart %s", serviceName))
-	return err
+	return service.Restart(ctx)
 }
 
+// CheckServiceStatus waits for the systemd unit to become active
 func CheckServiceStatus(ctx context.Context, serviceName string, executor CommandExecutor) (bool, error) {
-	if executor == nil {
-		executor = defaultExecutor
-	}
-
-	for range 5 {
-		output, err := executor(ctx, fmt.Sprintf("systemctl is-active %s", serviceName))
-		if err != nil {
-			return false, err
-		}
-		if strings.ReplaceAll(output, "\n", "") != "active" {
-			time.Sleep(1 * time.Second)
-		} else {
-			return true, nil
-		}
+	service, err := NewCommandService(ServiceSystemd, serviceName, executor)
+	if err != nil {
+		return false, err
 	}
-	return false, nil
+	return waitServiceActive(ctx, service)
 }
 
+// CheckOperability restarts the systemd unit and makes sure it is active
 func CheckOperability(ctx context.Context, serviceName string, executor CommandExecutor) error {
-	err := RestartService(ctx, serviceName, executor)
-	if err != nil {
-		return err
-	}
-	isActive, err := CheckServiceStatus(ctx, serviceName, executor)
+	service, err := NewCommandService(ServiceSystemd, serviceName, executor)
 	if err != nil {
 		return err
 	}
-	if !isActive {
-		return fmt.Errorf("%s service is not active", serviceName)
-	}
-	return nil
+	return CheckServiceOperability(ctx, service)
 }
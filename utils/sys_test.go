@@ -32,6 +32,19 @@ func TestCheckSudo(t *testing.T) {
 	}
 }
 
+func TestDropPrivileges(t *testing.T) {
+	err := DropPrivileges("no-such-user-of-the-tests")
+	AssertErrorContains(t, err, "failed to look up the user no-such-user-of-the-tests")
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, arg := range []string{"plain", "with space", "it's", "$HOME `id` \\", ""} {
+		out, err := ExecuteCommand(context.Background(), "printf %s "+ShellQuote(arg))
+		AssertNoError(t, err)
+		AssertCorrectString(t, arg, out)
+	}
+}
+
 func TestExecuteCommand(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -139,6 +152,34 @@ func TestExecuteCommand(t *testing.T) {
 	})
 }
 
+func TestExecuteFile(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("arguments are passed without a shell", func(t *testing.T) {
+		output, err := ExecuteFile(ctx, "/bin/echo", "a b", "$HOME")
+		AssertNoError(t, err)
+		AssertCorrectString(t, "a b $HOME\n", output)
+	})
+
+	t.Run("stderr is captured on failure", func(t *testing.T) {
+		output, err := ExecuteFile(ctx, "/bin/sh", "-c", "echo oops >&2; exit 3")
+		AssertErrorContains(t, err, "command execution failed")
+		AssertCorrectString(t, "oops\n", output)
+	})
+
+	t.Run("nonexistent file", func(t *testing.T) {
+		_, err := ExecuteFile(ctx, "/nonexistent/executable")
+		AssertError(t, err)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		_, err := ExecuteFile(ctx, "/bin/sleep", "5")
+		AssertErrorContains(t, err, "command timed out")
+	})
+}
+
 func TestRestartService(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
@@ -1,8 +1,10 @@
 package utils
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
@@ -126,3 +128,67 @@ func CreateTempFile(t testing.TB) (string, func()) {
 		}
 	}
 }
+
+func protoBytes(buf []byte, num int, data []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(num<<3|wireBytes))
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func protoVarint(buf []byte, num int, v uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(num<<3|wireVarint))
+	return binary.AppendUvarint(buf, v)
+}
+
+// BuildGeoIPList encodes the contents of a geoip.dat file (GeoIPList protobuf)
+// with the provided country codes mapped to their CIDRs.
+func BuildGeoIPList(entries map[string][]string) []byte {
+	var list []byte
+	for code, cidrs := range entries {
+		var entry []byte
+		entry = protoBytes(entry, 1, []byte(code))
+		for _, c := range cidrs {
+			_, ipNet, err := net.ParseCIDR(c)
+			if err != nil {
+				panic(err)
+			}
+			ones, _ := ipNet.Mask.Size()
+			ip := ipNet.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			var cidr []byte
+			cidr = protoBytes(cidr, 1, ip)
+			cidr = protoVarint(cidr, 2, uint64(ones))
+			entry = protoBytes(entry, 2, cidr)
+		}
+		list = protoBytes(list, 1, entry)
+	}
+	return list
+}
+
+// BuildGeoSiteList encodes the contents of a geosite.dat file (GeoSiteList protobuf)
+// with the provided country codes mapped to their domains. Attributes are appended
+// to the domain after "@", e.g. "doubleclick.net@ads".
+func BuildGeoSiteList(entries map[string][]string) []byte {
+	var list []byte
+	for code, domains := range entries {
+		var entry []byte
+		entry = protoBytes(entry, 1, []byte(code))
+		for _, d := range domains {
+			parts := strings.Split(d, "@")
+			var domain []byte
+			domain = protoVarint(domain, 1, 2)
+			domain = protoBytes(domain, 2, []byte(parts[0]))
+			for _, a := range parts[1:] {
+				var attr []byte
+				attr = protoBytes(attr, 1, []byte(a))
+				attr = protoVarint(attr, 2, 1)
+				domain = protoBytes(domain, 3, attr)
+			}
+			entry = protoBytes(entry, 2, domain)
+		}
+		list = protoBytes(list, 1, entry)
+	}
+	return list
+}
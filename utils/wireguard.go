@@ -0,0 +1,236 @@
+package utils
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Constants of the WireGuard protocol, see https://www.wireguard.com/protocol/
+const (
+	wgConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wgIdentifier   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wgLabelMAC1    = "mac1----"
+
+	wgMessageInitiation = 1
+	wgMessageResponse   = 2
+
+	// WireguardInitiationSize is the size of a handshake initiation message
+	WireguardInitiationSize = 148
+	// WireguardResponseSize is the size of a handshake response message
+	WireguardResponseSize = 92
+)
+
+func wgHash(data ...[]byte) [blake2s.Size]byte {
+	h, _ := blake2s.New256(nil)
+	for _, d := range data {
+		h.Write(d)
+	}
+	var sum [blake2s.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+func wgHMAC(key []byte, data ...[]byte) [blake2s.Size]byte {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	var sum [blake2s.Size]byte
+	mac.Sum(sum[:0])
+	return sum
+}
+
+// Derives the new chaining key from the chaining key and input
+func wgKDF1(chainingKey []byte, input []byte) [blake2s.Size]byte {
+	t0 := wgHMAC(chainingKey, input)
+	return wgHMAC(t0[:], []byte{1})
+}
+
+// Derives the new chaining key and a message key from the chaining key and input
+func wgKDF2(chainingKey []byte, input []byte) ([blake2s.Size]byte, [blake2s.Size]byte) {
+	t0 := wgHMAC(chainingKey, input)
+	t1 := wgHMAC(t0[:], []byte{1})
+	t2 := wgHMAC(t0[:], t1[:], []byte{2})
+	return t1, t2
+}
+
+func wgMAC1(peerPublicKey []byte, msg []byte) [blake2s.Size128]byte {
+	key := wgHash([]byte(wgLabelMAC1), peerPublicKey)
+	h, _ := blake2s.New128(key[:])
+	h.Write(msg)
+	var sum [blake2s.Size128]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// TAI64N timestamp as used in the handshake initiation
+func wgTimestamp(t time.Time) []byte {
+	ts := make([]byte, 12)
+	binary.BigEndian.PutUint64(ts, uint64(0x400000000000000a+t.Unix()))
+	binary.BigEndian.PutUint32(ts[8:], uint32(t.Nanosecond()))
+	return ts
+}
+
+func decodeWireguardKey(key string, name string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 32 {
+		return nil, fmt.Errorf("%s is not a valid WireGuard key", name)
+	}
+	return decoded, nil
+}
+
+// WireguardHandshakeInitiation builds the first message of the WireGuard handshake
+// from the base64 encoded private key of the initiator to the peer with the base64
+// encoded public key. A peer only responds to an initiation from a key it knows,
+// which makes the message suitable for probing the endpoints of the peer.
+// The reserved bytes, if any, are put into the message header the way xray does
+// for the Cloudflare WARP endpoints.
+func WireguardHandshakeInitiation(privateKey string, peerPublicKey string, reserved []int) ([]byte, error) {
+	staticPriv, err := decodeWireguardKey(privateKey, "private key")
+	if err != nil {
+		return nil, err
+	}
+	peerPub, err := decodeWireguardKey(peerPublicKey, "peer public key")
+	if err != nil {
+		return nil, err
+	}
+	if len(reserved) != 0 && len(reserved) != 3 {
+		return nil, fmt.Errorf("reserved shall have 3 bytes, got %d", len(reserved))
+	}
+
+	curve := ecdh.X25519()
+	static, err := curve.NewPrivateKey(staticPriv)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := curve.NewPublicKey(peerPub)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, WireguardInitiationSize)
+	msg[0] = wgMessageInitiation
+	if _, err := rand.Read(msg[4:8]); err != nil {
+		return nil, err
+	}
+
+	chainingKey := wgHash([]byte(wgConstruction))
+	h := wgHash(chainingKey[:], []byte(wgIdentifier))
+	h = wgHash(h[:], peerPub)
+
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	copy(msg[8:40], ephemeralPub)
+	chainingKey = wgKDF1(chainingKey[:], ephemeralPub)
+	h = wgHash(h[:], ephemeralPub)
+
+	encrypt := func(shared []byte, plaintext []byte, dst []byte) error {
+		var key [blake2s.Size]byte
+		chainingKey, key = wgKDF2(chainingKey[:], shared)
+		aead, err := chacha20poly1305.New(key[:])
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, chacha20poly1305.NonceSize)
+		sealed := aead.Seal(dst[:0], nonce, plaintext, h[:])
+		h = wgHash(h[:], sealed)
+		return nil
+	}
+
+	shared, err := ephemeral.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	if err := encrypt(shared, static.PublicKey().Bytes(), msg[40:88]); err != nil {
+		return nil, err
+	}
+
+	shared, err = static.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	if err := encrypt(shared, wgTimestamp(time.Now()), msg[88:116]); err != nil {
+		return nil, err
+	}
+
+	mac1 := wgMAC1(peerPub, msg[:116])
+	copy(msg[116:132], mac1[:])
+
+	// Same as xray, the reserved bytes are set after the MAC has been calculated
+	for i, b := range reserved {
+		if b < 0 || b > 255 {
+			return nil, fmt.Errorf("reserved value %d is not a byte", b)
+		}
+		msg[1+i] = byte(b)
+	}
+
+	return msg, nil
+}
+
+// IsWireguardHandshakeResponse reports whether the packet looks like a response
+// to the handshake initiation
+func IsWireguardHandshakeResponse(packet []byte) bool {
+	return len(packet) == WireguardResponseSize && packet[0] == wgMessageResponse
+}
+
+// ErrNoHandshakeResponse is returned when a peer has not responded to
+// the handshake initiation in time
+var ErrNoHandshakeResponse = errors.New("no handshake response")
+
+// ProbeWireguardEndpoint sends the handshake initiation packet to the UDP endpoint
+// and waits for the handshake response up to the timeout. Returns the round trip
+// time of the handshake.
+func ProbeWireguardEndpoint(ctx context.Context, endpoint string, packet []byte, timeout time.Duration) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", endpoint)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	if _, err := conn.Write(packet); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return 0, ErrNoHandshakeResponse
+			}
+			return 0, err
+		}
+		if IsWireguardHandshakeResponse(buf[:n]) {
+			return time.Since(start), nil
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func generateTestWireguardKey(t *testing.T) (*ecdh.PrivateKey, string, string) {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	AssertNoError(t, err)
+	return key, base64.StdEncoding.EncodeToString(key.Bytes()),
+		base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+}
+
+// Processes the initiation the way the responder does and returns the decrypted
+// static public key of the initiator
+func consumeInitiation(t *testing.T, responder *ecdh.PrivateKey, msg []byte) []byte {
+	t.Helper()
+
+	responderPub := responder.PublicKey().Bytes()
+
+	// The MAC is calculated with zero reserved bytes
+	unreserved := bytes.Clone(msg)
+	copy(unreserved[1:4], []byte{0, 0, 0})
+	mac1 := wgMAC1(responderPub, unreserved[:116])
+	if !bytes.Equal(mac1[:], msg[116:132]) {
+		t.Fatal("Invalid mac1")
+	}
+
+	chainingKey := wgHash([]byte(wgConstruction))
+	h := wgHash(chainingKey[:], []byte(wgIdentifier))
+	h = wgHash(h[:], responderPub)
+
+	ephemeralPub := msg[8:40]
+	chainingKey = wgKDF1(chainingKey[:], ephemeralPub)
+	h = wgHash(h[:], ephemeralPub)
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(ephemeralPub)
+	AssertNoError(t, err)
+	shared, err := responder.ECDH(ephemeral)
+	AssertNoError(t, err)
+
+	var key [blake2s.Size]byte
+	chainingKey, key = wgKDF2(chainingKey[:], shared)
+	aead, err := chacha20poly1305.New(key[:])
+	AssertNoError(t, err)
+	static, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), msg[40:88], h[:])
+	if err != nil {
+		t.Fatalf("Failed to decrypt the static key: %v", err)
+	}
+	h = wgHash(h[:], msg[40:88])
+
+	initiator, err := ecdh.X25519().NewPublicKey(static)
+	AssertNoError(t, err)
+	shared, err = responder.ECDH(initiator)
+	AssertNoError(t, err)
+	_, key = wgKDF2(chainingKey[:], shared)
+	aead, err = chacha20poly1305.New(key[:])
+	AssertNoError(t, err)
+	if _, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), msg[88:116], h[:]); err != nil {
+		t.Fatalf("Failed to decrypt the timestamp: %v", err)
+	}
+
+	return static
+}
+
+func TestWireguardHandshakeInitiation(t *testing.T) {
+	_, initiatorPriv, initiatorPub := generateTestWireguardKey(t)
+	responder, _, responderPub := generateTestWireguardKey(t)
+
+	msg, err := WireguardHandshakeInitiation(initiatorPriv, responderPub, []int{7, 8, 9})
+	AssertNoError(t, err)
+	AssertCorrectInt(t, WireguardInitiationSize, len(msg))
+	AssertCorrectInt(t, wgMessageInitiation, int(msg[0]))
+	if !bytes.Equal(msg[1:4], []byte{7, 8, 9}) {
+		t.Errorf("Expected the reserved bytes in the header, got %v", msg[1:4])
+	}
+
+	static := consumeInitiation(t, responder, msg)
+	AssertCorrectString(t, initiatorPub, base64.StdEncoding.EncodeToString(static))
+
+	errTests := []struct {
+		name     string
+		priv     string
+		pub      string
+		reserved []int
+		errMsg   string
+	}{
+		{"invalid private key", "abc", responderPub, nil, "private key is not a valid"},
+		{"invalid peer key", initiatorPriv, "abc", nil, "peer public key is not a valid"},
+		{"short reserved", initiatorPriv, responderPub, []int{1}, "reserved shall have 3 bytes"},
+		{"reserved out of range", initiatorPriv, responderPub, []int{1, 2, 256}, "not a byte"},
+	}
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := WireguardHandshakeInitiation(tt.priv, tt.pub, tt.reserved)
+			AssertErrorContains(t, err, tt.errMsg)
+		})
+	}
+}
+
+// Starts a UDP server that answers every handshake initiation with
+// a response-shaped packet, or ignores them if silent is set
+func startFakeWireguardPeer(t *testing.T, silent bool) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	AssertNoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if silent || n != WireguardInitiationSize || buf[0] != wgMessageInitiation {
+				continue
+			}
+			response := make([]byte, WireguardResponseSize)
+			response[0] = wgMessageResponse
+			conn.WriteTo(response, addr)
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestProbeWireguardEndpoint(t *testing.T) {
+	_, priv, _ := generateTestWireguardKey(t)
+	_, _, peerPub := generateTestWireguardKey(t)
+	msg, err := WireguardHandshakeInitiation(priv, peerPub, nil)
+	AssertNoError(t, err)
+
+	t.Run("peer responds", func(t *testing.T) {
+		endpoint := startFakeWireguardPeer(t, false)
+		rtt, err := ProbeWireguardEndpoint(context.Background(), endpoint, msg, time.Second)
+		AssertNoError(t, err)
+		if rtt <= 0 {
+			t.Errorf("Expected a positive round trip time, got %v", rtt)
+		}
+	})
+
+	t.Run("peer is silent", func(t *testing.T) {
+		endpoint := startFakeWireguardPeer(t, true)
+		_, err := ProbeWireguardEndpoint(context.Background(), endpoint, msg, 100*time.Millisecond)
+		if !errors.Is(err, ErrNoHandshakeResponse) {
+			t.Errorf("Expected ErrNoHandshakeResponse, got %v", err)
+		}
+	})
+}